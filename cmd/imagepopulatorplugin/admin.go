@@ -0,0 +1,112 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+const adminUsage = `usage: imagepopulatorplugin admin [-socket PATH] COMMAND
+
+commands:
+  list                                list volumes published on this node
+  inspect VOLUME_ID                   show a volume and its buildah container
+  commands VOLUME_ID                  show the last backend commands of a volume
+  purge [-target PATH] VOLUME_ID      unmount and delete a volume
+  refresh VOLUME_ID                   update a tmpfs volume to the current image
+  images                              list cached images and storage usage
+  gc                                  remove images no volume uses anymore
+  loglevel [LEVEL]                    show or change the log verbosity
+`
+
+// runAdmin implements the admin subcommand talking to the admin socket of
+// a running plugin and returns the exit code.
+func runAdmin(args []string) int {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	socket := fs.String("socket", "/run/image-populator/admin.sock", "admin socket of the plugin")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, adminUsage) }
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", *socket)
+		},
+	}}
+
+	var method, path string
+	switch cmd, rest := fs.Arg(0), fs.Args()[1:]; {
+	case cmd == "list" && len(rest) == 0:
+		method, path = http.MethodGet, "/volumes"
+	case cmd == "inspect" && len(rest) == 1:
+		method, path = http.MethodGet, "/volumes/"+url.PathEscape(rest[0])
+	case cmd == "commands" && len(rest) == 1:
+		method, path = http.MethodGet, "/volumes/"+url.PathEscape(rest[0])+"/commands"
+	case cmd == "purge":
+		pfs := flag.NewFlagSet("purge", flag.ContinueOnError)
+		target := pfs.String("target", "", "target path to unmount, defaults to the one of the tracked volume")
+		if err := pfs.Parse(rest); err != nil || pfs.NArg() != 1 {
+			fs.Usage()
+			return 2
+		}
+		method, path = http.MethodPost, "/volumes/"+url.PathEscape(pfs.Arg(0))+"/purge"
+		if *target != "" {
+			path += "?targetPath=" + url.QueryEscape(*target)
+		}
+	case cmd == "refresh" && len(rest) == 1:
+		method, path = http.MethodPost, "/volumes/"+url.PathEscape(rest[0])+"/refresh"
+	case cmd == "images" && len(rest) == 0:
+		method, path = http.MethodGet, "/images"
+	case cmd == "gc" && len(rest) == 0:
+		method, path = http.MethodPost, "/gc"
+	case cmd == "loglevel" && len(rest) == 0:
+		method, path = http.MethodGet, "/loglevel"
+	case cmd == "loglevel" && len(rest) == 1:
+		method, path = http.MethodPut, "/loglevel?v="+url.QueryEscape(rest[0])
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	req, err := http.NewRequest(method, "http://admin"+path, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		io.Copy(os.Stderr, resp.Body)
+		return 1
+	}
+	io.Copy(os.Stdout, resp.Body)
+	return 0
+}
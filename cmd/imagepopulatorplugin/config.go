@@ -0,0 +1,242 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is prepended to the upper-cased flag name, with dashes replaced
+// by underscores, to form the environment variable overriding a flag.
+const envPrefix = "IMAGE_POPULATOR_"
+
+// The config file is a flat YAML mapping from flag names to values:
+//
+//	storage-root: /var/lib/containers/storage
+//	max-concurrent-pulls: 4
+//	pull-retry-delay: 10s
+//
+// Settings are applied in the order config file, environment, command line,
+// each overriding the previous one.
+
+// loadConfig applies the config file at path, if any, and the environment to
+// all flags of fs that were not set on the command line.
+func loadConfig(fs *flag.FlagSet, path string, lookupEnv func(string) (string, bool)) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		settings, err := parseConfig(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for _, s := range settings {
+			if fs.Lookup(s.key) == nil {
+				return fmt.Errorf("%s:%d: unknown key %q", path, s.line, s.key)
+			}
+			if explicit[s.key] {
+				continue
+			}
+			if err := fs.Set(s.key, s.value); err != nil {
+				return fmt.Errorf("%s:%d: invalid value for key %q: %v", path, s.line, s.key, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if v, ok := lookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value for %s (key %q): %v", name, f.Name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+type configSetting struct {
+	line       int
+	key, value string
+}
+
+// parseConfig reads a flat YAML mapping of scalars. Comments, blank lines
+// and quoted values are supported, nested mappings and lists are not.
+func parseConfig(r io.Reader) ([]configSetting, error) {
+	var settings []configSetting
+	seen := map[string]bool{}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if text[0] == ' ' || text[0] == '\t' || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("line %d: only flat key: value pairs are supported", line)
+		}
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key: value", line)
+		}
+		key := strings.TrimSpace(parts[0])
+		value, err := parseScalar(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value for key %q: %v", line, key, err)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line, key)
+		}
+		seen[key] = true
+		settings = append(settings, configSetting{line: line, key: key, value: value})
+	}
+	return settings, s.Err()
+}
+
+func parseScalar(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		end := strings.LastIndex(v, `"`)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return strconv.Unquote(v[:end+1])
+	case strings.HasPrefix(v, "'"):
+		end := strings.LastIndex(v, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return strings.Replace(v[1:end], "''", "'", -1), nil
+	case v == "" || v == "~" || v == "null":
+		return "", nil
+	case strings.HasPrefix(v, "{") || strings.HasPrefix(v, "["):
+		return "", fmt.Errorf("only scalar values are supported")
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, nil
+}
+
+// validateConfig checks the ranges of numeric settings and the settings
+// that depend on each other, naming the key of the first invalid one.
+func validateConfig(fs *flag.FlagSet) error {
+	checks := []struct {
+		key      string
+		min, max int64
+	}{
+		{"cgroup-cpu-weight", 1, 10000},
+		{"cgroup-io-weight", 1, 10000},
+		{"max-concurrent-pulls", 0, 1 << 16},
+		{"pull-retries", 0, 100},
+		{"command-history", 0, 1000},
+		{"reserved-space", 0, 1 << 62},
+		{"pull-headroom", 0, 1 << 62},
+		{"tmpfs-size", 1, 1 << 62},
+	}
+	for _, c := range checks {
+		f := fs.Lookup(c.key)
+		if f == nil {
+			continue
+		}
+		n, err := strconv.ParseInt(f.Value.String(), 10, 64)
+		if err != nil || n < c.min || n > c.max {
+			return fmt.Errorf("invalid value %q for key %q: must be between %d and %d", f.Value.String(), c.key, c.min, c.max)
+		}
+	}
+	if f := fs.Lookup("log-format"); f != nil && f.Value.String() != "text" && f.Value.String() != "json" {
+		return fmt.Errorf("invalid value %q for key %q: must be text or json", f.Value.String(), "log-format")
+	}
+	if f := fs.Lookup("mount-propagation"); f != nil {
+		switch f.Value.String() {
+		case "", "rprivate", "rslave", "rshared":
+		default:
+			return fmt.Errorf("invalid value %q for key %q: must be rprivate, rslave or rshared", f.Value.String(), "mount-propagation")
+		}
+	}
+	if f := fs.Lookup("storage-driver"); f != nil {
+		switch f.Value.String() {
+		case "auto", "overlay", "fuse-overlayfs", "vfs":
+		default:
+			return fmt.Errorf("invalid value %q for key %q: must be auto, overlay, fuse-overlayfs or vfs", f.Value.String(), "storage-driver")
+		}
+	}
+	if addr, token := fs.Lookup("webhook-address"), fs.Lookup("webhook-token-file"); addr != nil && token != nil &&
+		addr.Value.String() != "" && token.Value.String() == "" {
+		return fmt.Errorf("missing value for key %q: registry webhooks need a token", "webhook-token-file")
+	}
+	return nil
+}
+
+// defaultDriverName is the driver name instances use unless told otherwise.
+const defaultDriverName = "image.csi.k8s.io"
+
+// instanceDirFlags name directories that must not be shared between driver
+// instances on one node, instanceFileFlags files in such directories.
+var (
+	instanceDirFlags  = []string{"storage-root", "run-root", "state-dir", "debug-log-dir"}
+	instanceFileFlags = []string{"admin-socket"}
+)
+
+// isolateInstance gives an instance with a non-default driver name its own
+// buildah storage and state by suffixing the default directories with the
+// driver name. Paths set explicitly are left alone.
+func isolateInstance(fs *flag.FlagSet, driverName string) {
+	if driverName == defaultDriverName {
+		return
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	suffix := func(dir string) string { return strings.TrimSuffix(dir, "/") + "-" + driverName }
+	for _, name := range instanceDirFlags {
+		if f := fs.Lookup(name); f != nil && !explicit[name] && f.Value.String() != "" {
+			fs.Set(name, suffix(f.Value.String()))
+		}
+	}
+	for _, name := range instanceFileFlags {
+		if f := fs.Lookup(name); f != nil && !explicit[name] && f.Value.String() != "" {
+			fs.Set(name, filepath.Join(suffix(filepath.Dir(f.Value.String())), filepath.Base(f.Value.String())))
+		}
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty elements.
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -18,7 +18,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
 
 	"github.com/sapcc/csi-driver-image-populator/pkg/image"
 )
@@ -27,20 +33,217 @@ func init() {
 	flag.Set("logtostderr", "true")
 }
 
+// Set by the build via -ldflags.
+var (
+	version   = ""
+	buildDate = ""
+)
+
 var (
+	showVersion = flag.Bool("version", false, "print version information and exit")
+	configFile  = flag.String("config", "", "YAML file with flag values, keyed by flag name; flags can also be set through "+envPrefix+"<FLAG_NAME> environment variables")
+
 	endpoint   = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	driverName = flag.String("drivername", "image.csi.k8s.io", "name of the driver")
+	driverName = flag.String("drivername", defaultDriverName, "name of the driver; other names than the default also suffix the default storage, state and socket paths with it")
 	nodeID     = flag.String("nodeid", "", "node id")
+	logFormat  = flag.String("log-format", "text", "log format, text or json")
+	podsDir    = flag.String("kubelet-pods-dir", "/var/lib/kubelet/pods", "pods directory of the kubelet, publishes and unpublishes of target paths outside of it are refused (empty disables the check)")
+
+	storageRoot   = flag.String("storage-root", "/var/lib/containers/storage", "containers/storage root used by buildah")
+	runRoot       = flag.String("run-root", "/var/run/containers/storage", "containers/storage run root used by buildah")
+	storageDrv    = flag.String("storage-driver", "auto", "containers/storage driver of the storage root: overlay, fuse-overlayfs, vfs or auto to use the first one that works")
+	fusePath      = flag.String("fuse-overlayfs-path", "/usr/bin/fuse-overlayfs", "fuse-overlayfs binary used by the fuse-overlayfs storage driver")
+	reservedSpace = flag.Int64("reserved-space", 1<<30, "bytes to keep free on the storage root, pulls are refused below this")
+	pullHeadroom  = flag.Int64("pull-headroom", 512<<20, "bytes assumed to be needed by a single pull in addition to the reserved space and the compressed image size")
+	storageCheck  = flag.Duration("storage-check-interval", 30*time.Second, "how often the storage root is checked for a read-only remount, low space and few free inodes (0 disables)")
+	cgroupPath    = flag.String("cgroup", "", "cgroup v2 directory to run buildah in, e.g. /sys/fs/cgroup/image-populator (empty disables)")
+	cgroupCPU     = flag.Int("cgroup-cpu-weight", 50, "cpu.weight of the buildah cgroup (1-10000)")
+	cgroupIO      = flag.Int("cgroup-io-weight", 50, "io.weight of the buildah cgroup (1-10000)")
+	pullRetries   = flag.Int("pull-retries", 2, "number of times a pull interrupted by a network error is retried")
+	pullDelay     = flag.Duration("pull-retry-delay", 5*time.Second, "delay between pull retries")
+	failedPullTTL = flag.Duration("failed-pull-cache-ttl", 30*time.Second, "how long publishes of an image that was not found or denied fail without pulling again (0 disables)")
+	cmdTimeout    = flag.Duration("command-timeout", 0, "how long a buildah command may run before it is stopped (0 means no limit)")
+	maxPullTime   = flag.Duration("max-pull-timeout", time.Hour, "longest pullTimeout a volume may set, longer ones are lowered to it (0 means no bound)")
+	tmpfsSize     = flag.Int64("tmpfs-size", 64<<20, "size in bytes of tmpfs mode volumes without a sizeLimit attribute")
+	stripXattrs   = flag.Bool("strip-xattrs", false, "drop extended attributes, file capabilities and ACLs when copying tmpfs mode volumes")
+	propagation   = flag.String("mount-propagation", "", "propagation of volume mounts without a mountPropagation attribute: rprivate, rslave or rshared (empty keeps the one of the parent mount)")
+	exportDir     = flag.String("export-dir", "", "directory volumes with the export attribute are written to as tarballs on unpublish, e.g. a mounted PVC (empty disables)")
+	exportURLs    = flag.String("export-url-prefixes", "", "comma separated URL prefixes volumes may be exported to with exportURL, e.g. https://bucket.s3.amazonaws.com/builds/ (empty disables)")
+	updateInt     = flag.Duration("update-interval", 5*time.Minute, "how often volumes with updatePolicy Watch check their image for a new digest (0 disables the policy)")
+	minResync     = flag.Duration("min-resync-interval", time.Minute, "shortest resyncInterval a volume may set, shorter ones are raised to it (0 means no bound)")
+	maxResync     = flag.Duration("max-resync-interval", 24*time.Hour, "longest resyncInterval a volume may set, longer ones are lowered to it (0 means no bound)")
+	metricsAddr   = flag.String("metrics-address", "", "listen address of the Prometheus metrics endpoint, e.g. :9090 (empty disables)")
+	pprofAddr     = flag.String("pprof-addr", "", "listen address of the pprof endpoint, e.g. localhost:6060 (empty disables)")
+	webhookAddr   = flag.String("webhook-address", "", "listen address of the registry webhooks that refresh pushed tags, e.g. :9092 (empty disables)")
+	webhookToken  = flag.String("webhook-token-file", "", "file with the token registry webhooks must send as bearer token or token parameter, required with --webhook-address")
+	localityAddr  = flag.String("locality-address", "", "listen address of the cache-locality endpoint for schedulers, built from the annotations of --annotate-node (empty disables)")
+	debugLevel    = flag.Int("debug-verbosity", 5, "log verbosity switched to by SIGHUP, a second SIGHUP switches back to -v")
+	events        = flag.Bool("events", true, "record Kubernetes events on pods consuming image volumes")
+	adminSocket   = flag.String("admin-socket", "/run/image-populator/admin.sock", "unix socket of the admin API used by the admin subcommand (empty disables)")
+	cmdHistory    = flag.Int("command-history", 10, "number of backend commands and their output kept per volume for the admin API (0 disables)")
+	debugLogDir   = flag.String("debug-log-dir", "/var/log/image-populator", "directory for the backend logs of volumes with the debug attribute (empty only logs to stderr)")
+	inventoryInt  = flag.Duration("inventory-interval", 5*time.Minute, "how often cached images, containers and storage usage are counted for metrics and the admin API (0 disables)")
+	annotateNode  = flag.Bool("annotate-node", false, "publish the digests of cached images in the <driver name>/cached-images annotation of the node on every inventory")
+	leakInterval  = flag.Duration("leak-check-interval", 10*time.Minute, "how often containers no tracked volume owns are looked for (0 disables)")
+	leakGrace     = flag.Duration("leak-grace-period", 30*time.Minute, "how long a container must be unowned before it is deleted with its mounts")
+	channelInt    = flag.Duration("image-channel-interval", 0, "how often the ImageChannel objects of published volumes are checked for a new digest, requires the custom resource definitions (0 disables the imageChannel attribute)")
+	prefetchInt   = flag.Duration("prefetch-interval", 0, "how often the ImagePrefetch objects selecting this node are reconciled, requires the custom resource definitions (0 disables)")
+	registryConf  = flag.String("registry-config", "", "JSON file with allowed images, registry mirrors and auth files, reloaded on change (empty allows all images)")
+	volumePolicy  = flag.String("volume-policy", "", "name of the ImageVolumePolicy object enforced in addition to the registry config (empty for none)")
+	criEndpoint   = flag.String("cri-endpoint", "", "CRI socket of the container runtime, e.g. unix:///var/run/crio/crio.sock; images it holds are copied from its image store instead of pulled (empty disables)")
+	criStore      = flag.String("cri-image-store", "overlay@/var/lib/containers/storage+/run/containers/storage", "containers/storage of the container runtime as driver@graphroot+runroot")
+	featureGates  = flag.String("feature-gates", "", "comma separated list of feature gates to enable or disable, e.g. ComposefsMode=false,VolumeStats=true")
+	stateDir      = flag.String("state-dir", "/var/lib/image-populator", "directory the tracked volumes are saved to on shutdown (empty disables)")
+	shutdownWait  = flag.Duration("shutdown-timeout", 20*time.Second, "how long in-flight calls may take to finish after SIGTERM")
+	shutdownClean = flag.Bool("shutdown-cleanup", false, "unpublish all volumes on shutdown instead of leaving them mounted")
+	storageReset  = flag.Bool("storage-auto-reset", false, "wipe the storage root when buildah reports corrupted metadata, as soon as no volume is published; ignored when storage-root or run-root is shared with the container runtime")
+	forceRemount  = flag.Bool("force-remount", false, "lazily unmount target paths that are stuck with stale file handles or disconnected transports on publish and mount them again")
+	hungThreshold = flag.Duration("hung-command-threshold", 10*time.Minute, "how long a buildah command may run before it is logged and counted as hung (0 disables)")
+	hungCancel    = flag.Duration("hung-command-cancel-after", 0, "cancel buildah commands running for longer than this, or their pullTimeout if longer, so the publish fails and cleans up (0 disables)")
+	socketMode    = flag.String("socket-mode", "", "octal permissions of the unix socket endpoint, e.g. 0660 (empty keeps the default)")
+	socketUID     = flag.Int("socket-uid", -1, "owner of the unix socket endpoint (-1 keeps the default)")
+	socketGID     = flag.Int("socket-gid", -1, "group of the unix socket endpoint (-1 keeps the default)")
+	tlsCert       = flag.String("tls-cert", "", "certificate file enabling TLS on a tcp:// endpoint")
+	tlsKey        = flag.String("tls-key", "", "key file of --tls-cert")
+	tlsClientCA   = flag.String("tls-client-ca", "", "CA file clients of a tcp:// endpoint must present a certificate of (mTLS)")
+	grpcMaxRecv   = flag.Int("grpc-max-recv-msg-size", 0, "maximum size in bytes of a CSI request (0 keeps the grpc default of 4MiB)")
+	grpcMaxSend   = flag.Int("grpc-max-send-msg-size", 0, "maximum size in bytes of a CSI response (0 keeps the grpc default)")
+	grpcStreams   = flag.Uint("grpc-max-concurrent-streams", 0, "maximum number of concurrent calls per connection (0 means unlimited)")
+	grpcKATime    = flag.Duration("grpc-keepalive-time", 0, "idle time after which the server pings a client (0 keeps the grpc default of 2h)")
+	grpcKATimeout = flag.Duration("grpc-keepalive-timeout", 0, "time to wait for a ping response before closing the connection (0 keeps the grpc default of 20s)")
+	grpcKAMinTime = flag.Duration("grpc-keepalive-min-time", 0, "shortest ping interval accepted from clients (0 keeps the grpc default of 5m)")
+	leaderElect   = flag.Bool("leader-election", false, "elect a leader among the driver instances, only the leader serves controller calls that change state")
+	leaderNS      = flag.String("leader-election-namespace", "default", "namespace of the leader election lease")
+	leaderLease   = flag.Duration("leader-election-lease-duration", 15*time.Second, "how long a leader keeps the lease without renewing it")
+	topology      = flag.Bool("topology", false, "report architecture, region and zone of the node as CSI topology; region and zone need read access to the node object")
+	maxVolumes    = flag.Int64("max-volumes-per-node", 0, "maximum number of image volumes the scheduler places on a node (0 means unlimited)")
+	selfTest      = flag.Bool("self-test", true, "check that buildah and the storage root work before serving and exit otherwise")
+	selfTestImage = flag.String("self-test-image", "", "image pulled by the startup self-test, e.g. k8s.gcr.io/pause:3.1 (empty skips the test pull)")
+	maxPulls      = flag.Int("max-concurrent-pulls", 0, "maximum number of concurrent pulls, queued pulls are started by volume priority (0 means unlimited)")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdmin(os.Args[2:]))
+	}
+
 	flag.Parse()
+	if *showVersion {
+		if version == "" {
+			version = "devel"
+		}
+		fmt.Printf("imagepopulatorplugin %s\nbuild date: %s\ngo: %s\nbuildah: %s\n", version, buildDate, runtime.Version(), image.BuildahVersion())
+		os.Exit(0)
+	}
+	if err := loadConfig(flag.CommandLine, *configFile, os.LookupEnv); err != nil {
+		glog.Fatal(err)
+	}
+	if err := validateConfig(flag.CommandLine); err != nil {
+		glog.Fatal(err)
+	}
+	isolateInstance(flag.CommandLine, *driverName)
+	if err := image.SetLogFormat(*logFormat); err != nil {
+		glog.Fatal(err)
+	}
 
 	handle()
 	os.Exit(0)
 }
 
 func handle() {
-	driver := image.NewDriver(*driverName, *nodeID, *endpoint)
+	gates, err := image.ParseFeatureGates(*featureGates)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	var mode uint64
+	if *socketMode != "" {
+		mode, err = strconv.ParseUint(*socketMode, 8, 32)
+		if err != nil {
+			glog.Fatalf("invalid socket-mode %q: %v", *socketMode, err)
+		}
+	}
+
+	driver := image.NewDriver(*driverName, *nodeID, *endpoint, image.Options{
+		Version:        version,
+		BuildDate:      buildDate,
+		KubeletPodsDir: *podsDir,
+
+		StorageRoot:   *storageRoot,
+		RunRoot:       *runRoot,
+		ReservedSpace: *reservedSpace,
+		PullHeadroom:  *pullHeadroom,
+
+		StorageDriver:        *storageDrv,
+		FuseOverlayfsPath:    *fusePath,
+		StorageCheckInterval: *storageCheck,
+
+		MaxConcurrentPulls: *maxPulls,
+		Cgroup:             *cgroupPath,
+		CgroupCPUWeight:    *cgroupCPU,
+		CgroupIOWeight:     *cgroupIO,
+		PullRetries:        *pullRetries,
+		PullRetryDelay:     *pullDelay,
+		FailedPullCacheTTL: *failedPullTTL,
+		CommandTimeout:     *cmdTimeout,
+		MaxPullTimeout:     *maxPullTime,
+		TmpfsSize:          *tmpfsSize,
+		StripXattrs:        *stripXattrs,
+		MountPropagation:   *propagation,
+		ExportDir:          *exportDir,
+		ExportURLPrefixes:  splitList(*exportURLs),
+		UpdateInterval:     *updateInt,
+		MinResyncInterval:  *minResync,
+		MaxResyncInterval:  *maxResync,
+		MetricsAddress:     *metricsAddr,
+		PprofAddress:       *pprofAddr,
+		LocalityAddress:    *localityAddr,
+		WebhookAddress:     *webhookAddr,
+		WebhookTokenFile:   *webhookToken,
+		DebugVerbosity:     *debugLevel,
+		Events:             *events,
+		AdminSocket:        *adminSocket,
+		CommandHistory:     *cmdHistory,
+		DebugLogDir:        *debugLogDir,
+		InventoryInterval:  *inventoryInt,
+		AnnotateNode:       *annotateNode,
+		LeakCheckInterval:  *leakInterval,
+		LeakGracePeriod:    *leakGrace,
+		PrefetchInterval:   *prefetchInt,
+		RegistryConfig:     *registryConf,
+		VolumePolicy:       *volumePolicy,
+		CRIEndpoint:        *criEndpoint,
+		CRIImageStore:      *criStore,
+		FeatureGates:       gates,
+		StateDir:           *stateDir,
+		ShutdownTimeout:    *shutdownWait,
+		ShutdownCleanup:    *shutdownClean,
+		StorageAutoReset:   *storageReset,
+		ForceRemount:       *forceRemount,
+		SocketMode:         os.FileMode(mode),
+		SocketUID:          *socketUID,
+		SocketGID:          *socketGID,
+		TLSCert:            *tlsCert,
+		TLSKey:             *tlsKey,
+		TLSClientCA:        *tlsClientCA,
+		LeaderElection:     *leaderElect,
+		Topology:           *topology,
+		MaxVolumesPerNode:  *maxVolumes,
+		SelfTest:           *selfTest,
+		SelfTestImage:      *selfTestImage,
+
+		HungCommandThreshold:   *hungThreshold,
+		HungCommandCancelAfter: *hungCancel,
+		ImageChannelInterval:   *channelInt,
+
+		GRPCMaxRecvMsgSize:       *grpcMaxRecv,
+		GRPCMaxSendMsgSize:       *grpcMaxSend,
+		GRPCMaxConcurrentStreams: uint32(*grpcStreams),
+		GRPCKeepaliveTime:        *grpcKATime,
+		GRPCKeepaliveTimeout:     *grpcKATimeout,
+		GRPCKeepaliveMinTime:     *grpcKAMinTime,
+
+		LeaderElectionNamespace:     *leaderNS,
+		LeaderElectionLeaseDuration: *leaderLease,
+	})
 	driver.Run()
 }
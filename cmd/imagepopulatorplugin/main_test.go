@@ -1,7 +1,91 @@
 package main
 
-import "testing"
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestStub(t *testing.T) {
 
 }
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# node settings\nstorage-root: \"/srv/storage\"\npull-retries: 5 # flaky registry\npull-retry-delay: 10s\ncgroup: /sys/fs/cgroup/a\n")
+	f.Close()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	root := fs.String("storage-root", "/var/lib/containers/storage", "")
+	retries := fs.Int("pull-retries", 2, "")
+	delay := fs.Duration("pull-retry-delay", 5*time.Second, "")
+	cgroup := fs.String("cgroup", "", "")
+	if err := fs.Parse([]string{"-cgroup", "/sys/fs/cgroup/b"}); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"IMAGE_POPULATOR_PULL_RETRIES": "7", "IMAGE_POPULATOR_CGROUP": "/sys/fs/cgroup/c"}
+	lookup := func(k string) (string, bool) { v, ok := env[k]; return v, ok }
+
+	if err := loadConfig(fs, f.Name(), lookup); err != nil {
+		t.Fatal(err)
+	}
+	if *root != "/srv/storage" || *retries != 7 || *delay != 10*time.Second || *cgroup != "/sys/fs/cgroup/b" {
+		t.Fatalf("unexpected settings %s %d %v %s", *root, *retries, *delay, *cgroup)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("pull-retries", 2, "")
+	env["IMAGE_POPULATOR_PULL_RETRIES"] = "many"
+	if err := loadConfig(fs, "", lookup); err == nil || !strings.Contains(err.Error(), `"pull-retries"`) {
+		t.Fatalf("expected error naming the key, got %v", err)
+	}
+	if _, err := parseConfig(strings.NewReader("registries:\n  - docker.io\n")); err == nil {
+		t.Fatal("nested config accepted")
+	}
+}
+
+func TestIsolateInstance(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	root := fs.String("storage-root", "/var/lib/containers/storage", "")
+	state := fs.String("state-dir", "/srv/state", "")
+	socket := fs.String("admin-socket", "/run/image-populator/admin.sock", "")
+	if err := fs.Parse([]string{"-state-dir", "/srv/state"}); err != nil {
+		t.Fatal(err)
+	}
+
+	isolateInstance(fs, defaultDriverName)
+	if *root != "/var/lib/containers/storage" {
+		t.Fatalf("default instance moved to %s", *root)
+	}
+	isolateInstance(fs, "canary.image.csi.k8s.io")
+	if *root != "/var/lib/containers/storage-canary.image.csi.k8s.io" || *state != "/srv/state" ||
+		*socket != "/run/image-populator-canary.image.csi.k8s.io/admin.sock" {
+		t.Fatalf("unexpected paths %s %s %s", *root, *state, *socket)
+	}
+}
+
+func TestValidateConfigWebhookToken(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("webhook-address", "", "")
+	token := fs.String("webhook-token-file", "", "")
+	if err := validateConfig(fs); err != nil {
+		t.Fatalf("disabled webhooks rejected: %v", err)
+	}
+	if err := fs.Parse([]string{"-webhook-address", ":9092"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(fs); err == nil || !strings.Contains(err.Error(), `"webhook-token-file"`) {
+		t.Fatalf("expected error naming the token file, got %v", err)
+	}
+	*token = "/etc/image-populator/webhook-token"
+	if err := validateConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+}
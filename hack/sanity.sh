@@ -0,0 +1,57 @@
+#!/bin/sh
+
+# Copyright 2019 The Kubernetes Authors.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Runs csi-sanity from kubernetes-csi/csi-test against bin/imagepopulatorplugin.
+# The plugin uses buildah from the host with storage below a temporary
+# directory, so this needs root.
+
+set -e
+
+if ! command -v csi-sanity >/dev/null; then
+	echo "csi-sanity not found in PATH, install it from https://github.com/kubernetes-csi/csi-test" >&2
+	exit 1
+fi
+
+dir=$(mktemp -d)
+trap 'kill $pid 2>/dev/null; rm -rf "$dir"' EXIT
+
+bin/imagepopulatorplugin \
+	--endpoint "unix://$dir/csi.sock" \
+	--nodeid sanity \
+	--kubelet-pods-dir "$dir" \
+	--storage-root "$dir/storage" \
+	--run-root "$dir/run" \
+	--state-dir "" \
+	--admin-socket "" \
+	--debug-log-dir "" \
+	--self-test=false \
+	--v 4 &
+pid=$!
+
+for i in $(seq 50); do
+	[ -S "$dir/csi.sock" ] && break
+	sleep 0.1
+done
+
+# Volumes created by the controller tests need an image.
+echo "image: docker.io/library/busybox:latest" >"$dir/parameters.yaml"
+
+csi-sanity \
+	--csi.endpoint "$dir/csi.sock" \
+	--csi.testvolumeparameters "$dir/parameters.yaml" \
+	--csi.mountdir "$dir/target" \
+	--csi.stagingdir "$dir/staging" \
+	"$@"
@@ -0,0 +1,201 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// The admin API is served over a unix socket on the node and backs the
+// "admin" subcommand of the plugin binary:
+//
+//	GET  /volumes             list tracked volumes
+//	GET  /volumes/<id>        inspect a volume and its buildah container
+//	GET  /volumes/<id>/commands  last backend commands run for a volume
+//	POST /volumes/<id>/purge  unmount and delete a volume, tracked or not
+//	POST /volumes/<id>/refresh  update a tmpfs volume to the current image
+//	GET  /images              last inventory of the storage root
+//	POST /gc                  remove images no container uses anymore
+//	GET  /loglevel            report the log verbosity
+//	PUT  /loglevel?v=<level>  change the log verbosity
+
+type adminServer struct {
+	ns        *nodeServer
+	inventory *inventory
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/volumes", a.listVolumes)
+	mux.HandleFunc("/volumes/", a.volume)
+	mux.HandleFunc("/images", a.images)
+	mux.HandleFunc("/gc", a.gc)
+	mux.HandleFunc("/loglevel", logLevelHandler)
+	return mux
+}
+
+func (a *adminServer) listVolumes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONResponse(w, a.ns.volumes.list())
+}
+
+func (a *adminServer) volume(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/volumes/"), "/")
+	id := parts[0]
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		v, tracked := a.ns.volumes.get(id)
+		container, err := a.ns.runCmd([]string{"inspect", a.ns.containerName(id)})
+		if !tracked && err != nil {
+			http.Error(w, "volume "+id+" is neither tracked nor has a container", http.StatusNotFound)
+			return
+		}
+		resp := struct {
+			Tracked   bool            `json:"tracked"`
+			Volume    *Volume         `json:"volume,omitempty"`
+			Container json.RawMessage `json:"container,omitempty"`
+		}{Tracked: tracked}
+		if tracked {
+			resp.Volume = &v
+		}
+		if err == nil && json.Valid(container) {
+			resp.Container = container
+		}
+		writeJSONResponse(w, resp)
+
+	case len(parts) == 2 && parts[1] == "commands" && r.Method == http.MethodGet:
+		writeJSONResponse(w, a.ns.history.get(id))
+
+	case len(parts) == 2 && parts[1] == "purge" && r.Method == http.MethodPost:
+		targetPath := r.URL.Query().Get("targetPath")
+		if v, ok := a.ns.volumes.get(id); ok && targetPath == "" {
+			targetPath = v.TargetPath
+			for _, shared := range v.SharedTargets {
+				if err := a.ns.teardownVolume(r.Context(), id, shared); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		logWarning("purging volume", "volume_id", id, "target_path", targetPath)
+		if err := a.ns.teardownVolume(r.Context(), id, targetPath); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "refresh" && r.Method == http.MethodPost:
+		changed, err := a.ns.refreshVolume(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v, _ := a.ns.volumes.get(id)
+		writeJSONResponse(w, struct {
+			Changed bool   `json:"changed"`
+			Digest  string `json:"digest"`
+		}{changed, v.Digest})
+
+	default:
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+	}
+}
+
+func (a *adminServer) images(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.inventory == nil {
+		http.Error(w, "inventory is disabled", http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, a.inventory.get())
+}
+
+func (a *adminServer) gc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	output, err := a.ns.runCmd([]string{"rmi", "--prune"})
+	if err != nil {
+		http.Error(w, err.Error()+": "+string(output), http.StatusInternalServerError)
+		return
+	}
+	if removed, err := a.ns.gcComposefsObjects(r.Context()); err != nil {
+		http.Error(w, "cannot remove unused composefs objects: "+err.Error(), http.StatusInternalServerError)
+		return
+	} else if removed > 0 {
+		output = append(output, fmt.Sprintf("removed %d unused composefs objects\n", removed)...)
+	}
+	if a.inventory != nil {
+		go a.inventory.refresh()
+	}
+	w.Write(output)
+}
+
+func writeJSONResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// serveAdmin serves the admin API on the unix socket at path until the
+// process exits.
+func serveAdmin(path string, ns *nodeServer, inv *inventory) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		glog.Errorf("cannot create admin socket directory: %v", err)
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("cannot remove admin socket %s: %v", path, err)
+		return
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		glog.Errorf("cannot listen on admin socket %s: %v", path, err)
+		return
+	}
+	// The API can delete volumes, keep it to root.
+	os.Chmod(path, 0600)
+
+	glog.Infof("serving admin API on %s", path)
+	a := &adminServer{ns: ns, inventory: inv}
+	go func() {
+		if err := http.Serve(listener, a.handler()); err != nil {
+			glog.Errorf("admin API failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,35 @@
+package image
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminListVolumes(t *testing.T) {
+	ns := &nodeServer{volumes: newVolumeTracker()}
+	ns.volumes.add(Volume{ID: "b", Image: "busybox", Mode: modeBind})
+	ns.volumes.add(Volume{ID: "a", Image: "alpine", Mode: modeTmpfs})
+	a := &adminServer{ns: ns}
+
+	rec := httptest.NewRecorder()
+	a.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/volumes", nil))
+	var volumes []Volume
+	if err := json.Unmarshal(rec.Body.Bytes(), &volumes); err != nil {
+		t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+	}
+	if len(volumes) != 2 || volumes[0].ID != "a" || volumes[1].Image != "busybox" {
+		t.Fatalf("unexpected volumes %+v", volumes)
+	}
+
+	ns.volumes.remove("a")
+	rec = httptest.NewRecorder()
+	a.handler().ServeHTTP(rec, httptest.NewRequest("POST", "/volumes", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected method not allowed, got %d", rec.Code)
+	}
+	if _, ok := ns.volumes.get("a"); ok {
+		t.Fatal("removed volume still tracked")
+	}
+}
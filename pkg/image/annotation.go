@@ -0,0 +1,158 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+// maxAnnotatedDigests bounds the size of the cached images annotation, node
+// annotations share a limit of 256KiB. The largest images are kept, as they
+// are the most expensive to pull.
+const maxAnnotatedDigests = 200
+
+// minBandwidthSample is the smallest pull that is taken into account for the
+// pull bandwidth, smaller ones are dominated by latency.
+const minBandwidthSample = 16 << 20
+
+// pullBandwidth estimates the rate this node pulls images at, as a moving
+// average over the pulls of the driver.
+type pullBandwidth struct {
+	mu   sync.Mutex
+	rate float64
+}
+
+func (b *pullBandwidth) observe(bytes int64, d time.Duration) {
+	if b == nil || bytes < minBandwidthSample || d <= 0 {
+		return
+	}
+	sample := float64(bytes) / d.Seconds()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		b.rate = sample
+	} else {
+		b.rate = 0.7*b.rate + 0.3*sample
+	}
+}
+
+// get returns the estimated bytes per second, zero if no pull was large
+// enough to tell.
+func (b *pullBandwidth) get() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// cachedImagesAnnotator publishes the digests of the images in the storage
+// root and the pull bandwidth as annotations of the node object.
+type cachedImagesAnnotator struct {
+	client       *kube.Client
+	nodeName     string
+	key          string
+	bandwidthKey string
+
+	published          string
+	publishedBandwidth int64
+	synced             bool
+}
+
+func newCachedImagesAnnotator(driverName, nodeName string) (*cachedImagesAnnotator, error) {
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return &cachedImagesAnnotator{client: client, nodeName: nodeName,
+		key: cachedImagesAnnotation(driverName), bandwidthKey: pullBandwidthAnnotation(driverName)}, nil
+}
+
+// cachedImagesAnnotation is the annotation key. It is prefixed with the
+// driver name, so that several instances on a node do not overwrite each
+// other.
+func cachedImagesAnnotation(driverName string) string {
+	return driverName + "/cached-images"
+}
+
+// pullBandwidthAnnotation is the annotation key of the pull bandwidth in
+// bytes per second.
+func pullBandwidthAnnotation(driverName string) string {
+	return driverName + "/pull-bandwidth"
+}
+
+// cachedDigests returns the sorted digests of the images buildah lists, at
+// most max of them.
+func cachedDigests(images []json.RawMessage, max int) []string {
+	type cachedImage struct {
+		Digest string `json:"digest"`
+		Size   int64  `json:"size"`
+	}
+	var cached []cachedImage
+	seen := map[string]bool{}
+	for _, raw := range images {
+		var image cachedImage
+		if json.Unmarshal(raw, &image) != nil || image.Digest == "" || seen[image.Digest] {
+			continue
+		}
+		seen[image.Digest] = true
+		cached = append(cached, image)
+	}
+	if len(cached) > max {
+		sort.Slice(cached, func(i, j int) bool { return cached[i].Size > cached[j].Size })
+		cached = cached[:max]
+	}
+	digests := make([]string, len(cached))
+	for i, image := range cached {
+		digests[i] = image.Digest
+	}
+	sort.Strings(digests)
+	return digests
+}
+
+// update annotates the node with the digests of images and the pull
+// bandwidth if they changed since the last update. Annotations without a
+// value are removed.
+func (a *cachedImagesAnnotator) update(images []json.RawMessage, bandwidth int64) error {
+	value := strings.Join(cachedDigests(images, maxAnnotatedDigests), ",")
+	if a.synced && value == a.published && bandwidth == a.publishedBandwidth {
+		return nil
+	}
+	annotations := map[string]interface{}{a.key: nil, a.bandwidthKey: nil}
+	if value != "" {
+		annotations[a.key] = value
+	}
+	if bandwidth > 0 {
+		annotations[a.bandwidthKey] = strconv.FormatInt(bandwidth, 10)
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	}
+	if err := a.client.Patch("/api/v1/nodes/"+a.nodeName, patch, nil); err != nil {
+		return err
+	}
+	a.published, a.publishedBandwidth, a.synced = value, bandwidth, true
+	return nil
+}
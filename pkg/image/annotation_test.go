@@ -0,0 +1,67 @@
+package image
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+func TestCachedImagesAnnotator(t *testing.T) {
+	images := []json.RawMessage{
+		json.RawMessage(`{"digest": "sha256:b", "size": 300}`),
+		json.RawMessage(`{"digest": "sha256:a", "size": 200}`),
+		json.RawMessage(`{"digest": "sha256:a", "size": 200}`),
+		json.RawMessage(`{"digest": "sha256:c", "size": 100}`),
+		json.RawMessage(`{"names": ["no digest"]}`),
+	}
+	if digests := strings.Join(cachedDigests(images, 2), ","); digests != "sha256:a,sha256:b" {
+		t.Fatalf("unexpected digests %s", digests)
+	}
+
+	var patches []map[string]map[string]map[string]*string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PATCH" || r.URL.Path != "/api/v1/nodes/node-a" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var patch map[string]map[string]map[string]*string
+		json.NewDecoder(r.Body).Decode(&patch)
+		patches = append(patches, patch)
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	a := &cachedImagesAnnotator{client: kube.NewClient(srv.URL, "", srv.Client()), nodeName: "node-a",
+		key: cachedImagesAnnotation("image.csi.k8s.io"), bandwidthKey: pullBandwidthAnnotation("image.csi.k8s.io")}
+
+	for i := 0; i < 2; i++ {
+		if err := a.update(images, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(patches) != 1 {
+		t.Fatalf("expected the unchanged annotation to be patched once, got %d patches", len(patches))
+	}
+	if v := patches[0]["metadata"]["annotations"]["image.csi.k8s.io/cached-images"]; v == nil || *v != "sha256:a,sha256:b,sha256:c" {
+		t.Fatalf("unexpected patch %v", patches[0])
+	}
+
+	// A new bandwidth estimate is published.
+	if err := a.update(images, 50<<20); err != nil {
+		t.Fatal(err)
+	}
+	if v := patches[1]["metadata"]["annotations"]["image.csi.k8s.io/pull-bandwidth"]; len(patches) != 2 || v == nil || *v != "52428800" {
+		t.Fatalf("bandwidth not published: %v", patches)
+	}
+
+	// Without images the annotation is removed.
+	if err := a.update(nil, 50<<20); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := patches[2]["metadata"]["annotations"]["image.csi.k8s.io/cached-images"]; !ok || v != nil {
+		t.Fatalf("annotation not removed: %v", patches[2])
+	}
+}
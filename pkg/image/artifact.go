@@ -0,0 +1,208 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// artifactAttributes are the volume attributes that shape image content and
+// have no meaning for artifacts.
+var artifactAttributes = []string{
+	"images", "path", "include", "exclude", "uid", "gid", "fileMode", "dirMode", "stripSetuid",
+	"symlinkPolicy", "metadata", "envFile", "provenance", "updatePolicy", "resyncInterval",
+	"retainChanges", "export", "exportURL", "diskPath", "baseImage",
+}
+
+// checkArtifactAttributes rejects the attributes artifact mode does not
+// support.
+func checkArtifactAttributes(attrib map[string]string) error {
+	for _, name := range artifactAttributes {
+		if attrib[name] != "" {
+			return fmt.Errorf("%s is not supported in artifact mode", name)
+		}
+	}
+	return nil
+}
+
+// artifactDir is where the artifact of a volume is fetched to before it is
+// unpacked.
+func (ns *nodeServer) artifactDir(volumeId string) string {
+	return filepath.Join(ns.storageRoot, "artifacts", volumeId)
+}
+
+// fetchArtifact copies the artifact image refers to into an OCI image
+// layout at dir. Unlike buildah, skopeo copies manifests with any media
+// types.
+func (ns *nodeServer) fetchArtifact(ctx context.Context, image, platform string, priority int, dir string) error {
+	policy := ns.registries.get()
+	if err := policy.check(image); err != nil {
+		return imageError(codes.PermissionDenied, errorReasonPolicyDenied, image, 0, err.Error())
+	}
+	failureKey := failedPullKey(image, platform)
+	if err := ns.pullFailures.get(failureKey); err != nil {
+		logInfo(4, "fetch failed recently, not retrying yet", "image", image)
+		return err
+	}
+
+	release, err := ns.pulls.acquire(ctx, priority)
+	if err != nil {
+		return backendError(image, "cannot fetch artifact "+image, nil, err)
+	}
+	defer release()
+
+	if err := os.RemoveAll(dir); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	var args []string
+	if signaturePolicy := policy.signaturePolicy(); signaturePolicy != "" {
+		args = append(args, "--policy", signaturePolicy)
+	}
+	args = append(args, "copy")
+	if authFile := policy.authFile(image); authFile != "" {
+		args = append(args, "--authfile", authFile)
+	}
+	if parts := strings.Split(platform, "/"); len(parts) >= 2 {
+		args = append(args, "--override-os", parts[0], "--override-arch", parts[1])
+		if len(parts) == 3 {
+			args = append(args, "--override-variant", parts[2])
+		}
+	}
+	args = append(args, "docker://"+policy.rewrite(image), "oci:"+dir+":artifact")
+	output, timeout, err := runProcessIn(ctx, ns.cgroup, exec.Command("skopeo", args...), ns.commandTimeout(ctx))
+	switch {
+	case err != nil && timeout:
+		err = TimeoutError
+	case err != nil && ctx.Err() != nil:
+		err = ctx.Err()
+	}
+	if err != nil {
+		err = backendError(image, "cannot fetch artifact "+image, output, err)
+		ns.pullFailures.record(failureKey, err)
+		return err
+	}
+	ns.pullFailures.record(failureKey, nil)
+	return nil
+}
+
+// publishArtifact fetches the artifact image refers to and unpacks its
+// layers into a tmpfs at targetPath, each with the unpacker registered for
+// its media type. It returns the manifest digest. Errors are status errors.
+func (ns *nodeServer) publishArtifact(ctx context.Context, volumeId, image, platform string, priority int, targetPath string, size int64, readOnly bool) (string, error) {
+	layout := ns.artifactDir(volumeId)
+	defer os.RemoveAll(layout)
+	if err := ns.fetchArtifact(ctx, image, platform, priority, layout); err != nil {
+		return "", err
+	}
+	digest, manifest, err := readManifest(layout)
+	if _, ok := err.(unsupportedMediaTypeError); ok {
+		return "", status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	if size == 0 {
+		size = ns.tmpfsSize
+	}
+	mounter := mount.New("")
+	if err := mounter.Mount("tmpfs", targetPath, "tmpfs", []string{"size=" + strconv.FormatInt(size, 10), "mode=0755"}); err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if err := unpackLayers(layout, manifest, targetPath); err != nil {
+		mounter.Unmount(targetPath)
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if readOnly {
+		if err := mounter.Mount("tmpfs", targetPath, "tmpfs", []string{"remount", "ro"}); err != nil {
+			mounter.Unmount(targetPath)
+			return "", status.Error(codes.Internal, err.Error())
+		}
+	}
+	return digest, nil
+}
+
+// publishArtifactVolume publishes a volume in artifact mode. Artifacts are
+// unpacked without a buildah container, so most of the image handling of
+// NodePublishVolume does not apply.
+func (ns *nodeServer) publishArtifactVolume(ctx context.Context, req *csi.NodePublishVolumeRequest, image, platform string, priority int, size int64, propagation string) (_ *csi.NodePublishVolumeResponse, err error) {
+	volumeId := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	attrib := req.GetVolumeContext()
+	if err := ns.recoverTarget(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	createdTarget, err := createTarget(targetPath, false)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer func() {
+		if err != nil {
+			removeTarget(targetPath, createdTarget)
+		}
+	}()
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	logInfo(4, "publishing artifact", append(volumeFields(volumeId, attrib), "target_path", targetPath, "platform", platform)...)
+	start := time.Now()
+	digest, err := ns.publishArtifact(ctx, volumeId, image, platform, priority, targetPath, size, req.GetReadonly())
+	if err != nil {
+		ns.events.podEvent(attrib, eventTypeWarning, reasonPullFailed, fmt.Sprintf("Failed to fetch artifact %q: %v", image, status.Convert(err).Message()))
+		return nil, err
+	}
+	ns.events.podEvent(attrib, eventTypeNormal, reasonPulled,
+		fmt.Sprintf("Fetched artifact %q (%s) in %v", image, digest, time.Since(start).Round(time.Millisecond)))
+
+	if propagation != "" {
+		if err := setPropagation(targetPath, propagation); err != nil {
+			mount.New("").Unmount(targetPath)
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	ns.volumes.add(Volume{
+		ID:            volumeId,
+		Image:         image,
+		Digest:        digest,
+		Mode:          modeArtifact,
+		ReadOnly:      req.GetReadonly(),
+		TargetPath:    targetPath,
+		PublishedAt:   time.Now(),
+		Attributes:    attrib,
+		CreatedTarget: createdTarget,
+	})
+	return &csi.NodePublishVolumeResponse{}, nil
+}
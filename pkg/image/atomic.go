@@ -0,0 +1,134 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Copied content is laid out like in ConfigMap volumes: it lives in a
+// timestamped directory below the volume, which the "..data" symlink
+// points at, and every top level entry of the volume is a symlink through
+// "..data". Replacing the content is a rename of "..data", so readers see
+// either the old or the new content, never a mix.
+const (
+	dataLink    = "..data"
+	dataLinkTmp = "..data_tmp"
+	// updateMarker is written next to the links after every refresh of
+	// the content, with the new digest, for applications to watch.
+	updateMarker = ".image-updated"
+)
+
+// swapContent calls fill with a new directory below root and atomically
+// replaces the content of root with it. The previous content is removed,
+// unless fill fails, in which case root is left unchanged.
+func swapContent(root string, fill func(dir string) error) error {
+	old, err := os.Readlink(filepath.Join(root, dataLink))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(root, ".."+time.Now().UTC().Format("2006_01_02_15_04_05."))
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := fill(dir); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	tmp := filepath.Join(root, dataLinkTmp)
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(dir), tmp); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(root, dataLink)); err != nil {
+		os.Remove(tmp)
+		os.RemoveAll(dir)
+		return err
+	}
+
+	// Link new top level entries and remove the links of the ones that
+	// are gone. The links of entries that stay do not change.
+	names := map[string]bool{}
+	for _, entry := range entries {
+		names[entry.Name()] = true
+		link := filepath.Join(root, entry.Name())
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(dataLink, entry.Name()), link); err != nil {
+			return err
+		}
+	}
+	current, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range current {
+		if strings.HasPrefix(entry.Name(), "..") || names[entry.Name()] {
+			continue
+		}
+		link := filepath.Join(root, entry.Name())
+		if target, err := os.Readlink(link); err != nil || !strings.HasPrefix(target, dataLink+"/") {
+			continue
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	}
+
+	if old != "" {
+		return os.RemoveAll(filepath.Join(root, old))
+	}
+	return nil
+}
+
+// writeUpdateMarker replaces the update marker in root with one holding
+// digest, owned by o.
+func writeUpdateMarker(root, digest string, o *owner) error {
+	tmp := filepath.Join(root, ".."+updateMarker+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(digest+"\n"), 0644); err != nil {
+		return err
+	}
+	if o != nil {
+		uid, gid := o.ids(-1, -1)
+		if err := os.Chown(tmp, uid, gid); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(root, updateMarker)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
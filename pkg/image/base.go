@@ -0,0 +1,98 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// baseContainer returns the key of the container holding the base image of
+// a volume with the baseImage attribute, see containerName. It only lives while the volume is
+// published, as the content is copied.
+func baseContainer(volumeId string) string {
+	return volumeId + "-base"
+}
+
+// mountBase pulls the base image of a volume and returns the directory of
+// its rootfs matching subPath, or "" if the base image has no such
+// directory and the whole content is new. Errors are status errors.
+func (ns *nodeServer) mountBase(ctx context.Context, volumeId, image, platform, subPath string, priority int) (string, error) {
+	container := baseContainer(volumeId)
+	if err := ns.setupVolume(ctx, container, image, platform, priority, 0); err != nil {
+		return "", err
+	}
+	output, err := ns.runVolumeCmd(volumeId, []string{"mount", ns.containerName(container)})
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("cannot mount base container %s: %v: %s", container, err, strings.TrimSpace(string(output))))
+	}
+	root, isFile, err := subPathSource(strings.TrimSpace(string(output)), subPath)
+	if err != nil || isFile {
+		glog.V(4).Infof("base image %s has no directory %q, publishing all of volume %s", image, subPath, volumeId)
+		return "", nil
+	}
+	return root, nil
+}
+
+// releaseBase deletes the base container of a volume.
+func (ns *nodeServer) releaseBase(volumeId string) {
+	container := baseContainer(volumeId)
+	if output, err := ns.runVolumeCmd(volumeId, []string{"delete", ns.containerName(container)}); err != nil {
+		glog.Warningf("cannot delete base container %s: %v: %s", container, err, output)
+	}
+}
+
+// unchanged reports whether the entry at rel of the copied tree is the same
+// in the base tree. Like rsync does, files are compared by type, mode, owner,
+// size and modification time, not by content. Directories only need to match
+// in mode and owner, their entries are compared one by one.
+func (c *copier) unchanged(rel string, info os.FileInfo) bool {
+	if c.base == "" {
+		return false
+	}
+	path := filepath.Join(c.base, rel)
+	base, err := os.Lstat(path)
+	if err != nil || base.Mode() != info.Mode() {
+		return false
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		bst, ok := base.Sys().(*syscall.Stat_t)
+		if !ok || bst.Uid != st.Uid || bst.Gid != st.Gid {
+			return false
+		}
+	}
+	switch {
+	case info.IsDir():
+		return true
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(filepath.Join(c.src, rel))
+		if err != nil {
+			return false
+		}
+		baseLink, err := os.Readlink(path)
+		return err == nil && link == baseLink
+	}
+	return base.Size() == info.Size() && base.ModTime().Equal(info.ModTime())
+}
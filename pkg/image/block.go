@@ -0,0 +1,180 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// Block volumes are backed by a loop device. In disk mode the raw disk image
+// embedded in the image is attached directly, otherwise the rootfs is
+// materialized into an ext4 filesystem image first.
+
+func (ns *nodeServer) blockDir() string {
+	return filepath.Join(ns.storageRoot, "block")
+}
+
+// loopRecord is the file remembering which loop device backs a volume.
+func (ns *nodeServer) loopRecord(volumeId string) string {
+	return filepath.Join(ns.blockDir(), volumeId+".loop")
+}
+
+// makeFile creates an empty file at path for a block volume to be bind
+// mounted onto.
+func makeFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// runTool runs a helper like losetup or mkfs.ext4 like the backend commands,
+// bounded by their timeout and ctx.
+func (ns *nodeServer) runTool(ctx context.Context, name string, args ...string) ([]byte, error) {
+	output, timedOut, err := runProcessIn(ctx, ns.cgroup, exec.Command(name, args...), ns.commandTimeout(ctx))
+	switch {
+	case err != nil && timedOut:
+		err = TimeoutError
+	case err != nil && ctx.Err() != nil:
+		err = ctx.Err()
+	}
+	return output, err
+}
+
+// publishBlock attaches the volume content to a loop device and bind mounts
+// the device at targetPath.
+func (ns *nodeServer) publishBlock(ctx context.Context, volumeId, mode, rootfs, diskPath, targetPath string, readOnly bool) error {
+	if err := os.MkdirAll(ns.blockDir(), 0700); err != nil {
+		return err
+	}
+
+	var backing string
+	if mode == modeDisk {
+		disk, err := findDiskImage(rootfs, diskPath)
+		if err != nil {
+			return err
+		}
+		// Attaching qcow2 would need qemu-nbd, the driver only
+		// attaches raw images.
+		if strings.HasSuffix(disk, ".qcow2") {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("qcow2 disk image %s cannot be attached as a block device, only raw images are supported", disk))
+		}
+		backing = disk
+	} else {
+		backing = filepath.Join(ns.blockDir(), volumeId+".img")
+		if err := ns.makeFilesystemImage(ctx, rootfs, backing); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"--find", "--show"}
+	if readOnly {
+		args = append(args, "--read-only")
+	}
+	output, err := ns.runTool(ctx, "losetup", append(args, backing)...)
+	if err != nil {
+		return fmt.Errorf("losetup failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	device := strings.TrimSpace(string(output))
+	glog.V(4).Infof("volume %s attached to %s from %s", volumeId, device, backing)
+
+	if err := ioutil.WriteFile(ns.loopRecord(volumeId), []byte(device), 0600); err != nil {
+		ns.detachLoop(volumeId, device)
+		return err
+	}
+
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	if err := mount.New("").Mount(device, targetPath, "", options); err != nil {
+		ns.detachLoop(volumeId, device)
+		return err
+	}
+	return nil
+}
+
+// makeFilesystemImage writes an ext4 image holding the contents of rootfs.
+func (ns *nodeServer) makeFilesystemImage(ctx context.Context, rootfs, image string) error {
+	var used int64
+	filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			used += info.Size()
+		}
+		return nil
+	})
+	// Leave room for filesystem metadata and inode tables.
+	size := used + used/5 + 64<<20
+
+	if output, err := ns.runTool(ctx, "mkfs.ext4", "-q", "-F", "-d", rootfs, image, strconv.FormatInt(size/1024, 10)+"k"); err != nil {
+		os.Remove(image)
+		return fmt.Errorf("mkfs.ext4 failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// unpublishBlock detaches the loop device of a block volume and removes its
+// filesystem image. It does nothing for volumes that are not block volumes.
+func (ns *nodeServer) unpublishBlock(volumeId, targetPath string) error {
+	if ns.storageRoot == "" {
+		return nil
+	}
+	device, err := ioutil.ReadFile(ns.loopRecord(volumeId))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := ns.detachLoop(volumeId, strings.TrimSpace(string(device))); err != nil {
+		return err
+	}
+	if targetPath != "" {
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ns *nodeServer) detachLoop(volumeId, device string) error {
+	// Loop devices do not survive a node reboot.
+	if output, err := ns.runTool(context.Background(), "losetup", "--detach", device); err != nil && !strings.Contains(string(output), "No such device") {
+		return fmt.Errorf("losetup --detach %s failed: %v: %s", device, err, strings.TrimSpace(string(output)))
+	}
+	os.Remove(ns.loopRecord(volumeId))
+	if err := os.Remove(filepath.Join(ns.blockDir(), volumeId+".img")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMakeFile(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "pods", "volumeDevices", "vol")
+	if err := makeFile(target); err != nil {
+		t.Fatalf("makeFile failed: %v", err)
+	}
+	fi, err := os.Stat(target)
+	if err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("expected a regular file at %s: %v", target, err)
+	}
+	if err := makeFile(target); err != nil {
+		t.Fatalf("makeFile on an existing file failed: %v", err)
+	}
+}
+
+func TestPublishBlockRefusesQcow2(t *testing.T) {
+	rootfs := t.TempDir()
+	writeTree(t, rootfs, map[string]string{"disk/vm.qcow2": ""})
+	ns := &nodeServer{storageRoot: t.TempDir()}
+	err := ns.publishBlock(context.Background(), "vol", modeDisk, rootfs, "", filepath.Join(t.TempDir(), "vol"), false)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for a qcow2 disk image, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// cgroup is a cgroup v2 directory that backend commands are started in, so
+// that pulls and extractions compete with workloads at a reduced weight.
+type cgroup struct {
+	path string
+}
+
+// newCgroup creates the cgroup at path and applies the given weights. A zero
+// weight leaves the kernel default in place.
+func newCgroup(path string, cpuWeight, ioWeight int) (*cgroup, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	// The controllers have to be enabled in the parent before the weight
+	// files show up. This fails if they already are or are unavailable, in
+	// which case writing the weights below reports the actual problem.
+	ioutil.WriteFile(filepath.Join(filepath.Dir(path), "cgroup.subtree_control"), []byte("+cpu +io"), 0644)
+
+	if cpuWeight > 0 {
+		if err := ioutil.WriteFile(filepath.Join(path, "cpu.weight"), []byte(strconv.Itoa(cpuWeight)), 0644); err != nil {
+			return nil, fmt.Errorf("setting cpu.weight: %v", err)
+		}
+	}
+	if ioWeight > 0 {
+		if err := ioutil.WriteFile(filepath.Join(path, "io.weight"), []byte("default "+strconv.Itoa(ioWeight)), 0644); err != nil {
+			return nil, fmt.Errorf("setting io.weight: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "cgroup.procs")); err != nil {
+		return nil, err
+	}
+	glog.Infof("backend commands run in cgroup %s (cpu weight %d, io weight %d)", path, cpuWeight, ioWeight)
+	return &cgroup{path: path}, nil
+}
+
+// add moves the started process pid into the cgroup. Its children are born
+// there; the backends only start helpers after parsing their arguments, so
+// the moment before the move does not matter.
+func (c *cgroup) add(pid int) error {
+	if c == nil {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(c.path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
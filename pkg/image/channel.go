@@ -0,0 +1,152 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+// channelRefreshes counts the refreshes of volumes started because their
+// ImageChannel moved to another digest.
+var channelRefreshes = metricsRegistry.NewCounterVec("image_populator_channel_refreshes_total",
+	"Refreshes of volumes whose ImageChannel changed by result.", "result")
+
+// imageChannel is an ImageChannel object: a logical image whose current
+// digest CI updates, so that workloads do not have to change with every
+// release.
+type imageChannel struct {
+	Spec struct {
+		Image  string `json:"image"`
+		Digest string `json:"digest"`
+	} `json:"spec"`
+}
+
+func imageChannelPath(namespace, name string) string {
+	return "/apis/" + crdGroup + "/" + crdVersion + "/namespaces/" + namespace + "/imagechannels/" + name
+}
+
+// channelWatcher resolves the imageChannel attribute of volumes and
+// refreshes the volumes when their channel moves to another digest.
+type channelWatcher struct {
+	ns     *nodeServer
+	client *kube.Client
+}
+
+func newChannelWatcher(ns *nodeServer) (*channelWatcher, error) {
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return &channelWatcher{ns: ns, client: client}, nil
+}
+
+// current returns the image the channel points at, pinned by digest.
+func (w *channelWatcher) current(namespace, name string) (string, error) {
+	var channel imageChannel
+	if err := w.client.Do("GET", imageChannelPath(namespace, name), nil, &channel); err != nil {
+		if kube.IsNotFound(err) {
+			return "", status.Error(codes.NotFound, fmt.Sprintf("ImageChannel %s/%s not found", namespace, name))
+		}
+		return "", status.Error(codes.Unavailable, fmt.Sprintf("cannot read ImageChannel %s/%s: %v", namespace, name, err))
+	}
+	if channel.Spec.Image == "" || !strings.HasPrefix(channel.Spec.Digest, "sha256:") {
+		return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("ImageChannel %s/%s has no image and sha256 digest", namespace, name))
+	}
+	return channel.Spec.Image + "@" + channel.Spec.Digest, nil
+}
+
+// resolve returns attrib with the image attribute set to the current image
+// of the channel named by the imageChannel attribute. Channels are looked
+// up in the namespace of the pod. attrib itself is not modified; without
+// imageChannel, it is returned as is.
+func (w *channelWatcher) resolve(attrib map[string]string) (map[string]string, error) {
+	name := attrib["imageChannel"]
+	if name == "" {
+		return attrib, nil
+	}
+	if w == nil {
+		return nil, status.Error(codes.InvalidArgument, "imageChannel needs the driver to run with --image-channel-interval")
+	}
+	if _, ok := attrib["images"]; ok {
+		return nil, status.Error(codes.InvalidArgument, "imageChannel and images are mutually exclusive")
+	}
+	namespace := attrib["csi.storage.k8s.io/pod.namespace"]
+	if namespace == "" {
+		return nil, status.Error(codes.InvalidArgument, "imageChannel needs the pod namespace, set podInfoOnMount in the CSIDriver object")
+	}
+	image, err := w.current(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]string, len(attrib)+1)
+	for k, v := range attrib {
+		resolved[k] = v
+	}
+	resolved["image"] = image
+	return resolved, nil
+}
+
+// run checks the channels of the published volumes every interval until
+// the process exits.
+func (w *channelWatcher) run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		w.check()
+	}
+}
+
+// check refreshes the volumes whose channel points at another image than
+// they were published with. Only volumes that can be refreshed, directories
+// in tmpfs mode, are looked at; others keep the image of their publish.
+func (w *channelWatcher) check() {
+	current := map[string]string{}
+	for _, v := range w.ns.volumes.list() {
+		name := v.Attributes["imageChannel"]
+		if name == "" || v.Mode != modeTmpfs || v.File {
+			continue
+		}
+		key := v.Attributes["csi.storage.k8s.io/pod.namespace"] + "/" + name
+		image, ok := current[key]
+		if !ok {
+			var err error
+			image, err = w.current(v.Attributes["csi.storage.k8s.io/pod.namespace"], name)
+			if err != nil {
+				logWarning("cannot check image channel", "volume_id", v.ID, "channel", key, "error", status.Convert(err).Message())
+				continue
+			}
+			current[key] = image
+		}
+		if image == v.Attributes["image"] {
+			continue
+		}
+		logInfo(2, "image channel moved, refreshing volume", "volume_id", v.ID, "channel", key, "image", image)
+		if _, err := w.ns.refreshVolume(context.Background(), v.ID); err != nil {
+			channelRefreshes.Inc("failure")
+			logWarning("cannot refresh volume after image channel moved", "volume_id", v.ID, "channel", key, "error", err)
+		} else {
+			channelRefreshes.Inc("success")
+		}
+	}
+}
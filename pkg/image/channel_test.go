@@ -0,0 +1,69 @@
+package image
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+func TestImageChannel(t *testing.T) {
+	digest := "sha256:old"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != imageChannelPath("team", "app") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"spec": {"image": "example.com/app", "digest": "` + digest + `"}}`))
+	}))
+	defer srv.Close()
+
+	d := NewDriver("image.csi.k8s.io", "node-a", "unix:///csi.sock", Options{StorageRoot: t.TempDir()})
+	ns := NewNodeServer(d)
+	fake := newFakeBuildah(t.TempDir())
+	ns.backend = fake.run
+	w := &channelWatcher{ns: ns, client: kube.NewClient(srv.URL, "", srv.Client())}
+
+	attrib := map[string]string{"imageChannel": "app", "csi.storage.k8s.io/pod.namespace": "team"}
+	resolved, err := w.resolve(attrib)
+	if err != nil || resolved["image"] != "example.com/app@sha256:old" || attrib["image"] != "" {
+		t.Fatalf("channel not resolved: %v %v", resolved, err)
+	}
+	if _, err := w.resolve(map[string]string{"imageChannel": "other", "csi.storage.k8s.io/pod.namespace": "team"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a missing channel, got %v", err)
+	}
+	if _, err := w.resolve(map[string]string{"imageChannel": "app"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without pod namespace, got %v", err)
+	}
+	if _, err := (*channelWatcher)(nil).resolve(attrib); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument with channels disabled, got %v", err)
+	}
+
+	// Volumes are refreshed with the new image once the channel moves.
+	ns.channels = w
+	ns.volumes.add(Volume{ID: "vol", Mode: modeTmpfs, Attributes: resolved})
+	w.check()
+	pulls := func() int {
+		n := 0
+		for _, call := range fake.calls {
+			joined := strings.Join(call, " ")
+			if strings.Contains(joined, " pull ") && strings.HasSuffix(joined, " example.com/app@sha256:new") {
+				n++
+			}
+		}
+		return n
+	}
+	if pulls() != 0 {
+		t.Fatal("volume refreshed before the channel moved")
+	}
+	digest = "sha256:new"
+	w.check()
+	if pulls() != 1 {
+		t.Fatalf("volume not refreshed after the channel moved: %v", fake.calls)
+	}
+}
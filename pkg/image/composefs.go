@@ -0,0 +1,139 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// The composefs mode turns the container rootfs into an erofs metadata image
+// whose file contents live in an object store shared by all volumes on the
+// node. Pods mounting the same image therefore share page cache, and
+// publishing only writes metadata instead of copying file contents.
+
+func (ns *nodeServer) composefsDir() string {
+	return filepath.Join(ns.storageRoot, "composefs")
+}
+
+func (ns *nodeServer) composefsImage(volumeId string) string {
+	return filepath.Join(ns.composefsDir(), "images", volumeId+".cfs")
+}
+
+// mountComposefs builds the composefs image of rootfs and mounts it read-only
+// at targetPath.
+func (ns *nodeServer) mountComposefs(ctx context.Context, volumeId, rootfs, targetPath string) error {
+	objects := filepath.Join(ns.composefsDir(), "objects")
+	image := ns.composefsImage(volumeId)
+	if err := os.MkdirAll(objects, 0700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(image), 0700); err != nil {
+		return err
+	}
+
+	ns.composefsMu.Lock()
+	output, err := ns.runTool(ctx, "mkcomposefs", "--digest-store="+objects, rootfs, image)
+	if err != nil {
+		os.Remove(image)
+	}
+	ns.composefsMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("mkcomposefs failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	glog.V(4).Infof("composefs image for volume %s written to %s", volumeId, image)
+
+	options := []string{"ro", "basedir=" + objects}
+	if err := mount.New("").Mount(image, targetPath, "composefs", options); err != nil {
+		os.Remove(image)
+		return err
+	}
+	return nil
+}
+
+// removeComposefs deletes the composefs image of a volume, if there is one,
+// and the objects no other image references anymore.
+func (ns *nodeServer) removeComposefs(volumeId string) error {
+	if ns.storageRoot == "" {
+		return nil
+	}
+	err := os.Remove(ns.composefsImage(volumeId))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if removed, err := ns.gcComposefsObjects(context.Background()); err != nil {
+		logWarning("cannot remove unused composefs objects", "volume_id", volumeId, "error", err)
+	} else if removed > 0 {
+		logInfo(4, "removed unused composefs objects", "volume_id", volumeId, "objects", removed)
+	}
+	return nil
+}
+
+// gcComposefsObjects removes the objects of the store that no composefs
+// image references and returns how many. Nothing is removed if the objects
+// of an image cannot be listed.
+func (ns *nodeServer) gcComposefsObjects(ctx context.Context) (int, error) {
+	ns.composefsMu.Lock()
+	defer ns.composefsMu.Unlock()
+
+	objects := filepath.Join(ns.composefsDir(), "objects")
+	if _, err := os.Stat(objects); os.IsNotExist(err) {
+		return 0, nil
+	}
+	images, err := filepath.Glob(filepath.Join(ns.composefsDir(), "images", "*.cfs"))
+	if err != nil {
+		return 0, err
+	}
+	referenced := map[string]bool{}
+	for _, image := range images {
+		output, err := ns.runTool(ctx, "composefs-info", "objects", image)
+		if err != nil {
+			return 0, fmt.Errorf("cannot list objects of %s: %v: %s", image, err, strings.TrimSpace(string(output)))
+		}
+		for _, object := range strings.Split(string(output), "\n") {
+			if object = strings.TrimSpace(object); object != "" {
+				referenced[filepath.Clean(object)] = true
+			}
+		}
+	}
+
+	removed := 0
+	err = filepath.Walk(objects, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(objects, path)
+		if err != nil || referenced[rel] {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,46 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestGCComposefsObjects(t *testing.T) {
+	ns := &nodeServer{storageRoot: t.TempDir()}
+	if removed, err := ns.gcComposefsObjects(context.Background()); err != nil || removed != 0 {
+		t.Fatalf("gc without a store = %d, %v", removed, err)
+	}
+
+	object := filepath.Join(ns.composefsDir(), "objects", "ab", "cdef")
+	os.MkdirAll(filepath.Dir(object), 0700)
+	ioutil.WriteFile(object, []byte("content"), 0600)
+	image := ns.composefsImage("vol")
+	os.MkdirAll(filepath.Dir(image), 0700)
+	ioutil.WriteFile(image, nil, 0600)
+
+	// Objects are kept as long as the images referencing them cannot be
+	// listed.
+	if _, err := exec.LookPath("composefs-info"); err != nil {
+		if _, err := ns.gcComposefsObjects(context.Background()); err == nil {
+			t.Error("expected an error when the objects of an image cannot be listed")
+		}
+		if _, err := os.Stat(object); err != nil {
+			t.Errorf("object removed although it may be referenced: %v", err)
+		}
+	}
+
+	if err := ns.removeComposefs("vol"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := ns.gcComposefsObjects(context.Background()); err != nil || removed != 0 {
+		t.Errorf("second gc = %d, %v", removed, err)
+	}
+	if _, err := os.Stat(object); !os.IsNotExist(err) {
+		t.Errorf("unreferenced object not removed: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// contentOptions are the volume attributes that shape the published
+// content. Publishing and refreshing a volume apply them alike.
+type contentOptions struct {
+	metadata   bool
+	envFile    bool
+	provenance bool
+	filter     *pathFilter
+	owner      *owner
+	perms      *permissions
+	symlinks   string
+	// platform selects the image of manifest lists, "" until the node
+	// platform is filled in.
+	platform string
+	// base is the image whose content is left out, baseRoot its mounted
+	// rootfs once the volume is published.
+	base     string
+	baseRoot string
+}
+
+// volumeContent returns the content attributes of a volume. Errors are
+// status errors.
+func volumeContent(attrib map[string]string) (*contentOptions, error) {
+	c := &contentOptions{}
+	var err error
+	if c.filter, err = volumeFilter(attrib); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if c.metadata, err = boolAttribute(attrib, "metadata"); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if c.envFile, err = boolAttribute(attrib, "envFile"); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if c.owner, err = volumeOwner(attrib); err != nil {
+		return nil, err
+	}
+	if c.perms, err = volumePermissions(attrib); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if c.symlinks, err = volumeSymlinkPolicy(attrib); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if c.provenance, err = boolAttribute(attrib, "provenance"); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if c.platform, err = volumePlatform(attrib); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	c.base = attrib["baseImage"]
+	return c, nil
+}
+
+// prepareContent writes the metadata files below root, the published
+// directory of the container, and applies owner, permissions and symlink
+// policy in place unless copied is set, in which case the copier applies
+// them. Errors are status errors.
+func (ns *nodeServer) prepareContent(container, image, digest string, pulledAt time.Time, root string, c *contentOptions, copied bool) error {
+	if c.metadata || c.envFile {
+		raw, config, err := ns.inspectImageConfig(container)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if c.metadata {
+			if err := writeImageMetadata(root, raw, config); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+		if c.envFile {
+			if err := writeEnvFile(root, config.Config.Env); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+	}
+	if c.provenance {
+		if err := ns.writeProvenance(root, image, digest, c.platform, pulledAt); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if (c.owner != nil || c.perms != nil) && !copied {
+		if err := rewriteTree(root, c.owner, c.perms); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := applySymlinkPolicy(root, c.symlinks, !copied); err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return nil
+}
+
+// copier returns the copier applying the options to copied content.
+func (c *contentOptions) copier(stripXattrs bool) *copier {
+	return &copier{
+		filter:          c.filter,
+		stripXattrs:     stripXattrs,
+		owner:           c.owner,
+		perms:           c.perms,
+		resolveSymlinks: c.symlinks == symlinkResolveInternal,
+		base:            c.baseRoot,
+	}
+}
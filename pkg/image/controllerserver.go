@@ -17,16 +17,205 @@ limitations under the License.
 package image
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+
+	storageRoot   string
+	reservedSpace int64
+	topology      bool
+}
+
+// CreateVolume provisions an image volume for the external-provisioner. The
+// StorageClass parameters become the attributes of the volume and its name
+// the volume ID; nothing is stored, the image is pulled on the nodes the
+// volume is published on, like for inline volumes.
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return nil, err
+	}
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume name missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+	if err := checkVolumeID(req.GetName()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "image volumes cannot be created from snapshots or other volumes")
+	}
+	attrib, err := provisionedAttributes(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := cs.checkCapabilities(attrib, req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	capacity, err := provisionedCapacity(attrib, req.GetCapacityRange())
+	if err != nil {
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+
+	resp := &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      req.GetName(),
+			CapacityBytes: capacity,
+			VolumeContext: attrib,
+		},
+	}
+	// Every node running the driver can publish the volume. Handing back
+	// the topologies the provisioner asks for, those of the nodes running
+	// the driver, keeps pods off the others.
+	if cs.topology {
+		resp.Volume.AccessibleTopology = req.GetAccessibilityRequirements().GetRequisite()
+		if len(resp.Volume.AccessibleTopology) == 0 {
+			resp.Volume.AccessibleTopology = req.GetAccessibilityRequirements().GetPreferred()
+		}
+	}
+	logInfo(2, "provisioned volume", "volume_id", req.GetName(), "capacity", capacity)
+	return resp, nil
+}
+
+// DeleteVolume has nothing to remove: images of deleted volumes stay cached
+// on the nodes until admin gc removes them, like those of inline volumes.
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// ValidateVolumeCapabilities checks the capabilities against the volume
+// attributes. The controller keeps no record of the volumes it provisioned,
+// so volumes are never reported as not found.
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return cs.DefaultControllerServer.ValidateVolumeCapabilities(ctx, req)
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+	attrib, err := provisionedAttributes(req.GetVolumeContext())
+	if err == nil {
+		err = cs.checkCapabilities(attrib, req.GetVolumeCapabilities())
+	}
+	if err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// provisionedAttributes validates the parameters of a StorageClass as volume
+// attributes and returns a copy of them. The external-provisioner already
+// removed its own csi.storage.k8s.io/ parameters.
+func provisionedAttributes(params map[string]string) (map[string]string, error) {
+	if err := checkVolumeContext(params); err != nil {
+		return nil, err
+	}
+	supported := map[string]bool{}
+	for _, name := range volumeAttributes {
+		supported[name] = true
+	}
+	attrib := make(map[string]string, len(params))
+	for k, v := range params {
+		if !supported[k] {
+			return nil, fmt.Errorf("unsupported parameter %q, supported are %s", k, strings.Join(volumeAttributes, ", "))
+		}
+		attrib[k] = v
+	}
+	if attrib["imageChannel"] != "" {
+		if _, ok := attrib["image"]; ok {
+			return nil, fmt.Errorf("image and imageChannel are mutually exclusive")
+		}
+	} else if _, err := volumeImages(attrib); err != nil {
+		return nil, err
+	}
+	if _, err := publishMode(attrib); err != nil {
+		return nil, err
+	}
+	if _, err := volumePlatform(attrib); err != nil {
+		return nil, err
+	}
+	if _, err := volumeSizeLimit(attrib); err != nil {
+		return nil, err
+	}
+	return attrib, nil
+}
+
+// checkCapabilities rejects access modes the driver does not support and
+// block access for modes that only provide directories.
+func (cs *controllerServer) checkCapabilities(attrib map[string]string, caps []*csi.VolumeCapability) error {
+	mode, err := publishMode(attrib)
+	if err != nil {
+		return err
+	}
+	for _, c := range caps {
+		supported := false
+		for _, m := range cs.Driver.GetVolumeCapabilityAccessModes() {
+			if c.GetAccessMode().GetMode() == m.GetMode() {
+				supported = true
+			}
+		}
+		if !supported {
+			return fmt.Errorf("access mode %s is not supported", c.GetAccessMode().GetMode())
+		}
+		if c.GetBlock() != nil && (mode == modeComposefs || mode == modeTmpfs || mode == modeArtifact) {
+			return fmt.Errorf("%s mode does not support block volumes", mode)
+		}
+	}
+	return nil
+}
+
+// provisionedCapacity returns the capacity of a volume: its sizeLimit if set,
+// which has to lie in the requested range, the requested bytes otherwise.
+func provisionedCapacity(attrib map[string]string, r *csi.CapacityRange) (int64, error) {
+	sizeLimit, err := volumeSizeLimit(attrib)
+	if err != nil {
+		return 0, err
+	}
+	if sizeLimit == 0 {
+		return r.GetRequiredBytes(), nil
+	}
+	if sizeLimit < r.GetRequiredBytes() || r.GetLimitBytes() > 0 && sizeLimit > r.GetLimitBytes() {
+		return 0, fmt.Errorf("sizeLimit %d is outside of the requested capacity range %d-%d", sizeLimit, r.GetRequiredBytes(), r.GetLimitBytes())
+	}
+	return sizeLimit, nil
+}
+
+// GetCapacity reports the space left on the storage root before pulls start
+// being refused, so that capacity tracking can steer pods away from full nodes.
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if cs.storageRoot == "" {
+		return nil, status.Error(codes.Unimplemented, "storage root not configured")
+	}
+	avail, err := availableBytes(cs.storageRoot)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	capacity := avail - cs.reservedSpace
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &csi.GetCapacityResponse{AvailableCapacity: capacity}, nil
 }
@@ -0,0 +1,86 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetCapacity(t *testing.T) {
+	cs := &controllerServer{storageRoot: t.TempDir()}
+	resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatalf("GetCapacity failed: %v", err)
+	}
+	if resp.GetAvailableCapacity() <= 0 {
+		t.Fatalf("expected positive capacity, got %d", resp.GetAvailableCapacity())
+	}
+
+	cs.reservedSpace = 1 << 62
+	resp, err = cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatalf("GetCapacity failed: %v", err)
+	}
+	if resp.GetAvailableCapacity() != 0 {
+		t.Fatalf("expected zero capacity below the reserve, got %d", resp.GetAvailableCapacity())
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	d := NewDriver("image.csi.k8s.io", "node-a", "unix:///csi.sock", Options{Topology: true})
+	cs := NewControllerServer(d)
+	ctx := context.Background()
+	rox := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}}
+	zone := []*csi.Topology{{Segments: map[string]string{topologyZone: "a"}}}
+
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                      "pvc-1",
+		VolumeCapabilities:        rox,
+		Parameters:                map[string]string{"image": "example.com/models:v1", "mode": "tmpfs"},
+		CapacityRange:             &csi.CapacityRange{RequiredBytes: 1 << 30},
+		AccessibilityRequirements: &csi.TopologyRequirement{Requisite: zone},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := resp.GetVolume()
+	if v.GetVolumeId() != "pvc-1" || v.GetCapacityBytes() != 1<<30 || v.GetVolumeContext()["image"] != "example.com/models:v1" ||
+		len(v.GetAccessibleTopology()) != 1 || v.GetAccessibleTopology()[0].GetSegments()[topologyZone] != "a" {
+		t.Errorf("unexpected volume %v", v)
+	}
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"}); err != nil {
+		t.Errorf("cannot delete volume: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		req  *csi.CreateVolumeRequest
+		code codes.Code
+	}{
+		"no name":           {&csi.CreateVolumeRequest{VolumeCapabilities: rox, Parameters: map[string]string{"image": "app"}}, codes.InvalidArgument},
+		"no image":          {&csi.CreateVolumeRequest{Name: "pvc-2", VolumeCapabilities: rox, Parameters: map[string]string{"mode": "tmpfs"}}, codes.InvalidArgument},
+		"unknown parameter": {&csi.CreateVolumeRequest{Name: "pvc-2", VolumeCapabilities: rox, Parameters: map[string]string{"image": "app", "fsType": "ext4"}}, codes.InvalidArgument},
+		"multi node writer": {&csi.CreateVolumeRequest{Name: "pvc-2", Parameters: map[string]string{"image": "app"}, VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}}}, codes.InvalidArgument},
+		"size limit too small": {&csi.CreateVolumeRequest{Name: "pvc-2", VolumeCapabilities: rox, Parameters: map[string]string{"image": "app", "mode": "tmpfs", "sizeLimit": "1Mi"},
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30}}, codes.OutOfRange},
+	} {
+		if _, err := cs.CreateVolume(ctx, tc.req); status.Code(err) != tc.code {
+			t.Errorf("%s: expected %s, got %v", name, tc.code, err)
+		}
+	}
+
+	validate, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "pvc-1", VolumeContext: v.GetVolumeContext(), VolumeCapabilities: rox,
+	})
+	if err != nil || validate.GetConfirmed() == nil {
+		t.Errorf("capabilities not confirmed: %v %v", validate, err)
+	}
+}
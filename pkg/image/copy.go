@@ -0,0 +1,242 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// copier copies the content of a container rootfs into a volume, preserving
+// ownership, permissions, extended attributes and timestamps.
+type copier struct {
+	// filter selects the copied entries, nil copies everything.
+	filter *pathFilter
+	// stripXattrs drops extended attributes, including file capabilities
+	// and ACLs, instead of copying them.
+	stripXattrs bool
+	// owner replaces the owner of the copied entries, nil keeps it.
+	owner *owner
+	// perms rewrites the modes of the copied entries, nil keeps them.
+	perms *permissions
+	// resolveSymlinks rewrites links leaving the copied tree into links
+	// to the same path inside of it.
+	resolveSymlinks bool
+
+	// base is the root of a tree whose entries are left out of the copy
+	// unless they differ, "" copies everything.
+	base string
+
+	// src is the root of the copied tree.
+	src string
+
+	// dirTimes collects directory timestamps, which can only be applied
+	// once all entries below a directory have been written.
+	dirTimes []dirTime
+
+	// pending holds the directories that are not included themselves or
+	// unchanged from the base. They are created once an entry below them
+	// is copied.
+	pending map[string]pendingDir
+}
+
+type pendingDir struct {
+	path string
+	info os.FileInfo
+}
+
+type dirTime struct {
+	path  string
+	mtime time.Time
+}
+
+// copyTree copies the content of src into the existing directory dst.
+func (c *copier) copyTree(src, dst string) error {
+	c.src = src
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if rel == "." {
+			return c.copyMetadata(path, info, target)
+		}
+
+		rel = filepath.ToSlash(rel)
+		if c.filter.excluded(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !c.filter.included(rel, info.IsDir()) || c.unchanged(rel, info) {
+			if info.IsDir() {
+				if c.pending == nil {
+					c.pending = map[string]pendingDir{}
+				}
+				c.pending[rel] = pendingDir{path: path, info: info}
+			}
+			return nil
+		}
+		if err := c.createPending(dst, rel); err != nil {
+			return err
+		}
+		return c.copyEntry(path, target, info)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(c.dirTimes) - 1; i >= 0; i-- {
+		d := c.dirTimes[i]
+		os.Chtimes(d.path, d.mtime, d.mtime)
+	}
+	return nil
+}
+
+// createPending creates the pending directories above rel.
+func (c *copier) createPending(dst, rel string) error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	names := strings.Split(rel, "/")
+	for i := 1; i < len(names); i++ {
+		dir := strings.Join(names[:i], "/")
+		d, ok := c.pending[dir]
+		if !ok {
+			continue
+		}
+		delete(c.pending, dir)
+		if err := c.copyEntry(d.path, filepath.Join(dst, dir), d.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *copier) copyEntry(path, target string, info os.FileInfo) error {
+	mode := info.Mode()
+	switch {
+	case mode.IsDir():
+		if err := os.Mkdir(target, 0700); err != nil {
+			return err
+		}
+	case mode.IsRegular():
+		if err := copyFile(path, target); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if c.resolveSymlinks {
+			rel, err := filepath.Rel(c.src, path)
+			if err != nil {
+				return err
+			}
+			link, _ = internalTarget(filepath.ToSlash(rel), link)
+		}
+		if err := os.Symlink(link, target); err != nil {
+			return err
+		}
+	case mode&os.ModeNamedPipe != 0:
+		if err := syscall.Mkfifo(target, uint32(mode.Perm())); err != nil {
+			return err
+		}
+	default:
+		glog.V(4).Infof("skipping %s with unsupported file mode %v", path, mode)
+		return nil
+	}
+	return c.copyMetadata(path, info, target)
+}
+
+// copyMetadata applies owner, permissions, extended attributes and
+// timestamps of the entry at path with the given info to target.
+func (c *copier) copyMetadata(path string, info os.FileInfo, target string) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid := c.owner.ids(int(st.Uid), int(st.Gid))
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	// Chmod after chown, as chown clears the setuid and setgid bits.
+	if err := os.Chmod(target, c.perms.apply(info.Mode())); err != nil {
+		return err
+	}
+	// Likewise, chown drops file capabilities.
+	if !c.stripXattrs {
+		if err := copyXattrs(path, target); err != nil {
+			// Not every filesystem supports every namespace,
+			// e.g. tmpfs only supports user.* since Linux 6.6.
+			glog.Warningf("cannot copy extended attributes: %v", err)
+		}
+	}
+	if info.IsDir() {
+		c.dirTimes = append(c.dirTimes, dirTime{path: target, mtime: info.ModTime()})
+		return nil
+	}
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// isSparse reports whether fewer blocks are allocated for a file than its
+// size needs.
+func isSparse(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Blocks*512 < info.Size()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if info, err := in.Stat(); err == nil && isSparse(info) {
+		copied, err := copySparse(in, out, info.Size())
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("copying %s: %v", src, err)
+		}
+		if copied {
+			return out.Close()
+		}
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("copying %s: %v", src, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,177 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestCopyTreeWhiteouts checks that copying the rootfs of a container does
+// not bring back files deleted in upper layers. containers/storage mounts
+// the layers with overlayfs, which applies whiteouts and opaque directories,
+// so the layers here are stacked the same way, lowest first.
+func TestCopyTreeWhiteouts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("overlay mounts need root")
+	}
+
+	type layer struct {
+		files     map[string]string
+		whiteouts []string
+		opaque    []string
+	}
+	for _, test := range []struct {
+		name   string
+		layers []layer
+		want   []string
+	}{
+		{
+			name: "deleted file",
+			layers: []layer{
+				{files: map[string]string{"etc/secret": "x", "etc/keep": "x"}},
+				{whiteouts: []string{"etc/secret"}},
+			},
+			want: []string{"etc/keep"},
+		},
+		{
+			name: "deleted directory",
+			layers: []layer{
+				{files: map[string]string{"usr/share/doc/README": "x", "usr/bin/tool": "x"}},
+				{whiteouts: []string{"usr/share/doc"}},
+			},
+			want: []string{"usr/bin/tool", "usr/share"},
+		},
+		{
+			name: "recreated opaque directory",
+			layers: []layer{
+				{files: map[string]string{"app/old.so": "x", "app/lib/dep.so": "x"}},
+				{files: map[string]string{"app/new.so": "x"}, opaque: []string{"app"}},
+			},
+			want: []string{"app/new.so"},
+		},
+		{
+			name: "opaque directory in a middle layer",
+			layers: []layer{
+				{files: map[string]string{"data/a": "x"}},
+				{files: map[string]string{"data/b": "x"}, opaque: []string{"data"}},
+				{files: map[string]string{"data/c": "x"}},
+			},
+			want: []string{"data/b", "data/c"},
+		},
+		{
+			name: "file deleted and added again",
+			layers: []layer{
+				{files: map[string]string{"etc/config": "old"}},
+				{whiteouts: []string{"etc/config"}},
+				{files: map[string]string{"etc/config": "new"}},
+			},
+			want: []string{"etc/config"},
+		},
+		{
+			name: "file replaced by directory",
+			layers: []layer{
+				{files: map[string]string{"opt/app": "x"}},
+				{files: map[string]string{"opt/app/bin": "x"}, opaque: []string{"opt/app"}},
+			},
+			want: []string{"opt/app/bin"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var lower []string
+			for i, l := range test.layers {
+				root := filepath.Join(dir, "layer"+strconv.Itoa(i))
+				if err := os.Mkdir(root, 0755); err != nil {
+					t.Fatal(err)
+				}
+				writeTree(t, root, l.files)
+				for _, w := range l.whiteouts {
+					p := filepath.Join(root, w)
+					os.MkdirAll(filepath.Dir(p), 0755)
+					if err := unix.Mknod(p, unix.S_IFCHR, 0); err != nil {
+						t.Fatal(err)
+					}
+				}
+				for _, o := range l.opaque {
+					if err := unix.Setxattr(filepath.Join(root, o), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+						t.Skipf("cannot mark opaque directory: %v", err)
+					}
+				}
+				lower = append([]string{root}, lower...)
+			}
+
+			rootfs := filepath.Join(dir, "rootfs")
+			os.Mkdir(rootfs, 0755)
+			if err := unix.Mount("overlay", rootfs, "overlay", unix.MS_RDONLY, "lowerdir="+strings.Join(lower, ":")); err != nil {
+				t.Skipf("cannot mount overlay: %v", err)
+			}
+			defer unix.Unmount(rootfs, 0)
+
+			dst := filepath.Join(dir, "volume")
+			os.Mkdir(dst, 0755)
+			c := &copier{}
+			if err := c.copyTree(rootfs, dst); err != nil {
+				t.Fatalf("copyTree failed: %v", err)
+			}
+
+			var got []string
+			filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, _ := filepath.Rel(dst, path)
+				entries, _ := ioutil.ReadDir(path)
+				if !info.IsDir() || (rel != "." && len(entries) == 0) {
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("copied %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCopyTreeSparse(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	disk := filepath.Join(src, "disk.img")
+	f, err := os.Create(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 64 << 20
+	f.WriteAt([]byte("boot"), 0)
+	f.WriteAt([]byte("data"), 32<<20)
+	f.Truncate(size)
+	f.Close()
+	if fi, _ := os.Stat(disk); !isSparse(fi) {
+		t.Skip("filesystem does not support sparse files")
+	}
+
+	c := &copier{}
+	if err := c.copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree failed: %v", err)
+	}
+
+	copied := filepath.Join(dst, "disk.img")
+	content, err := ioutil.ReadFile(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != size || string(content[:4]) != "boot" || string(content[32<<20:32<<20+4]) != "data" {
+		t.Errorf("sparse file content not preserved")
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(copied, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks*512 >= 1<<20 {
+		t.Errorf("copy allocates %d bytes, expected holes to be preserved", st.Blocks*512)
+	}
+}
@@ -0,0 +1,389 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeTree creates files below root, a trailing slash denotes a directory
+// and an "->" prefix in the content a symlink.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if len(content) > 2 && content[:2] == "->" {
+			if err := os.Symlink(content[2:], p); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeTree(t, src, map[string]string{
+		"etc/app/config": "key=value",
+		"bin/tool":       "#!/bin/sh",
+		"bin/alias":      "->tool",
+		"var/empty/":     "",
+	})
+	os.Chmod(filepath.Join(src, "bin/tool"), 0750)
+	mtime := time.Unix(1500000000, 0)
+	os.Chtimes(filepath.Join(src, "etc/app"), mtime, mtime)
+
+	c := &copier{}
+	if err := c.copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree failed: %v", err)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dst, "etc/app/config")); err != nil || string(b) != "key=value" {
+		t.Errorf("unexpected config content %q: %v", b, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "bin/tool")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("unexpected mode of bin/tool: %v, %v", fi.Mode(), err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "bin/alias")); err != nil || link != "tool" {
+		t.Errorf("unexpected symlink %q: %v", link, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "var/empty")); err != nil || !fi.IsDir() {
+		t.Errorf("expected empty directory to be copied: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "etc/app")); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("directory mtime not preserved: %v, %v", fi.ModTime(), err)
+	}
+}
+
+func TestCopyTreeFilter(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"usr/lib/plugins/a.so":      "a",
+		"usr/lib/plugins/b.so":      "b",
+		"usr/lib/plugins/README":    "readme",
+		"usr/lib/libc.so":           "libc",
+		"usr/share/doc/app/a.so":    "doc",
+		"usr/share/doc/app/COPYING": "copying",
+		"etc/app/config":            "key=value",
+		"etc/app/conf.d/extra.conf": "extra",
+		"var/cache/":                "",
+	})
+
+	for _, test := range []struct {
+		include, exclude string
+		want             []string
+	}{
+		{"", "/usr/share/doc", []string{"etc/app/conf.d/extra.conf", "etc/app/config", "usr/lib/libc.so", "usr/lib/plugins/README", "usr/lib/plugins/a.so", "usr/lib/plugins/b.so", "usr/share", "var/cache"}},
+		{"*.so", "doc/", []string{"usr/lib/libc.so", "usr/lib/plugins/a.so", "usr/lib/plugins/b.so"}},
+		{"usr/lib/plugins/*.so", "", []string{"usr/lib/plugins/a.so", "usr/lib/plugins/b.so"}},
+		{"/etc/app", "*.conf", []string{"etc/app/conf.d", "etc/app/config"}},
+		{"etc/**/app/**", "etc/app/conf.d/[!c]*", []string{"etc/app/conf.d", "etc/app/config"}},
+	} {
+		filter, err := volumeFilter(map[string]string{"include": test.include, "exclude": test.exclude})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := t.TempDir()
+		c := &copier{filter: filter}
+		if err := c.copyTree(src, dst); err != nil {
+			t.Fatalf("copyTree failed: %v", err)
+		}
+
+		var got []string
+		filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(dst, path)
+			entries, _ := ioutil.ReadDir(path)
+			if !info.IsDir() || (rel != "." && len(entries) == 0) {
+				got = append(got, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("include %q, exclude %q copied %v, want %v", test.include, test.exclude, got, test.want)
+		}
+	}
+
+	if _, err := volumeFilter(map[string]string{"include": "[abc"}); err == nil {
+		t.Errorf("expected an error for an unterminated character class")
+	}
+}
+
+func TestCopyTreeBase(t *testing.T) {
+	base, src, dst := t.TempDir(), t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"bin/tool":        "#!/bin/sh",
+		"bin/alias":       "->tool",
+		"etc/app/config":  "key=value",
+		"etc/app/other":   "other",
+		"usr/lib/libc.so": "libc",
+	}
+	writeTree(t, base, files)
+	files["bin/alias"] = "->other-tool"
+	files["etc/app/config"] = "key=other value"
+	files["usr/lib/plugins/a.so"] = "a"
+	files["opt/empty/"] = ""
+	writeTree(t, src, files)
+	mtime := time.Unix(1500000000, 0)
+	for _, root := range []string{base, src} {
+		for _, name := range []string{"bin/tool", "etc/app/other", "usr/lib/libc.so"} {
+			os.Chtimes(filepath.Join(root, name), mtime, mtime)
+		}
+	}
+
+	c := &copier{base: base}
+	if err := c.copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree failed: %v", err)
+	}
+
+	var got []string
+	filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dst, path)
+		entries, _ := ioutil.ReadDir(path)
+		if !info.IsDir() || (rel != "." && len(entries) == 0) {
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	want := []string{"bin/alias", "etc/app/config", "opt/empty", "usr/lib/plugins/a.so"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("copied %v, want %v", got, want)
+	}
+}
+
+func TestCopyTreeXattrs(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"bin/tool": "#!/bin/sh"})
+	tool := filepath.Join(src, "bin/tool")
+	if err := unix.Setxattr(tool, "user.origin", []byte("image"), 0); err != nil {
+		t.Skipf("filesystem does not support user xattrs: %v", err)
+	}
+
+	for _, strip := range []bool{false, true} {
+		dst := t.TempDir()
+		c := &copier{stripXattrs: strip}
+		if err := c.copyTree(src, dst); err != nil {
+			t.Fatalf("copyTree failed: %v", err)
+		}
+		buf := make([]byte, 64)
+		n, err := unix.Getxattr(filepath.Join(dst, "bin/tool"), "user.origin", buf)
+		switch {
+		case strip && err != unix.ENODATA:
+			t.Errorf("expected xattr to be stripped, got %q, %v", buf[:n], err)
+		case !strip && (err != nil || string(buf[:n]) != "image"):
+			t.Errorf("unexpected xattr %q: %v", buf[:n], err)
+		}
+	}
+}
+
+func TestCopyTreeOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"bin/tool": "#!/bin/sh", "bin/alias": "->tool"})
+	os.Chmod(filepath.Join(src, "bin/tool"), 0755|os.ModeSetuid)
+
+	dst := t.TempDir()
+	c := &copier{owner: &owner{uid: 1000, gid: -1}}
+	if err := c.copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree failed: %v", err)
+	}
+	for _, name := range []string{"bin", "bin/tool", "bin/alias"} {
+		fi, err := os.Lstat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 0 {
+			t.Errorf("%s is owned by %d:%d, want 1000:0", name, st.Uid, st.Gid)
+		}
+	}
+	if fi, _ := os.Stat(filepath.Join(dst, "bin/tool")); fi.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("setuid bit lost: %v", fi.Mode())
+	}
+
+	if err := rewriteTree(src, &owner{uid: -1, gid: 3000}, nil); err != nil {
+		t.Fatalf("rewriteTree failed: %v", err)
+	}
+	fi, _ := os.Stat(filepath.Join(src, "bin/tool"))
+	if st := fi.Sys().(*syscall.Stat_t); st.Gid != 3000 || fi.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("unexpected owner %d:%d or mode %v after rewriteTree", st.Uid, st.Gid, fi.Mode())
+	}
+}
+
+func TestCopyTreePermissions(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"bin/tool":       "#!/bin/sh",
+		"etc/app/config": "key=value",
+	})
+	os.Chmod(filepath.Join(src, "bin/tool"), 0775|os.ModeSetuid|os.ModeSetgid)
+	os.Chmod(filepath.Join(src, "etc/app/config"), 0666)
+	os.Chmod(filepath.Join(src, "etc/app"), 0777|os.ModeSticky)
+
+	perms, err := volumePermissions(map[string]string{"fileMode": "0755", "dirMode": "750", "stripSetuid": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	c := &copier{perms: perms}
+	if err := c.copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree failed: %v", err)
+	}
+	for name, want := range map[string]os.FileMode{
+		"bin/tool":       0755,
+		"etc/app/config": 0644,
+		"etc/app":        os.ModeDir | os.ModeSticky | 0750,
+	} {
+		if fi, err := os.Lstat(filepath.Join(dst, name)); err != nil || fi.Mode() != want {
+			t.Errorf("%s has mode %v, want %v: %v", name, fi.Mode(), want, err)
+		}
+	}
+
+	for _, attrib := range []map[string]string{{"fileMode": "0999"}, {"dirMode": "01777"}, {"stripSetuid": "yes please"}} {
+		if _, err := volumePermissions(attrib); err == nil {
+			t.Errorf("expected an error for %v", attrib)
+		}
+	}
+	if perms, err := volumePermissions(map[string]string{}); perms != nil || err != nil {
+		t.Errorf("expected no permission rewrites without attributes, got %+v, %v", perms, err)
+	}
+}
+
+func TestCopyTreeSymlinks(t *testing.T) {
+	files := map[string]string{
+		"bin/tool":         "#!/bin/sh",
+		"bin/alias":        "->tool",
+		"usr/bin/tool":     "->/bin/tool",
+		"etc/passwd":       "->../../../etc/passwd",
+		"etc/app/config":   "->../../etc/passwd/../app",
+		"etc/app/hostroot": "->/",
+		"var/empty/":       "",
+	}
+	want := map[string]string{
+		"bin/alias":        "tool",
+		"usr/bin/tool":     "../../bin/tool",
+		"etc/passwd":       "passwd",
+		"etc/app/config":   "../../etc/passwd/../app",
+		"etc/app/hostroot": "../..",
+	}
+
+	src, dst := t.TempDir(), t.TempDir()
+	writeTree(t, src, files)
+	c := &copier{resolveSymlinks: true}
+	if err := c.copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree failed: %v", err)
+	}
+	for name, target := range want {
+		if link, err := os.Readlink(filepath.Join(dst, name)); err != nil || link != target {
+			t.Errorf("%s links to %q, want %q: %v", name, link, target, err)
+		}
+	}
+
+	// Bind mounts rewrite the links in place.
+	if err := applySymlinkPolicy(src, symlinkResolveInternal, true); err != nil {
+		t.Fatalf("applySymlinkPolicy failed: %v", err)
+	}
+	for name, target := range want {
+		if link, err := os.Readlink(filepath.Join(src, name)); err != nil || link != target {
+			t.Errorf("%s links to %q in place, want %q: %v", name, link, target, err)
+		}
+	}
+	if err := applySymlinkPolicy(src, symlinkRejectAbsolute, false); err != nil {
+		t.Errorf("resolved links are rejected: %v", err)
+	}
+
+	for _, link := range []string{"/etc/passwd", "../../../etc/passwd"} {
+		root := t.TempDir()
+		writeTree(t, root, map[string]string{"bin/tool": "->tool2", "etc/passwd": "->" + link})
+		if err := applySymlinkPolicy(root, symlinkRejectAbsolute, false); err == nil {
+			t.Errorf("expected link to %q to be rejected", link)
+		}
+		if err := applySymlinkPolicy(root, symlinkPreserve, true); err != nil {
+			t.Errorf("preserve rejects link to %q: %v", link, err)
+		}
+	}
+
+	if _, err := volumeSymlinkPolicy(map[string]string{"symlinkPolicy": "follow"}); err == nil {
+		t.Error("expected an error for an unknown symlinkPolicy")
+	}
+}
+
+func TestSwapContent(t *testing.T) {
+	root := t.TempDir()
+	fill := func(files map[string]string) func(string) error {
+		return func(dir string) error {
+			writeTree(t, dir, files)
+			return nil
+		}
+	}
+	if err := swapContent(root, fill(map[string]string{"etc/config": "v1", "old": "v1"})); err != nil {
+		t.Fatal(err)
+	}
+	first, err := os.Readlink(filepath.Join(root, dataLink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(filepath.Join(root, "etc")); err != nil || link != "..data/etc" {
+		t.Errorf("etc links to %q: %v", link, err)
+	}
+	if err := writeUpdateMarker(root, "sha256:v1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := swapContent(root, fill(map[string]string{"etc/config": "v2", "new": "v2"})); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "etc/config")); err != nil || string(b) != "v2" {
+		t.Errorf("unexpected content %q: %v", b, err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "old")); !os.IsNotExist(err) {
+		t.Errorf("link to removed entry kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "new")); err != nil {
+		t.Errorf("link to new entry missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, first)); !os.IsNotExist(err) {
+		t.Errorf("previous content kept: %v", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, updateMarker)); err != nil || string(b) != "sha256:v1\n" {
+		t.Errorf("update marker not kept: %q, %v", b, err)
+	}
+
+	// A failing fill leaves the content alone.
+	failing := func(dir string) error {
+		writeTree(t, dir, map[string]string{"etc/config": "v3"})
+		return os.ErrInvalid
+	}
+	if err := swapContent(root, failing); err == nil {
+		t.Error("expected the error of fill")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "etc/config")); err != nil || string(b) != "v2" {
+		t.Errorf("content changed by failed swap: %q, %v", b, err)
+	}
+	if entries, _ := ioutil.ReadDir(root); len(entries) != 5 {
+		t.Errorf("unexpected entries after failed swap: %d", len(entries))
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	storageCorrupted = metricsRegistry.NewGaugeVec("image_populator_storage_corrupted",
+		"1 while buildah reports corrupted metadata in the storage root, 0 otherwise.")
+	storageResets = metricsRegistry.NewCounterVec("image_populator_storage_resets_total",
+		"Automatic resets of a corrupted storage root by result.", "result")
+)
+
+// storageCorruptionErrors match lowercased buildah output that indicates
+// broken containers/storage metadata rather than a problem of the image:
+// layers the metadata refers to but that are gone, metadata files that
+// cannot be parsed and dangling overlay layer links. They stay until the
+// storage is repaired, retries do not help.
+var storageCorruptionErrors = []*regexp.Regexp{
+	regexp.MustCompile(`: layer not known`),
+	regexp.MustCompile(`(layers|images|containers)\.json"?: (unexpected end of json input|invalid character)`),
+	regexp.MustCompile(`/overlay/l/[a-z0-9]+: no such file or directory`),
+}
+
+func isStorageCorruption(output []byte) bool {
+	lower := strings.ToLower(string(output))
+	for _, e := range storageCorruptionErrors {
+		if e.MatchString(lower) {
+			return true
+		}
+	}
+	return false
+}
+
+// storageHealth remembers whether the storage root showed signs of
+// corruption, and whether a reset is running.
+type storageHealth struct {
+	mu        sync.Mutex
+	output    string
+	resetting bool
+}
+
+// report records corrupted storage and reports whether it is news.
+func (h *storageHealth) report(output string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	news := h.output == ""
+	h.output = output
+	return news
+}
+
+// beginReset reports whether a reset may start, which is not the case while
+// another one is running.
+func (h *storageHealth) beginReset() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.resetting {
+		return false
+	}
+	h.resetting = true
+	return true
+}
+
+// endReset ends a reset, marking the storage healthy if it succeeded.
+func (h *storageHealth) endReset(ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.resetting = false
+	if ok {
+		h.output = ""
+	}
+}
+
+// reportCorruption records a backend failure that indicates corrupted
+// storage and, with --storage-auto-reset, starts a reset.
+func (ns *nodeServer) reportCorruption(output []byte) {
+	if ns.storage.report(strings.TrimSpace(string(output))) {
+		logError("storage root is corrupted", "storage_root", ns.storageRoot, "output", strings.TrimSpace(string(output)))
+		storageCorrupted.Set(1)
+	}
+	if ns.storageAutoReset && ns.storage.beginReset() {
+		go ns.resetStorage()
+	}
+}
+
+// storageResetWait is how long a reset waits for the node to have no
+// volumes before it gives up. The next corruption report tries again.
+const storageResetWait = time.Minute
+
+// errStorageBusy postpones a reset while the storage root holds content
+// that is not tracked as volume.
+var errStorageBusy = errors.New("storage root is in use")
+
+// resetStorage wipes the storage root as soon as no volume is published or
+// being published, no pull is running and no container is retained, so
+// nothing references its content anymore. Publishes wait for the reset to
+// finish, and pull their images again afterwards.
+func (ns *nodeServer) resetStorage() {
+	if ns.storageRoot == "" {
+		// Never wipe the storage of the node's own buildah.
+		ns.storage.endReset(false)
+		return
+	}
+	deadline := time.Now().Add(storageResetWait)
+	for {
+		idle, err := ns.volumes.whileIdle(func() error {
+			if ns.pulls.busy() || ns.hasRetainedContainers() {
+				return errStorageBusy
+			}
+			return ns.wipeStorage()
+		})
+		if idle && err != errStorageBusy {
+			if err != nil {
+				storageResets.Inc("failure")
+				logError("cannot reset storage root", "storage_root", ns.storageRoot, "error", err)
+			} else {
+				storageResets.Inc("success")
+				storageCorrupted.Set(0)
+				logWarning("storage root reset", "storage_root", ns.storageRoot)
+			}
+			ns.storage.endReset(err == nil)
+			return
+		}
+		if time.Now().After(deadline) {
+			logWarning("storage root reset postponed, volumes, pulls or retained containers use it", "storage_root", ns.storageRoot)
+			ns.storage.endReset(false)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// hasRetainedContainers reports whether containers kept for a later pod
+// exist. If buildah cannot list them, which is likely with corrupted
+// storage, the container metadata is searched for their names instead.
+func (ns *nodeServer) hasRetainedContainers() bool {
+	output, err := ns.runCmd([]string{"containers", "--json"})
+	if err == nil {
+		var containers []struct {
+			Name string `json:"containername"`
+		}
+		if json.Unmarshal(output, &containers) == nil {
+			for _, c := range containers {
+				if strings.HasPrefix(c.Name, "retained-") {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(ns.storageRoot, "*-containers", "containers.json"))
+	for _, f := range files {
+		if data, err := ioutil.ReadFile(f); err == nil && strings.Contains(string(data), `"retained-`) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedStorageRoots are where containers/storage keeps the images of
+// podman, CRI-O and buildah on the node unless configured otherwise.
+var sharedStorageRoots = []string{"/var/lib/containers/storage", "/run/containers/storage", "/var/run/containers/storage"}
+
+// checkDedicatedStorage returns an error unless the storage root and run
+// root belong to the driver alone, so a reset cannot destroy images and
+// containers of the container runtime or other tools. criStore is the
+// image store of the container runtime as driver@graphroot+runroot.
+func checkDedicatedStorage(storageRoot, runRoot, criStore string) error {
+	if storageRoot == "" {
+		return errors.New("the storage of the node's own buildah is used")
+	}
+	shared := append([]string(nil), sharedStorageRoots...)
+	if i := strings.Index(criStore, "@"); i >= 0 {
+		roots := strings.SplitN(criStore[i+1:], "+", 2)
+		if len(roots) == 2 {
+			roots[1] = strings.SplitN(roots[1], ":", 2)[0]
+		}
+		shared = append(shared, roots...)
+	}
+	for _, dir := range []string{storageRoot, runRoot} {
+		if dir == "" {
+			continue
+		}
+		for _, s := range shared {
+			if sameDir(dir, s) {
+				return fmt.Errorf("%s is shared with the container runtime", dir)
+			}
+		}
+	}
+	return nil
+}
+
+// sameDir reports whether a and b name the same directory, following
+// symlinks like /var/run to /run where they exist.
+func sameDir(a, b string) bool {
+	resolve := func(dir string) string {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return resolved
+		}
+		return filepath.Clean(dir)
+	}
+	return filepath.Clean(a) == filepath.Clean(b) || resolve(a) == resolve(b)
+}
+
+// storageEntries are the entries containers/storage creates in a storage
+// root or run root for the storage drivers the driver selects from.
+var storageEntries = []string{
+	"overlay", "overlay-containers", "overlay-images", "overlay-layers",
+	"vfs", "vfs-containers", "vfs-images", "vfs-layers",
+	"storage.lock", "userns.lock",
+}
+
+// wipeStorage removes the containers/storage content of the storage root
+// and run root. Other content is left alone.
+func (ns *nodeServer) wipeStorage() error {
+	ns.runCmd([]string{"umount", "--all"})
+	for _, dir := range []string{ns.storageRoot, ns.runRoot} {
+		if dir == "" {
+			continue
+		}
+		for _, entry := range storageEntries {
+			if err := os.RemoveAll(filepath.Join(dir, entry)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
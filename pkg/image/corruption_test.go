@@ -0,0 +1,117 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestResetStorage(t *testing.T) {
+	storage := t.TempDir()
+	writeTree(t, storage, map[string]string{"overlay-layers/layers.json": "{", "overlay/l/ABC": "->../missing", "block/notes": "kept"})
+	containers := "[]"
+	ns := &nodeServer{
+		storageRoot:      storage,
+		storageAutoReset: true,
+		volumes:          newVolumeTracker(),
+		pulls:            newPullQueue(1),
+		backend: func(args []string) ([]byte, error) {
+			if args[len(args)-2] == "containers" {
+				return []byte(containers), nil
+			}
+			return nil, nil
+		},
+	}
+
+	// Nothing is wiped while a volume is published.
+	ns.volumes.add(Volume{ID: "published"})
+	if idle, _ := ns.volumes.whileIdle(ns.wipeStorage); idle {
+		t.Fatal("storage wiped with a published volume")
+	}
+	ns.volumes.remove("published")
+
+	// Nor while a container is retained or an image is pulled.
+	containers = `[{"containername":"retained-0123abcd"}]`
+	if !ns.hasRetainedContainers() {
+		t.Fatal("retained container not found")
+	}
+	containers = "[]"
+	release, _ := ns.pulls.acquire(context.Background(), 0)
+	ns.storage.beginReset()
+	done := make(chan struct{})
+	go func() {
+		ns.resetStorage()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(storage, "overlay-layers")); err != nil {
+		t.Fatal("storage wiped while an image is pulled")
+	}
+	release()
+	<-done
+	writeTree(t, storage, map[string]string{"overlay-layers/layers.json": "{"})
+
+	ns.reportCorruption([]byte("error locating layer with ID \"abc\": layer not known"))
+	for i := 0; ; i++ {
+		entries, _ := ioutil.ReadDir(storage)
+		if len(entries) == 1 && entries[0].Name() == "block" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("storage root not reset, holds %d entries", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; ; i++ {
+		ns.storage.mu.Lock()
+		healthy := ns.storage.output == "" && !ns.storage.resetting
+		ns.storage.mu.Unlock()
+		if healthy {
+			break
+		}
+		if i == 100 {
+			t.Fatal("storage still reported as corrupted after the reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckDedicatedStorage(t *testing.T) {
+	const criStore = "overlay@/var/lib/cri/storage+/run/cri/storage:overlay.mountopt=nodev"
+	for _, c := range []struct {
+		storageRoot, runRoot string
+		dedicated            bool
+	}{
+		{"/var/lib/image-populator/storage", "/run/image-populator/storage", true},
+		{"/var/lib/image-populator/storage", "", true},
+		{"", "", false},
+		{"/var/lib/containers/storage", "/run/image-populator/storage", false},
+		{"/var/lib/image-populator/storage", "/var/run/containers/storage", false},
+		{"/var/lib/cri/storage/", "/run/image-populator/storage", false},
+		{"/var/lib/image-populator/storage", "/run/cri/storage", false},
+	} {
+		err := checkDedicatedStorage(c.storageRoot, c.runRoot, criStore)
+		if (err == nil) != c.dedicated {
+			t.Errorf("checkDedicatedStorage(%q, %q) = %v, expected dedicated: %v", c.storageRoot, c.runRoot, err, c.dedicated)
+		}
+	}
+}
+
+func TestIsStorageCorruption(t *testing.T) {
+	for output, want := range map[string]bool{
+		`Error: error locating layer with ID "0123abcd": layer not known`:                                                  true,
+		`Error: error loading "/var/lib/image-populator/storage/overlay-layers/layers.json": unexpected end of JSON input`: true,
+		`Error: readlink /var/lib/image-populator/storage/overlay/l/ABCDEF: no such file or directory`:                     true,
+		`Error: copying layers.json from the image: manifest unknown`:                                                      false,
+		`Error: creating build container: writing blob: /overlay/l/ is full`:                                               false,
+		`Error: initializing source docker://registry.example.com/images.json:latest: manifest unknown`:                    false,
+	} {
+		if got := isStorageCorruption([]byte(output)); got != want {
+			t.Errorf("isStorageCorruption(%q) = %v, expected %v", output, got, want)
+		}
+	}
+}
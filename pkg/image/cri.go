@@ -0,0 +1,155 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// criTimeout bounds the queries of the container runtime, which must not
+// hold up a publish for long.
+const criTimeout = 10 * time.Second
+
+// criVersions are the CRI API versions tried in order. Runtimes before
+// Kubernetes 1.23 only serve v1alpha2.
+var criVersions = []string{"v1", "v1alpha2"}
+
+// The messages of the CRI ImageService needed for ImageStatus, wire
+// compatible with k8s.io/cri-api. Fields the driver does not use are
+// skipped when decoding.
+
+type criImageSpec struct {
+	Image string `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+}
+
+func (m *criImageSpec) Reset()         { *m = criImageSpec{} }
+func (m *criImageSpec) String() string { return proto.CompactTextString(m) }
+func (*criImageSpec) ProtoMessage()    {}
+
+type criImageStatusRequest struct {
+	Image   *criImageSpec `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+	Verbose bool          `protobuf:"varint,2,opt,name=verbose,proto3" json:"verbose,omitempty"`
+}
+
+func (m *criImageStatusRequest) Reset()         { *m = criImageStatusRequest{} }
+func (m *criImageStatusRequest) String() string { return proto.CompactTextString(m) }
+func (*criImageStatusRequest) ProtoMessage()    {}
+
+type criImage struct {
+	Id          string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	RepoTags    []string `protobuf:"bytes,2,rep,name=repo_tags,json=repoTags,proto3" json:"repo_tags,omitempty"`
+	RepoDigests []string `protobuf:"bytes,3,rep,name=repo_digests,json=repoDigests,proto3" json:"repo_digests,omitempty"`
+	Size_       uint64   `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`
+}
+
+func (m *criImage) Reset()         { *m = criImage{} }
+func (m *criImage) String() string { return proto.CompactTextString(m) }
+func (*criImage) ProtoMessage()    {}
+
+type criImageStatusResponse struct {
+	Image *criImage `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+}
+
+func (m *criImageStatusResponse) Reset()         { *m = criImageStatusResponse{} }
+func (m *criImageStatusResponse) String() string { return proto.CompactTextString(m) }
+func (*criImageStatusResponse) ProtoMessage()    {}
+
+// criImageService asks the container runtime of the node whether it holds
+// an image. Runtimes storing images in containers/storage, like CRI-O, can
+// then provide them to buildah without a registry pull.
+type criImageService struct {
+	conn *grpc.ClientConn
+	// store is the containers/storage of the runtime in the form of the
+	// containers-storage transport, [driver@graphroot+runroot].
+	store string
+}
+
+// newCRIImageService connects to the CRI socket at endpoint, given as path
+// or unix:// URL. The connection is established lazily.
+func newCRIImageService(endpoint, store string) (*criImageService, error) {
+	path := strings.TrimPrefix(endpoint, "unix://")
+	conn, err := grpc.Dial(path, grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		return nil, err
+	}
+	return &criImageService{conn: conn, store: store}, nil
+}
+
+// imageStatus returns the runtime's image for the reference image, nil if
+// the runtime does not have it.
+func (c *criImageService) imageStatus(ctx context.Context, image string) (*criImage, error) {
+	ctx, cancel := context.WithTimeout(ctx, criTimeout)
+	defer cancel()
+	req := &criImageStatusRequest{Image: &criImageSpec{Image: image}}
+	var err error
+	for _, version := range criVersions {
+		resp := &criImageStatusResponse{}
+		err = c.conn.Invoke(ctx, "/runtime."+version+".ImageService/ImageStatus", req, resp)
+		if status.Code(err) == codes.Unimplemented {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return resp.Image, nil
+	}
+	return nil, err
+}
+
+// copyFromRuntime copies image from the image store of the container
+// runtime into the storage root if the runtime holds it, so that creating
+// the container does not pull it from the registry. It returns whether the
+// image was copied; on failure the image is pulled as usual. Images the
+// registry config redirects to a mirror are not looked up, the runtime
+// does not know them under that name.
+func (ns *nodeServer) copyFromRuntime(ctx context.Context, volumeId, image string, policy *RegistryConfig) bool {
+	if ns.cri == nil || policy.rewrite(image) != image {
+		return false
+	}
+	runtimeImage, err := ns.cri.imageStatus(ctx, image)
+	if err != nil {
+		logWarning("cannot look up image in the container runtime", "volume_id", volumeId, "image", image, "error", err)
+		return false
+	}
+	if runtimeImage == nil {
+		return false
+	}
+
+	args := []string{"pull"}
+	if signaturePolicy := policy.signaturePolicy(); signaturePolicy != "" {
+		args = append(args, "--signature-policy", signaturePolicy)
+	}
+	args = append(args, "containers-storage:["+ns.cri.store+"]"+normalizeImage(image))
+	if output, err := ns.runVolumeCmdContext(ctx, volumeId, args); err != nil {
+		logWarning("cannot copy image from the container runtime, pulling it", "volume_id", volumeId, "image", image,
+			"error", err, "output", strings.TrimSpace(string(output)))
+		return false
+	}
+	logInfo(2, "copied image from the container runtime", "volume_id", volumeId, "image", image, "runtime_image_id", runtimeImage.Id)
+	return true
+}
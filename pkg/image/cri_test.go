@@ -0,0 +1,67 @@
+package image
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestCopyFromRuntime(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "cri.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The runtime only serves v1alpha2, v1 is tried first.
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "runtime.v1alpha2.ImageService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "ImageStatus",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &criImageStatusRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if req.Image == nil || req.Image.Image != "busybox" {
+					return &criImageStatusResponse{}, nil
+				}
+				return &criImageStatusResponse{Image: &criImage{Id: "abc", RepoTags: []string{"docker.io/library/busybox:latest"}}}, nil
+			},
+		}},
+	}, struct{}{})
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cri, err := newCRIImageService("unix://"+socket, "overlay@/runtime/storage+/runtime/run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeBuildah(dir)
+	ns := &nodeServer{cri: cri, backend: fake.run}
+	if !ns.copyFromRuntime(context.Background(), "vol", "busybox", nil) {
+		t.Fatal("image held by the runtime not copied")
+	}
+	if call := strings.Join(fake.calls[len(fake.calls)-1], " "); call != "pull containers-storage:[overlay@/runtime/storage+/runtime/run]docker.io/library/busybox" {
+		t.Fatalf("unexpected copy %s", call)
+	}
+	if ns.copyFromRuntime(context.Background(), "vol", "alpine", nil) {
+		t.Fatal("image unknown to the runtime copied")
+	}
+	mirrored := &RegistryConfig{Mirrors: map[string]string{"docker.io": "mirror.local"}}
+	if ns.copyFromRuntime(context.Background(), "vol", "busybox", mirrored) {
+		t.Fatal("image redirected to a mirror copied")
+	}
+
+	// The image is pulled as usual if the copy fails.
+	fake.setFailing("pull", true)
+	if ns.copyFromRuntime(context.Background(), "vol", "busybox", nil) {
+		t.Fatal("failed copy reported as success")
+	}
+}
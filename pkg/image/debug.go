@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// volumeDebug returns whether the debug volume attribute is set.
+func volumeDebug(attrib map[string]string) (bool, error) {
+	return boolAttribute(attrib, "debug")
+}
+
+// debugVolumes tracks the volumes published with the debug attribute. Their
+// backend commands run with debug logging and are written to a log file per
+// volume in dir. The set outlives the publish call because the attribute is
+// not passed to NodeUnpublishVolume.
+type debugVolumes struct {
+	mu  sync.Mutex
+	dir string
+	ids map[string]bool
+}
+
+func newDebugVolumes(dir string) *debugVolumes {
+	return &debugVolumes{dir: dir, ids: map[string]bool{}}
+}
+
+func (d *debugVolumes) enable(volumeId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ids[volumeId] = true
+}
+
+func (d *debugVolumes) disable(volumeId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.ids, volumeId)
+}
+
+func (d *debugVolumes) enabled(volumeId string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ids[volumeId]
+}
+
+// logPath returns the debug log file of a volume.
+func (d *debugVolumes) logPath(volumeId string) string {
+	return filepath.Join(d.dir, volumeId+".log")
+}
+
+// write appends a command to the debug log of a volume.
+func (d *debugVolumes) write(volumeId string, c Command) {
+	logInfo(0, "backend command", "volume_id", volumeId, "args", strings.Join(c.Args, " "),
+		"duration", c.Duration, "error", c.Error)
+	if d.dir == "" {
+		return
+	}
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		glog.Warningf("cannot create debug log directory %s: %v", d.dir, err)
+		return
+	}
+	f, err := os.OpenFile(d.logPath(volumeId), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		glog.Warningf("cannot open debug log of volume %s: %v", volumeId, err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s $ %s (%s)\n", c.Time.Format(time.RFC3339Nano), strings.Join(c.Args, " "), c.Duration)
+	if c.Error != "" {
+		fmt.Fprintf(f, "error: %s\n", c.Error)
+	}
+	fmt.Fprintf(f, "%s\n", c.Output)
+}
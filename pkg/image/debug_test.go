@@ -0,0 +1,31 @@
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDebugVolumeLog(t *testing.T) {
+	if _, err := volumeDebug(map[string]string{"debug": "yes please"}); err == nil {
+		t.Fatal("invalid debug attribute accepted")
+	}
+
+	dir := t.TempDir()
+
+	d := newDebugVolumes(filepath.Join(dir, "logs"))
+	d.enable("vol")
+	if !d.enabled("vol") || d.enabled("other") {
+		t.Fatal("debug not tracked per volume")
+	}
+	d.write("vol", Command{Args: []string{"buildah", "--log-level", "debug", "mount", "vol"}, Output: "level=debug msg=hello"})
+	log, err := ioutil.ReadFile(d.logPath("vol"))
+	if err != nil || !bytes.Contains(log, []byte("level=debug msg=hello")) {
+		t.Fatalf("unexpected debug log %q: %v", log, err)
+	}
+	d.disable("vol")
+	if d.enabled("vol") {
+		t.Fatal("debug still enabled")
+	}
+}
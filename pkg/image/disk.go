@@ -0,0 +1,100 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// defaultDiskDir is where KubeVirt containerDisks keep their disk image.
+	defaultDiskDir = "/disk"
+)
+
+var diskExtensions = []string{".img", ".raw", ".qcow2"}
+
+// findDiskImage locates the disk image inside rootfs. diskPath is the path of
+// the disk inside the image; if it is empty, the single disk image found in
+// /disk is used. Symlinks are resolved inside rootfs, so that an image cannot
+// have host files mounted or attached as its disk.
+func findDiskImage(rootfs, diskPath string) (string, error) {
+	if diskPath != "" {
+		p, err := resolveInRoot(rootfs, filepath.Clean("/"+diskPath))
+		if err != nil {
+			return "", err
+		}
+		if err := checkDiskFile(p); err != nil {
+			return "", fmt.Errorf("disk image %s: %v", diskPath, err)
+		}
+		return p, nil
+	}
+
+	dir, err := resolveInRoot(rootfs, defaultDiskDir)
+	if err != nil {
+		return "", fmt.Errorf("no diskPath given and %s is not readable: %v", defaultDiskDir, err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("no diskPath given and %s is not readable: %v", defaultDiskDir, err)
+	}
+	var found []string
+	for _, e := range entries {
+		if !e.Mode().IsRegular() {
+			continue
+		}
+		for _, ext := range diskExtensions {
+			if strings.HasSuffix(e.Name(), ext) {
+				found = append(found, filepath.Join(dir, e.Name()))
+				break
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no disk image (%s) found in %s", strings.Join(diskExtensions, ", "), defaultDiskDir)
+	case 1:
+		if err := checkDiskFile(found[0]); err != nil {
+			return "", fmt.Errorf("disk image in %s: %v", defaultDiskDir, err)
+		}
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("multiple disk images found in %s, set diskPath", defaultDiskDir)
+	}
+}
+
+// checkDiskFile verifies that p, resolved by resolveInRoot, is a regular
+// file and not a symlink swapped in after it was resolved.
+func checkDiskFile(p string) error {
+	f, err := os.OpenFile(p, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindDiskImage(t *testing.T) {
+	rootfs := t.TempDir()
+	if _, err := findDiskImage(rootfs, ""); err == nil {
+		t.Fatalf("expected an error without /disk")
+	}
+
+	os.MkdirAll(filepath.Join(rootfs, "disk"), 0755)
+	ioutil.WriteFile(filepath.Join(rootfs, "disk", "README"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(rootfs, "disk", "vm.qcow2"), nil, 0644)
+	got, err := findDiskImage(rootfs, "")
+	if err != nil || got != filepath.Join(rootfs, "disk", "vm.qcow2") {
+		t.Fatalf("findDiskImage = %q, %v", got, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(rootfs, "disk", "other.img"), nil, 0644)
+	if _, err := findDiskImage(rootfs, ""); err == nil {
+		t.Fatalf("expected an error with multiple disk images")
+	}
+
+	got, err = findDiskImage(rootfs, "../../disk/other.img")
+	if err != nil || got != filepath.Join(rootfs, "disk", "other.img") {
+		t.Fatalf("findDiskImage with diskPath = %q, %v", got, err)
+	}
+
+	// Links in the image are resolved inside the rootfs, not on the host.
+	host := t.TempDir()
+	ioutil.WriteFile(filepath.Join(host, "secret.img"), []byte("host"), 0644)
+	linked := t.TempDir()
+	os.Symlink(host, filepath.Join(linked, "disk"))
+	if got, err := findDiskImage(linked, ""); err == nil {
+		t.Errorf("symlinked /disk resolved to %s on the host", got)
+	}
+	os.Symlink(filepath.Join(host, "secret.img"), filepath.Join(linked, "vm.img"))
+	if got, err := findDiskImage(linked, "vm.img"); err == nil {
+		t.Errorf("symlinked diskPath resolved to %s on the host", got)
+	}
+	os.Symlink("/disk/other.img", filepath.Join(rootfs, "link.img"))
+	got, err = findDiskImage(rootfs, "link.img")
+	if err != nil || got != filepath.Join(rootfs, "disk", "other.img") {
+		t.Errorf("findDiskImage with a link inside the image = %q, %v", got, err)
+	}
+}
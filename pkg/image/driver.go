@@ -17,18 +17,219 @@ limitations under the License.
 package image
 
 import (
+	"os"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
 )
 
+// Options carries the node-level settings of the driver.
+type Options struct {
+	// Version and BuildDate identify the driver build. Version defaults to
+	// the version of this package.
+	Version   string
+	BuildDate string
+	// StorageRoot and RunRoot are the containers/storage directories used
+	// by buildah. Instances of the driver on the same node need their own.
+	StorageRoot string
+	RunRoot     string
+	// StorageDriver is the containers/storage driver of StorageRoot:
+	// overlay, fuse-overlayfs, vfs or auto to pick the first usable one.
+	// FuseOverlayfsPath is the fuse-overlayfs binary.
+	StorageDriver     string
+	FuseOverlayfsPath string
+	// KubeletPodsDir is the pods directory of the kubelet, which target
+	// paths must lie within. Empty disables the check.
+	KubeletPodsDir string
+	// ReservedSpace is the number of bytes that must stay free on the
+	// storage root after a pull.
+	ReservedSpace int64
+	// PullHeadroom is the number of bytes assumed to be needed by a pull
+	// on top of ReservedSpace and the compressed size of the image, for
+	// unpacking the layers.
+	PullHeadroom int64
+	// StorageCheckInterval is how often the filesystem of the storage root
+	// is checked for a read-only remount, low space and few free inodes.
+	// Zero disables the checks.
+	StorageCheckInterval time.Duration
+	// MaxConcurrentPulls limits the number of pulls running at the same
+	// time, zero means no limit.
+	MaxConcurrentPulls int
+	// FailedPullCacheTTL is how long publishes of an image whose pull
+	// failed permanently, e.g. because it does not exist, fail without
+	// pulling again. Zero disables the cache.
+	FailedPullCacheTTL time.Duration
+	// Cgroup is the cgroup v2 directory backend commands are moved into
+	// once started, empty to run them in the driver's own cgroup.
+	Cgroup string
+	// CgroupCPUWeight and CgroupIOWeight are the weights applied to Cgroup.
+	CgroupCPUWeight int
+	CgroupIOWeight  int
+	// PullRetries is the number of times an interrupted pull is started
+	// over from scratch, waiting PullRetryDelay in between without a pull
+	// queue slot. Downloads are not resumed.
+	PullRetries    int
+	PullRetryDelay time.Duration
+	// CommandTimeout bounds each backend command, zero for no bound.
+	// Volumes can choose another timeout for their pulls with the
+	// pullTimeout attribute, up to MaxPullTimeout, zero for no bound.
+	CommandTimeout time.Duration
+	MaxPullTimeout time.Duration
+	// TmpfsSize is the size of tmpfs volumes that do not set sizeLimit.
+	TmpfsSize int64
+	// StripXattrs drops extended attributes when copying volume content.
+	StripXattrs bool
+	// MountPropagation is the propagation of volumes without the
+	// mountPropagation attribute, empty to keep the one they get.
+	MountPropagation string
+	// ExportDir is where volumes with the export attribute are written to
+	// on unpublish, empty to only allow exports to URLs starting with one
+	// of ExportURLPrefixes.
+	ExportDir         string
+	ExportURLPrefixes []string
+	// UpdateInterval is how often volumes with updatePolicy Watch check
+	// their image for a new digest, zero to disable the policy. Volumes
+	// can choose another interval between MinResyncInterval and
+	// MaxResyncInterval, zero means no bound.
+	UpdateInterval    time.Duration
+	MinResyncInterval time.Duration
+	MaxResyncInterval time.Duration
+	// MetricsAddress is the listen address of the metrics endpoint, empty
+	// to disable it.
+	MetricsAddress string
+	// PprofAddress is the listen address of the pprof endpoint, empty to
+	// disable it.
+	PprofAddress string
+	// LocalityAddress is the listen address of the cache-locality
+	// endpoint, empty to disable it.
+	LocalityAddress string
+	// WebhookAddress is the listen address of the registry webhooks, empty
+	// to disable them. WebhookTokenFile holds the token requests must
+	// carry, it is required with WebhookAddress.
+	WebhookAddress   string
+	WebhookTokenFile string
+	// DebugVerbosity is the glog verbosity SIGHUP toggles to.
+	DebugVerbosity int
+	// AdminSocket is the path of the unix socket serving the admin API,
+	// empty to disable it.
+	AdminSocket string
+	// CommandHistory is the number of backend commands kept per volume
+	// for the admin API.
+	CommandHistory int
+	// DebugLogDir is where the backend output of volumes with the debug
+	// attribute is written to, empty to only log it.
+	DebugLogDir string
+	// InventoryInterval is how often the content of the storage root is
+	// taken stock of for the metrics and the admin API, zero to disable.
+	InventoryInterval time.Duration
+	// AnnotateNode publishes the digests of the cached images as an
+	// annotation of the node object on every inventory.
+	AnnotateNode bool
+	// LeakCheckInterval is how often containers no tracked volume owns
+	// are looked for, zero to disable. They are deleted once they were
+	// unowned for LeakGracePeriod.
+	LeakCheckInterval time.Duration
+	LeakGracePeriod   time.Duration
+	// PrefetchInterval is how often the ImagePrefetch objects are
+	// reconciled, zero to disable.
+	PrefetchInterval time.Duration
+	// ImageChannelInterval is how often the ImageChannel objects of
+	// published volumes are checked for a new digest, zero to not support
+	// the imageChannel attribute.
+	ImageChannelInterval time.Duration
+	// RegistryConfig is the path of a JSON file with a RegistryConfig. It
+	// is reloaded when it changes.
+	RegistryConfig string
+	// CRIEndpoint is the CRI socket of the container runtime, empty to not
+	// look up images in its image store. CRIImageStore is that store as
+	// [driver@graphroot+runroot].
+	CRIEndpoint   string
+	CRIImageStore string
+	// VolumePolicy is the name of the ImageVolumePolicy object applied in
+	// addition to the registry config, empty for none.
+	VolumePolicy string
+	// FeatureGates enables experimental features, nil for the defaults.
+	FeatureGates FeatureGates
+	// StateDir is where the tracked volumes are saved on shutdown and
+	// restored from on start, empty to not persist them.
+	StateDir string
+	// ShutdownTimeout bounds how long in-flight calls may take to finish
+	// after SIGTERM.
+	ShutdownTimeout time.Duration
+	// ShutdownCleanup unpublishes all volumes on shutdown instead of
+	// leaving them mounted.
+	ShutdownCleanup bool
+	// StorageAutoReset wipes a corrupted storage root once no volume is
+	// published anymore. It is ignored unless StorageRoot and RunRoot are
+	// dedicated to the driver.
+	StorageAutoReset bool
+	// ForceRemount lazily unmounts target paths whose mount no longer
+	// responds on publish, so they can be mounted again.
+	ForceRemount bool
+	// HungCommandThreshold is how long a backend command may run before it
+	// is reported as hung. With HungCommandCancelAfter, hung commands are
+	// cancelled after that long. Zero disables either.
+	HungCommandThreshold   time.Duration
+	HungCommandCancelAfter time.Duration
+	// SocketMode, SocketUID and SocketGID are applied to a unix socket
+	// endpoint. Zero and -1 keep the defaults.
+	SocketMode os.FileMode
+	SocketUID  int
+	SocketGID  int
+	// TLSCert and TLSKey enable TLS on a TCP endpoint. With TLSClientCA,
+	// clients need a certificate signed by it.
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	// GRPCMaxRecvMsgSize, GRPCMaxSendMsgSize and GRPCMaxConcurrentStreams
+	// tune the CSI server, zero keeps the grpc defaults.
+	GRPCMaxRecvMsgSize       int
+	GRPCMaxSendMsgSize       int
+	GRPCMaxConcurrentStreams uint32
+	// GRPCKeepaliveTime and GRPCKeepaliveTimeout configure server pings,
+	// GRPCKeepaliveMinTime is the shortest ping interval accepted from
+	// clients. Zero keeps the grpc defaults.
+	GRPCKeepaliveTime    time.Duration
+	GRPCKeepaliveTimeout time.Duration
+	GRPCKeepaliveMinTime time.Duration
+	// LeaderElection makes the instances of the driver elect a leader
+	// through a Lease in LeaderElectionNamespace. Only the leader serves
+	// controller calls that change state.
+	LeaderElection              bool
+	LeaderElectionNamespace     string
+	LeaderElectionLeaseDuration time.Duration
+	// Topology reports the architecture, region and zone of the node in
+	// NodeGetInfo and advertises accessibility constraints.
+	Topology bool
+	// MaxVolumesPerNode is the number of volumes the scheduler may place
+	// on the node, zero for no limit.
+	MaxVolumesPerNode int64
+	// SelfTest makes the driver check its backend before it starts to
+	// listen and exit if the check fails. SelfTestImage is pulled as part
+	// of the check if set.
+	SelfTest      bool
+	SelfTestImage string
+	// Events enables Kubernetes events on the pods consuming volumes. It
+	// needs the driver to run in-cluster and podInfoOnMount to be set.
+	Events bool
+}
+
 type driver struct {
 	csiDriver *csicommon.CSIDriver
 	endpoint  string
+	name      string
+	nodeID    string
+	opts      Options
 
-	ids *csicommon.DefaultIdentityServer
-	ns  *nodeServer
+	ids     *csicommon.DefaultIdentityServer
+	ns      *nodeServer
+	storage *storageMonitor
+
+	buildahVersion string
 
 	cap   []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
@@ -38,42 +239,258 @@ var (
 	version = "0.0.1"
 )
 
-func NewDriver(driverName, nodeID, endpoint string) *driver {
-	glog.Infof("Driver: %v version: %v", driverName, version)
+func NewDriver(driverName, nodeID, endpoint string, opts Options) *driver {
+	if opts.Version == "" {
+		opts.Version = version
+	}
+	buildahVersion := BuildahVersion()
+	glog.Infof("Driver: %v version: %v buildah: %v", driverName, opts.Version, buildahVersion)
 
 	d := &driver{}
 
 	d.endpoint = endpoint
+	d.name = driverName
+	d.nodeID = nodeID
+	d.opts = opts
+	d.buildahVersion = buildahVersion
 
-	csiDriver := csicommon.NewCSIDriver(driverName, version, nodeID)
-	csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
-	// image plugin does not support ControllerServiceCapability now.
-	// If support is added, it should set to appropriate
-	// ControllerServiceCapability RPC types.
-	csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_UNKNOWN})
+	csiDriver := csicommon.NewCSIDriver(driverName, opts.Version, nodeID)
+	// Every node pulls its own copy of the image, so volumes can be read on
+	// many nodes but writes stay on the node.
+	csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	})
+	// The controller reports the capacity of the node's storage root and
+	// provisions volumes, which need no storage of their own.
+	csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
 
 	d.csiDriver = csiDriver
 
 	return d
 }
 
+func NewIdentityServer(d *driver) *identityServer {
+	return &identityServer{
+		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d.csiDriver),
+		storageRoot:           d.opts.StorageRoot,
+		manifest:              buildManifest(d.opts.BuildDate, d.buildahVersion),
+		topology:              d.opts.Topology,
+		storage:               d.storage,
+	}
+}
+
 func NewNodeServer(d *driver) *nodeServer {
-	return &nodeServer{
+	var cg *cgroup
+	if d.opts.Cgroup != "" {
+		var err error
+		cg, err = newCgroup(d.opts.Cgroup, d.opts.CgroupCPUWeight, d.opts.CgroupIOWeight)
+		if err != nil {
+			glog.Warningf("cannot set up cgroup %s, backend commands run unconstrained: %v", d.opts.Cgroup, err)
+			cg = nil
+		}
+	}
+
+	var events *eventRecorder
+	if d.opts.Events {
+		client, err := kube.NewInClusterClient()
+		if err != nil {
+			glog.Warningf("events disabled, cannot create Kubernetes client: %v", err)
+		} else {
+			events = &eventRecorder{client: client, component: d.name, host: d.nodeID}
+		}
+	}
+
+	registries, err := newRegistryPolicy(d.opts.RegistryConfig)
+	if err != nil {
+		glog.Fatalf("cannot load registry config: %v", err)
+	}
+	go registries.watch()
+	if d.opts.VolumePolicy != "" {
+		if err := watchVolumePolicy(registries, d.opts.VolumePolicy); err != nil {
+			glog.Fatalf("cannot load volume policy: %v", err)
+		}
+	}
+
+	var cri *criImageService
+	if d.opts.CRIEndpoint != "" {
+		if cri, err = newCRIImageService(d.opts.CRIEndpoint, d.opts.CRIImageStore); err != nil {
+			glog.Warningf("cannot connect to the container runtime at %s, images are always pulled: %v", d.opts.CRIEndpoint, err)
+		}
+	}
+
+	autoReset := d.opts.StorageAutoReset
+	if autoReset {
+		if err := checkDedicatedStorage(d.opts.StorageRoot, d.opts.RunRoot, d.opts.CRIImageStore); err != nil {
+			glog.Warningf("storage auto reset disabled: %v", err)
+			autoReset = false
+		}
+	}
+
+	var topology map[string]string
+	if d.opts.Topology {
+		topology = nodeTopology(d.nodeID)
+	}
+
+	ns := &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
+		Timeout:           d.opts.CommandTimeout,
+		execPath:          "/bin/buildah",
+		nodeID:            d.nodeID,
+		driverName:        d.name,
+		driverVersion:     d.opts.Version,
+		storageRoot:       d.opts.StorageRoot,
+		runRoot:           d.opts.RunRoot,
+		podsDir:           d.opts.KubeletPodsDir,
+		reservedSpace:     d.opts.ReservedSpace,
+		pullHeadroom:      d.opts.PullHeadroom,
+		pulls:             newPullQueue(d.opts.MaxConcurrentPulls),
+		pullFailures:      newFailedPulls(d.opts.FailedPullCacheTTL),
+		cgroup:            cg,
+		pullRetries:       d.opts.PullRetries,
+		pullRetryDelay:    d.opts.PullRetryDelay,
+		tmpfsSize:         d.opts.TmpfsSize,
+		stripXattrs:       d.opts.StripXattrs,
+		propagation:       d.opts.MountPropagation,
+		exportDir:         d.opts.ExportDir,
+		exportURLs:        d.opts.ExportURLPrefixes,
+		events:            events,
+		volumes:           newVolumeTracker(),
+		history:           newCommandHistory(d.opts.CommandHistory),
+		debug:             newDebugVolumes(d.opts.DebugLogDir),
+		registries:        registries,
+		bandwidth:         &pullBandwidth{},
+		cri:               cri,
+		features:          d.opts.FeatureGates,
+		topology:          topology,
+		maxVolumes:        d.opts.MaxVolumesPerNode,
+		maxPullTimeout:    d.opts.MaxPullTimeout,
+		storageAutoReset:  autoReset,
+		forceRemount:      d.opts.ForceRemount,
+		watchdog:          newCommandWatchdog(d.opts.HungCommandThreshold, d.opts.HungCommandCancelAfter),
 	}
+	ns.updates = newUpdateWatcher(d.opts.UpdateInterval, d.opts.MinResyncInterval, d.opts.MaxResyncInterval, ns.refreshVolume)
+	return ns
 }
 
-func NewControllerServer(d *csicommon.CSIDriver) *controllerServer {
+func NewControllerServer(d *driver) *controllerServer {
 	return &controllerServer{
-		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(d.csiDriver),
+		storageRoot:             d.opts.StorageRoot,
+		reservedSpace:           d.opts.ReservedSpace,
+		topology:                d.opts.Topology,
 	}
 }
 
 func (d *driver) Run() {
-	s := csicommon.NewNonBlockingGRPCServer()
+	handleSIGHUP(d.opts.DebugVerbosity)
+	if d.opts.MetricsAddress != "" {
+		serveMetrics(d.opts.MetricsAddress, d.opts.StorageRoot)
+	}
+	if d.opts.PprofAddress != "" {
+		servePprof(d.opts.PprofAddress)
+	}
+	if d.opts.LocalityAddress != "" {
+		if err := serveLocality(d.opts.LocalityAddress, d.name); err != nil {
+			glog.Warningf("locality endpoint disabled, cannot create Kubernetes client: %v", err)
+		}
+	}
+
+	ns := NewNodeServer(d)
+	if err := ns.selectStorageDriver(d.opts.StorageDriver, d.opts.FuseOverlayfsPath); err != nil {
+		glog.Fatalf("cannot set up storage driver: %v", err)
+	}
+	if d.opts.SelfTest {
+		if err := ns.selfTest(d.opts.SelfTestImage); err != nil {
+			glog.Fatalf("self-test failed: %v", err)
+		}
+	}
+	if d.opts.StateDir != "" {
+		if err := ns.restoreState(d.opts.StateDir); err != nil {
+			glog.Warningf("cannot restore state from %s: %v", d.opts.StateDir, err)
+		}
+	}
+
+	if ns.watchdog != nil {
+		go ns.watchdog.run()
+	}
+	if d.opts.LeakCheckInterval > 0 {
+		leaks := &leakDetector{ns: ns, grace: d.opts.LeakGracePeriod}
+		go leaks.run(d.opts.LeakCheckInterval)
+	}
+
+	if d.opts.ImageChannelInterval > 0 {
+		channels, err := newChannelWatcher(ns)
+		if err != nil {
+			glog.Warningf("image channels disabled, cannot create Kubernetes client: %v", err)
+		} else {
+			ns.channels = channels
+			go channels.run(d.opts.ImageChannelInterval)
+		}
+	}
+	if d.opts.PrefetchInterval > 0 {
+		prefetch, err := newPrefetcher(ns, d.nodeID)
+		if err != nil {
+			glog.Warningf("image prefetches disabled, cannot create Kubernetes client: %v", err)
+		} else {
+			go prefetch.run(d.opts.PrefetchInterval)
+		}
+	}
+
+	var inv *inventory
+	if d.opts.InventoryInterval > 0 && (d.opts.MetricsAddress != "" || d.opts.AdminSocket != "" || d.opts.AnnotateNode) {
+		inv = &inventory{ns: ns}
+		if d.opts.AnnotateNode {
+			annotator, err := newCachedImagesAnnotator(d.name, d.nodeID)
+			if err != nil {
+				glog.Warningf("node annotation disabled, cannot create Kubernetes client: %v", err)
+			}
+			inv.annotator = annotator
+		}
+		go inv.run(d.opts.InventoryInterval)
+	}
+	if d.opts.AdminSocket != "" {
+		serveAdmin(d.opts.AdminSocket, ns, inv)
+	}
+	if d.opts.WebhookAddress != "" {
+		if err := serveWebhook(d.opts.WebhookAddress, d.opts.WebhookTokenFile, ns, d.nodeID); err != nil {
+			glog.Fatalf("cannot serve registry webhooks: %v", err)
+		}
+	}
+
+	if d.opts.StorageRoot != "" && d.opts.StorageCheckInterval > 0 {
+		d.storage = newStorageMonitor(d.opts.StorageRoot, d.opts.ReservedSpace)
+		go d.storage.run(d.opts.StorageCheckInterval)
+	}
+
+	s := NewNonBlockingGRPCServer()
+	s.health = &backendHealth{storageRoot: d.opts.StorageRoot, storage: d.storage}
+	s.socketMode = d.opts.SocketMode
+	s.socketUID = d.opts.SocketUID
+	s.socketGID = d.opts.SocketGID
+	s.options = grpcServerOptions(d.opts)
+	if d.opts.LeaderElection {
+		isLeader, err := d.startLeaderElection()
+		if err != nil {
+			glog.Fatalf("cannot start leader election: %v", err)
+		}
+		s.isLeader = isLeader
+	}
+	if d.opts.TLSCert != "" {
+		config, err := serverTLSConfig(d.opts.TLSCert, d.opts.TLSKey, d.opts.TLSClientCA)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		s.tls = config
+	}
 	s.Start(d.endpoint,
-		csicommon.NewDefaultIdentityServer(d.csiDriver),
-		NewControllerServer(d.csiDriver),
-		NewNodeServer(d))
+		NewIdentityServer(d),
+		NewControllerServer(d),
+		ns)
+	go ns.shutdownOnSignal(s, d.opts.ShutdownTimeout, d.opts.StateDir, d.opts.ShutdownCleanup)
 	s.Wait()
 }
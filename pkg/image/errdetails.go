@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	durpb "github.com/golang/protobuf/ptypes/duration"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain is the domain of the ErrorInfo details of this driver.
+const errorDomain = "image-populator.csi.sapcc.github.com"
+
+// Reasons of the ErrorInfo details, so sidecars and tooling can tell failure
+// classes apart without parsing messages.
+const (
+	errorReasonImageNotFound    = "IMAGE_NOT_FOUND"
+	errorReasonUnauthenticated  = "REGISTRY_UNAUTHENTICATED"
+	errorReasonPermissionDenied = "REGISTRY_PERMISSION_DENIED"
+	errorReasonPolicyDenied     = "REGISTRY_POLICY_DENIED"
+	errorReasonRateLimited      = "REGISTRY_RATE_LIMITED"
+	errorReasonUnavailable      = "REGISTRY_UNAVAILABLE"
+	errorReasonDiskPressure     = "DISK_PRESSURE"
+	errorReasonStorageCorrupted = "STORAGE_CORRUPTED"
+	errorReasonTimeout          = "BACKEND_TIMEOUT"
+	errorReasonBackendFailure   = "BACKEND_FAILURE"
+)
+
+// The following messages mirror google.rpc.ErrorInfo, RetryInfo and
+// ResourceInfo field by field, as the errdetails package is not vendored.
+// They are registered under the same names, so clients decode them with the
+// standard types.
+
+type errorInfo struct {
+	Reason   string            `protobuf:"bytes,1,opt,name=reason,proto3" json:"reason,omitempty"`
+	Metadata map[string]string `protobuf:"bytes,2,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Domain   string            `protobuf:"bytes,3,opt,name=domain,proto3" json:"domain,omitempty"`
+}
+
+func (m *errorInfo) Reset()         { *m = errorInfo{} }
+func (m *errorInfo) String() string { return proto.CompactTextString(m) }
+func (*errorInfo) ProtoMessage()    {}
+
+type retryInfo struct {
+	RetryDelay *durpb.Duration `protobuf:"bytes,1,opt,name=retry_delay,json=retryDelay,proto3" json:"retry_delay,omitempty"`
+}
+
+func (m *retryInfo) Reset()         { *m = retryInfo{} }
+func (m *retryInfo) String() string { return proto.CompactTextString(m) }
+func (*retryInfo) ProtoMessage()    {}
+
+type resourceInfo struct {
+	ResourceType string `protobuf:"bytes,1,opt,name=resource_type,json=resourceType,proto3" json:"resource_type,omitempty"`
+	ResourceName string `protobuf:"bytes,2,opt,name=resource_name,json=resourceName,proto3" json:"resource_name,omitempty"`
+	Owner        string `protobuf:"bytes,3,opt,name=owner,proto3" json:"owner,omitempty"`
+	Description  string `protobuf:"bytes,4,opt,name=description,proto3" json:"description,omitempty"`
+}
+
+func (m *resourceInfo) Reset()         { *m = resourceInfo{} }
+func (m *resourceInfo) String() string { return proto.CompactTextString(m) }
+func (*resourceInfo) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*errorInfo)(nil), "google.rpc.ErrorInfo")
+	proto.RegisterType((*retryInfo)(nil), "google.rpc.RetryInfo")
+	proto.RegisterType((*resourceInfo)(nil), "google.rpc.ResourceInfo")
+}
+
+// imageError returns a status error with the failure reason, the image it
+// concerns, if any, and a retry hint, if the failure is worth retrying
+// after a delay.
+func imageError(code codes.Code, reason, image string, retry time.Duration, msg string) error {
+	st := status.New(code, msg)
+	details := []proto.Message{&errorInfo{Reason: reason, Domain: errorDomain}}
+	if image != "" {
+		details = append(details, &resourceInfo{ResourceType: "image", ResourceName: image})
+	}
+	if retry > 0 {
+		details = append(details, &retryInfo{RetryDelay: ptypes.DurationProto(retry)})
+	}
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// errorReason returns the reason of the ErrorInfo detail of err, "" if it
+// has none.
+func errorReason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
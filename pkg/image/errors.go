@@ -0,0 +1,88 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// backendErrorCodes maps fragments of buildah and skopeo output to the
+// status code, reason and retry hint of the failure. The first match wins,
+// so more specific fragments come first.
+var backendErrorCodes = []struct {
+	fragment string
+	code     codes.Code
+	reason   string
+	retry    time.Duration
+}{
+	{"no space left on device", codes.ResourceExhausted, errorReasonDiskPressure, time.Minute},
+	{"disk quota exceeded", codes.ResourceExhausted, errorReasonDiskPressure, time.Minute},
+	{"toomanyrequests", codes.ResourceExhausted, errorReasonRateLimited, 5 * time.Minute},
+	{"429 too many requests", codes.ResourceExhausted, errorReasonRateLimited, 5 * time.Minute},
+	{"unauthorized", codes.Unauthenticated, errorReasonUnauthenticated, 0},
+	{"authentication required", codes.Unauthenticated, errorReasonUnauthenticated, 0},
+	{"denied", codes.PermissionDenied, errorReasonPermissionDenied, 0},
+	{"403 forbidden", codes.PermissionDenied, errorReasonPermissionDenied, 0},
+	{"manifest unknown", codes.NotFound, errorReasonImageNotFound, 0},
+	{"name unknown", codes.NotFound, errorReasonImageNotFound, 0},
+	{"no image found in manifest list", codes.NotFound, errorReasonImageNotFound, 0},
+	{"image not known", codes.NotFound, errorReasonImageNotFound, 0},
+	{"no such image", codes.NotFound, errorReasonImageNotFound, 0},
+	{"404 not found", codes.NotFound, errorReasonImageNotFound, 0},
+}
+
+// backendError turns a failed buildah or skopeo command on image into a
+// status error whose code says what went wrong, so the kubelet backs off
+// sensibly and pod events are meaningful. Failures nobody recognizes are
+// Unknown; Internal is left to bugs of the driver. image is "" for commands
+// on containers.
+func backendError(image, msg string, output []byte, err error) error {
+	out := strings.TrimSpace(string(output))
+	switch err {
+	case TimeoutError, context.DeadlineExceeded:
+		return imageError(codes.DeadlineExceeded, errorReasonTimeout, image, 30*time.Second, fmt.Sprintf("%s: %v", msg, err))
+	case context.Canceled:
+		return status.Error(codes.Canceled, fmt.Sprintf("%s: %v", msg, err))
+	}
+	text := fmt.Sprintf("%s: %v: %s", msg, err, out)
+
+	if isStorageCorruption(output) {
+		return imageError(codes.FailedPrecondition, errorReasonStorageCorrupted, image, time.Minute, text)
+	}
+	lower := strings.ToLower(out)
+	for _, e := range backendErrorCodes {
+		if strings.Contains(lower, e.fragment) {
+			return imageError(e.code, e.reason, image, e.retry, text)
+		}
+	}
+	if isTransientPullError(output) {
+		return imageError(codes.Unavailable, errorReasonUnavailable, image, 10*time.Second, text)
+	}
+	return imageError(codes.Unknown, errorReasonBackendFailure, image, 0, text)
+}
+
+// isDiskPressure tells a ResourceExhausted error caused by a full storage
+// root from one caused by a registry rate limit.
+func isDiskPressure(err error) bool {
+	return errorReason(err) == errorReasonDiskPressure
+}
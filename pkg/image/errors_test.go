@@ -0,0 +1,65 @@
+package image
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackendError(t *testing.T) {
+	exit := errors.New("exit status 125")
+	for _, test := range []struct {
+		output string
+		err    error
+		code   codes.Code
+		reason string
+		retry  bool
+	}{
+		{"reading manifest latest in docker.io/library/nope: manifest unknown", exit, codes.NotFound, errorReasonImageNotFound, false},
+		{"initializing source: reading manifest v1: unauthorized: authentication required", exit, codes.Unauthenticated, errorReasonUnauthenticated, false},
+		{"requested access to the resource is denied", exit, codes.PermissionDenied, errorReasonPermissionDenied, false},
+		{"toomanyrequests: You have reached your pull rate limit", exit, codes.ResourceExhausted, errorReasonRateLimited, true},
+		{"writing blob: storing blob to file: write /var/lib/containers: no space left on device", exit, codes.ResourceExhausted, errorReasonDiskPressure, true},
+		{"pinging container registry: dial tcp: i/o timeout", exit, codes.Unavailable, errorReasonUnavailable, true},
+		{"", TimeoutError, codes.DeadlineExceeded, errorReasonTimeout, true},
+		{"creating container: layer not known", exit, codes.FailedPrecondition, errorReasonStorageCorrupted, true},
+		{"something nobody expected", exit, codes.Unknown, errorReasonBackendFailure, false},
+	} {
+		err := backendError("busybox", "cannot pull busybox", []byte(test.output), test.err)
+		if status.Code(err) != test.code || errorReason(err) != test.reason {
+			t.Errorf("%q: got %v, %s, want %v, %s", test.output, status.Code(err), errorReason(err), test.code, test.reason)
+		}
+		var retry, resource bool
+		for _, d := range status.Convert(err).Details() {
+			switch d := d.(type) {
+			case *retryInfo:
+				retry = d.RetryDelay.GetSeconds() > 0
+			case *resourceInfo:
+				resource = d.ResourceType == "image" && d.ResourceName == "busybox"
+			}
+		}
+		if retry != test.retry || !resource {
+			t.Errorf("%q: unexpected details %v", test.output, status.Convert(err).Details())
+		}
+	}
+
+	if isDiskPressure(backendError("busybox", "cannot pull busybox", []byte("toomanyrequests"), exit)) {
+		t.Error("rate limit reported as disk pressure")
+	}
+	if !isDiskPressure(backendError("busybox", "cannot pull busybox", []byte("no space left on device"), exit)) {
+		t.Error("full storage root not reported as disk pressure")
+	}
+
+	// The details travel under the names of the standard messages.
+	p := status.Convert(backendError("busybox", "cannot pull busybox", []byte("manifest unknown"), exit)).Proto()
+	var urls []string
+	for _, d := range p.GetDetails() {
+		urls = append(urls, d.GetTypeUrl())
+	}
+	if strings.Join(urls, " ") != "type.googleapis.com/google.rpc.ErrorInfo type.googleapis.com/google.rpc.ResourceInfo" {
+		t.Errorf("unexpected detail types %v", urls)
+	}
+}
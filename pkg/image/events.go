@@ -0,0 +1,108 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"time"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+const (
+	eventTypeNormal  = "Normal"
+	eventTypeWarning = "Warning"
+
+	reasonPulled       = "ImageVolumePulled"
+	reasonPullFailed   = "ImageVolumePullFailed"
+	reasonMountFailed  = "ImageVolumeMountFailed"
+	reasonDiskPressure = "ImageVolumeDiskPressure"
+	reasonUpdated      = "ImageVolumeUpdated"
+	reasonUpdateFailed = "ImageVolumeUpdateFailed"
+	reasonExported     = "ImageVolumeExported"
+	reasonExportFailed = "ImageVolumeExportFailed"
+)
+
+// eventRecorder posts events about the pods consuming image volumes. Pod
+// information is only available when the CSIDriver object sets
+// podInfoOnMount.
+type eventRecorder struct {
+	client    *kube.Client
+	component string
+	host      string
+}
+
+type objectReference struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+}
+
+type event struct {
+	Metadata struct {
+		GenerateName string `json:"generateName"`
+		Namespace    string `json:"namespace"`
+	} `json:"metadata"`
+	InvolvedObject objectReference `json:"involvedObject"`
+	Reason         string          `json:"reason"`
+	Message        string          `json:"message"`
+	Type           string          `json:"type"`
+	Source         struct {
+		Component string `json:"component"`
+		Host      string `json:"host"`
+	} `json:"source"`
+	FirstTimestamp string `json:"firstTimestamp"`
+	LastTimestamp  string `json:"lastTimestamp"`
+	Count          int    `json:"count"`
+}
+
+// podEvent records an event on the pod described by the volume attributes.
+// It does not block, failures to post the event are only logged.
+func (r *eventRecorder) podEvent(attrib map[string]string, eventType, reason, message string) {
+	if r == nil {
+		return
+	}
+	namespace := attrib["csi.storage.k8s.io/pod.namespace"]
+	name := attrib["csi.storage.k8s.io/pod.name"]
+	if namespace == "" || name == "" {
+		return
+	}
+
+	var e event
+	e.Metadata.GenerateName = name + "."
+	e.Metadata.Namespace = namespace
+	e.InvolvedObject = objectReference{
+		Kind:      "Pod",
+		Namespace: namespace,
+		Name:      name,
+		UID:       attrib["csi.storage.k8s.io/pod.uid"],
+	}
+	e.Reason = reason
+	e.Message = message
+	e.Type = eventType
+	e.Source.Component = r.component
+	e.Source.Host = r.host
+	now := time.Now().UTC().Format(time.RFC3339)
+	e.FirstTimestamp, e.LastTimestamp = now, now
+	e.Count = 1
+
+	go func() {
+		if err := r.client.Do("POST", "/api/v1/namespaces/"+namespace+"/events", &e, nil); err != nil {
+			logWarning("cannot record event", "pod", namespace+"/"+name, "reason", reason, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,36 @@
+package image
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+func TestPodEvent(t *testing.T) {
+	received := make(chan event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/events" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var e event
+		json.NewDecoder(r.Body).Decode(&e)
+		received <- e
+	}))
+	defer srv.Close()
+
+	r := &eventRecorder{client: kube.NewClient(srv.URL, "", srv.Client()), component: "image.csi.k8s.io", host: "node1"}
+	// Without pod info nothing is recorded.
+	r.podEvent(map[string]string{"image": "busybox"}, eventTypeNormal, reasonPulled, "ignored")
+	r.podEvent(map[string]string{
+		"csi.storage.k8s.io/pod.name":      "web",
+		"csi.storage.k8s.io/pod.namespace": "default",
+	}, eventTypeWarning, reasonPullFailed, "Failed to pull")
+
+	e := <-received
+	if e.InvolvedObject.Name != "web" || e.Reason != reasonPullFailed || e.Type != eventTypeWarning || e.Source.Host != "node1" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
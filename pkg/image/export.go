@@ -0,0 +1,303 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Export modes, selected by the "export" volume attribute.
+const (
+	// exportContent exports what the volume shows at unpublish.
+	exportContent = "content"
+	// exportDiff exports only what was written to the container.
+	exportDiff = "diff"
+)
+
+// exportClient uploads exports, which can be large.
+var exportClient = &http.Client{Timeout: 30 * time.Minute}
+
+// exportSpec is what and where a volume is exported to on unpublish. The
+// tarball goes to url if set, to the export directory of the node
+// otherwise.
+type exportSpec struct {
+	mode string
+	url  string
+}
+
+// volumeExport returns the export attributes of a volume, nil if it is not
+// exported.
+func (ns *nodeServer) volumeExport(attrib map[string]string) (*exportSpec, error) {
+	spec := &exportSpec{mode: attrib["export"], url: attrib["exportURL"]}
+	switch spec.mode {
+	case "":
+		if spec.url != "" {
+			return nil, fmt.Errorf("exportURL needs the export attribute")
+		}
+		return nil, nil
+	case exportContent, exportDiff:
+	default:
+		return nil, fmt.Errorf("unsupported export %q: must be %s or %s", spec.mode, exportContent, exportDiff)
+	}
+	if spec.url == "" {
+		if ns.exportDir == "" {
+			return nil, fmt.Errorf("export needs exportURL, this node has no export directory")
+		}
+		return spec, nil
+	}
+	for _, prefix := range ns.exportURLs {
+		if exportURLAllowed(spec.url, prefix) {
+			return spec, nil
+		}
+	}
+	return nil, fmt.Errorf("exportURL is not allowed on this node")
+}
+
+// exportURLAllowed tells whether raw lies below prefix. Both are parsed, so
+// that the scheme and host have to match exactly and the path cannot leave
+// the prefix with ".." or continue the last segment of a prefix without a
+// trailing slash.
+func exportURLAllowed(raw, prefix string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Opaque != "" || u.User != nil {
+		return false
+	}
+	p, err := url.Parse(prefix)
+	if err != nil {
+		return false
+	}
+	if !strings.EqualFold(u.Scheme, p.Scheme) || !strings.EqualFold(u.Host, p.Host) {
+		return false
+	}
+	if clean := path.Clean(u.Path); u.Path != clean && u.Path != clean+"/" {
+		return false
+	}
+	dir := strings.TrimSuffix(p.Path, "/")
+	return u.Path == dir || strings.HasPrefix(u.Path, dir+"/")
+}
+
+// exportVolume writes the content of a volume, or what was written to it,
+// as a gzipped tarball to the destination requested by its attributes. It
+// returns where the tarball went. The volume must still be mounted. An
+// upload is aborted when ctx is done.
+func (ns *nodeServer) exportVolume(ctx context.Context, v Volume) (string, error) {
+	spec, err := ns.volumeExport(v.Attributes)
+	if err != nil || spec == nil {
+		return "", err
+	}
+
+	root := v.TargetPath
+	if spec.mode == exportDiff {
+		if root, err = ns.containerDiffDir(v.ID); err != nil {
+			return "", err
+		}
+	} else if v.Mode == modeTmpfs {
+		// Export the content of tmpfs volumes without the layout links.
+		// The link is resolved within the volume, the pod may have
+		// replaced it.
+		if data, err := resolveInRoot(root, dataLink); err == nil {
+			root = data
+		}
+	}
+
+	name := exportName(v, time.Now())
+	if spec.url == "" {
+		dest := filepath.Join(ns.exportDir, name)
+		if err := os.MkdirAll(ns.exportDir, 0750); err != nil {
+			return "", err
+		}
+		tmp := dest + ".tmp"
+		if err := writeTarballFile(root, tmp); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+		return dest, os.Rename(tmp, dest)
+	}
+
+	f, err := ioutil.TempFile("", "export-")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := writeTarballFile(root, f.Name()); err != nil {
+		return "", err
+	}
+	if err := uploadFile(ctx, spec.url, f.Name()); err != nil {
+		return "", err
+	}
+	// The URL may carry credentials, e.g. a presigned URL.
+	return strings.SplitN(spec.url, "?", 2)[0], nil
+}
+
+// exportName is the file name of a tarball exported at t, telling the pod
+// and the volume it belongs to.
+func exportName(v Volume, t time.Time) string {
+	name := v.ID
+	if pod := v.Attributes["csi.storage.k8s.io/pod.name"]; pod != "" {
+		name = v.Attributes["csi.storage.k8s.io/pod.namespace"] + "_" + pod + "_" + name
+	}
+	return name + "_" + t.UTC().Format("20060102T150405Z") + ".tar.gz"
+}
+
+// containerDiffDir returns the upper directory of the overlay storage
+// driver, which holds what was written to the container of a volume.
+func (ns *nodeServer) containerDiffDir(volumeId string) (string, error) {
+	output, err := ns.runCmd([]string{"inspect", "--format", "{{.ContainerID}}", ns.containerName(volumeId)})
+	if err != nil {
+		return "", fmt.Errorf("cannot inspect container of volume %s: %v: %s", volumeId, err, strings.TrimSpace(string(output)))
+	}
+	id := strings.TrimSpace(string(output))
+
+	data, err := ioutil.ReadFile(filepath.Join(ns.storageRoot, "overlay-containers", "containers.json"))
+	if err != nil {
+		return "", fmt.Errorf("diff exports need the overlay storage driver: %v", err)
+	}
+	var containers []struct {
+		ID    string `json:"id"`
+		Layer string `json:"layer"`
+	}
+	if err := json.Unmarshal(data, &containers); err != nil {
+		return "", err
+	}
+	for _, c := range containers {
+		if c.ID == id {
+			return filepath.Join(ns.storageRoot, "overlay", c.Layer, "diff"), nil
+		}
+	}
+	return "", fmt.Errorf("container %s not found in the storage", id)
+}
+
+// writeTarballFile writes the tree below root as gzipped tarball to path.
+func writeTarballFile(root, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if err := writeTarball(root, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeTarball writes the tree below root as gzipped tarball to w, with
+// the paths relative to root. Overlay whiteouts are kept as the character
+// devices they are.
+func writeTarball(root string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel = info.Name()
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// uploadFile uploads the file at path with a PUT to dest, which works for
+// presigned object store URLs.
+func uploadFile(ctx context.Context, dest, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, dest, f)
+	if err != nil {
+		return fmt.Errorf("invalid exportURL")
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/gzip")
+	resp, err := exportClient.Do(req)
+	if err != nil {
+		// The error contains the URL, which may carry credentials.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return fmt.Errorf("upload failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("upload failed with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// readTarball returns the entries of a gzipped tarball with the content of
+// regular files.
+func readTarball(t *testing.T, r io.Reader) map[string]string {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		if hdr.Typeflag == tar.TypeSymlink {
+			content = []byte("->" + hdr.Linkname)
+		}
+		entries[hdr.Name] = string(content)
+	}
+}
+
+func TestExportVolume(t *testing.T) {
+	var uploaded map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.ContentLength <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		uploaded = readTarball(t, r.Body)
+	}))
+	defer server.Close()
+
+	storage := t.TempDir()
+	ns := &nodeServer{
+		storageRoot: storage,
+		volumes:     newVolumeTracker(),
+		exportDir:   t.TempDir(),
+		exportURLs:  []string{server.URL + "/builds/"},
+		backend: func(args []string) ([]byte, error) {
+			return []byte("0123abcd\n"), nil
+		},
+	}
+	target := t.TempDir()
+	writeTree(t, target, map[string]string{"out/result": "ok", "out/latest": "->result"})
+	v := Volume{ID: "csi-export", TargetPath: target, Attributes: map[string]string{
+		"export":                           exportContent,
+		"csi.storage.k8s.io/pod.namespace": "ci",
+		"csi.storage.k8s.io/pod.name":      "build-1",
+	}}
+
+	dest, err := ns.exportVolume(context.Background(), v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(filepath.Base(dest), "ci_build-1_csi-export_") || filepath.Dir(dest) != ns.exportDir {
+		t.Errorf("unexpected export destination %s", dest)
+	}
+	f, err := os.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if entries := readTarball(t, f); entries["out/result"] != "ok" || entries["out/latest"] != "->result" || len(entries) != 3 {
+		t.Errorf("unexpected tarball entries %v", entries)
+	}
+
+	// Diff exports take the upper directory of the container's layer.
+	writeTree(t, storage, map[string]string{
+		"overlay-containers/containers.json": `[{"id":"0123abcd","layer":"layer1"}]`,
+		"overlay/layer1/diff/written":        "new",
+	})
+	v.Attributes["export"] = exportDiff
+	v.Attributes["exportURL"] = server.URL + "/builds/build-1.tar.gz?signature=secret"
+	dest, err = ns.exportVolume(context.Background(), v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dest, "secret") {
+		t.Errorf("destination %s contains the query", dest)
+	}
+	if uploaded["written"] != "new" || len(uploaded) != 1 {
+		t.Errorf("unexpected uploaded entries %v", uploaded)
+	}
+
+	for _, attrib := range []map[string]string{
+		{"export": "everything"},
+		{"exportURL": server.URL + "/builds/x"},
+		{"export": exportContent, "exportURL": "https://elsewhere.example.com/builds/x"},
+		{"export": exportContent, "exportURL": server.URL + "/builds/../secrets/x"},
+		{"export": exportContent, "exportURL": server.URL + ".elsewhere.example.com/builds/x"},
+		{"export": exportContent, "exportURL": server.URL + "@elsewhere.example.com/builds/x"},
+	} {
+		if _, err := ns.volumeExport(attrib); err == nil {
+			t.Errorf("expected an error for %v", attrib)
+		}
+	}
+	ns.exportDir = ""
+	if _, err := ns.volumeExport(map[string]string{"export": exportContent}); err == nil {
+		t.Error("expected an error without export directory")
+	}
+}
+
+func TestExportURLAllowed(t *testing.T) {
+	for raw, want := range map[string]bool{
+		"https://bucket.example.com/builds/x.tar.gz?sig=1": true,
+		"HTTPS://Bucket.example.com/builds/x":              true,
+		"https://bucket.example.com/builds":                true,
+		"https://bucket.example.com/buildsx/x":             false,
+		"https://bucket.example.com/builds/../x":           false,
+		"https://bucket.example.com/builds/%2e%2e/x":       false,
+		"https://bucket.example.com.evil.com/builds/x":     false,
+		"https://bucket.example.com@evil.com/builds/x":     false,
+		"https://user@bucket.example.com/builds/x":         false,
+		"http://bucket.example.com/builds/x":               false,
+	} {
+		if got := exportURLAllowed(raw, "https://bucket.example.com/builds/"); got != want {
+			t.Errorf("exportURLAllowed(%s) = %v, expected %v", raw, got, want)
+		}
+	}
+}
+
+func TestExportTmpfsDataLink(t *testing.T) {
+	ns := &nodeServer{volumes: newVolumeTracker(), exportDir: t.TempDir()}
+	outside := t.TempDir()
+	writeTree(t, outside, map[string]string{"secret": "host"})
+	target := t.TempDir()
+	writeTree(t, target, map[string]string{"..2019/result": "ok", dataLink: "->..2019"})
+	v := Volume{ID: "csi-export", Mode: modeTmpfs, TargetPath: target, Attributes: map[string]string{"export": exportContent}}
+
+	read := func() map[string]string {
+		dest, err := ns.exportVolume(context.Background(), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return readTarball(t, f)
+	}
+	if entries := read(); entries["result"] != "ok" || len(entries) != 1 {
+		t.Errorf("unexpected tarball entries %v", entries)
+	}
+
+	// A link the pod replaced cannot point the export at the host.
+	os.Remove(filepath.Join(target, dataLink))
+	if err := os.Symlink(outside, filepath.Join(target, dataLink)); err != nil {
+		t.Fatal(err)
+	}
+	if entries := read(); entries["secret"] != "" {
+		t.Errorf("export followed the link out of the volume: %v", entries)
+	}
+}
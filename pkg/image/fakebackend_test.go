@@ -0,0 +1,183 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fakeBuildah emulates the buildah commands the driver runs in memory.
+// Every container is a directory below root holding the files "hello" and
+// "etc/app/config" with the image name as content and an empty file
+// "from-<image>", which "mount" returns as the mount point. The image "missing" cannot be pulled.
+// Images have the digest set in digests, or "sha256:fake". Commands in
+// failing fail.
+type fakeBuildah struct {
+	root string
+
+	mu         sync.Mutex
+	images     map[string]bool
+	digests    map[string]string
+	containers map[string]string
+	from       map[string]string
+	failing    map[string]bool
+	calls      [][]string
+}
+
+func newFakeBuildah(root string) *fakeBuildah {
+	return &fakeBuildah{
+		root:       root,
+		images:     map[string]bool{},
+		digests:    map[string]string{},
+		containers: map[string]string{},
+		from:       map[string]string{},
+		failing:    map[string]bool{},
+	}
+}
+
+// setFailing makes command fail or work again.
+func (f *fakeBuildah) setFailing(command string, failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[command] = failing
+}
+
+// setDigest changes the digest image resolves to.
+func (f *fakeBuildah) setDigest(image, digest string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.digests[image] = digest
+}
+
+func (f *fakeBuildah) run(args []string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, args)
+
+	// Drop global options.
+	for len(args) > 1 && (args[0] == "--root" || args[0] == "--runroot" || args[0] == "--log-level" || args[0] == "--storage-opt") {
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command")
+	}
+	last := args[len(args)-1]
+	if f.failing[args[0]] {
+		return []byte("injected failure"), fmt.Errorf("exit status 1")
+	}
+
+	switch args[0] {
+	case "version", "info":
+		return []byte("Version: 1.11.3\n"), nil
+	case "from":
+		name := ""
+		for i, arg := range args {
+			if arg == "--name" && i+1 < len(args) {
+				name = args[i+1]
+			}
+		}
+		if _, ok := f.containers[name]; ok {
+			return []byte("the container name \"" + name + "\" is already in use"), fmt.Errorf("exit status 125")
+		}
+		if last == "missing" {
+			return []byte("manifest unknown"), fmt.Errorf("exit status 125")
+		}
+		dir := filepath.Join(f.root, "containers", name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "hello"), []byte(last), 0644); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "from-"+last), nil, 0644); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "etc", "app"), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "etc", "app", "config"), []byte(last), 0644); err != nil {
+			return nil, err
+		}
+		f.images[last] = true
+		f.containers[name] = dir
+		f.from[name] = last
+		return []byte(name + "\n"), nil
+	case "mount":
+		dir, ok := f.containers[last]
+		if !ok {
+			return []byte("container not known"), fmt.Errorf("exit status 125")
+		}
+		return []byte(dir + "\n"), nil
+	case "umount":
+		return nil, nil
+	case "delete", "rm":
+		dir, ok := f.containers[last]
+		if !ok {
+			return []byte("container not known"), fmt.Errorf("exit status 125")
+		}
+		delete(f.containers, last)
+		delete(f.from, last)
+		return nil, os.RemoveAll(dir)
+	case "rename":
+		dir, ok := f.containers[args[1]]
+		if !ok {
+			return []byte("container not known"), fmt.Errorf("exit status 125")
+		}
+		if _, ok := f.containers[last]; ok {
+			return []byte("the container name \"" + last + "\" is already in use"), fmt.Errorf("exit status 125")
+		}
+		delete(f.containers, args[1])
+		f.containers[last] = dir
+		f.from[last] = f.from[args[1]]
+		delete(f.from, args[1])
+		return nil, nil
+	case "pull":
+		f.images[last] = true
+		return nil, nil
+	case "inspect":
+		if len(args) > 2 && args[1] == "--type" && args[2] == "image" {
+			if !f.images[last] {
+				return []byte("image not known"), fmt.Errorf("exit status 125")
+			}
+			if len(args) > 4 && args[3] == "--format" {
+				if digest, ok := f.digests[last]; ok {
+					return []byte(digest + "\n"), nil
+				}
+				return []byte("sha256:fake\n"), nil
+			}
+			return []byte("{}"), nil
+		}
+		if _, ok := f.containers[last]; !ok {
+			return []byte("container not known"), fmt.Errorf("exit status 125")
+		}
+		if len(args) > 2 && args[1] == "--format" && args[2] == "{{json .OCIv1}}" {
+			return []byte(`{"created":"2019-06-01T12:00:00Z","config":{"Env":["PATH=/bin","VERSION=1.2"],` +
+				`"Entrypoint":["/bin/app"],"Cmd":["--serve"],"Labels":{"org.opencontainers.image.version":"1.2"}}}` + "\n"), nil
+		}
+		if len(args) > 2 && args[1] == "--format" {
+			if digest, ok := f.digests[f.from[last]]; ok {
+				return []byte(digest + "\n"), nil
+			}
+			return []byte("sha256:fake\n"), nil
+		}
+		return json.Marshal(map[string]string{"Container": last})
+	case "images":
+		var images []map[string]string
+		for name := range f.images {
+			images = append(images, map[string]string{"names": name})
+		}
+		return json.Marshal(images)
+	case "containers":
+		var containers []map[string]string
+		for name := range f.containers {
+			containers = append(containers, map[string]string{"containername": name})
+		}
+		return json.Marshal(containers)
+	case "rmi":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported command %v", args)
+}
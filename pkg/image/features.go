@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Feature gates. New experimental subsystems are added here disabled by
+// default and enabled with --feature-gates.
+const (
+	// ComposefsMode allows the composefs publish mode.
+	ComposefsMode = "ComposefsMode"
+	// BlockVolumes allows volumes with volumeMode Block.
+	BlockVolumes = "BlockVolumes"
+	// VolumeStats advertises and serves NodeGetVolumeStats.
+	VolumeStats = "VolumeStats"
+)
+
+var defaultFeatureGates = map[string]bool{
+	ComposefsMode: true,
+	BlockVolumes:  true,
+	VolumeStats:   true,
+}
+
+// FeatureGates tells which feature gates are enabled.
+type FeatureGates map[string]bool
+
+// ParseFeatureGates parses a comma separated list of Name=bool pairs and
+// applies it to the defaults. Unknown gates are an error.
+func ParseFeatureGates(s string) (FeatureGates, error) {
+	gates := FeatureGates{}
+	for name, enabled := range defaultFeatureGates {
+		gates[name] = enabled
+	}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid feature gate %q, expected Name=true|false", pair)
+		}
+		name := strings.TrimSpace(kv[0])
+		if _, ok := defaultFeatureGates[name]; !ok {
+			return nil, fmt.Errorf("unknown feature gate %q, known gates are %s", name, strings.Join(knownFeatureGates(), ", "))
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for feature gate %s: %v", name, err)
+		}
+		gates[name] = enabled
+	}
+	return gates, nil
+}
+
+func knownFeatureGates() []string {
+	names := make([]string, 0, len(defaultFeatureGates))
+	for name := range defaultFeatureGates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enabled returns whether a gate is enabled. Gates that were not parsed
+// have their default value.
+func (g FeatureGates) Enabled(name string) bool {
+	if enabled, ok := g[name]; ok {
+		return enabled
+	}
+	return defaultFeatureGates[name]
+}
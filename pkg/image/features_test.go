@@ -0,0 +1,35 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+func TestFeatureGates(t *testing.T) {
+	gates, err := ParseFeatureGates("VolumeStats=false, BlockVolumes=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gates.Enabled(VolumeStats) || !gates.Enabled(BlockVolumes) || !gates.Enabled(ComposefsMode) {
+		t.Fatalf("unexpected gates %v", gates)
+	}
+	if _, err := ParseFeatureGates("LazyPull=true"); err == nil {
+		t.Fatal("unknown gate accepted")
+	}
+	if _, err := ParseFeatureGates("VolumeStats"); err == nil {
+		t.Fatal("gate without value accepted")
+	}
+
+	ns := &nodeServer{features: gates}
+	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	if err != nil || len(resp.GetCapabilities()) != 0 {
+		t.Fatalf("disabled capability advertised: %v %v", resp, err)
+	}
+	ns.features = nil
+	resp, err = ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	if err != nil || len(resp.GetCapabilities()) != 1 {
+		t.Fatalf("default capability missing: %v %v", resp, err)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pattern is a gitignore style pattern. Patterns without a slash match the
+// name of an entry at any depth, others match the path from the root of the
+// copied tree. "**" matches any number of directories and a trailing slash
+// only matches directories.
+type pattern struct {
+	re      *regexp.Regexp
+	dirOnly bool
+}
+
+func parsePattern(p string) (pattern, error) {
+	var pat pattern
+	if strings.HasSuffix(p, "/") {
+		pat.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return pat, fmt.Errorf("empty pattern")
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	var expr strings.Builder
+	if !anchored {
+		expr.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				return pat, fmt.Errorf("unterminated character class in %q", p)
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(p):
+			i++
+			expr.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	re, err := regexp.Compile("^" + expr.String() + "$")
+	if err != nil {
+		return pat, fmt.Errorf("invalid pattern %q: %v", p, err)
+	}
+	pat.re = re
+	return pat, nil
+}
+
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return p.re.MatchString(rel)
+}
+
+// pathFilter selects the entries copied into a volume. An entry is copied
+// if neither it nor one of its directories matches an exclude pattern and,
+// when include patterns are given, it or one of its directories matches one
+// of them.
+type pathFilter struct {
+	include []pattern
+	exclude []pattern
+}
+
+func parsePatterns(list string) ([]pattern, error) {
+	var patterns []pattern
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		pat, err := parsePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pat)
+	}
+	return patterns, nil
+}
+
+// volumeFilter returns the filter given by the include and exclude
+// attributes, or nil if there is none.
+func volumeFilter(attrib map[string]string) (*pathFilter, error) {
+	include, err := parsePatterns(attrib["include"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid include: %v", err)
+	}
+	exclude, err := parsePatterns(attrib["exclude"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude: %v", err)
+	}
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	return &pathFilter{include: include, exclude: exclude}, nil
+}
+
+func matchAny(patterns []pattern, rel string, isDir bool) bool {
+	for _, p := range patterns {
+		if p.match(rel, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether rel, a slash separated path relative to the
+// root of the copied tree, matches an exclude pattern. The directories of
+// rel have been checked already while walking the tree.
+func (f *pathFilter) excluded(rel string, isDir bool) bool {
+	return f != nil && matchAny(f.exclude, rel, isDir)
+}
+
+// included reports whether rel or one of its directories matches an
+// include pattern.
+func (f *pathFilter) included(rel string, isDir bool) bool {
+	if f == nil || len(f.include) == 0 {
+		return true
+	}
+	for {
+		if matchAny(f.include, rel, isDir) {
+			return true
+		}
+		rel = path.Dir(rel)
+		if rel == "." || rel == "/" {
+			return false
+		}
+		isDir = true
+	}
+}
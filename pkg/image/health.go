@@ -0,0 +1,103 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// The grpc.health.v1.Health service. The generated package is not part of
+// the vendored grpc, so the two messages of its Check call are declared here;
+// golang/protobuf marshals them based on the struct tags alone.
+
+type healthCheckRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`
+}
+
+func (m *healthCheckRequest) Reset()         { *m = healthCheckRequest{} }
+func (m *healthCheckRequest) String() string { return proto.CompactTextString(m) }
+func (*healthCheckRequest) ProtoMessage()    {}
+
+type healthCheckResponse struct {
+	Status int32 `protobuf:"varint,1,opt,name=status,proto3" json:"status,omitempty"`
+}
+
+func (m *healthCheckResponse) Reset()         { *m = healthCheckResponse{} }
+func (m *healthCheckResponse) String() string { return proto.CompactTextString(m) }
+func (*healthCheckResponse) ProtoMessage()    {}
+
+// Values of HealthCheckResponse.ServingStatus.
+const (
+	healthServing    = 1
+	healthNotServing = 2
+)
+
+type healthServer interface {
+	Check(ctx context.Context, req *healthCheckRequest) (*healthCheckResponse, error)
+}
+
+type backendHealth struct {
+	storageRoot string
+	storage     *storageMonitor
+}
+
+func (h *backendHealth) Check(ctx context.Context, req *healthCheckRequest) (*healthCheckResponse, error) {
+	if err := checkBackend(h.storageRoot); err != nil {
+		logWarning("health check failed", "error", err)
+		return &healthCheckResponse{Status: healthNotServing}, nil
+	}
+	if conditions := h.storage.degraded(); len(conditions) > 0 {
+		logWarning("health check failed, storage root degraded", "conditions", strings.Join(conditions, ","))
+		return &healthCheckResponse{Status: healthNotServing}, nil
+	}
+	return &healthCheckResponse{Status: healthServing}, nil
+}
+
+func healthCheckHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(healthCheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(healthServer).Check(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.health.v1.Health/Check",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(healthServer).Check(ctx, req.(*healthCheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var healthServiceDesc = grpc.ServiceDesc{
+	ServiceName: "grpc.health.v1.Health",
+	HandlerType: (*healthServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler:    healthCheckHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "grpc/health/v1/health.proto",
+}
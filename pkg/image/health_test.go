@@ -0,0 +1,23 @@
+package image
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestHealthCheckMessages(t *testing.T) {
+	b, err := proto.Marshal(&healthCheckResponse{Status: healthServing})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	// field 1, varint 1
+	if !bytes.Equal(b, []byte{0x08, 0x01}) {
+		t.Fatalf("unexpected encoding %x", b)
+	}
+	var req healthCheckRequest
+	if err := proto.Unmarshal([]byte{0x0a, 0x03, 'c', 's', 'i'}, &req); err != nil || req.Service != "csi" {
+		t.Fatalf("Unmarshal = %+v, %v", req, err)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// maxRecordedOutput caps the output kept per command.
+	maxRecordedOutput = 4 << 10
+	// maxHistoryVolumes caps the number of volumes with a history, the
+	// least recently active one is dropped first.
+	maxHistoryVolumes = 256
+)
+
+// Command is a backend invocation recorded for a volume.
+type Command struct {
+	Time     time.Time `json:"time"`
+	Args     []string  `json:"args"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+	Output   string    `json:"output,omitempty"`
+}
+
+// commandHistory keeps the last commands run for each volume, including
+// volumes that are gone, so that failed publishes can be diagnosed later.
+type commandHistory struct {
+	mu      sync.Mutex
+	keep    int
+	volumes map[string][]Command
+	order   []string
+}
+
+func newCommandHistory(keep int) *commandHistory {
+	return &commandHistory{keep: keep, volumes: map[string][]Command{}}
+}
+
+func (h *commandHistory) record(volumeId string, c Command) {
+	if h == nil || h.keep <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, id := range h.order {
+		if id == volumeId {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+	h.order = append(h.order, volumeId)
+	if len(h.order) > maxHistoryVolumes {
+		delete(h.volumes, h.order[0])
+		h.order = h.order[1:]
+	}
+
+	cmds := append(h.volumes[volumeId], c)
+	if len(cmds) > h.keep {
+		cmds = cmds[len(cmds)-h.keep:]
+	}
+	h.volumes[volumeId] = cmds
+}
+
+// get returns the recorded commands of a volume, oldest first.
+func (h *commandHistory) get(volumeId string) []Command {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Command(nil), h.volumes[volumeId]...)
+}
+
+var (
+	secretArgs   = map[string]bool{"--creds": true, "--password": true, "--registry-token": true}
+	secretOutput = regexp.MustCompile(`(?i)(authorization:\s*(?:basic|bearer)\s+|(?:bearer|password|token)[=:" ]+)\S+`)
+)
+
+// redactArgs hides the values of arguments carrying credentials.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case i > 0 && secretArgs[args[i-1]]:
+			redacted[i] = "<redacted>"
+		case strings.Contains(arg, "=") && secretArgs[strings.SplitN(arg, "=", 2)[0]]:
+			redacted[i] = strings.SplitN(arg, "=", 2)[0] + "=<redacted>"
+		default:
+			redacted[i] = arg
+		}
+	}
+	return redacted
+}
+
+// redactOutput hides credentials in command output and caps its size,
+// keeping the end where the error usually is.
+func redactOutput(output []byte) string {
+	s := secretOutput.ReplaceAllString(string(output), "${1}<redacted>")
+	if len(s) > maxRecordedOutput {
+		s = "..." + s[len(s)-maxRecordedOutput:]
+	}
+	return s
+}
+
+// runVolumeCmd runs a backend command on behalf of a volume and records it
+// in the volume's command history.
+func (ns *nodeServer) runVolumeCmd(volumeId string, args []string) ([]byte, error) {
+	return ns.runVolumeCmdContext(context.Background(), volumeId, args)
+}
+
+// runVolumeCmdContext is runVolumeCmd for commands that stop when ctx is
+// done.
+func (ns *nodeServer) runVolumeCmdContext(ctx context.Context, volumeId string, args []string) ([]byte, error) {
+	debug := ns.debug.enabled(volumeId)
+	if debug {
+		args = append([]string{"--log-level", "debug"}, args...)
+	}
+
+	start := time.Now()
+	output, err := ns.runCmdContext(ctx, args)
+	c := Command{
+		Time:     start,
+		Args:     redactArgs(append([]string{ns.execPath}, args...)),
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+		Output:   redactOutput(output),
+	}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	ns.history.record(volumeId, c)
+	if debug {
+		ns.debug.write(volumeId, c)
+	}
+	return output, err
+}
@@ -0,0 +1,27 @@
+package image
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCommandHistory(t *testing.T) {
+	h := newCommandHistory(2)
+	for _, arg := range []string{"one", "two", "three"} {
+		h.record("vol", Command{Args: []string{arg}})
+	}
+	cmds := h.get("vol")
+	if len(cmds) != 2 || cmds[0].Args[0] != "two" || cmds[1].Args[0] != "three" {
+		t.Fatalf("unexpected history %+v", cmds)
+	}
+
+	args := redactArgs([]string{"pull", "--creds", "user:secret", "--creds=user:secret", "image"})
+	for _, arg := range args {
+		if bytes.Contains([]byte(arg), []byte("secret")) {
+			t.Fatalf("credentials not redacted: %v", args)
+		}
+	}
+	if out := redactOutput([]byte(`error: Authorization: Bearer abc123`)); bytes.Contains([]byte(out), []byte("abc123")) {
+		t.Fatalf("token not redacted: %q", out)
+	}
+}
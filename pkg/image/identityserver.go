@@ -17,9 +17,58 @@ limitations under the License.
 package image
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	storageRoot string
+	manifest    map[string]string
+	topology    bool
+	storage     *storageMonitor
+}
+
+// Probe reports the driver as healthy only if buildah runs and the storage
+// root is writable, so that liveness probes restart a wedged driver. A
+// storage root that is full or out of inodes makes the driver not ready,
+// which a restart would not fix.
+func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if err := checkBackend(ids.storageRoot); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if conditions := ids.storage.degraded(); len(conditions) > 0 {
+		logWarning("storage root degraded", "storage_root", ids.storageRoot, "conditions", strings.Join(conditions, ","))
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+}
+
+// checkBackend verifies that buildah can be executed and that the storage
+// root accepts writes.
+func checkBackend(storageRoot string) error {
+	if output, err := exec.Command("/bin/buildah", "version").CombinedOutput(); err != nil {
+		return fmt.Errorf("buildah is not usable: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	if storageRoot == "" {
+		return nil
+	}
+	f, err := ioutil.TempFile(storageRoot, ".probe")
+	if err != nil {
+		return fmt.Errorf("storage root is not writable: %v", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
 }
@@ -0,0 +1,89 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type requestIDKey struct{}
+
+var grpcDuration = metricsRegistry.NewHistogramVec("image_populator_grpc_request_duration_seconds",
+	"Duration of CSI gRPC calls.", []float64{.005, .05, .25, 1, 5, 30, 120, 600}, "method", "code")
+
+// requestID returns the ID assigned to the call ctx belongs to.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// unaryInterceptor assigns every call a request ID, logs a summary of the
+// request and its outcome, records the call latency and turns panics into
+// Internal errors.
+func unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	id := uuid.New()[:8]
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	start := time.Now()
+	fields := append([]interface{}{"request_id", id, "method", method}, requestFields(req)...)
+
+	defer func() {
+		if r := recover(); r != nil {
+			logError("panic in gRPC handler", "request_id", id, "method", method, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			resp, err = nil, status.Error(codes.Internal, fmt.Sprintf("internal error in %s", method))
+		}
+		code := status.Code(err)
+		grpcDuration.Observe(time.Since(start).Seconds(), method, code.String())
+		if err != nil {
+			if reason := errorReason(err); reason != "" {
+				fields = append(fields, "reason", reason)
+			}
+			logError("gRPC call failed", append(fields, "duration", time.Since(start).String(), "error", err)...)
+		} else {
+			logInfo(5, "gRPC call succeeded", append(fields, "duration", time.Since(start).String())...)
+		}
+	}()
+
+	logInfo(3, "gRPC call", fields...)
+	return handler(ctx, req)
+}
+
+// requestFields returns the log fields that identify the volume a request is
+// about. Secrets and the full volume context are deliberately left out.
+func requestFields(req interface{}) []interface{} {
+	var fields []interface{}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		var attrib map[string]string
+		if c, ok := req.(interface{ GetVolumeContext() map[string]string }); ok {
+			attrib = c.GetVolumeContext()
+		}
+		fields = append(fields, volumeFields(r.GetVolumeId(), attrib)...)
+	}
+	if r, ok := req.(interface{ GetTargetPath() string }); ok && r.GetTargetPath() != "" {
+		fields = append(fields, "target_path", r.GetTargetPath())
+	}
+	return fields
+}
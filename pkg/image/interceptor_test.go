@@ -0,0 +1,51 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+
+	var id string
+	_, err := unaryInterceptor(context.Background(), &csi.NodePublishVolumeRequest{VolumeId: "vol"}, info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			id = requestID(ctx)
+			return &csi.NodePublishVolumeResponse{}, nil
+		})
+	if err != nil || id == "" {
+		t.Fatalf("expected a request ID and no error, got %q, %v", id, err)
+	}
+
+	_, err = unaryInterceptor(context.Background(), &csi.NodePublishVolumeRequest{}, info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			panic("boom")
+		})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("expected a panic to become Internal, got %v", err)
+	}
+}
+
+func TestRequestFields(t *testing.T) {
+	got := formatFields(requestFields(&csi.NodePublishVolumeRequest{
+		VolumeId:   "vol",
+		TargetPath: "/target",
+		VolumeContext: map[string]string{
+			"image":                            "busybox",
+			"token":                            "secret",
+			"csi.storage.k8s.io/pod.name":      "web",
+			"csi.storage.k8s.io/pod.namespace": "default",
+		},
+		Secrets: map[string]string{"password": "secret"},
+	}))
+	want := ` volume_id="vol" image="busybox" pod="default/web" target_path="/target"`
+	if got != want {
+		t.Fatalf("unexpected fields %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	cachedImages = metricsRegistry.NewGaugeVec("image_populator_cached_images",
+		"Images in the storage root.")
+	workingContainers = metricsRegistry.NewGaugeVec("image_populator_containers",
+		"Buildah containers in the storage root.")
+	storageUsed = metricsRegistry.NewGaugeVec("image_populator_storage_used_bytes",
+		"Bytes used by the storage root.")
+)
+
+// Inventory describes the content of the storage root. Images are passed
+// through as buildah reports them.
+type Inventory struct {
+	Updated      time.Time         `json:"updated"`
+	Images       []json.RawMessage `json:"images"`
+	Containers   int               `json:"containers"`
+	StorageBytes int64             `json:"storageBytes"`
+}
+
+// inventory periodically takes stock of the storage root. Walking the
+// storage root is too expensive to do on every scrape.
+type inventory struct {
+	ns *nodeServer
+	// annotator publishes the cached images on the node object, nil to
+	// not publish them.
+	annotator *cachedImagesAnnotator
+
+	mu      sync.Mutex
+	current Inventory
+}
+
+// run refreshes the inventory every interval until the process exits.
+func (inv *inventory) run(interval time.Duration) {
+	for {
+		if err := inv.refresh(); err != nil {
+			glog.Warningf("cannot take inventory of the storage root: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (inv *inventory) refresh() error {
+	ns := inv.ns
+	output, err := ns.runCmd([]string{"images", "--json"})
+	if err != nil {
+		return fmt.Errorf("cannot list images: %v: %s", err, output)
+	}
+	var images []json.RawMessage
+	if err := json.Unmarshal(output, &images); err != nil {
+		return fmt.Errorf("cannot parse image list: %v", err)
+	}
+
+	output, err = ns.runCmd([]string{"containers", "--json"})
+	if err != nil {
+		return fmt.Errorf("cannot list containers: %v: %s", err, output)
+	}
+	var containers []json.RawMessage
+	if err := json.Unmarshal(output, &containers); err != nil {
+		return fmt.Errorf("cannot parse container list: %v", err)
+	}
+
+	used, err := diskUsage(ns.storageRoot)
+	if err != nil {
+		return err
+	}
+
+	cachedImages.Set(float64(len(images)))
+	workingContainers.Set(float64(len(containers)))
+	storageUsed.Set(float64(used))
+
+	if inv.annotator != nil {
+		if err := inv.annotator.update(images, ns.bandwidth.get()); err != nil {
+			glog.Warningf("cannot annotate node with cached images: %v", err)
+		}
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.current = Inventory{
+		Updated:      time.Now(),
+		Images:       images,
+		Containers:   len(containers),
+		StorageBytes: used,
+	}
+	return nil
+}
+
+func (inv *inventory) get() Inventory {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.current
+}
+
+// diskUsage returns the bytes allocated below root, counting hard linked
+// files once. Mount points below root, like mounted containers, are skipped.
+func diskUsage(root string) (int64, error) {
+	if root == "" {
+		return 0, nil
+	}
+	var rootDev uint64
+	if fi, err := os.Lstat(root); err != nil {
+		return 0, err
+	} else if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		rootDev = uint64(st.Dev)
+	}
+
+	type inode struct{ dev, ino uint64 }
+	seen := map[inode]bool{}
+	var total int64
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Containers come and go while walking.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			total += fi.Size()
+			return nil
+		}
+		if uint64(st.Dev) != rootDev {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if st.Nlink > 1 && !fi.IsDir() {
+			key := inode{uint64(st.Dev), uint64(st.Ino)}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		total += int64(st.Blocks) * 512
+		return nil
+	})
+	return total, err
+}
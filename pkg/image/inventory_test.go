@@ -0,0 +1,30 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), make([]byte, 64<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	single, err := diskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	linked, err := diskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single < 64<<10 || linked != single {
+		t.Fatalf("expected hard links to be counted once, got %d and %d", single, linked)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+// readOnlyControllerMethods may be served by every replica, all other
+// controller calls only by the leader.
+var readOnlyControllerMethods = map[string]bool{
+	"ControllerGetCapabilities":  true,
+	"GetCapacity":                true,
+	"ListVolumes":                true,
+	"ValidateVolumeCapabilities": true,
+	"ListSnapshots":              true,
+}
+
+// leaderInterceptor rejects controller calls that change state on replicas
+// that are not the leader, so that sidecars retry them against the leader.
+func leaderInterceptor(isLeader func() bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if strings.HasPrefix(info.FullMethod, "/csi.v1.Controller/") {
+			method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+			if !readOnlyControllerMethods[method] && !isLeader() {
+				return nil, status.Error(codes.Unavailable, "this replica is not the leader")
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// leaseName derives the name of the leader election lease from the driver
+// name, which may contain dots.
+func leaseName(driverName string) string {
+	return strings.Replace(driverName, ".", "-", -1) + "-controller"
+}
+
+// startLeaderElection starts competing for the controller lease and returns
+// the function telling whether this instance leads.
+func (d *driver) startLeaderElection() (func() bool, error) {
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	le := &kube.LeaderElector{
+		Client:        client,
+		Namespace:     d.opts.LeaderElectionNamespace,
+		Name:          leaseName(d.name),
+		Identity:      d.nodeID,
+		LeaseDuration: d.opts.LeaderElectionLeaseDuration,
+		OnChange: func(leading bool) {
+			logInfo(0, "leadership changed", "leading", leading, "lease", leaseName(d.name))
+		},
+	}
+	go le.Run(make(chan struct{}))
+	return le.IsLeader, nil
+}
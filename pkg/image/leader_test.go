@@ -0,0 +1,29 @@
+package image
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLeaderInterceptor(t *testing.T) {
+	leading := false
+	gate := leaderInterceptor(func() bool { return leading })
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+
+	if _, err := gate(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}, handler); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable on a follower, got %v", err)
+	}
+	for _, method := range []string{"/csi.v1.Controller/GetCapacity", "/csi.v1.Node/NodePublishVolume"} {
+		if _, err := gate(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler); err != nil {
+			t.Fatalf("%s rejected on a follower: %v", method, err)
+		}
+	}
+	leading = true
+	if _, err := gate(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}, handler); err != nil {
+		t.Fatalf("leader rejected: %v", err)
+	}
+}
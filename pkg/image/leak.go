@@ -0,0 +1,180 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var leaksReclaimed = metricsRegistry.NewCounterVec("image_populator_leaks_reclaimed_total",
+	"Containers and volume mounts no tracked volume owned, released by the leak detector.", "kind")
+
+// generatedContainer matches the names containerName generates. The leak
+// detector leaves containers with other names alone: operators create
+// containers in the storage for debugging, and containers of volumes
+// published before names were hashed are named after their volume ID.
+var generatedContainer = regexp.MustCompile(`^csi-[0-9a-f]{32}$`)
+
+// leakDetector periodically deletes the buildah containers with generated
+// names no tracked volume owns and releases the loop devices, composefs
+// images and merged images of volumes that are not tracked anymore. Crashes of the driver in the middle
+// of a publish or unpublish leave them behind, and without the detector
+// they stay until the node reboots. They must be unowned for the grace
+// period before they are released, so operations in progress are not
+// disturbed.
+type leakDetector struct {
+	ns    *nodeServer
+	grace time.Duration
+
+	// unowned maps the containers and volumes found unowned to when they
+	// were first found.
+	unowned map[string]time.Time
+}
+
+// run checks for leaks every interval until the process exits.
+func (d *leakDetector) run(interval time.Duration) {
+	for {
+		if err := d.check(); err != nil {
+			glog.Warningf("cannot check for leaks: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// check releases the containers and volumes that are unowned for longer
+// than the grace period.
+func (d *leakDetector) check() error {
+	ns := d.ns
+	output, err := ns.runCmd([]string{"containers", "--json"})
+	if err != nil {
+		return fmt.Errorf("cannot list containers: %v: %s", err, output)
+	}
+	var containers []struct {
+		Name string `json:"containername"`
+	}
+	if err := json.Unmarshal(output, &containers); err != nil {
+		return fmt.Errorf("cannot parse container list: %v", err)
+	}
+
+	now := time.Now()
+	unowned := map[string]time.Time{}
+	release := func(kind, name string, fn func() error) {
+		key := kind + "/" + name
+		since, ok := d.unowned[key]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < d.grace {
+			unowned[key] = since
+			return
+		}
+		logWarning("releasing leaked "+kind, kind, name, "unowned_since", since.Format(time.RFC3339))
+		if err := fn(); err != nil {
+			logWarning("cannot release leaked "+kind, kind, name, "error", err.Error())
+			unowned[key] = since
+			return
+		}
+		leaksReclaimed.Inc(kind)
+	}
+
+	owned := ns.ownedContainers()
+	for _, c := range containers {
+		if name := c.Name; generatedContainer.MatchString(name) && !owned[name] {
+			release("container", name, func() error { return ns.deleteContainer(name) })
+		}
+	}
+	for _, id := range ns.recordedVolumes() {
+		if !ns.volumes.busy(id) {
+			id := id
+			release("volume", id, func() error { return ns.releaseVolume(id) })
+		}
+	}
+	d.unowned = unowned
+	return nil
+}
+
+// ownedContainers returns the names of the containers of the volumes that
+// are published or being published, including their helper containers.
+// Retained containers outlive their volume on purpose and are not listed.
+func (ns *nodeServer) ownedContainers() map[string]bool {
+	ids := ns.volumes.inFlight()
+	for _, v := range ns.volumes.list() {
+		ids = append(ids, v.ID)
+	}
+	owned := map[string]bool{}
+	for _, id := range ids {
+		for _, key := range []string{id, baseContainer(id), nextContainer(id)} {
+			owned[ns.containerName(key)] = true
+		}
+		layers, _ := ns.recordedLayers(id)
+		for _, layer := range layers {
+			owned[layer] = true
+		}
+	}
+	return owned
+}
+
+// recordedVolumes returns the IDs of the volumes with a loop device,
+// composefs image or merged images recorded in the storage root.
+func (ns *nodeServer) recordedVolumes() []string {
+	if ns.storageRoot == "" {
+		return nil
+	}
+	var ids []string
+	for _, dir := range []struct{ path, suffix string }{
+		{filepath.Join(ns.storageRoot, "merged"), ""},
+		{ns.blockDir(), ".loop"},
+		{filepath.Join(ns.composefsDir(), "images"), ".cfs"},
+	} {
+		entries, _ := ioutil.ReadDir(dir.path)
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), dir.suffix) {
+				ids = append(ids, strings.TrimSuffix(entry.Name(), dir.suffix))
+			}
+		}
+	}
+	return ids
+}
+
+// deleteContainer deletes a container by name, unmounting it.
+func (ns *nodeServer) deleteContainer(name string) error {
+	output, err := ns.runCmd([]string{"rm", name})
+	if err != nil && !isContainerNotFound(output) {
+		return backendError("", "cannot delete container "+name, output, err)
+	}
+	return nil
+}
+
+// releaseVolume releases the loop device, composefs image and merged images
+// of a volume.
+func (ns *nodeServer) releaseVolume(volumeId string) error {
+	if err := ns.unpublishBlock(volumeId, ""); err != nil {
+		return err
+	}
+	if err := ns.removeComposefs(volumeId); err != nil {
+		return err
+	}
+	return ns.unmergeImages(volumeId)
+}
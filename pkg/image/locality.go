@@ -0,0 +1,179 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+// localityCacheTTL is how long the node list is reused. The annotations it
+// is built from only change once per inventory interval.
+const localityCacheTTL = 30 * time.Second
+
+// NodeLocality describes how fast a node can provide an image.
+type NodeLocality struct {
+	Node   string `json:"node"`
+	Cached bool   `json:"cached"`
+	// EstimatedPullSeconds is zero for nodes holding the image and
+	// omitted if the image size or the pull bandwidth of the node is not
+	// known.
+	EstimatedPullSeconds *float64 `json:"estimatedPullSeconds,omitempty"`
+}
+
+// ImageLocality is the answer of the locality endpoint, nodes sorted by how
+// fast they provide the image.
+type ImageLocality struct {
+	Digest string         `json:"digest"`
+	Nodes  []NodeLocality `json:"nodes"`
+}
+
+type nodeCache struct {
+	name      string
+	digests   map[string]bool
+	bandwidth int64
+}
+
+// localityServer serves cache-locality hints for scheduler plugins and
+// extenders. It is built from the annotations the drivers publish on their
+// nodes with --annotate-node.
+type localityServer struct {
+	client     *kube.Client
+	driverName string
+
+	mu      sync.Mutex
+	nodes   []nodeCache
+	fetched time.Time
+}
+
+// serveLocality serves cache-locality hints on addr.
+func serveLocality(addr, driverName string) error {
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return err
+	}
+	l := &localityServer{client: client, driverName: driverName}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/locality", l.handle)
+	glog.Infof("serving cache-locality hints on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			glog.Errorf("locality endpoint failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// listNodes returns the cached images and pull bandwidth of all nodes.
+func (l *localityServer) listNodes() ([]nodeCache, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.nodes != nil && time.Since(l.fetched) < localityCacheTTL {
+		return l.nodes, nil
+	}
+
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name        string            `json:"name"`
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := l.client.Do("GET", "/api/v1/nodes", nil, &list); err != nil {
+		return nil, err
+	}
+	nodes := make([]nodeCache, 0, len(list.Items))
+	for _, item := range list.Items {
+		annotations := item.Metadata.Annotations
+		n := nodeCache{name: item.Metadata.Name, digests: map[string]bool{}}
+		if v := annotations[cachedImagesAnnotation(l.driverName)]; v != "" {
+			for _, digest := range strings.Split(v, ",") {
+				n.digests[digest] = true
+			}
+		}
+		n.bandwidth, _ = strconv.ParseInt(annotations[pullBandwidthAnnotation(l.driverName)], 10, 64)
+		nodes = append(nodes, n)
+	}
+	l.nodes, l.fetched = nodes, time.Now()
+	return nodes, nil
+}
+
+// locality ranks nodes by how fast they provide the image with digest and
+// size in bytes, zero if unknown: nodes holding it first, then by estimated
+// pull time, then nodes without an estimate.
+func locality(nodes []nodeCache, digest string, size int64) ImageLocality {
+	result := ImageLocality{Digest: digest, Nodes: make([]NodeLocality, 0, len(nodes))}
+	for _, n := range nodes {
+		nl := NodeLocality{Node: n.name, Cached: n.digests[digest]}
+		switch {
+		case nl.Cached:
+			zero := 0.0
+			nl.EstimatedPullSeconds = &zero
+		case size > 0 && n.bandwidth > 0:
+			seconds := float64(size) / float64(n.bandwidth)
+			nl.EstimatedPullSeconds = &seconds
+		}
+		result.Nodes = append(result.Nodes, nl)
+	}
+	sort.SliceStable(result.Nodes, func(i, j int) bool {
+		a, b := result.Nodes[i].EstimatedPullSeconds, result.Nodes[j].EstimatedPullSeconds
+		if a == nil || b == nil {
+			return a != nil && b == nil || a == nil && b == nil && result.Nodes[i].Node < result.Nodes[j].Node
+		}
+		if *a != *b {
+			return *a < *b
+		}
+		return result.Nodes[i].Node < result.Nodes[j].Node
+	})
+	return result
+}
+
+// handle answers GET /locality?digest=sha256:...&size=bytes.
+func (l *localityServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	digest := r.URL.Query().Get("digest")
+	if !strings.HasPrefix(digest, "sha256:") {
+		http.Error(w, "digest must be given as sha256:<hex>", http.StatusBadRequest)
+		return
+	}
+	var size int64
+	if v := r.URL.Query().Get("size"); v != "" {
+		var err error
+		if size, err = parseSize(v); err != nil {
+			http.Error(w, "invalid size: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	nodes, err := l.listNodes()
+	if err != nil {
+		http.Error(w, "cannot list nodes: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSONResponse(w, locality(nodes, digest, size))
+}
@@ -0,0 +1,55 @@
+package image
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+func TestLocality(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [
+			{"metadata": {"name": "slow", "annotations": {"image.csi.k8s.io/pull-bandwidth": "1048576"}}},
+			{"metadata": {"name": "unknown"}},
+			{"metadata": {"name": "fast", "annotations": {"image.csi.k8s.io/pull-bandwidth": "104857600"}}},
+			{"metadata": {"name": "cached", "annotations": {"image.csi.k8s.io/cached-images": "sha256:a,sha256:b"}}}
+		]}`))
+	}))
+	defer srv.Close()
+	l := &localityServer{client: kube.NewClient(srv.URL, "", srv.Client()), driverName: "image.csi.k8s.io"}
+
+	for query, expected := range map[string]string{
+		"digest=sha256:a&size=100Mi": "cached:0 fast:1 slow:100 unknown:-",
+		"digest=sha256:a":            "cached:0 fast:- slow:- unknown:-",
+		"digest=sha256:c&size=1Mi":   "fast:0.01 slow:1 cached:- unknown:-",
+	} {
+		rec := httptest.NewRecorder()
+		l.handle(rec, httptest.NewRequest("GET", "/locality?"+query, nil))
+		var result ImageLocality
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: %v: %s", query, err, rec.Body.String())
+		}
+		var ranking []string
+		for _, n := range result.Nodes {
+			estimate := "-"
+			if n.EstimatedPullSeconds != nil {
+				estimate = strconv.FormatFloat(*n.EstimatedPullSeconds, 'g', 3, 64)
+			}
+			ranking = append(ranking, n.Node+":"+estimate)
+		}
+		if strings.Join(ranking, " ") != expected {
+			t.Errorf("%s: expected %s, got %s", query, expected, strings.Join(ranking, " "))
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	l.handle(rec, httptest.NewRequest("GET", "/locality?digest=busybox", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a bad request for a tag, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Structured logging on top of glog. Messages carry key/value pairs; with
+// the text format they are appended to the glog line, with the json format
+// every message is written as one JSON object per line to stderr. glog's
+// -v flag controls the verbosity in both cases.
+
+var (
+	logJSON   bool
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stderr
+)
+
+// SetLogFormat selects "text" (the default) or "json" log output.
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		logJSON = false
+	case "json":
+		logJSON = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// volumeFields returns the log fields identifying a volume and the pod using
+// it.
+func volumeFields(volumeId string, attrib map[string]string) []interface{} {
+	kv := []interface{}{"volume_id", volumeId}
+	if image := attrib["image"]; image != "" {
+		kv = append(kv, "image", image)
+	}
+	if pod := attrib["csi.storage.k8s.io/pod.name"]; pod != "" {
+		kv = append(kv, "pod", attrib["csi.storage.k8s.io/pod.namespace"]+"/"+pod)
+	}
+	return kv
+}
+
+func logInfo(level glog.Level, msg string, kv ...interface{}) {
+	if !glog.V(level) {
+		return
+	}
+	if logJSON {
+		writeJSON("info", msg, kv)
+		return
+	}
+	glog.InfoDepth(1, msg+formatFields(kv))
+}
+
+func logWarning(msg string, kv ...interface{}) {
+	if logJSON {
+		writeJSON("warning", msg, kv)
+		return
+	}
+	glog.WarningDepth(1, msg+formatFields(kv))
+}
+
+func logError(msg string, kv ...interface{}) {
+	if logJSON {
+		writeJSON("error", msg, kv)
+		return
+	}
+	glog.ErrorDepth(1, msg+formatFields(kv))
+}
+
+func formatFields(kv []interface{}) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%q", kv[i], fmt.Sprint(kv[i+1]))
+	}
+	return b.String()
+}
+
+func writeJSON(level, msg string, kv []interface{}) {
+	entry := map[string]interface{}{
+		"ts":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level,
+		"msg":   msg,
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := kv[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[fmt.Sprint(kv[i])] = v
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"error","msg":"cannot encode log entry: %v"}`, err))
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(append(line, '\n'))
+}
+
+// logVerbosity returns glog's current -v level.
+func logVerbosity() string {
+	if f := flag.Lookup("v"); f != nil {
+		return f.Value.String()
+	}
+	return "0"
+}
+
+// setLogVerbosity changes glog's -v level at runtime.
+func setLogVerbosity(level int) error {
+	if level < 0 {
+		return fmt.Errorf("invalid verbosity %d", level)
+	}
+	if err := flag.Set("v", strconv.Itoa(level)); err != nil {
+		return err
+	}
+	logWarning("log verbosity changed", "v", level)
+	return nil
+}
+
+// handleSIGHUP toggles the verbosity between its configured value and
+// debugLevel on every SIGHUP, so that detailed logs can be switched on
+// during an incident without restarting the driver.
+func handleSIGHUP(debugLevel int) {
+	configured, _ := strconv.Atoi(logVerbosity())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		debug := false
+		for range c {
+			debug = !debug
+			level := configured
+			if debug {
+				level = debugLevel
+			}
+			if err := setLogVerbosity(level); err != nil {
+				logError("cannot change log verbosity", "error", err)
+			}
+		}
+	}()
+}
+
+// logLevelHandler reports the verbosity on GET and changes it on PUT or
+// POST with a "v" query parameter.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level, err := strconv.Atoi(r.URL.Query().Get("v"))
+		if err == nil {
+			err = setLogVerbosity(level)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, logVerbosity())
+}
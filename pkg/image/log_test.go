@@ -0,0 +1,51 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestJSONLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logOutput = &buf
+	SetLogFormat("json")
+	defer func() {
+		logOutput = os.Stderr
+		SetLogFormat("text")
+	}()
+
+	logWarning("pull interrupted", "volume_id", "vol", "attempt", 2, "error", errors.New("reset"))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v: %s", err, buf.String())
+	}
+	if entry["level"] != "warning" || entry["msg"] != "pull interrupted" || entry["volume_id"] != "vol" ||
+		entry["attempt"] != float64(2) || entry["error"] != "reset" {
+		t.Fatalf("unexpected log entry %v", entry)
+	}
+	if err := SetLogFormat("xml"); err == nil {
+		t.Fatalf("expected an error for an unknown format")
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	old := logVerbosity()
+	defer flag.Set("v", old)
+
+	rec := httptest.NewRecorder()
+	logLevelHandler(rec, httptest.NewRequest("PUT", "/loglevel?v=4", nil))
+	if rec.Code != http.StatusOK || logVerbosity() != "4" {
+		t.Fatalf("setting verbosity failed: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	logLevelHandler(rec, httptest.NewRequest("PUT", "/loglevel?v=loud", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// volumeImages returns the images of a volume, either the image attribute
+// or the comma separated images attribute. One of them is required.
+func volumeImages(attrib map[string]string) ([]string, error) {
+	list, ok := attrib["images"]
+	if !ok {
+		image := strings.TrimSpace(attrib["image"])
+		if image == "" {
+			return nil, fmt.Errorf("image attribute missing: image or images is required, supported attributes are %s",
+				strings.Join(volumeAttributes, ", "))
+		}
+		return []string{image}, nil
+	}
+	if _, ok := attrib["image"]; ok {
+		return nil, fmt.Errorf("image and images are mutually exclusive")
+	}
+	var images []string
+	for _, image := range strings.Split(list, ",") {
+		image = strings.TrimSpace(image)
+		if image == "" {
+			return nil, fmt.Errorf("invalid images %q: empty image reference", list)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// layerContainer is the container key of the i-th image of a merged volume,
+// see containerName. The first image uses the container of the volume
+// itself.
+func layerContainer(volumeId string, i int) string {
+	return fmt.Sprintf("%s-layer%d", volumeId, i)
+}
+
+func (ns *nodeServer) mergeDir(volumeId string) string {
+	return filepath.Join(ns.storageRoot, "merged", volumeId)
+}
+
+// layerRecord is the file listing the layer containers of a merged volume,
+// so they are found again after a restart.
+func (ns *nodeServer) layerRecord(volumeId string) string {
+	return filepath.Join(ns.mergeDir(volumeId), "layers")
+}
+
+// recordLayers saves the names of the layer containers of a merged volume
+// before they are created, so unsetup also removes the ones of a failed
+// publish.
+func (ns *nodeServer) recordLayers(volumeId string, n int) error {
+	var layers []string
+	for i := 1; i < n; i++ {
+		layers = append(layers, ns.containerName(layerContainer(volumeId, i)))
+	}
+	if err := os.MkdirAll(ns.mergeDir(volumeId), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ns.layerRecord(volumeId), []byte(strings.Join(layers, "\n")+"\n"), 0600)
+}
+
+func (ns *nodeServer) recordedLayers(volumeId string) ([]string, error) {
+	content, err := ioutil.ReadFile(ns.layerRecord(volumeId))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(content)), nil
+}
+
+// setupLayers pulls the images merged on top of the first image of a
+// volume into layer containers.
+func (ns *nodeServer) setupLayers(ctx context.Context, volumeId string, images []string, platform string, priority int) error {
+	if err := ns.recordLayers(volumeId, len(images)+1); err != nil {
+		return err
+	}
+	for i, image := range images {
+		if err := ns.setupVolume(ctx, layerContainer(volumeId, i+1), image, platform, priority, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergedRoot returns the overlay of a merged volume, or "" if the volume
+// has a single image.
+func (ns *nodeServer) mergedRoot(volumeId string) string {
+	if _, err := os.Stat(ns.layerRecord(volumeId)); err != nil {
+		return ""
+	}
+	return filepath.Join(ns.mergeDir(volumeId), "rootfs")
+}
+
+// mergeImages mounts the layer containers of a volume and overlays them on
+// top of rootfs, later images winning. Writes go to an upper directory of
+// the volume, so the containers are not modified.
+func (ns *nodeServer) mergeImages(volumeId, rootfs string) (string, error) {
+	layers, err := ns.recordedLayers(volumeId)
+	if err != nil {
+		return "", err
+	}
+	merged := ns.mergedRoot(volumeId)
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(merged)
+	if err == nil && !notMnt {
+		return merged, nil
+	}
+
+	lower := []string{rootfs}
+	for _, layer := range layers {
+		output, err := ns.runVolumeCmd(volumeId, []string{"mount", layer})
+		if err != nil {
+			return "", fmt.Errorf("cannot mount layer container %s: %v: %s", layer, err, strings.TrimSpace(string(output)))
+		}
+		lower = append([]string{strings.TrimSpace(string(output))}, lower...)
+	}
+
+	upper := filepath.Join(ns.mergeDir(volumeId), "upper")
+	work := filepath.Join(ns.mergeDir(volumeId), "work")
+	for _, dir := range []string{merged, upper, work} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+	}
+	options := []string{"lowerdir=" + strings.Join(lower, ":"), "upperdir=" + upper, "workdir=" + work}
+	if err := mount.New("").Mount("overlay", merged, "overlay", options); err != nil {
+		return "", err
+	}
+	glog.V(4).Infof("merged %d images of volume %s at %s", len(lower), volumeId, merged)
+	return merged, nil
+}
+
+// unmergeImages unmounts the overlay of a merged volume and deletes its
+// layer containers. Volumes with a single image are left alone.
+func (ns *nodeServer) unmergeImages(volumeId string) error {
+	layers, err := ns.recordedLayers(volumeId)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	merged := ns.mergedRoot(volumeId)
+	if notMnt, err := mount.New("").IsLikelyNotMountPoint(merged); err == nil && !notMnt {
+		if err := mount.New("").Unmount(merged); err != nil {
+			return err
+		}
+	}
+	for _, layer := range layers {
+		if output, err := ns.runVolumeCmd(volumeId, []string{"delete", layer}); err != nil {
+			glog.Warningf("cannot delete layer container %s: %v: %s", layer, err, output)
+		}
+	}
+	return os.RemoveAll(ns.mergeDir(volumeId))
+}
@@ -0,0 +1,31 @@
+package image
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVolumeImages(t *testing.T) {
+	for _, test := range []struct {
+		attrib map[string]string
+		want   []string
+	}{
+		{map[string]string{"image": "busybox"}, []string{"busybox"}},
+		{map[string]string{"images": "base:1, plugin-a:2,plugin-b:3"}, []string{"base:1", "plugin-a:2", "plugin-b:3"}},
+		{map[string]string{"images": "base,,plugin"}, nil},
+		{map[string]string{"image": "busybox", "images": "base"}, nil},
+		{map[string]string{}, nil},
+		{map[string]string{"image": " "}, nil},
+	} {
+		got, err := volumeImages(test.attrib)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("expected an error for %v", test.attrib)
+			}
+			continue
+		}
+		if err != nil || strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("volumeImages(%v) = %v, %v, want %v", test.attrib, got, err, test.want)
+		}
+	}
+}
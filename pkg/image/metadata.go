@@ -0,0 +1,182 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// metadataDir is the directory of a volume the image configuration is
+	// written to with the metadata attribute.
+	metadataDir = ".image"
+	// provenanceFile is written to the root of a volume with the
+	// provenance attribute.
+	provenanceFile = ".image-populator.json"
+	// envFileName is written to the root of a volume with the envFile
+	// attribute.
+	envFileName = "image.env"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// boolAttribute returns the value of a boolean volume attribute, false if
+// it is not set.
+func boolAttribute(attrib map[string]string, name string) (bool, error) {
+	v, ok := attrib[name]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", name, v, err)
+	}
+	return b, nil
+}
+
+// imageConfig is the part of the OCI image configuration exposed in volumes.
+type imageConfig struct {
+	Created *time.Time `json:"created,omitempty"`
+	Config  struct {
+		Env        []string          `json:"Env,omitempty"`
+		Entrypoint []string          `json:"Entrypoint,omitempty"`
+		Cmd        []string          `json:"Cmd,omitempty"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+}
+
+// inspectImageConfig returns the OCI configuration of the image a volume's
+// container was created from, both raw and parsed.
+func (ns *nodeServer) inspectImageConfig(volumeId string) ([]byte, *imageConfig, error) {
+	output, err := ns.runCmd([]string{"inspect", "--format", "{{json .OCIv1}}", ns.containerName(volumeId)})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot inspect container of volume %s: %v: %s", volumeId, err, strings.TrimSpace(string(output)))
+	}
+	var config imageConfig
+	if err := json.Unmarshal(output, &config); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse image configuration of volume %s: %v", volumeId, err)
+	}
+	return bytes.TrimSpace(output), &config, nil
+}
+
+// writeImageMetadata writes the image configuration into the .image
+// directory below root: config.json as returned by buildah and one file per
+// label, environment variable, entrypoint, cmd and creation time, so
+// workloads can read single values without parsing JSON.
+func writeImageMetadata(root string, raw []byte, config *imageConfig) error {
+	dir := filepath.Join(root, metadataDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	files := map[string]string{}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, raw, "", "  "); err != nil {
+		return err
+	}
+	files["config.json"] = indented.String() + "\n"
+	for name, value := range config.Config.Labels {
+		files[filepath.Join("labels", metadataFileName(name))] = value
+	}
+	for _, env := range config.Config.Env {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) == 2 {
+			files[filepath.Join("env", metadataFileName(kv[0]))] = kv[1]
+		}
+	}
+	if len(config.Config.Entrypoint) > 0 {
+		files["entrypoint"] = strings.Join(config.Config.Entrypoint, "\n") + "\n"
+	}
+	if len(config.Config.Cmd) > 0 {
+		files["cmd"] = strings.Join(config.Config.Cmd, "\n") + "\n"
+	}
+	if config.Created != nil {
+		files["created"] = config.Created.UTC().Format(time.RFC3339) + "\n"
+	}
+
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEnvFile renders the environment of the image into root in dotenv
+// format. Values are single quoted, so the file can also be sourced by a
+// shell. Variables with names a shell cannot assign are skipped.
+func writeEnvFile(root string, env []string) error {
+	var b strings.Builder
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !envNamePattern.MatchString(kv[0]) {
+			continue
+		}
+		b.WriteString(kv[0] + "='" + strings.Replace(kv[1], "'", `'\''`, -1) + "'\n")
+	}
+	return ioutil.WriteFile(filepath.Join(root, envFileName), []byte(b.String()), 0644)
+}
+
+// provenance records where the content of a volume came from.
+type provenance struct {
+	Image         string    `json:"image"`
+	Digest        string    `json:"digest"`
+	Platform      string    `json:"platform,omitempty"`
+	PulledAt      time.Time `json:"pulledAt"`
+	Driver        string    `json:"driver"`
+	DriverVersion string    `json:"driverVersion"`
+	Node          string    `json:"node"`
+}
+
+// writeProvenance writes the provenance file into root.
+func (ns *nodeServer) writeProvenance(root, image, digest, platform string, pulledAt time.Time) error {
+	data, err := json.MarshalIndent(provenance{
+		Image:         image,
+		Digest:        digest,
+		Platform:      platform,
+		PulledAt:      pulledAt.UTC(),
+		Driver:        ns.driverName,
+		DriverVersion: ns.driverVersion,
+		Node:          ns.nodeID,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(root, provenanceFile), append(data, '\n'), 0644)
+}
+
+// metadataFileName turns a label or variable name into a file name.
+func metadataFileName(name string) string {
+	name = strings.Replace(name, "/", "_", -1)
+	if name == "" || name == "." || name == ".." {
+		return "_" + name
+	}
+	return name
+}
@@ -0,0 +1,30 @@
+package image
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteEnvFile(t *testing.T) {
+	root := t.TempDir()
+	env := []string{"PATH=/usr/bin:/bin", "GREETING=it's a=b", "EMPTY=", "1INVALID=x", "NOVALUE"}
+	if err := writeEnvFile(root, env); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, "image.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "PATH='/usr/bin:/bin'\nGREETING='it'\\''s a=b'\nEMPTY=''\n"
+	if string(content) != want {
+		t.Errorf("unexpected env file %q, want %q", content, want)
+	}
+
+	// The file must restore the values when sourced by a shell.
+	out, err := exec.Command("sh", "-c", ". "+filepath.Join(root, "image.env")+` && printf %s "$GREETING"`).Output()
+	if err != nil || string(out) != "it's a=b" {
+		t.Errorf("sourcing the env file yields %q, %v", out, err)
+	}
+}
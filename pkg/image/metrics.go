@@ -0,0 +1,101 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/status"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/metrics"
+)
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	pullDuration = metricsRegistry.NewHistogramVec("image_populator_pull_duration_seconds",
+		"Duration of image pulls.", metrics.DefBuckets, "registry")
+	pullBytes = metricsRegistry.NewCounterVec("image_populator_pull_bytes_total",
+		"Bytes written to the storage root by image pulls.", "registry")
+	pullsTotal = metricsRegistry.NewCounterVec("image_populator_pulls_total",
+		"Image pulls by result.", "registry", "result")
+	cacheLookups = metricsRegistry.NewCounterVec("image_populator_cache_lookups_total",
+		"Lookups of images in the local storage and the container runtime before pulling.", "result")
+	operationDuration = metricsRegistry.NewHistogramVec("image_populator_operation_duration_seconds",
+		"Duration of node operations.", metrics.DefBuckets, "operation")
+	operationFailures = metricsRegistry.NewCounterVec("image_populator_operation_failures_total",
+		"Failed node operations by gRPC status code.", "operation", "code")
+	inflightOperations = metricsRegistry.NewGaugeVec("image_populator_inflight_operations",
+		"Node operations currently in progress.", "operation")
+	refreshesTotal = metricsRegistry.NewCounterVec("image_populator_refreshes_total",
+		"Refreshes of volume content by result.", "result")
+)
+
+// trackOperation accounts an operation as in flight and returns the function
+// recording its outcome.
+func trackOperation(operation string) func(err error) {
+	start := time.Now()
+	inflightOperations.Inc(operation)
+	return func(err error) {
+		inflightOperations.Dec(operation)
+		operationDuration.Observe(time.Since(start).Seconds(), operation)
+		if err != nil {
+			operationFailures.Inc(operation, status.Code(err).String())
+		}
+	}
+}
+
+// imageRegistry returns the registry host of an image reference, following
+// the docker convention that the first path component is a host only if it
+// contains a dot or a port, or is localhost.
+func imageRegistry(image string) string {
+	i := strings.IndexRune(image, '/')
+	if i < 0 {
+		return "docker.io"
+	}
+	host := image[:i]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return "docker.io"
+}
+
+// serveMetrics serves the metrics endpoint on addr until the process exits.
+func serveMetrics(addr, storageRoot string) {
+	if storageRoot != "" {
+		metricsRegistry.NewGaugeFunc("image_populator_storage_available_bytes",
+			"Bytes available on the storage root.", func() float64 {
+				avail, err := availableBytes(storageRoot)
+				if err != nil {
+					return 0
+				}
+				return float64(avail)
+			})
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsRegistry.Handler())
+	glog.Infof("serving metrics on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			glog.Errorf("metrics endpoint failed: %v", err)
+		}
+	}()
+}
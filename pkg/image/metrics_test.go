@@ -0,0 +1,19 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestImageRegistry(t *testing.T) {
+	for image, want := range map[string]string{
+		"busybox":                         "docker.io",
+		"kfox1111/misc:test":              "docker.io",
+		"quay.io/k8scsi/image:canary":     "quay.io",
+		"localhost/test":                  "localhost",
+		"registry.local:5000/team/app:v1": "registry.local:5000",
+	} {
+		if got := imageRegistry(image); got != want {
+			t.Errorf("imageRegistry(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
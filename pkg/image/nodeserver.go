@@ -17,10 +17,17 @@ limitations under the License.
 package image
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -36,6 +43,13 @@ import (
 
 const (
 	deviceID = "deviceID"
+
+	// Publish modes, selected by the "mode" volume attribute.
+	modeArtifact  = "artifact"
+	modeBind      = "bind"
+	modeComposefs = "composefs"
+	modeDisk      = "disk"
+	modeTmpfs     = "tmpfs"
 )
 
 var (
@@ -47,9 +61,65 @@ type nodeServer struct {
 	Timeout  time.Duration
 	execPath string
 	args     []string
+
+	nodeID        string
+	driverName    string
+	driverVersion string
+	storageRoot   string
+	runRoot       string
+	storageDriver string
+	mountProgram  string
+	podsDir       string
+	reservedSpace int64
+	pullHeadroom  int64
+	pulls         *pullQueue
+	pullFailures  *failedPulls
+	cgroup        *cgroup
+
+	pullRetries    int
+	pullRetryDelay time.Duration
+	tmpfsSize      int64
+	stripXattrs    bool
+	propagation    string
+	exportDir      string
+	exportURLs     []string
+	events         *eventRecorder
+	volumes        *volumeTracker
+	history        *commandHistory
+	debug          *debugVolumes
+	updates        *updateWatcher
+	registries     *registryPolicy
+	bandwidth      *pullBandwidth
+	cri            *criImageService
+	channels       *channelWatcher
+	features       FeatureGates
+	topology       map[string]string
+	maxVolumes     int64
+	maxPullTimeout time.Duration
+
+	storage          storageHealth
+	storageAutoReset bool
+	forceRemount     bool
+	watchdog         *commandWatchdog
+
+	// composefsMu keeps the garbage collection of the composefs object
+	// store from removing objects of images that are being written.
+	composefsMu sync.Mutex
+
+	// platform is the node platform, read once by nodePlatform.
+	platformOnce sync.Once
+	platform     string
+
+	// backend replaces the buildah binary in tests.
+	backend func(args []string) ([]byte, error)
+	// inspectManifest replaces skopeo inspect --raw in tests.
+	inspectManifest func(ref string) ([]byte, error)
 }
 
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, err error) {
+	done := trackOperation("publish")
+	defer func() { done(err) }()
+	defer ns.volumes.begin(req.GetVolumeId())()
 
 	// Check arguments
 	if req.GetVolumeCapability() == nil {
@@ -61,21 +131,258 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if err := checkVolumeID(req.GetVolumeId()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	unlock, err := ns.volumes.lock(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, backendError("", "cannot publish volume "+req.GetVolumeId(), nil, err)
+	}
+	defer unlock()
+	if err := checkVolumeContext(req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := checkTargetPath(ns.podsDir, req.GetTargetPath()); err != nil {
+		logWarning("refusing target path", "volume_id", req.GetVolumeId(), "target_path", req.GetTargetPath(), "error", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	volumePolicy := ns.registries.get().volumePolicy()
+	req.VolumeContext = volumePolicy.withDefaults(req.GetVolumeContext())
+	if _, ok := req.GetVolumeContext()["image"]; ok && req.GetVolumeContext()["imageChannel"] != "" {
+		return nil, status.Error(codes.InvalidArgument, "image and imageChannel are mutually exclusive")
+	}
+	if req.VolumeContext, err = ns.channels.resolve(req.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+	release, owner := ns.volumes.claimTarget(req.GetVolumeId(), req.GetTargetPath())
+	if owner != "" {
+		logWarning("target path used by another volume", "volume_id", req.GetVolumeId(), "target_path", req.GetTargetPath(), "owner", owner)
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("target path %s is used by volume %s", req.GetTargetPath(), owner))
+	}
+	defer release()
 
-	image := req.GetVolumeContext()["image"]
+	images, err := volumeImages(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	image := strings.Join(images, ",")
+	priority, err := pullPriority(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if ctx, err = ns.pullContext(ctx, req.GetVolumeId(), req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mode, err := publishMode(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	isBlock := req.GetVolumeCapability().GetBlock() != nil
+	if isBlock && !ns.features.Enabled(BlockVolumes) {
+		return nil, status.Error(codes.InvalidArgument, "block volumes are disabled by the BlockVolumes feature gate")
+	}
+	if mode == modeComposefs && !ns.features.Enabled(ComposefsMode) {
+		return nil, status.Error(codes.InvalidArgument, "composefs mode is disabled by the ComposefsMode feature gate")
+	}
+	if isBlock && (mode == modeComposefs || mode == modeTmpfs || mode == modeArtifact) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s mode does not support block volumes", mode))
+	}
+	if mode == modeArtifact {
+		if err := checkArtifactAttributes(req.GetVolumeContext()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
 
-	err := ns.setupVolume(req.GetVolumeId(), image)
+	sizeLimit, err := volumeSizeLimit(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := volumePolicy.checkSizeLimit(sizeLimit); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	debug, err := volumeDebug(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(images) > 1 && sizeLimit > 0 && mode != modeTmpfs {
+		return nil, status.Error(codes.InvalidArgument, "sizeLimit is only supported in tmpfs mode for volumes with several images")
+	}
+	subPath, err := volumeSubPath(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if subPath != "" && (isBlock || mode == modeDisk) {
+		return nil, status.Error(codes.InvalidArgument, "path is not supported for block volumes and disk mode")
+	}
+	content, err := volumeContent(req.GetVolumeContext())
 	if err != nil {
 		return nil, err
 	}
+	if content.platform == "" {
+		content.platform = ns.nodePlatform()
+	}
+	if content.filter != nil && mode != modeTmpfs {
+		return nil, status.Error(codes.InvalidArgument, "include and exclude are only supported in tmpfs mode")
+	}
+	if content.base != "" && (mode != modeTmpfs || isBlock || len(images) > 1) {
+		return nil, status.Error(codes.InvalidArgument, "baseImage is only supported in tmpfs mode for volumes of a single image")
+	}
+	if isBlock || mode == modeDisk {
+		switch {
+		case content.metadata:
+			return nil, status.Error(codes.InvalidArgument, "metadata is not supported for block volumes and disk mode")
+		case content.envFile:
+			return nil, status.Error(codes.InvalidArgument, "envFile is not supported for block volumes and disk mode")
+		case content.owner != nil:
+			return nil, status.Error(codes.InvalidArgument, "uid and gid are not supported for block volumes and disk mode")
+		case content.perms != nil:
+			return nil, status.Error(codes.InvalidArgument, "fileMode, dirMode and stripSetuid are not supported for block volumes and disk mode")
+		case content.symlinks != symlinkPreserve:
+			return nil, status.Error(codes.InvalidArgument, "symlinkPolicy is not supported for block volumes and disk mode")
+		case content.provenance:
+			return nil, status.Error(codes.InvalidArgument, "provenance is not supported for block volumes and disk mode")
+		}
+	}
+	updatePolicy, err := volumeUpdatePolicy(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resync, err := volumeResyncInterval(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if resync > 0 && updatePolicy != updateWatch {
+		return nil, status.Error(codes.InvalidArgument, "resyncInterval needs updatePolicy Watch")
+	}
+	if updatePolicy == updateWatch {
+		switch {
+		case !ns.updates.enabled():
+			return nil, status.Error(codes.InvalidArgument, "updatePolicy Watch is disabled on this node")
+		case mode != modeTmpfs || isBlock:
+			return nil, status.Error(codes.InvalidArgument, "updatePolicy Watch is only supported in tmpfs mode")
+		case len(images) > 1:
+			return nil, status.Error(codes.InvalidArgument, "updatePolicy Watch is not supported for volumes with several images")
+		case content.base != "":
+			return nil, status.Error(codes.InvalidArgument, "updatePolicy Watch is not supported with baseImage")
+		}
+	}
+	propagation, err := volumePropagation(req.GetVolumeContext(), ns.propagation)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if isBlock {
+		if _, ok := req.GetVolumeContext()["mountPropagation"]; ok {
+			return nil, status.Error(codes.InvalidArgument, "mountPropagation is not supported for block volumes")
+		}
+		propagation = ""
+	}
+	retain, err := boolAttribute(req.GetVolumeContext(), "retainChanges")
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if retain && (mode != modeBind || isBlock || len(images) > 1) {
+		return nil, status.Error(codes.InvalidArgument, "retainChanges is only supported in bind mode for volumes of a single image")
+	}
+	var retained string
+	if retain {
+		if retained, err = retainedContainer(req.GetVolumeContext(), image); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+	export, err := ns.volumeExport(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if export != nil && isBlock {
+		return nil, status.Error(codes.InvalidArgument, "export is not supported for block volumes")
+	}
+	if export != nil && export.mode == exportDiff && (mode != modeBind || len(images) > 1) {
+		return nil, status.Error(codes.InvalidArgument, "export diff is only supported in bind mode for volumes of a single image")
+	}
+	// Another pod on the node already uses the volume.
+	if v, ok := ns.volumes.get(req.GetVolumeId()); ok && filepath.Clean(v.TargetPath) != filepath.Clean(req.GetTargetPath()) {
+		return ns.publishSharedTarget(v, req)
+	}
+	if debug {
+		ns.debug.enable(req.GetVolumeId())
+	}
+	if mode == modeArtifact {
+		return ns.publishArtifactVolume(ctx, req, image, content.platform, priority, sizeLimit, propagation)
+	}
+
+	// In tmpfs mode the size limit applies to the tmpfs instead of the
+	// container layer.
+	layerLimit := sizeLimit
+	if mode == modeTmpfs {
+		layerLimit = 0
+	}
+
+	// After a restart without saved state, the kubelet publishes volumes
+	// again whose mounts are still in place.
+	if _, published := ns.volumes.get(req.GetVolumeId()); !published && mode == modeBind && !isBlock && len(images) == 1 && !retain {
+		if ns.adoptMount(req, image, subPath) {
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+	}
+
+	reattached := false
+	if retained != "" {
+		if reattached, err = ns.reattachContainer(req.GetVolumeId(), retained); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// A failed publish must not leave containers and mounts behind, unless
+	// they serve an earlier publish of the volume.
+	if _, published := ns.volumes.get(req.GetVolumeId()); !published {
+		defer func() {
+			if err != nil {
+				ns.rollbackPublish(req.GetVolumeId(), retained, reattached)
+			}
+		}()
+	}
+
+	pullStart := time.Now()
+	if !reattached {
+		err = ns.setupVolume(ctx, req.GetVolumeId(), images[0], content.platform, priority, layerLimit)
+	}
+	if err == nil && len(images) > 1 {
+		err = ns.setupLayers(ctx, req.GetVolumeId(), images[1:], content.platform, priority)
+	}
+	if err != nil {
+		if isDiskPressure(err) {
+			ns.events.podEvent(req.GetVolumeContext(), eventTypeWarning, reasonDiskPressure, status.Convert(err).Message())
+		} else {
+			ns.events.podEvent(req.GetVolumeContext(), eventTypeWarning, reasonPullFailed, fmt.Sprintf("Failed to pull image %q: %v", image, status.Convert(err).Message()))
+		}
+		return nil, err
+	}
+	pulledAt := time.Now()
+	digest := ns.containerDigest(req.GetVolumeId())
+	if reattached {
+		ns.events.podEvent(req.GetVolumeContext(), eventTypeNormal, reasonPulled,
+			fmt.Sprintf("Reattached container of image %q (%s) with the changes of a previous pod", image, digest))
+	} else {
+		ns.events.podEvent(req.GetVolumeContext(), eventTypeNormal, reasonPulled,
+			fmt.Sprintf("Pulled image %q (%s) in %v", image, digest, time.Since(pullStart).Round(time.Millisecond)))
+	}
 
 	targetPath := req.GetTargetPath()
+	if err := ns.recoverTarget(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	createdTarget := ""
 	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if err = os.MkdirAll(targetPath, 0750); err != nil {
+			if createdTarget, err = createTarget(targetPath, isBlock); err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
+			defer func() {
+				if err != nil {
+					removeTarget(targetPath, createdTarget)
+				}
+			}()
 			notMnt = true
 		} else {
 			return nil, status.Error(codes.Internal, err.Error())
@@ -83,7 +390,13 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 
 	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+		if !ns.isStaleMount(req.GetVolumeId(), mode, isBlock, subPath, targetPath) {
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+		logWarning("stale mount found, remounting", append(volumeFields(req.GetVolumeId(), req.GetVolumeContext()), "target_path", targetPath)...)
+		if err := mount.New("").Unmount(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
@@ -98,31 +411,277 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	attrib := req.GetVolumeContext()
 	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 
-	glog.V(4).Infof("target %v\nfstype %v\ndevice %v\nreadonly %v\nvolumeId %v\nattributes %v\n mountflags %v\n",
-		targetPath, fsType, deviceId, readOnly, volumeId, attrib, mountFlags)
+	logLevel := glog.Level(4)
+	if debug {
+		logLevel = 0
+	}
+	logInfo(logLevel, "publishing volume", append(volumeFields(volumeId, attrib),
+		"target_path", targetPath, "platform", content.platform, "mode", mode, "block", isBlock, "fstype", fsType, "device", deviceId,
+		"readonly", readOnly, "mount_flags", strings.Join(mountFlags, ","))...)
 
 	options := []string{"bind"}
 	if readOnly {
 		options = append(options, "ro")
 	}
 
-	args := []string{"mount", volumeId}
-	ns.execPath = "/bin/buildah" // FIXME
-	output, err := ns.runCmd(args)
-	// FIXME handle failure.
+	args := []string{"mount", ns.containerName(volumeId)}
+	output, err := ns.runVolumeCmd(volumeId, args)
+	if err != nil {
+		err = backendError("", "cannot mount container "+volumeId, output, err)
+		ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, status.Convert(err).Message())
+		return nil, err
+	}
 	provisionRoot := strings.TrimSpace(string(output[:]))
-	glog.V(4).Infof("container mount point at %s\n", provisionRoot)
+	logInfo(4, "container mounted", "volume_id", volumeId, "path", provisionRoot)
+	if len(images) > 1 {
+		provisionRoot, err = ns.mergeImages(volumeId, provisionRoot)
+		if err != nil {
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	publishRoot, isFile, err := subPathSource(provisionRoot, subPath)
+	if err != nil {
+		ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
 
-	mounter := mount.New("")
-	path := provisionRoot
-	if err := mounter.Mount(path, targetPath, "", options); err != nil {
+	if isFile && updatePolicy == updateWatch {
+		return nil, status.Error(codes.FailedPrecondition, "single file volumes cannot be updated")
+	}
+	if isFile && (content.metadata || content.envFile || content.provenance) {
+		return nil, status.Error(codes.FailedPrecondition, "metadata, envFile and provenance cannot be written into a single file volume")
+	}
+	if content.base != "" {
+		if isFile {
+			return nil, status.Error(codes.FailedPrecondition, "baseImage cannot be compared to a single file volume")
+		}
+		defer ns.releaseBase(volumeId)
+		if content.baseRoot, err = ns.mountBase(ctx, volumeId, content.base, content.platform, subPath, priority); err != nil {
+			ns.events.podEvent(attrib, eventTypeWarning, reasonPullFailed, fmt.Sprintf("Failed to pull base image %q: %v", content.base, status.Convert(err).Message()))
+			return nil, err
+		}
+	}
+	if err := ns.prepareContent(volumeId, image, digest, pulledAt, publishRoot, content, mode == modeTmpfs); err != nil {
+		ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, status.Convert(err).Message())
 		return nil, err
 	}
 
+	switch {
+	case isFile:
+		if err := ns.publishFile(volumeId, mode, publishRoot, targetPath, content.owner, content.perms, readOnly); err != nil {
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	case isBlock:
+		if err := ns.publishBlock(ctx, volumeId, mode, provisionRoot, attrib["diskPath"], targetPath, readOnly); err != nil {
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, status.Convert(err).Message())
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	case mode == modeComposefs:
+		if err := ns.mountComposefs(ctx, volumeId, publishRoot, targetPath); err != nil {
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	case mode == modeTmpfs:
+		if err := ns.publishTmpfs(volumeId, publishRoot, targetPath, sizeLimit, content, readOnly); err != nil {
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	case mode == modeDisk:
+		// Expose the directory holding the disk image, so the disk shows
+		// up as a file below the target path.
+		disk, err := findDiskImage(provisionRoot, attrib["diskPath"])
+		if err != nil {
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		logInfo(4, "exposing disk image", "volume_id", volumeId, "disk", disk)
+		if err := mount.New("").Mount(filepath.Dir(disk), targetPath, "", options); err != nil {
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	default:
+		mounter := mount.New("")
+		if err := mounter.Mount(publishRoot, targetPath, "", options); err != nil {
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+			return nil, err
+		}
+	}
+
+	if propagation != "" {
+		if err := setPropagation(targetPath, propagation); err != nil {
+			mount.New("").Unmount(targetPath)
+			ns.events.podEvent(attrib, eventTypeWarning, reasonMountFailed, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	ns.volumes.add(Volume{
+		ID:            volumeId,
+		Image:         image,
+		Digest:        digest,
+		Mode:          mode,
+		Block:         isBlock,
+		Container:     ns.containerName(volumeId),
+		MountPath:     provisionRoot,
+		SubPath:       subPath,
+		File:          isFile,
+		Retained:      retained,
+		ReadOnly:      readOnly,
+		TargetPath:    targetPath,
+		PublishedAt:   time.Now(),
+		Attributes:    attrib,
+		CreatedTarget: createdTarget,
+	})
+	if updatePolicy == updateWatch {
+		ns.updates.watch(volumeId, resync)
+	}
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+// isStaleMount reports whether an existing mount at targetPath no longer
+// serves the volume, e.g. because the container was recreated after a node
+// crash and the bind mount still points at the old root.
+func (ns *nodeServer) isStaleMount(volumeId, mode string, isBlock bool, subPath, targetPath string) bool {
+	target, err := os.Stat(targetPath)
+	if err != nil {
+		glog.V(4).Infof("target %s is not accessible: %v", targetPath, err)
+		return true
+	}
+	if mode != modeBind || isBlock {
+		return false
+	}
+
+	output, err := ns.runCmd([]string{"mount", ns.containerName(volumeId)})
+	if err != nil {
+		glog.V(4).Infof("cannot mount container of volume %s: %v", volumeId, err)
+		return true
+	}
+	rootfs := strings.TrimSpace(string(output))
+	if merged := ns.mergedRoot(volumeId); merged != "" {
+		rootfs = merged
+	}
+	rootfs, _, err = subPathSource(rootfs, subPath)
+	if err != nil {
+		return true
+	}
+	root, err := os.Stat(rootfs)
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(root, target)
+}
+
+// adoptMount tracks a bind mode volume whose target is still mounted by an
+// earlier run of the driver, if the mount is served by the container of the
+// volume and that was created from the image as it is stored now. It
+// reports whether the volume was adopted, so the publish can return without
+// a buildah from that would conflict with the existing container.
+func (ns *nodeServer) adoptMount(req *csi.NodePublishVolumeRequest, image, subPath string) bool {
+	volumeId := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	if err != nil || notMnt {
+		return false
+	}
+	digest := ns.containerDigest(volumeId)
+	if digest == "unknown digest" || digest != ns.imageDigest(image) {
+		logInfo(4, "existing mount not adopted, container does not match the image", "volume_id", volumeId, "image", image, "container_digest", digest)
+		return false
+	}
+	if ns.isStaleMount(volumeId, modeBind, false, subPath, targetPath) {
+		return false
+	}
+	target, err := os.Stat(targetPath)
+	if err != nil {
+		return false
+	}
+
+	logInfo(2, "adopted existing mount", append(volumeFields(volumeId, req.GetVolumeContext()), "target_path", targetPath, "digest", digest)...)
+	ns.volumes.add(Volume{
+		ID:          volumeId,
+		Image:       image,
+		Digest:      digest,
+		Mode:        modeBind,
+		Container:   ns.containerName(volumeId),
+		SubPath:     subPath,
+		File:        !target.IsDir(),
+		ReadOnly:    req.GetReadonly(),
+		TargetPath:  targetPath,
+		PublishedAt: time.Now(),
+		Attributes:  req.GetVolumeContext(),
+	})
+	return true
+}
+
+// Limits of the requests. Volume IDs name files and directories of the
+// driver, and volume attributes end up in the arguments of commands.
+const (
+	maxVolumeIDLength     = 128
+	maxVolumeContextSize  = 64 << 10
+	maxVolumeContextCount = 64
+)
+
+var volumeIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// checkVolumeID rejects volume IDs that cannot be used as file name.
+func checkVolumeID(id string) error {
+	if len(id) > maxVolumeIDLength {
+		return fmt.Errorf("volume ID is longer than %d bytes", maxVolumeIDLength)
+	}
+	if !volumeIDPattern.MatchString(id) {
+		return fmt.Errorf("volume ID %q contains characters other than letters, digits, '.', '_' and '-' or does not start with a letter or digit", id)
+	}
+	return nil
+}
+
+// checkVolumeContext rejects volume contexts with too many or too large
+// attributes.
+func checkVolumeContext(attrib map[string]string) error {
+	if len(attrib) > maxVolumeContextCount {
+		return fmt.Errorf("volume context has %d attributes, at most %d are supported", len(attrib), maxVolumeContextCount)
+	}
+	size := 0
+	for k, v := range attrib {
+		size += len(k) + len(v)
+		if strings.ContainsRune(v, 0) {
+			return fmt.Errorf("volume attribute %s contains a NUL byte", k)
+		}
+	}
+	if size > maxVolumeContextSize {
+		return fmt.Errorf("volume context has %d bytes, at most %d are supported", size, maxVolumeContextSize)
+	}
+	return nil
+}
+
+// volumeAttributes are the volume attributes the driver supports, besides
+// the pod information the kubelet adds.
+var volumeAttributes = []string{
+	"image", "images", "platform", "mode", "path", "mountPropagation", "include", "exclude", "baseImage",
+	"uid", "gid", "fileMode", "dirMode", "stripSetuid", "symlinkPolicy", "metadata", "envFile", "provenance",
+	"updatePolicy", "resyncInterval", "retainChanges", "export", "exportURL", "diskPath", "sizeLimit",
+	"priority", "pullTimeout", "debug", "imageChannel",
+}
+
+// publishMode returns the publish mode requested by the volume attributes.
+func publishMode(attrib map[string]string) (string, error) {
+	switch mode := attrib["mode"]; mode {
+	case "", modeBind:
+		return modeBind, nil
+	case modeArtifact, modeComposefs, modeDisk, modeTmpfs:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported mode %q", mode)
+	}
+}
+
+func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (_ *csi.NodeUnpublishVolumeResponse, err error) {
+	done := trackOperation("unpublish")
+	defer func() { done(err) }()
 
 	// Check arguments
 	if len(req.GetVolumeId()) == 0 {
@@ -133,77 +692,521 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 	targetPath := req.GetTargetPath()
 	volumeId := req.GetVolumeId()
-
-	// Check that target path is actually still a MountPoint
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := checkTargetPath(ns.podsDir, targetPath); err != nil {
+		logWarning("refusing target path", "volume_id", volumeId, "target_path", targetPath, "error", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	if !notMnt {
-		// Unmounting the image
-		err := mount.New("").Unmount(req.GetTargetPath())
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+	// Volumes published before the volume ID was checked are still
+	// unpublished.
+	if _, published := ns.volumes.get(volumeId); !published {
+		if err := checkVolumeID(volumeId); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
 	}
-	glog.V(4).Infof("image: volume %s/%s has been unmounted.", targetPath, volumeId)
 
-	err = ns.unsetupVolume(volumeId)
-	if err != nil {
+	if err := ns.teardownVolume(ctx, volumeId, targetPath); err != nil {
 		return nil, err
 	}
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) setupVolume(volumeId string, image string) error {
+// teardownVolume unmounts targetPath and releases everything the volume
+// holds on the node. It waits for publishes and refreshes of the volume to
+// finish. ctx only bounds the export of the volume.
+func (ns *nodeServer) teardownVolume(ctx context.Context, volumeId, targetPath string) error {
+	unlock, _ := ns.volumes.lock(context.Background(), volumeId)
+	defer unlock()
+	// Other pods still use a volume published to several targets.
+	if v, ok := ns.volumes.get(volumeId); ok && len(v.SharedTargets) > 0 && targetPath != "" {
+		return ns.unpublishSharedTarget(v, targetPath)
+	}
+	// A refresh waiting for the lock gives up.
+	ns.updates.unwatch(volumeId)
+
+	// A failed export must not keep the pod from terminating.
+	if v, ok := ns.volumes.get(volumeId); ok && targetPath != "" && !v.Exported {
+		if dest, err := ns.exportVolume(ctx, v); err != nil {
+			logWarning("cannot export volume", "volume_id", volumeId, "error", err.Error())
+			ns.events.podEvent(v.Attributes, eventTypeWarning, reasonExportFailed, "Failed to export volume: "+err.Error())
+		} else if dest != "" {
+			logInfo(2, "volume exported", "volume_id", volumeId, "destination", dest)
+			ns.events.podEvent(v.Attributes, eventTypeNormal, reasonExported, "Exported volume to "+dest)
+			v.Exported = true
+			ns.volumes.add(v)
+		}
+	}
+
+	if targetPath != "" {
+		// Check that target path is actually still a MountPoint. A missing
+		// target, e.g. removed by a previous unpublish, by the kubelet or
+		// with the mounts by a node reboot, is as good as unmounted, so
+		// the backend is still cleaned up.
+		notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+		if os.IsNotExist(err) {
+			notMnt, err = true, nil
+		}
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if !notMnt {
+			// Unmounting the image
+			err := mount.New("").Unmount(targetPath)
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+		logInfo(4, "volume unmounted", "volume_id", volumeId, "target_path", targetPath)
+
+		// Directory targets are removed by the kubelet, but the file
+		// target of a single file volume was created by the driver.
+		if v, ok := ns.volumes.get(volumeId); ok && v.File {
+			if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+		if v, ok := ns.volumes.get(volumeId); ok {
+			removeTarget(targetPath, v.CreatedTarget)
+		}
+	}
+
+	if err := ns.unpublishBlock(volumeId, targetPath); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.removeComposefs(volumeId); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.unmergeImages(volumeId); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	v, ok := ns.volumes.get(volumeId)
+	switch {
+	case ok && v.Mode == modeArtifact:
+		// Artifacts are unpacked without a container.
+	case ok && v.Retained != "":
+		if err := ns.retainContainer(volumeId, v.Retained); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	default:
+		if err := ns.unsetupVolume(volumeId); err != nil {
+			return err
+		}
+	}
+	ns.volumes.remove(volumeId)
+	ns.debug.disable(volumeId)
+	return nil
+}
+
+// rollbackPublish releases what a failed publish of a volume set up. A
+// reattached container is retained again, so the changes of the previous pod
+// survive the failure.
+func (ns *nodeServer) rollbackPublish(volumeId, retained string, reattached bool) {
+	logWarning("rolling back failed publish", "volume_id", volumeId)
+	if err := ns.unpublishBlock(volumeId, ""); err != nil {
+		glog.Warningf("cannot detach loop device of volume %s: %v", volumeId, err)
+	}
+	if err := ns.removeComposefs(volumeId); err != nil {
+		glog.Warningf("cannot remove composefs image of volume %s: %v", volumeId, err)
+	}
+	if err := ns.unmergeImages(volumeId); err != nil {
+		glog.Warningf("cannot remove merged images of volume %s: %v", volumeId, err)
+	}
+	if reattached {
+		if err := ns.retainContainer(volumeId, retained); err != nil {
+			glog.Warningf("cannot retain container of volume %s again: %v", volumeId, err)
+		}
+		return
+	}
+	if err := ns.unsetupVolume(volumeId); err != nil {
+		glog.Warningf("cannot delete container of volume %s: %v", volumeId, err)
+	}
+}
+
+// containerName returns the name of the buildah container for key, a volume
+// ID or the key of a helper container derived from it. Volume IDs can be
+// longer than buildah allows or contain characters it rejects, so names are
+// derived from a hash of the key and the driver name, which also keeps
+// instances of the driver apart. Volumes published before keep the name
+// recorded in their state.
+func (ns *nodeServer) containerName(key string) string {
+	if v, ok := ns.volumes.get(key); ok && v.Container != "" {
+		return v.Container
+	}
+	sum := sha256.Sum256([]byte(ns.driverName + "/" + key))
+	return "csi-" + hex.EncodeToString(sum[:16])
+}
 
-	args := []string{"from", "--name", volumeId, "--pull", image}
-	ns.execPath = "/bin/buildah" // FIXME
-	output, err := ns.runCmd(args)
-	// FIXME handle failure.
-	// FIXME handle already deleted.
+func (ns *nodeServer) setupVolume(ctx context.Context, volumeId string, image, platform string, priority int, sizeLimit int64) error {
+	policy := ns.registries.get()
+	if err := policy.check(image); err != nil {
+		return imageError(codes.PermissionDenied, errorReasonPolicyDenied, image, 0, err.Error())
+	}
+	failureKey := failedPullKey(image, platform)
+	if err := ns.pullFailures.get(failureKey); err != nil {
+		logInfo(4, "pull failed recently, not retrying yet", "volume_id", volumeId, "image", image)
+		return err
+	}
+
+	release, err := ns.pulls.acquire(ctx, priority)
+	if err != nil {
+		return backendError(image, "cannot pull "+image, nil, err)
+	}
+	defer func() { release() }()
+
+	requested := image
+	args := []string{"from", "--name", ns.containerName(volumeId), "--pull"}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	if authFile := policy.authFile(image); authFile != "" {
+		args = append(args, "--authfile", authFile)
+	}
+	if signaturePolicy := policy.signaturePolicy(); signaturePolicy != "" {
+		args = append(args, "--signature-policy", signaturePolicy)
+	}
+	image = policy.rewrite(image)
+	args = append(args, image)
+	if sizeLimit > 0 && (ns.storageDriver == storageDriverVFS || ns.mountProgram != "") {
+		return status.Error(codes.FailedPrecondition, "sizeLimit needs the kernel overlay storage driver")
+	}
+	if sizeLimit > 0 {
+		// The overlay driver enforces this with a project quota on the
+		// container layer, which needs an xfs storage root mounted
+		// with pquota.
+		args = append([]string{"--storage-opt", "overlay.size=" + strconv.FormatInt(sizeLimit, 10)}, args...)
+	}
+
+	registry := imageRegistry(image)
+	_, err = ns.runCmd([]string{"inspect", "--type", "image", image})
+	cached := err == nil
+	if !cached {
+		// Images in the storage root are not pulled again.
+		size, err := ns.compressedSize(ctx, requested, platform, policy)
+		if err != nil {
+			logWarning("cannot read compressed image size, only checking for the headroom", "volume_id", volumeId, "image", requested, "error", err)
+		}
+		if err := ns.checkDiskSpace(requested, size); err != nil {
+			return err
+		}
+	}
+	if cached {
+		cacheLookups.Inc("hit")
+	} else if ns.copyFromRuntime(ctx, volumeId, requested, policy) {
+		cached = true
+		cacheLookups.Inc("runtime")
+	} else {
+		cacheLookups.Inc("miss")
+	}
+	availBefore, _ := availableBytes(ns.storageRoot)
+	start := time.Now()
+
+	// A retry starts the pull over, buildah does not keep the layers of a
+	// pull that failed. Interrupted downloads are not resumed: staging the
+	// layers in a directory of the driver would store the image under that
+	// directory instead of its reference, which the cache lookups, digest
+	// checks and garbage collection rely on. The slot is given up while
+	// waiting, so other pulls are not blocked by a flaky registry.
+	var output []byte
+	for attempt := 1; ; attempt++ {
+		output, err = ns.runVolumeCmdContext(ctx, volumeId, args)
+		if err == nil || attempt > ns.pullRetries || !isTransientPullError(output) {
+			break
+		}
+		logWarning("pull interrupted, retrying", "volume_id", volumeId, "image", image, "attempt", attempt,
+			"delay", ns.pullRetryDelay.String(), "output", strings.TrimSpace(string(output)))
+		release()
+		release = func() {}
+		select {
+		case <-time.After(ns.pullRetryDelay):
+		case <-ctx.Done():
+		}
+		if release, err = ns.pulls.acquire(ctx, priority); err != nil {
+			release = func() {}
+			break
+		}
+	}
+	if err != nil && strings.Contains(string(output), "already in use") {
+		output, err = ns.adoptContainer(ctx, volumeId, requested, args)
+	}
+	if err != nil {
+		pullsTotal.Inc(registry, "failure")
+	} else if !cached {
+		pullsTotal.Inc(registry, "success")
+		pullDuration.Observe(time.Since(start).Seconds(), registry)
+		// This is an estimate, concurrent pulls and deletions also
+		// change the available space.
+		if availAfter, err := availableBytes(ns.storageRoot); err == nil && availBefore > availAfter {
+			pullBytes.Add(float64(availBefore-availAfter), registry)
+			ns.bandwidth.observe(availBefore-availAfter, time.Since(start))
+		}
+	}
+	if err != nil {
+		err = backendError(requested, "cannot create container from "+image, output, err)
+		ns.pullFailures.record(failureKey, err)
+		return err
+	}
+	ns.pullFailures.record(failureKey, nil)
 	provisionRoot := strings.TrimSpace(string(output[:]))
 	// FIXME remove
 	glog.V(4).Infof("container mount point at %s\n", provisionRoot)
-	return err
+	return nil
+}
+
+// adoptContainer deals with a container of a previous attempt that already
+// has the name of the volume, e.g. after a publish timed out on the kubelet
+// side. It is reused if it was created from the image as it is stored now,
+// and recreated otherwise, so repeated publishes converge.
+func (ns *nodeServer) adoptContainer(ctx context.Context, volumeId, image string, args []string) ([]byte, error) {
+	digest := ns.containerDigest(volumeId)
+	if digest != "unknown digest" && digest == ns.imageDigest(image) {
+		logInfo(4, "reusing existing container", "volume_id", volumeId, "image", image, "digest", digest)
+		return []byte(ns.containerName(volumeId) + "\n"), nil
+	}
+	logWarning("recreating existing container", "volume_id", volumeId, "image", image, "container_digest", digest)
+	if output, err := ns.runVolumeCmd(volumeId, []string{"delete", ns.containerName(volumeId)}); err != nil {
+		return output, err
+	}
+	return ns.runVolumeCmdContext(ctx, volumeId, args)
+}
+
+// containerDigest returns the digest of the image the volume's container was
+// created from, or "unknown digest" if buildah cannot tell.
+func (ns *nodeServer) containerDigest(volumeId string) string {
+	output, err := ns.runCmd([]string{"inspect", "--format", "{{.FromImageDigest}}", ns.containerName(volumeId)})
+	digest := strings.TrimSpace(string(output))
+	if err != nil || digest == "" {
+		return "unknown digest"
+	}
+	return digest
 }
 
 func (ns *nodeServer) unsetupVolume(volumeId string) error {
 
-	args := []string{"delete", volumeId}
-	ns.execPath = "/bin/buildah" // FIXME
-	output, err := ns.runCmd(args)
-	// FIXME handle failure.
-	// FIXME handle already deleted.
+	args := []string{"delete", ns.containerName(volumeId)}
+	output, err := ns.runVolumeCmd(volumeId, args)
+	// A container removed by node cleanup or by hand is as good as
+	// deleted, failing would make the kubelet retry forever.
+	if err != nil && isContainerNotFound(output) {
+		logInfo(4, "container already deleted", "volume_id", volumeId)
+		return nil
+	}
+	if err != nil {
+		return backendError("", "cannot delete container "+volumeId, output, err)
+	}
 	provisionRoot := strings.TrimSpace(string(output[:]))
 	// FIXME remove
 	glog.V(4).Infof("container mount point at %s\n", provisionRoot)
-	return err
+	return nil
+}
+
+// transientPullErrors are fragments of buildah output that indicate the
+// transfer was interrupted rather than rejected.
+var transientPullErrors = []string{
+	"connection reset by peer",
+	"connection refused",
+	"unexpected EOF",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"broken pipe",
+	"no route to host",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+}
+
+// containerNotFoundErrors are fragments of buildah output for a container
+// that does not exist.
+var containerNotFoundErrors = []string{
+	"container not known",
+	"no such container",
+	"container does not exist",
+}
+
+func isContainerNotFound(output []byte) bool {
+	for _, e := range containerNotFoundErrors {
+		if strings.Contains(string(output), e) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTransientPullError(output []byte) bool {
+	for _, e := range transientPullErrors {
+		if strings.Contains(string(output), e) {
+			return true
+		}
+	}
+	return false
 }
 
 func (ns *nodeServer) runCmd(args []string) ([]byte, error) {
+	return ns.runCmdContext(context.Background(), args)
+}
+
+// runCmdContext runs the backend with args until it exits or ctx is done,
+// e.g. because the kubelet gave up on the call, so no orphaned pull keeps
+// running. It returns the error of ctx in that case.
+func (ns *nodeServer) runCmdContext(ctx context.Context, args []string) ([]byte, error) {
+	output, err := ns.execCmd(ctx, args)
+	if err != nil && isStorageCorruption(output) {
+		ns.reportCorruption(output)
+	}
+	return output, err
+}
+
+// execCmd runs a backend command for runCmdContext.
+func (ns *nodeServer) execCmd(ctx context.Context, args []string) ([]byte, error) {
+	args = append(ns.storageArgs(), args...)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ns.backend != nil {
+		return ns.backend(args)
+	}
 	execPath := ns.execPath
 
 	cmd := exec.Command(execPath, args...)
 
-	timeout := false
-	if ns.Timeout > 0 {
-		timer := time.AfterFunc(ns.Timeout, func() {
-			timeout = true
-			// TODO: cmd.Stop()
-		})
-		defer timer.Stop()
+	timeout := ns.commandTimeout(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	untrack := ns.watchdog.track(args, timeout, cancel)
+	output, timedOut, execErr := runProcessIn(ctx, ns.cgroup, cmd, timeout)
+	if untrack() {
+		return output, TimeoutError
 	}
-
-	output, execErr := cmd.CombinedOutput()
 	if execErr != nil {
-		if timeout {
+		if timedOut {
 			return nil, TimeoutError
 		}
+		if err := ctx.Err(); err != nil {
+			return output, err
+		}
 	}
 	return output, execErr
 }
 
+// killGracePeriod is how long the processes of a stopped command get to exit
+// after SIGTERM before they are killed.
+const killGracePeriod = 5 * time.Second
+
+// runProcess runs cmd in its own process group. It returns the output on
+// stdout if the command succeeds, so warnings on stderr cannot end up in
+// results like mount paths, and stderr followed by stdout if it fails. Both
+// are capped. When the timeout passes or ctx is done first, the whole group
+// is stopped, so no helper of the command keeps downloading, and timedOut
+// tells which of both happened.
+func runProcess(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) (output []byte, timedOut bool, err error) {
+	return runProcessIn(ctx, nil, cmd, timeout)
+}
+
+// runProcessIn is runProcess with cmd moved into cg once it started. If that
+// fails, the command runs in the driver's cgroup.
+func runProcessIn(ctx context.Context, cg *cgroup, cmd *exec.Cmd, timeout time.Duration) (output []byte, timedOut bool, err error) {
+	stdout := &cappedBuffer{max: maxStdout}
+	stderr := &cappedBuffer{max: maxStderr, tail: true}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	startGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, false, err
+	}
+	if err := cg.add(cmd.Process.Pid); err != nil {
+		logWarning("cannot move command into cgroup, it runs unconstrained", "command", cmd.Path, "error", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err = <-done:
+	case <-expired:
+		timedOut = true
+		err = stopGroup(cmd, killGracePeriod, done)
+	case <-ctx.Done():
+		err = stopGroup(cmd, killGracePeriod, done)
+	}
+	if stdout.truncated {
+		logWarning("command output truncated", "command", cmd.Path, "max_bytes", maxStdout)
+	}
+	if err == nil {
+		return stdout.Bytes(), timedOut, nil
+	}
+	return append(stderr.Bytes(), stdout.Bytes()...), timedOut, err
+}
+
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	var caps []*csi.NodeServiceCapability
+	if ns.features.Enabled(VolumeStats) {
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				},
+			},
+		})
+	}
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if !ns.features.Enabled(VolumeStats) {
+		return nil, status.Error(codes.Unimplemented, "volume stats are disabled by the VolumeStats feature gate")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	v, ok := ns.volumes.get(req.GetVolumeId())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not published on this node", req.GetVolumeId())
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(req.GetVolumePath(), &st); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	bsize := int64(st.Bsize)
+	used := int64(st.Blocks-st.Bfree) * bsize
+	if v.Mode == modeBind && !v.Block {
+		// The file system is the storage root's, what the volume uses is
+		// what was written to its container.
+		if diff, err := ns.containerDiffDir(v.ID); err != nil {
+			logInfo(4, "cannot locate container layer, reporting file system usage", "volume_id", v.ID, "error", err)
+		} else if used, err = diskUsage(diff); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(st.Blocks) * bsize,
+				Available: int64(st.Bavail) * bsize,
+				Used:      used,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(st.Files),
+				Available: int64(st.Ffree),
+				Used:      int64(st.Files - st.Ffree),
+			},
+		},
+	}, nil
+}
+
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
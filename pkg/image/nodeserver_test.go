@@ -1,7 +1,216 @@
 package image
 
-import "testing"
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
 
 func TestStub(t *testing.T) {
 
 }
+
+func TestIsTransientPullError(t *testing.T) {
+	for output, want := range map[string]bool{
+		"error reading blob: read tcp 10.0.0.1:443: connection reset by peer": true,
+		"Get https://registry/v2/: net/http: TLS handshake timeout":           true,
+		"manifest unknown: manifest unknown":                                  false,
+		"unauthorized: authentication required":                               false,
+	} {
+		if got := isTransientPullError([]byte(output)); got != want {
+			t.Errorf("isTransientPullError(%q) = %v, want %v", output, got, want)
+		}
+	}
+}
+
+func TestPublishMode(t *testing.T) {
+	for attr, want := range map[string]string{
+		"":          modeBind,
+		"bind":      modeBind,
+		"composefs": modeComposefs,
+	} {
+		got, err := publishMode(map[string]string{"mode": attr})
+		if err != nil || got != want {
+			t.Errorf("publishMode(%q) = %q, %v, want %q", attr, got, err, want)
+		}
+	}
+	if _, err := publishMode(map[string]string{"mode": "bogus"}); err == nil {
+		t.Errorf("expected an error for an unknown mode")
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	fake := newFakeBuildah(t.TempDir())
+	ns := &nodeServer{storageRoot: t.TempDir(), volumes: newVolumeTracker(), backend: fake.run}
+	_, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "vol",
+		VolumePath: t.TempDir(),
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for a volume that is not published, got %v", err)
+	}
+
+	// Bind volumes use what was written to the container layer.
+	if _, err := fake.run([]string{"from", "--name", ns.containerName("vol"), "busybox"}); err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, ns.storageRoot, map[string]string{
+		"overlay-containers/containers.json": `[{"id": "sha256:fake", "layer": "upper"}]`,
+		"overlay/upper/diff/data":            strings.Repeat("x", 64<<10),
+	})
+	ns.volumes.add(Volume{ID: "vol", Mode: modeBind})
+	resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "vol",
+		VolumePath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats failed: %v", err)
+	}
+	if len(resp.GetUsage()) != 2 || resp.GetUsage()[0].GetTotal() <= 0 {
+		t.Fatalf("unexpected usage: %v", resp.GetUsage())
+	}
+	if used := resp.GetUsage()[0].GetUsed(); used < 64<<10 || used > 1<<20 {
+		t.Errorf("expected the usage of the container layer, got %d bytes", used)
+	}
+
+	_, err = ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "vol",
+		VolumePath: "/nonexistent/volume/path",
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for a missing path, got %v", err)
+	}
+}
+
+func TestCheckVolumeRequest(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"csi-3f5a0c1d2e":         true,
+		"pvc-1234.v2_a":          true,
+		"../../etc":              false,
+		"vol/ume":                false,
+		".hidden":                false,
+		"vol ume":                false,
+		strings.Repeat("a", 128): true,
+		strings.Repeat("a", 129): false,
+		"vol\x00ume":             false,
+	} {
+		if err := checkVolumeID(id); (err == nil) != valid {
+			t.Errorf("unexpected result for volume ID %q: %v", id, err)
+		}
+	}
+
+	if err := checkVolumeContext(map[string]string{"image": "busybox"}); err != nil {
+		t.Errorf("unexpected error for a small volume context: %v", err)
+	}
+	if err := checkVolumeContext(map[string]string{"image": strings.Repeat("a", maxVolumeContextSize)}); err == nil {
+		t.Error("expected an error for a huge volume context")
+	}
+	if err := checkVolumeContext(map[string]string{"image": "busybox\x00"}); err == nil {
+		t.Error("expected an error for a NUL byte")
+	}
+	many := map[string]string{}
+	for i := 0; i <= maxVolumeContextCount; i++ {
+		many["attribute"+strconv.Itoa(i)] = "x"
+	}
+	if err := checkVolumeContext(many); err == nil {
+		t.Error("expected an error for too many attributes")
+	}
+}
+
+func TestContainerName(t *testing.T) {
+	ns := &nodeServer{driverName: "image.csi.k8s.io", volumes: newVolumeTracker()}
+	id := "csi-" + strings.Repeat("0123456789abcdef", 16) + "/with:odd chars"
+	name := ns.containerName(id)
+	if name != ns.containerName(id) || !regexp.MustCompile(`^csi-[0-9a-f]{32}$`).MatchString(name) {
+		t.Errorf("unexpected container name %q", name)
+	}
+	other := &nodeServer{driverName: "other.csi.k8s.io", volumes: newVolumeTracker()}
+	if other.containerName(id) == name {
+		t.Error("instances of the driver share container names")
+	}
+	if ns.containerName(baseContainer(id)) == name {
+		t.Error("helper container shares the name of the volume container")
+	}
+
+	ns.volumes.add(Volume{ID: "legacy", Container: "legacy"})
+	if name := ns.containerName("legacy"); name != "legacy" {
+		t.Errorf("published volume lost its container name, got %q", name)
+	}
+}
+
+func TestCachedImageSkipsDiskCheck(t *testing.T) {
+	fake := newFakeBuildah(t.TempDir())
+	fake.images["busybox"] = true
+	ns := &nodeServer{
+		storageRoot:  t.TempDir(),
+		volumes:      newVolumeTracker(),
+		pulls:        newPullQueue(1),
+		pullHeadroom: 1 << 62,
+		backend:      fake.run,
+		inspectManifest: func(ref string) ([]byte, error) {
+			return nil, errors.New("no registry")
+		},
+	}
+	if err := ns.setupVolume(context.Background(), "csi-cached", "busybox", "", 0, 0); err != nil {
+		t.Errorf("cached image refused for lack of pull headroom: %v", err)
+	}
+	if err := ns.setupVolume(context.Background(), "csi-uncached", "example.com/app:v1", "", 0, 0); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted for an image that is pulled, got %v", err)
+	}
+}
+
+func TestPullRetryReleasesSlot(t *testing.T) {
+	fake := newFakeBuildah(t.TempDir())
+	interrupted := make(chan struct{})
+	attempts := 0
+	ns := &nodeServer{
+		storageRoot:    t.TempDir(),
+		volumes:        newVolumeTracker(),
+		pulls:          newPullQueue(1),
+		pullRetries:    1,
+		pullRetryDelay: 200 * time.Millisecond,
+		inspectManifest: func(ref string) ([]byte, error) {
+			return nil, errors.New("no registry")
+		},
+	}
+	ns.backend = func(args []string) ([]byte, error) {
+		for _, arg := range args {
+			if arg != "from" {
+				continue
+			}
+			if attempts++; attempts == 1 {
+				close(interrupted)
+				return []byte("read: connection reset by peer"), errors.New("exit status 125")
+			}
+		}
+		return fake.run(args)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ns.setupVolume(context.Background(), "csi-retry", "busybox", "", 0, 0)
+	}()
+	<-interrupted
+	// The slot is handed on while the pull waits for its retry.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	release, err := ns.pulls.acquire(ctx, 0)
+	if err != nil {
+		t.Fatal("pull queue slot held while waiting for the retry")
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 pull attempts, got %d", attempts)
+	}
+}
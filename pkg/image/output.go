@@ -0,0 +1,72 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+// Limits of the output captured from a backend command. Results on stdout,
+// like listings of images, are small; the last lines of stderr tell what
+// went wrong, while progress output before them is dispensable.
+const (
+	maxStdout = 4 << 20
+	maxStderr = 64 << 10
+)
+
+// truncatedMarker precedes the kept output of a stream that was cut.
+const truncatedMarker = "[truncated]\n"
+
+// cappedBuffer keeps at most max bytes written to it, the first ones or,
+// with tail set, the last ones. Writes never fail, so a chatty command is
+// not killed by a broken pipe.
+type cappedBuffer struct {
+	max       int
+	tail      bool
+	buf       []byte
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if !b.tail {
+		if room := b.max - len(b.buf); len(p) > room {
+			p = p[:room]
+			b.truncated = true
+		}
+		b.buf = append(b.buf, p...)
+		return n, nil
+	}
+	b.buf = append(b.buf, p...)
+	// Drop in large steps, so the buffer is not copied on every write.
+	if len(b.buf) > 2*b.max {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.max:]...)
+		b.truncated = true
+	}
+	return n, nil
+}
+
+// Bytes returns the kept output.
+func (b *cappedBuffer) Bytes() []byte {
+	if !b.tail {
+		return b.buf
+	}
+	kept := b.buf
+	if len(kept) > b.max {
+		kept = kept[len(kept)-b.max:]
+	}
+	if len(kept) < len(b.buf) || b.truncated {
+		return append([]byte(truncatedMarker), kept...)
+	}
+	return kept
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ownerFromPod is the value of the uid and gid attributes taking the id
+// from the security context of the pod.
+const ownerFromPod = "pod"
+
+// owner is the uid and gid volume content is changed to. Negative ids keep
+// the owner of the image.
+type owner struct {
+	uid, gid int
+}
+
+// parseOwnerID parses a uid or gid attribute. It returns -1 if the
+// attribute is not set and whether the id is taken from the pod.
+func parseOwnerID(attrib map[string]string, name string) (int, bool, error) {
+	v, ok := attrib[name]
+	if !ok {
+		return -1, false, nil
+	}
+	if v == ownerFromPod {
+		return -1, true, nil
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil || id < 0 {
+		return -1, false, fmt.Errorf("invalid %s %q: must be a non-negative integer or %q", name, v, ownerFromPod)
+	}
+	return id, false, nil
+}
+
+// volumeOwner returns the owner given by the uid and gid attributes, nil if
+// the content keeps the owners of the image. Ids set to "pod" are read from
+// the pod's security context: runAsUser for the uid, runAsGroup or else
+// fsGroup for the gid.
+func volumeOwner(attrib map[string]string) (*owner, error) {
+	uid, uidFromPod, err := parseOwnerID(attrib, "uid")
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	gid, gidFromPod, err := parseOwnerID(attrib, "gid")
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if uid < 0 && gid < 0 && !uidFromPod && !gidFromPod {
+		return nil, nil
+	}
+	if uidFromPod || gidFromPod {
+		sc, err := podSecurityContext(attrib)
+		if err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if uidFromPod {
+			if sc.RunAsUser == nil {
+				return nil, status.Errorf(codes.FailedPrecondition, "uid is %q, but the pod sets no runAsUser", ownerFromPod)
+			}
+			uid = int(*sc.RunAsUser)
+		}
+		if gidFromPod {
+			switch {
+			case sc.RunAsGroup != nil:
+				gid = int(*sc.RunAsGroup)
+			case sc.FSGroup != nil:
+				gid = int(*sc.FSGroup)
+			default:
+				return nil, status.Errorf(codes.FailedPrecondition, "gid is %q, but the pod sets neither runAsGroup nor fsGroup", ownerFromPod)
+			}
+		}
+	}
+	return &owner{uid: uid, gid: gid}, nil
+}
+
+type podSecurity struct {
+	RunAsUser  *int64 `json:"runAsUser"`
+	RunAsGroup *int64 `json:"runAsGroup"`
+	FSGroup    *int64 `json:"fsGroup"`
+}
+
+// podSecurityContext reads the pod level security context of the pod
+// described by the volume attributes, which needs podInfoOnMount.
+func podSecurityContext(attrib map[string]string) (*podSecurity, error) {
+	namespace := attrib["csi.storage.k8s.io/pod.namespace"]
+	name := attrib["csi.storage.k8s.io/pod.name"]
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("pod information missing, podInfoOnMount must be set on the CSIDriver object")
+	}
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create Kubernetes client: %v", err)
+	}
+	var pod struct {
+		Spec struct {
+			SecurityContext podSecurity `json:"securityContext"`
+		} `json:"spec"`
+	}
+	if err := client.Do("GET", "/api/v1/namespaces/"+namespace+"/pods/"+name, nil, &pod); err != nil {
+		return nil, fmt.Errorf("cannot read pod %s/%s: %v", namespace, name, err)
+	}
+	return &pod.Spec.SecurityContext, nil
+}
+
+// ids returns the ids a file owned by uid and gid gets.
+func (o *owner) ids(uid, gid int) (int, int) {
+	if o == nil {
+		return uid, gid
+	}
+	if o.uid >= 0 {
+		uid = o.uid
+	}
+	if o.gid >= 0 {
+		gid = o.gid
+	}
+	return uid, gid
+}
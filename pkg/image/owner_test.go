@@ -0,0 +1,32 @@
+package image
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeOwner(t *testing.T) {
+	for _, test := range []struct {
+		attrib map[string]string
+		want   *owner
+		code   codes.Code
+	}{
+		{map[string]string{}, nil, codes.OK},
+		{map[string]string{"uid": "1000"}, &owner{uid: 1000, gid: -1}, codes.OK},
+		{map[string]string{"uid": "1000", "gid": "0"}, &owner{uid: 1000, gid: 0}, codes.OK},
+		{map[string]string{"gid": "-1"}, nil, codes.InvalidArgument},
+		{map[string]string{"uid": "nobody"}, nil, codes.InvalidArgument},
+		{map[string]string{"uid": "pod"}, nil, codes.FailedPrecondition},
+	} {
+		got, err := volumeOwner(test.attrib)
+		if status.Code(err) != test.code {
+			t.Errorf("volumeOwner(%v) returned %v, want code %v", test.attrib, err, test.code)
+			continue
+		}
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Errorf("volumeOwner(%v) = %+v, want %+v", test.attrib, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// permissions rewrites the modes of volume content. The permission bits of
+// files and directories are limited to fileMode and dirMode, e.g. 0755
+// removes group and world write access but keeps executables executable.
+type permissions struct {
+	fileMode, dirMode os.FileMode
+	stripSetuid       bool
+}
+
+func parseModeAttribute(attrib map[string]string, name string) (os.FileMode, bool, error) {
+	v, ok := attrib[name]
+	if !ok {
+		return os.ModePerm, false, nil
+	}
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > uint64(os.ModePerm) {
+		return 0, false, fmt.Errorf("invalid %s %q: must be octal permission bits like 0755", name, v)
+	}
+	return os.FileMode(mode), true, nil
+}
+
+// volumePermissions returns the permission rewrites given by the fileMode,
+// dirMode and stripSetuid attributes, nil if modes are kept.
+func volumePermissions(attrib map[string]string) (*permissions, error) {
+	fileMode, fileSet, err := parseModeAttribute(attrib, "fileMode")
+	if err != nil {
+		return nil, err
+	}
+	dirMode, dirSet, err := parseModeAttribute(attrib, "dirMode")
+	if err != nil {
+		return nil, err
+	}
+	stripSetuid, err := boolAttribute(attrib, "stripSetuid")
+	if err != nil {
+		return nil, err
+	}
+	if !fileSet && !dirSet && !stripSetuid {
+		return nil, nil
+	}
+	return &permissions{fileMode: fileMode, dirMode: dirMode, stripSetuid: stripSetuid}, nil
+}
+
+// apply returns the permission and special bits an entry with the given
+// mode gets.
+func (p *permissions) apply(mode os.FileMode) os.FileMode {
+	perm := mode & os.ModePerm
+	special := mode & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if p == nil {
+		return perm | special
+	}
+	switch {
+	case mode.IsDir():
+		perm &= p.dirMode
+	case mode.IsRegular():
+		perm &= p.fileMode
+	}
+	if p.stripSetuid {
+		special &^= os.ModeSetuid | os.ModeSetgid
+	}
+	return perm | special
+}
+
+// rewriteTree changes owner and permissions of all entries below root in
+// place. chown clears the setuid and setgid bits, so the modes are set
+// afterwards. File capabilities are dropped by the kernel.
+func rewriteTree(root string, o *owner, p *permissions) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if o != nil {
+			uid, gid := -1, -1
+			if o.uid >= 0 {
+				uid = o.uid
+			}
+			if o.gid >= 0 {
+				gid = o.gid
+			}
+			if err := os.Lchown(path, uid, gid); err != nil {
+				return err
+			}
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chmod(path, p.apply(info.Mode()))
+	})
+}
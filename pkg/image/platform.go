@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	labelOS   = "kubernetes.io/os"
+	labelArch = "kubernetes.io/arch"
+)
+
+var platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// volumePlatform returns the platform attribute of a volume, "" if it is not
+// set.
+func volumePlatform(attrib map[string]string) (string, error) {
+	platform := attrib["platform"]
+	if platform != "" && !platformPattern.MatchString(platform) {
+		return "", fmt.Errorf("invalid platform %q: must be os/arch or os/arch/variant, e.g. linux/arm64", platform)
+	}
+	return platform, nil
+}
+
+// nodePlatform returns the platform manifest lists are resolved for when a
+// volume does not ask for one. The node labels are read once and win over
+// the platform the driver runs on, e.g. for nodes running emulated.
+func (ns *nodeServer) nodePlatform() string {
+	ns.platformOnce.Do(func() {
+		labels, err := nodeLabels(ns.nodeID)
+		if err != nil {
+			glog.V(4).Infof("cannot read node labels, using the runtime platform: %v", err)
+		}
+		ns.platform = platformFromLabels(labels)
+		glog.Infof("resolving manifest lists for platform %s", ns.platform)
+	})
+	return ns.platform
+}
+
+func platformFromLabels(labels map[string]string) string {
+	os, arch := runtime.GOOS, runtime.GOARCH
+	if v := labels[labelOS]; v != "" {
+		os = v
+	}
+	if v := labels[labelArch]; v != "" {
+		arch = v
+	}
+	return strings.ToLower(os + "/" + arch)
+}
@@ -0,0 +1,26 @@
+package image
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestPlatform(t *testing.T) {
+	for _, platform := range []string{"", "linux/amd64", "linux/arm/v7", "windows/amd64"} {
+		if got, err := volumePlatform(map[string]string{"platform": platform}); err != nil || got != platform {
+			t.Errorf("platform %q: got %q, %v", platform, got, err)
+		}
+	}
+	for _, platform := range []string{"linux", "linux/", "Linux/AMD64", "linux/arm/v7/extra"} {
+		if _, err := volumePlatform(map[string]string{"platform": platform}); err == nil {
+			t.Errorf("platform %q: expected an error", platform)
+		}
+	}
+
+	if got := platformFromLabels(map[string]string{labelOS: "linux", labelArch: "arm64"}); got != "linux/arm64" {
+		t.Errorf("unexpected platform from labels %q", got)
+	}
+	if got := platformFromLabels(nil); got != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Errorf("unexpected runtime platform %q", got)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+const (
+	// crdGroup and crdVersion identify the custom resources of the driver,
+	// see deploy/kubernetes-latest/csi-image-crds.yaml.
+	crdGroup   = "imagepopulator.sapcc.github.com"
+	crdVersion = "v1alpha1"
+
+	conditionReady       = "Ready"
+	reasonPrefetched     = "Prefetched"
+	reasonPrefetchFailed = "PrefetchFailed"
+)
+
+var prefetchPulls = metricsRegistry.NewCounterVec("image_populator_prefetch_pulls_total",
+	"Images pulled for ImagePrefetch objects by result.", "result")
+
+// imagePrefetch is an ImagePrefetch object. Its spec lists images to pull on
+// the nodes matching the node selector, every node reports its progress in
+// its own entry of status.nodes.
+type imagePrefetch struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Images       []string          `json:"images"`
+		NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+		Platform     string            `json:"platform,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Nodes map[string]*prefetchNodeStatus `json:"nodes,omitempty"`
+	} `json:"status"`
+}
+
+type prefetchNodeStatus struct {
+	ObservedGeneration int64               `json:"observedGeneration"`
+	Images             []prefetchedImage   `json:"images"`
+	Conditions         []prefetchCondition `json:"conditions"`
+}
+
+type prefetchedImage struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type prefetchCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+}
+
+// ready reports whether the node has pulled all images of generation.
+func (s *prefetchNodeStatus) ready(generation int64) bool {
+	if s == nil || s.ObservedGeneration != generation {
+		return false
+	}
+	c := s.condition(conditionReady)
+	return c != nil && c.Status == "True"
+}
+
+func (s *prefetchNodeStatus) condition(conditionType string) *prefetchCondition {
+	if s == nil {
+		return nil
+	}
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == conditionType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// prefetcher pulls the images of the ImagePrefetch objects selecting this
+// node, so that volumes using them publish without waiting for a pull.
+type prefetcher struct {
+	ns       *nodeServer
+	client   *kube.Client
+	nodeName string
+}
+
+func newPrefetcher(ns *nodeServer, nodeName string) (*prefetcher, error) {
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return &prefetcher{ns: ns, client: client, nodeName: nodeName}, nil
+}
+
+// run reconciles all ImagePrefetch objects every interval until the process
+// exits.
+func (p *prefetcher) run(interval time.Duration) {
+	for {
+		if err := p.reconcileAll(); err != nil {
+			glog.Warningf("cannot reconcile image prefetches: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (p *prefetcher) reconcileAll() error {
+	var list struct {
+		Items []*imagePrefetch `json:"items"`
+	}
+	if err := p.client.Do("GET", prefetchPath(""), nil, &list); err != nil {
+		return err
+	}
+	labels, err := getNodeLabels(p.client, p.nodeName)
+	if err != nil {
+		return fmt.Errorf("cannot read labels of node %s: %v", p.nodeName, err)
+	}
+	for _, prefetch := range list.Items {
+		if err := p.reconcile(prefetch, labels); err != nil {
+			glog.Warningf("cannot reconcile image prefetch %s: %v", prefetch.Metadata.Name, err)
+		}
+	}
+	return nil
+}
+
+// reconcile pulls the images of prefetch if it selects this node and its
+// current generation has not been pulled yet. Failed pulls are retried on
+// the next run. Nodes no longer selected remove their status entry.
+func (p *prefetcher) reconcile(prefetch *imagePrefetch, labels map[string]string) error {
+	name := prefetch.Metadata.Name
+	current := prefetch.Status.Nodes[p.nodeName]
+	if !selectorMatches(prefetch.Spec.NodeSelector, labels) {
+		if current == nil {
+			return nil
+		}
+		return p.patchStatus(name, nil)
+	}
+	if current.ready(prefetch.Metadata.Generation) {
+		return nil
+	}
+
+	status := &prefetchNodeStatus{ObservedGeneration: prefetch.Metadata.Generation}
+	var failed []string
+	for _, image := range prefetch.Spec.Images {
+		pulled := prefetchedImage{Image: image}
+		err := p.ns.pullImage(context.Background(), "prefetch-"+name, image, prefetch.Spec.Platform, backgroundPriority)
+		if err != nil {
+			prefetchPulls.Inc("failure")
+			pulled.Error = err.Error()
+			failed = append(failed, image)
+		} else {
+			prefetchPulls.Inc("success")
+			pulled.Digest = p.ns.imageDigest(image)
+		}
+		status.Images = append(status.Images, pulled)
+	}
+
+	ready := prefetchCondition{Type: conditionReady, Status: "True", Reason: reasonPrefetched,
+		Message: fmt.Sprintf("Pulled %d images", len(prefetch.Spec.Images))}
+	if len(failed) > 0 {
+		ready.Status, ready.Reason = "False", reasonPrefetchFailed
+		ready.Message = "Cannot pull " + strings.Join(failed, ", ")
+	}
+	ready.LastTransitionTime = time.Now().UTC().Format(time.RFC3339)
+	if previous := current.condition(conditionReady); previous != nil && previous.Status == ready.Status {
+		ready.LastTransitionTime = previous.LastTransitionTime
+	}
+	status.Conditions = []prefetchCondition{ready}
+
+	logInfo(2, "image prefetch reconciled", "prefetch", name, "generation", status.ObservedGeneration, "ready", ready.Status)
+	return p.patchStatus(name, status)
+}
+
+// patchStatus replaces the status entry of this node, or removes it if
+// status is nil. The merge patch leaves the entries of other nodes alone.
+func (p *prefetcher) patchStatus(name string, status *prefetchNodeStatus) error {
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"nodes": map[string]interface{}{p.nodeName: status},
+		},
+	}
+	return p.client.Patch(prefetchPath(name)+"/status", patch, nil)
+}
+
+// prefetchPath is the API path of the ImagePrefetch object name, or of the
+// collection if name is empty.
+func prefetchPath(name string) string {
+	path := "/apis/" + crdGroup + "/" + crdVersion + "/imageprefetches"
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// selectorMatches reports whether labels contain all key-value pairs of
+// selector. An empty selector matches every node.
+func selectorMatches(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package image
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+func TestPrefetch(t *testing.T) {
+	prefetch := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "models", "generation": 1},
+		"spec": map[string]interface{}{
+			"images":       []string{"example.com/a", "example.com/b"},
+			"nodeSelector": map[string]string{"pool": "gpu"},
+		},
+		"status": map[string]interface{}{},
+	}
+	nodeLabels := map[string]string{"pool": "gpu"}
+	var patches []map[string]map[string]map[string]*prefetchNodeStatus
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == prefetchPath(""):
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": []interface{}{prefetch}})
+		case r.URL.Path == "/api/v1/nodes/node-a":
+			json.NewEncoder(w).Encode(map[string]interface{}{"metadata": map[string]interface{}{"labels": nodeLabels}})
+		case r.URL.Path == prefetchPath("models")+"/status" && r.Method == "PATCH":
+			var patch map[string]map[string]map[string]*prefetchNodeStatus
+			json.NewDecoder(r.Body).Decode(&patch)
+			patches = append(patches, patch)
+			prefetch["status"] = patch["status"]
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	d := NewDriver("image.csi.k8s.io", "node-a", "unix:///csi.sock", Options{StorageRoot: t.TempDir()})
+	ns := NewNodeServer(d)
+	fake := newFakeBuildah(t.TempDir())
+	fake.setDigest("example.com/a", "sha256:a")
+	ns.backend = fake.run
+	p := &prefetcher{ns: ns, client: kube.NewClient(srv.URL, "", srv.Client()), nodeName: "node-a"}
+
+	// A failed pull is reported and retried on the next run.
+	fake.setFailing("pull", true)
+	if err := p.reconcileAll(); err != nil {
+		t.Fatal(err)
+	}
+	status := patches[0]["status"]["nodes"]["node-a"]
+	if status.ready(1) || status.Conditions[0].Reason != reasonPrefetchFailed || status.Images[0].Error == "" {
+		t.Fatalf("failed pulls not reported: %+v", status)
+	}
+	fake.setFailing("pull", false)
+	if err := p.reconcileAll(); err != nil {
+		t.Fatal(err)
+	}
+	status = patches[1]["status"]["nodes"]["node-a"]
+	if !status.ready(1) || len(status.Images) != 2 || status.Images[0].Digest != "sha256:a" {
+		t.Fatalf("prefetch not ready after pulling: %+v", status)
+	}
+
+	// A ready generation is not pulled again.
+	if err := p.reconcileAll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("ready prefetch reconciled again: %d patches", len(patches))
+	}
+
+	// Nodes no longer selected remove their entry.
+	nodeLabels["pool"] = "cpu"
+	if err := p.reconcileAll(); err != nil {
+		t.Fatal(err)
+	}
+	if status, ok := patches[2]["status"]["nodes"]["node-a"]; len(patches) != 3 || !ok || status != nil {
+		t.Fatalf("status of unselected node not removed: %v", patches)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// startGroup makes cmd the leader of a new process group, so stopGroup also
+// reaches the helpers it spawns, e.g. gpg or decompressors.
+func startGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// stopGroup sends SIGTERM to the process group of a started cmd, and
+// SIGKILL if it has not exited after grace. done delivers the result of
+// cmd.Wait, which stopGroup returns.
+func stopGroup(cmd *exec.Cmd, grace time.Duration, done <-chan error) error {
+	pgid := -cmd.Process.Pid
+	syscall.Kill(pgid, syscall.SIGTERM)
+	select {
+	case err := <-done:
+		// Helpers may outlive the leader.
+		syscall.Kill(pgid, syscall.SIGKILL)
+		return err
+	case <-time.After(grace):
+	}
+	syscall.Kill(pgid, syscall.SIGKILL)
+	return <-done
+}
@@ -0,0 +1,66 @@
+package image
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestRunProcessTimeout checks that a timeout stops the helpers a command
+// spawned, not only the command itself.
+func TestRunProcessTimeout(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "trap '' TERM; sleep 30 & echo $!; wait")
+	start := time.Now()
+	output, timedOut, err := runProcess(context.Background(), cmd, 100*time.Millisecond)
+	if !timedOut || err == nil {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > killGracePeriod+5*time.Second {
+		t.Errorf("stopping the command took %v", elapsed)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		t.Fatalf("unexpected output %q", output)
+	}
+	// SIGKILL is delivered asynchronously, and the helper may linger as
+	// zombie until it is reaped.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("helper %d still running: %s", pid, stat)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunProcessOutput(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "echo 'WARN[0000] deprecated option' >&2; echo /var/lib/containers/storage/overlay/abc/merged")
+	output, _, err := runProcess(context.Background(), cmd, 0)
+	if err != nil || string(output) != "/var/lib/containers/storage/overlay/abc/merged\n" {
+		t.Errorf("expected only stdout of a successful command, got %q, %v", output, err)
+	}
+
+	cmd = exec.Command("sh", "-c", "echo partial; echo 'Error: image not known' >&2; exit 125")
+	output, _, err = runProcess(context.Background(), cmd, 0)
+	if err == nil || string(output) != "Error: image not known\npartial\n" {
+		t.Errorf("expected stderr and stdout of a failed command, got %q, %v", output, err)
+	}
+
+	cmd = exec.Command("sh", "-c", "yes progress | head -c 1000000 >&2; echo 'Error: last words' >&2; exit 1")
+	output, _, err = runProcess(context.Background(), cmd, 0)
+	if err == nil || len(output) > maxStderr+len(truncatedMarker) {
+		t.Errorf("stderr not capped: %d bytes, %v", len(output), err)
+	}
+	if !strings.HasPrefix(string(output), truncatedMarker) || !strings.HasSuffix(string(output), "Error: last words\n") {
+		t.Errorf("expected the tail of stderr, got %q...%q", output[:20], output[len(output)-20:])
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"os/exec"
+	"time"
+)
+
+func startGroup(cmd *exec.Cmd) {}
+
+// stopGroup kills cmd, helpers it spawned are not reached.
+func stopGroup(cmd *exec.Cmd, grace time.Duration, done <-chan error) error {
+	cmd.Process.Kill()
+	return <-done
+}
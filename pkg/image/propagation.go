@@ -0,0 +1,49 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// volumePropagation returns the mount propagation of a volume, the
+// mountPropagation attribute or else def. Empty keeps the propagation the
+// target mount gets from its parent.
+func volumePropagation(attrib map[string]string, def string) (string, error) {
+	propagation, ok := attrib["mountPropagation"]
+	if !ok {
+		propagation = def
+	}
+	switch propagation {
+	case "", "rprivate", "rslave", "rshared":
+		return propagation, nil
+	default:
+		return "", fmt.Errorf("unsupported mountPropagation %q: must be rprivate, rslave or rshared", propagation)
+	}
+}
+
+// setPropagation changes the propagation of the mount at target and the
+// mounts below it.
+func setPropagation(target, propagation string) error {
+	output, err := exec.Command("mount", "--make-"+propagation, target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot make %s %s: %v: %s", target, propagation, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
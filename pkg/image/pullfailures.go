@@ -0,0 +1,92 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"sync"
+	"time"
+)
+
+var failedPullHits = metricsRegistry.NewCounterVec("image_populator_failed_pull_cache_hits_total",
+	"Publishes failed from the cache of recently failed pulls instead of pulling again.")
+
+// permanentPullFailures are the reasons of pull failures that a retry a few
+// seconds later does not fix.
+var permanentPullFailures = map[string]bool{
+	errorReasonImageNotFound:    true,
+	errorReasonUnauthenticated:  true,
+	errorReasonPermissionDenied: true,
+}
+
+// failedPulls remembers images whose pull just failed permanently, so the
+// retries of the kubelet fail fast instead of asking the registry again
+// every few seconds.
+type failedPulls struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	failures map[string]failedPull
+}
+
+type failedPull struct {
+	err   error
+	until time.Time
+}
+
+func newFailedPulls(ttl time.Duration) *failedPulls {
+	return &failedPulls{ttl: ttl, failures: map[string]failedPull{}}
+}
+
+// failedPullKey identifies a pull by image and platform.
+func failedPullKey(image, platform string) string {
+	return image + "|" + platform
+}
+
+// get returns the error of a recent permanent failure of the pull of key,
+// nil if there is none.
+func (f *failedPulls) get(key string) error {
+	if f == nil || f.ttl <= 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failure, ok := f.failures[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(failure.until) {
+		delete(f.failures, key)
+		return nil
+	}
+	failedPullHits.Inc()
+	return failure.err
+}
+
+// record remembers err for key if it is a permanent failure and forgets
+// earlier failures otherwise.
+func (f *failedPulls) record(key string, err error) {
+	if f == nil || f.ttl <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil || !permanentPullFailures[errorReason(err)] {
+		delete(f.failures, key)
+		return
+	}
+	f.failures[key] = failedPull{err: err, until: time.Now().Add(f.ttl)}
+}
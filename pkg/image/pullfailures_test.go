@@ -0,0 +1,36 @@
+package image
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestFailedPulls(t *testing.T) {
+	f := newFailedPulls(time.Minute)
+	notFound := imageError(codes.NotFound, errorReasonImageNotFound, "missing", 0, "manifest unknown")
+	f.record("missing|", notFound)
+	if err := f.get("missing|"); err != notFound {
+		t.Errorf("expected the cached failure, got %v", err)
+	}
+	if err := f.get("missing|linux/arm64"); err != nil {
+		t.Errorf("failure cached for another platform: %v", err)
+	}
+	f.record("missing|", nil)
+	if err := f.get("missing|"); err != nil {
+		t.Errorf("failure still cached after a successful pull: %v", err)
+	}
+
+	f.record("flaky|", imageError(codes.Unavailable, errorReasonUnavailable, "flaky", 10*time.Second, "connection reset by peer"))
+	if err := f.get("flaky|"); err != nil {
+		t.Errorf("transient failure cached: %v", err)
+	}
+
+	f = newFailedPulls(time.Nanosecond)
+	f.record("missing|", notFound)
+	time.Sleep(time.Millisecond)
+	if err := f.get("missing|"); err != nil {
+		t.Errorf("failure cached beyond its TTL: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// systemPriority is used for volumes of pods in kube-system that do not
+	// set a priority attribute themselves.
+	systemPriority = 1000
+	// backgroundPriority is used for pulls no pod is waiting for, like
+	// prefetches, so that they yield to the pulls of volumes.
+	backgroundPriority = -1000
+)
+
+// pullPriority derives the queue priority of a volume from its attributes.
+// Any pod author can set the priority attribute, so it is clamped between
+// the background and the system priority: only pods in kube-system reach
+// systemPriority, and no volume falls behind the background pulls.
+func pullPriority(attrib map[string]string) (int, error) {
+	max := systemPriority - 1
+	if attrib["csi.storage.k8s.io/pod.namespace"] == "kube-system" {
+		max = systemPriority
+	}
+	p, ok := attrib["priority"]
+	if !ok {
+		if max == systemPriority {
+			return systemPriority, nil
+		}
+		return 0, nil
+	}
+	prio, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, fmt.Errorf("invalid priority %q: %v", p, err)
+	}
+	if prio > max {
+		prio = max
+	}
+	if prio <= backgroundPriority {
+		prio = backgroundPriority + 1
+	}
+	return prio, nil
+}
+
+// volumePullTimeout returns the pullTimeout attribute, zero if it is not
+// set.
+func volumePullTimeout(attrib map[string]string) (time.Duration, error) {
+	v, ok := attrib["pullTimeout"]
+	if !ok {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid pullTimeout %q: must be a positive duration like 10m", v)
+	}
+	return d, nil
+}
+
+// commandTimeoutKey is the context key of the timeout of the backend
+// commands of a volume, see withCommandTimeout.
+type commandTimeoutKey struct{}
+
+// pullContext returns ctx carrying the pullTimeout of a volume, bounded by
+// --max-pull-timeout, as the timeout of its backend commands instead of
+// --command-timeout. Huge images, e.g. of models, get longer deadlines this
+// way without raising the timeout of all volumes.
+func (ns *nodeServer) pullContext(ctx context.Context, volumeId string, attrib map[string]string) (context.Context, error) {
+	timeout, err := volumePullTimeout(attrib)
+	if err != nil || timeout == 0 {
+		return ctx, err
+	}
+	if ns.maxPullTimeout > 0 && timeout > ns.maxPullTimeout {
+		logWarning("pullTimeout out of bounds", "volume_id", volumeId, "pull_timeout", timeout.String(), "max", ns.maxPullTimeout.String())
+		timeout = ns.maxPullTimeout
+	}
+	return context.WithValue(ctx, commandTimeoutKey{}, timeout), nil
+}
+
+// commandTimeout returns the timeout of backend commands run with ctx.
+func (ns *nodeServer) commandTimeout(ctx context.Context) time.Duration {
+	if timeout, ok := ctx.Value(commandTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+	return ns.Timeout
+}
+
+// pullQueue limits the number of concurrent pulls. When all slots are taken,
+// waiters are admitted by descending priority and in arrival order within
+// the same priority.
+type pullQueue struct {
+	mu      sync.Mutex
+	slots   int
+	active  int
+	seq     uint64
+	waiting pullWaiters
+}
+
+type pullWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+func newPullQueue(slots int) *pullQueue {
+	return &pullQueue{slots: slots}
+}
+
+// acquire blocks until a pull slot is available and returns the function
+// releasing it. It gives up with the error of ctx when ctx is done first. A
+// queue without slots never blocks.
+func (q *pullQueue) acquire(ctx context.Context, priority int) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	if q.slots <= 0 || q.active < q.slots && len(q.waiting) == 0 {
+		q.active++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	w := &pullWaiter{priority: priority, seq: q.seq, ready: make(chan struct{})}
+	q.seq++
+	heap.Push(&q.waiting, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return q.release, nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	for i, waiting := range q.waiting {
+		if waiting == w {
+			heap.Remove(&q.waiting, i)
+			q.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	q.mu.Unlock()
+	// The slot was handed over in the meantime, pass it on.
+	q.release()
+	return nil, ctx.Err()
+}
+
+// busy reports whether a pull holds a slot.
+func (q *pullQueue) busy() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active > 0
+}
+
+func (q *pullQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) > 0 {
+		// Hand the slot over directly, active stays the same.
+		w := heap.Pop(&q.waiting).(*pullWaiter)
+		close(w.ready)
+		return
+	}
+	q.active--
+}
+
+type pullWaiters []*pullWaiter
+
+func (p pullWaiters) Len() int { return len(p) }
+
+func (p pullWaiters) Less(i, j int) bool {
+	if p[i].priority != p[j].priority {
+		return p[i].priority > p[j].priority
+	}
+	return p[i].seq < p[j].seq
+}
+
+func (p pullWaiters) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func (p *pullWaiters) Push(x interface{}) { *p = append(*p, x.(*pullWaiter)) }
+
+func (p *pullWaiters) Pop() interface{} {
+	old := *p
+	n := len(old)
+	w := old[n-1]
+	*p = old[:n-1]
+	return w
+}
@@ -0,0 +1,106 @@
+package image
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestPullQueuePriority(t *testing.T) {
+	q := newPullQueue(1)
+	release, _ := q.acquire(context.Background(), 0)
+
+	order := make(chan int, 3)
+	for _, prio := range []int{1, 10, 5} {
+		go func(prio int) {
+			r, _ := q.acquire(context.Background(), prio)
+			order <- prio
+			r()
+		}(prio)
+	}
+	for {
+		q.mu.Lock()
+		n := len(q.waiting)
+		q.mu.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	release()
+
+	for _, want := range []int{10, 5, 1} {
+		if got := <-order; got != want {
+			t.Fatalf("expected priority %d to be admitted, got %d", want, got)
+		}
+	}
+}
+
+func TestPullPriority(t *testing.T) {
+	for _, tc := range []struct {
+		attrib   map[string]string
+		priority int
+	}{
+		{map[string]string{}, 0},
+		{map[string]string{"csi.storage.k8s.io/pod.namespace": "kube-system"}, systemPriority},
+		{map[string]string{"priority": "10"}, 10},
+		{map[string]string{"priority": "1000000"}, systemPriority - 1},
+		{map[string]string{"priority": "1000000", "csi.storage.k8s.io/pod.namespace": "kube-system"}, systemPriority},
+		{map[string]string{"priority": "-5000"}, backgroundPriority + 1},
+	} {
+		if prio, err := pullPriority(tc.attrib); err != nil || prio != tc.priority {
+			t.Errorf("%v: expected priority %d, got %d: %v", tc.attrib, tc.priority, prio, err)
+		}
+	}
+	if _, err := pullPriority(map[string]string{"priority": "high"}); err == nil {
+		t.Error("expected an error for a priority that is no integer")
+	}
+}
+
+func TestPullQueueCancel(t *testing.T) {
+	q := newPullQueue(1)
+	release, _ := q.acquire(context.Background(), 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.acquire(ctx, 0); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to end with the deadline, got %v", err)
+	}
+	if len(q.waiting) != 0 {
+		t.Fatalf("cancelled waiter still queued")
+	}
+	release()
+	if r, err := q.acquire(context.Background(), 0); err != nil || q.active != 1 {
+		t.Fatalf("slot not available after release: %v", err)
+	} else {
+		r()
+	}
+}
+
+func TestPullTimeout(t *testing.T) {
+	ns := &nodeServer{Timeout: 5 * time.Minute, maxPullTimeout: time.Hour}
+	for _, test := range []struct {
+		attrib map[string]string
+		want   time.Duration
+	}{
+		{map[string]string{}, 5 * time.Minute},
+		{map[string]string{"pullTimeout": "30m"}, 30 * time.Minute},
+		{map[string]string{"pullTimeout": "1m"}, time.Minute},
+		{map[string]string{"pullTimeout": "48h"}, time.Hour},
+	} {
+		ctx, err := ns.pullContext(context.Background(), "vol", test.attrib)
+		if err != nil {
+			t.Errorf("pullContext(%v) failed: %v", test.attrib, err)
+			continue
+		}
+		if got := ns.commandTimeout(ctx); got != test.want {
+			t.Errorf("timeout for %v is %v, want %v", test.attrib, got, test.want)
+		}
+	}
+	for _, v := range []string{"15", "-1m", "0s", "forever"} {
+		if _, err := ns.pullContext(context.Background(), "vol", map[string]string{"pullTimeout": v}); err == nil {
+			t.Errorf("expected an error for pullTimeout %q", v)
+		}
+	}
+}
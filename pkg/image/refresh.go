@@ -0,0 +1,233 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// nextContainer is the key of the container a refresh creates from the new
+// image, see containerName. It replaces the container of the volume once the
+// content has been swapped.
+func nextContainer(volumeId string) string {
+	return volumeId + "-next"
+}
+
+// pullImage pulls image again, so its tag resolves to the latest digest in
+// the registry.
+func (ns *nodeServer) pullImage(ctx context.Context, volumeId, image, platform string, priority int) error {
+	policy := ns.registries.get()
+	if err := policy.check(image); err != nil {
+		return imageError(codes.PermissionDenied, errorReasonPolicyDenied, image, 0, err.Error())
+	}
+
+	release, err := ns.pulls.acquire(ctx, priority)
+	if err != nil {
+		return backendError(image, "cannot pull "+image, nil, err)
+	}
+	defer release()
+
+	args := []string{"pull"}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	if authFile := policy.authFile(image); authFile != "" {
+		args = append(args, "--authfile", authFile)
+	}
+	if signaturePolicy := policy.signaturePolicy(); signaturePolicy != "" {
+		args = append(args, "--signature-policy", signaturePolicy)
+	}
+	args = append(args, policy.rewrite(image))
+	if output, err := ns.runVolumeCmdContext(ctx, volumeId, args); err != nil {
+		return backendError(image, "cannot pull "+image, output, err)
+	}
+	return nil
+}
+
+// imageDigest returns the digest of a pulled image, or "unknown digest" if
+// buildah cannot tell.
+func (ns *nodeServer) imageDigest(image string) string {
+	output, err := ns.runCmd([]string{"inspect", "--type", "image", "--format", "{{.FromImageDigest}}", ns.registries.get().rewrite(image)})
+	digest := strings.TrimSpace(string(output))
+	if err != nil || digest == "" {
+		return "unknown digest"
+	}
+	return digest
+}
+
+// refreshVolume pulls the image of a volume published in tmpfs mode again
+// and, if the tag now resolves to another digest, atomically replaces the
+// content with the new image. It returns whether the content changed. If
+// the refresh fails, the volume keeps serving the previous content. The
+// refresh waits for publishes and unpublishes of the volume to finish and
+// gives up when ctx is done.
+func (ns *nodeServer) refreshVolume(ctx context.Context, volumeId string) (bool, error) {
+	changed, err := ns.updateContent(ctx, volumeId)
+	switch {
+	case err != nil:
+		refreshesTotal.Inc("failure")
+		if v, ok := ns.volumes.get(volumeId); ok {
+			ns.events.podEvent(v.Attributes, eventTypeWarning, reasonUpdateFailed,
+				fmt.Sprintf("Failed to update content, keeping %s: %v", v.Digest, err))
+		}
+	case changed:
+		refreshesTotal.Inc("updated")
+	default:
+		refreshesTotal.Inc("unchanged")
+	}
+	return changed, err
+}
+
+func (ns *nodeServer) updateContent(ctx context.Context, volumeId string) (bool, error) {
+	defer ns.volumes.begin(volumeId)()
+	unlock, err := ns.volumes.lock(ctx, volumeId)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	v, ok := ns.volumes.get(volumeId)
+	if !ok {
+		return false, fmt.Errorf("volume %s is not published", volumeId)
+	}
+	if v.Mode != modeTmpfs || v.File {
+		return false, fmt.Errorf("only directories published in tmpfs mode can be refreshed")
+	}
+	// The image of a channel is pinned by digest, a refresh follows the
+	// channel instead.
+	attrib, err := ns.channels.resolve(v.Attributes)
+	if err != nil {
+		return false, err
+	}
+	v.Attributes = attrib
+	images, err := volumeImages(v.Attributes)
+	if err != nil {
+		return false, err
+	}
+	if len(images) > 1 {
+		return false, fmt.Errorf("volumes merged from several images cannot be refreshed")
+	}
+	image := images[0]
+	priority, err := pullPriority(v.Attributes)
+	if err != nil {
+		return false, err
+	}
+	subPath, err := volumeSubPath(v.Attributes)
+	if err != nil {
+		return false, err
+	}
+	content, err := volumeContent(v.Attributes)
+	if err != nil {
+		return false, err
+	}
+	if content.platform == "" {
+		content.platform = ns.nodePlatform()
+	}
+
+	ctx, err = ns.pullContext(ctx, volumeId, v.Attributes)
+	if err != nil {
+		return false, err
+	}
+	if err := ns.pullImage(ctx, volumeId, image, content.platform, priority); err != nil {
+		return false, err
+	}
+	if ns.imageDigest(image) == v.Digest {
+		return false, nil
+	}
+	next := nextContainer(volumeId)
+	// Remove the leftovers of an interrupted refresh.
+	ns.unsetupVolume(next)
+	if err := ns.setupVolume(ctx, next, image, content.platform, priority, 0); err != nil {
+		ns.unsetupVolume(next)
+		return false, err
+	}
+	pulledAt := time.Now()
+	digest := ns.containerDigest(next)
+	if digest == v.Digest {
+		return false, ns.unsetupVolume(next)
+	}
+
+	output, err := ns.runVolumeCmd(volumeId, []string{"mount", ns.containerName(next)})
+	if err != nil {
+		ns.unsetupVolume(next)
+		return false, fmt.Errorf("cannot mount container %s: %v: %s", ns.containerName(next), err, strings.TrimSpace(string(output)))
+	}
+	publishRoot, isFile, err := subPathSource(strings.TrimSpace(string(output)), subPath)
+	if err == nil && isFile {
+		err = fmt.Errorf("path %s of %s is not a directory anymore", subPath, image)
+	}
+	if err == nil {
+		err = ns.prepareContent(next, image, digest, pulledAt, publishRoot, content, true)
+	}
+	if err == nil {
+		err = ns.swapTmpfs(publishRoot, v.TargetPath, digest, content, v.ReadOnly)
+	}
+	ns.runVolumeCmd(volumeId, []string{"umount", ns.containerName(next)})
+	if err != nil {
+		ns.unsetupVolume(next)
+		return false, err
+	}
+
+	// The new content is served from here on, whatever happens to the
+	// containers.
+	logInfo(2, "volume refreshed", "volume_id", volumeId, "image", image, "previous_digest", v.Digest, "digest", digest)
+	ns.events.podEvent(v.Attributes, eventTypeNormal, reasonUpdated,
+		fmt.Sprintf("Updated content to image %q (%s)", image, digest))
+	v.Digest = digest
+	if _, ok := ns.volumes.get(volumeId); !ok {
+		return false, fmt.Errorf("volume %s was unpublished during the refresh", volumeId)
+	}
+	ns.volumes.add(v)
+
+	// The volume keeps its container name, unpublish and restarts rely on
+	// it.
+	if err := ns.unsetupVolume(volumeId); err != nil {
+		glog.Warningf("cannot remove previous container of volume %s: %v", volumeId, err)
+	}
+	if output, err := ns.runVolumeCmd(volumeId, []string{"rename", ns.containerName(next), ns.containerName(volumeId)}); err != nil {
+		glog.Warningf("cannot rename container %s to %s: %v: %s", ns.containerName(next), ns.containerName(volumeId), err, strings.TrimSpace(string(output)))
+	}
+	return true, nil
+}
+
+// swapTmpfs replaces the content of the tmpfs at targetPath with a copy of
+// rootfs of the image with the given digest and updates the update marker,
+// making a read-only tmpfs writable for the time of the copy.
+func (ns *nodeServer) swapTmpfs(rootfs, targetPath, digest string, content *contentOptions, readOnly bool) error {
+	mounter := mount.New("")
+	if readOnly {
+		if err := mounter.Mount("tmpfs", targetPath, "tmpfs", []string{"remount", "rw"}); err != nil {
+			return err
+		}
+		defer func() {
+			if err := mounter.Mount("tmpfs", targetPath, "tmpfs", []string{"remount", "ro"}); err != nil {
+				glog.Errorf("cannot remount %s read-only: %v", targetPath, err)
+			}
+		}()
+	}
+	if err := ns.fillTmpfs(rootfs, targetPath, content); err != nil {
+		return err
+	}
+	return writeUpdateMarker(targetPath, digest, content.owner)
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// configPollInterval is how often the registry config file is checked for
+// changes. ConfigMap volumes are updated by swapping a symlink, which inotify
+// on the file itself would miss, so the content is compared instead.
+const configPollInterval = 10 * time.Second
+
+var configReloads = metricsRegistry.NewCounterVec("image_populator_config_reloads_total",
+	"Reloads of the registry config by result.", "result")
+
+// RegistryConfig restricts and redirects the pulls of the driver. Image
+// references are matched in their normalized form, e.g.
+// docker.io/library/busybox.
+type RegistryConfig struct {
+	// Allow lists the images volumes may use. A trailing "*" matches any
+	// suffix, other patterns match the repository with any tag or digest.
+	// Empty allows all images.
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists images volumes may not use, even if Allow matches them.
+	Deny []string `json:"deny,omitempty"`
+	// Mirrors maps registry hosts to the hosts pulled from instead.
+	Mirrors map[string]string `json:"mirrors,omitempty"`
+	// AuthFiles maps registry hosts to the auth file passed to buildah for
+	// pulls from them.
+	AuthFiles map[string]string `json:"authFiles,omitempty"`
+
+	// volume is the cluster-wide policy applied on top of the config.
+	volume *VolumePolicy
+}
+
+// normalizeImage returns the fully qualified form of an image reference.
+func normalizeImage(image string) string {
+	registry := imageRegistry(image)
+	rest := image
+	if strings.HasPrefix(image, registry+"/") {
+		rest = strings.TrimPrefix(image, registry+"/")
+	}
+	if registry == "docker.io" && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	return registry + "/" + rest
+}
+
+func matchImage(pattern, image string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(image, strings.TrimSuffix(pattern, "*"))
+	}
+	return image == pattern || strings.HasPrefix(image, pattern+":") || strings.HasPrefix(image, pattern+"@")
+}
+
+func matchAnyImage(patterns []string, image string) bool {
+	for _, pattern := range patterns {
+		if matchImage(pattern, image) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if the config or the volume policy does not allow
+// image.
+func (c *RegistryConfig) check(image string) error {
+	if c == nil {
+		return nil
+	}
+	normalized := normalizeImage(image)
+	if matchAnyImage(c.Deny, normalized) || len(c.Allow) > 0 && !matchAnyImage(c.Allow, normalized) {
+		return fmt.Errorf("image %s is not allowed on this node", image)
+	}
+	return c.volume.check(image)
+}
+
+// volumePolicy returns the cluster-wide policy, nil if there is none.
+func (c *RegistryConfig) volumePolicy() *VolumePolicy {
+	if c == nil {
+		return nil
+	}
+	return c.volume
+}
+
+// rewrite returns the reference to pull image from, taking mirrors into
+// account.
+func (c *RegistryConfig) rewrite(image string) string {
+	if c == nil {
+		return image
+	}
+	registry := imageRegistry(image)
+	mirror, ok := c.Mirrors[registry]
+	if !ok {
+		return image
+	}
+	return mirror + strings.TrimPrefix(normalizeImage(image), registry)
+}
+
+// authFile returns the auth file for pulls of image, if any.
+func (c *RegistryConfig) authFile(image string) string {
+	if c == nil {
+		return ""
+	}
+	return c.AuthFiles[imageRegistry(image)]
+}
+
+// signaturePolicy returns the signature policy file pulls are verified
+// against, if any.
+func (c *RegistryConfig) signaturePolicy() string {
+	if c == nil || c.volume == nil {
+		return ""
+	}
+	return c.volume.signaturePolicyFile
+}
+
+// registryPolicy holds the current registry config and reloads it when its
+// file changes.
+type registryPolicy struct {
+	path string
+
+	mu      sync.RWMutex
+	config  *RegistryConfig
+	content []byte
+	volume  *VolumePolicy
+}
+
+// newRegistryPolicy loads the registry config at path. An empty path yields
+// a policy allowing everything.
+func newRegistryPolicy(path string) (*registryPolicy, error) {
+	p := &registryPolicy{path: path}
+	if path == "" {
+		return p, nil
+	}
+	if _, err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *registryPolicy) get() *RegistryConfig {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config
+}
+
+// reload reads the config file and applies it if it changed. An invalid
+// config is rejected and the previous one stays in effect.
+func (p *registryPolicy) reload() (bool, error) {
+	content, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return false, err
+	}
+	p.mu.RLock()
+	unchanged := p.content != nil && bytes.Equal(content, p.content)
+	p.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	config := &RegistryConfig{}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return false, fmt.Errorf("invalid registry config %s: %v", p.path, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	config.volume = p.volume
+	p.config = config
+	p.content = content
+	return true, nil
+}
+
+// setVolumePolicy applies v on top of the registry config, nil removes the
+// volume policy.
+func (p *registryPolicy) setVolumePolicy(v *VolumePolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	config := &RegistryConfig{}
+	if p.config != nil {
+		*config = *p.config
+	}
+	config.volume = v
+	p.config = config
+	p.volume = v
+}
+
+// watch polls the config file until the process exits.
+func (p *registryPolicy) watch() {
+	if p.path == "" {
+		return
+	}
+	for {
+		time.Sleep(configPollInterval)
+		changed, err := p.reload()
+		switch {
+		case err != nil:
+			configReloads.Inc("failure")
+			glog.Errorf("cannot reload registry config, keeping the previous one: %v", err)
+		case changed:
+			configReloads.Inc("success")
+			config := p.get()
+			logInfo(0, "registry config reloaded", "path", p.path, "allow", len(config.Allow), "deny", len(config.Deny),
+				"mirrors", len(config.Mirrors), "auth_files", len(config.AuthFiles))
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package image
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistryConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "registries.json")
+	if err := ioutil.WriteFile(path, []byte(`{"allow": ["docker.io/library/busybox", "quay.io/org/*"], "mirrors": {"docker.io": "mirror.local:5000"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newRegistryPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := p.get()
+	for image, allowed := range map[string]bool{
+		"busybox:1.31":         true,
+		"busybox2":             false,
+		"quay.io/org/app@sha1": true,
+		"quay.io/other/app":    false,
+	} {
+		if err := c.check(image); (err == nil) != allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", image, allowed, err)
+		}
+	}
+	if img := c.rewrite("busybox:1.31"); img != "mirror.local:5000/library/busybox:1.31" {
+		t.Errorf("unexpected mirror rewrite %s", img)
+	}
+	if img := c.rewrite("quay.io/org/app"); img != "quay.io/org/app" {
+		t.Errorf("unexpected rewrite %s", img)
+	}
+
+	// An invalid config is rejected and the previous one kept.
+	if err := ioutil.WriteFile(path, []byte(`{"allow": "everything"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.reload(); err == nil || p.get() != c {
+		t.Fatalf("invalid config applied: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := p.reload(); err != nil || !changed || p.get().check("anything") != nil {
+		t.Fatalf("reload failed: %v %v", changed, err)
+	}
+}
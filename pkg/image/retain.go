@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// retainedContainer is the name the container of a volume with the
+// retainChanges attribute is kept under after unpublish. It is derived from
+// the pod and the image, so the next pod of the same name on the node, e.g.
+// of a StatefulSet, finds the container again.
+func retainedContainer(attrib map[string]string, image string) (string, error) {
+	namespace := attrib["csi.storage.k8s.io/pod.namespace"]
+	name := attrib["csi.storage.k8s.io/pod.name"]
+	if namespace == "" || name == "" {
+		return "", fmt.Errorf("retainChanges needs pod information, set podInfoOnMount in the CSIDriver object")
+	}
+	sum := sha256.Sum256([]byte(namespace + "/" + name + "/" + image))
+	return "retained-" + hex.EncodeToString(sum[:8]), nil
+}
+
+// reattachContainer makes a retained container the container of a volume
+// and reports whether there was one.
+func (ns *nodeServer) reattachContainer(volumeId, retained string) (bool, error) {
+	if _, err := ns.runCmd([]string{"inspect", retained}); err != nil {
+		return false, nil
+	}
+	output, err := ns.runVolumeCmd(volumeId, []string{"rename", retained, ns.containerName(volumeId)})
+	if err != nil {
+		return false, fmt.Errorf("cannot reattach container %s: %v: %s", retained, err, strings.TrimSpace(string(output)))
+	}
+	logInfo(2, "reattached retained container", "volume_id", volumeId, "container", retained)
+	return true, nil
+}
+
+// retainContainer keeps the container of a volume with its changes under
+// the retained name instead of deleting it.
+func (ns *nodeServer) retainContainer(volumeId, retained string) error {
+	container := ns.containerName(volumeId)
+	if output, err := ns.runVolumeCmd(volumeId, []string{"umount", container}); err != nil {
+		glog.Warningf("cannot unmount container %s: %v: %s", container, err, output)
+	}
+	output, err := ns.runVolumeCmd(volumeId, []string{"rename", container, retained})
+	if err != nil {
+		return fmt.Errorf("cannot retain container %s as %s: %v: %s", container, retained, err, strings.TrimSpace(string(output)))
+	}
+	logInfo(2, "retained container", "volume_id", volumeId, "container", retained)
+	return nil
+}
@@ -0,0 +1,972 @@
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// TestSanity runs the parts of the CSI conformance checks of
+// kubernetes-csi/csi-test that apply to this driver against a server backed
+// by a fake buildah. "make sanity" runs it together with csi-sanity itself.
+func TestSanity(t *testing.T) {
+	dir := t.TempDir()
+
+	// Like the container storage on a node, the fake containers live on
+	// another filesystem than the target paths, otherwise bind mounts are
+	// not detected as mount points.
+	if os.Geteuid() == 0 {
+		containers := filepath.Join(dir, "containers")
+		if err := os.Mkdir(containers, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := mount.New("").Mount("tmpfs", containers, "tmpfs", nil); err != nil {
+			t.Fatal(err)
+		}
+		defer mount.New("").Unmount(containers)
+	}
+
+	endpoint := "unix://" + filepath.Join(dir, "csi.sock")
+	d := NewDriver("image.csi.k8s.io", "sanity-node", endpoint, Options{StorageRoot: filepath.Join(dir, "storage")})
+	ns := NewNodeServer(d)
+	fake := newFakeBuildah(dir)
+	ns.backend = fake.run
+
+	s := NewNonBlockingGRPCServer()
+	s.Start(endpoint, NewIdentityServer(d), NewControllerServer(d), ns)
+	defer s.ForceStop()
+
+	conn, err := grpc.Dial(filepath.Join(dir, "csi.sock"), grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(5*time.Second),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	identity := csi.NewIdentityClient(conn)
+	node := csi.NewNodeClient(conn)
+	controller := csi.NewControllerClient(conn)
+
+	t.Run("GetPluginInfo", func(t *testing.T) {
+		info, err := identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+		if err != nil || info.GetName() != "image.csi.k8s.io" || info.GetVendorVersion() == "" {
+			t.Fatalf("unexpected plugin info %v: %v", info, err)
+		}
+	})
+
+	t.Run("NodeGetInfo", func(t *testing.T) {
+		info, err := node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+		if err != nil || info.GetNodeId() != "sanity-node" {
+			t.Fatalf("unexpected node info %v: %v", info, err)
+		}
+	})
+
+	t.Run("ControllerGetCapabilities", func(t *testing.T) {
+		if _, err := controller.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	target := filepath.Join(dir, "target")
+
+	t.Run("NodePublishVolumeMissingArguments", func(t *testing.T) {
+		for _, req := range []*csi.NodePublishVolumeRequest{
+			{TargetPath: target, VolumeCapability: capability},
+			{VolumeId: "vol", VolumeCapability: capability},
+			{VolumeId: "vol", TargetPath: target},
+		} {
+			if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("expected InvalidArgument for %v, got %v", req, err)
+			}
+		}
+	})
+
+	t.Run("NodeUnpublishVolumeMissingArguments", func(t *testing.T) {
+		for _, req := range []*csi.NodeUnpublishVolumeRequest{{TargetPath: target}, {VolumeId: "vol"}} {
+			if _, err := node.NodeUnpublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("expected InvalidArgument for %v, got %v", req, err)
+			}
+		}
+	})
+
+	t.Run("NodePublishVolume", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(target, "hello")); err != nil || string(content) != "busybox" {
+			t.Fatalf("unexpected volume content %q: %v", content, err)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.containers) != 0 {
+			t.Errorf("containers left behind after unpublish: %v", fake.containers)
+		}
+	})
+
+	t.Run("NodePublishVolumeSubPath", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-path",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox", "path": "/etc/app"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(target, "config")); err != nil || string(content) != "busybox" {
+			t.Errorf("unexpected volume content %q: %v", content, err)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-path", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("NodePublishVolumeFile", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		for _, mode := range []string{modeBind, modeTmpfs} {
+			fileTarget := filepath.Join(dir, "file-"+mode)
+			req := &csi.NodePublishVolumeRequest{
+				VolumeId:         "csi-sanity-file",
+				TargetPath:       fileTarget,
+				VolumeCapability: capability,
+				Readonly:         true,
+				VolumeContext:    map[string]string{"image": "busybox", "path": "/etc/app/config", "mode": mode},
+			}
+			if _, err := node.NodePublishVolume(ctx, req); err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			if content, err := ioutil.ReadFile(fileTarget); err != nil || string(content) != "busybox" {
+				t.Errorf("%s: unexpected file content %q: %v", mode, content, err)
+			}
+			if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-file", TargetPath: fileTarget}); err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			if _, err := os.Lstat(fileTarget); !os.IsNotExist(err) {
+				t.Errorf("%s: file target not removed: %v", mode, err)
+			}
+		}
+	})
+
+	t.Run("NodePublishVolumeImages", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		for _, mode := range []string{modeBind, modeTmpfs} {
+			req := &csi.NodePublishVolumeRequest{
+				VolumeId:         "csi-sanity-images",
+				TargetPath:       target,
+				VolumeCapability: capability,
+				VolumeContext:    map[string]string{"images": "busybox, alpine", "mode": mode},
+			}
+			if _, err := node.NodePublishVolume(ctx, req); err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			if content, err := ioutil.ReadFile(filepath.Join(target, "hello")); err != nil || string(content) != "alpine" {
+				t.Errorf("%s: unexpected volume content %q: %v", mode, content, err)
+			}
+			for _, name := range []string{"from-busybox", "from-alpine"} {
+				if _, err := os.Stat(filepath.Join(target, name)); err != nil {
+					t.Errorf("%s: %v", mode, err)
+				}
+			}
+			if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-images", TargetPath: target}); err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			if len(fake.containers) != 0 {
+				t.Errorf("%s: containers left behind after unpublish: %v", mode, fake.containers)
+			}
+		}
+	})
+
+	t.Run("NodePublishVolumeMetadata", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-metadata",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox", "metadata": "true"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]string{
+			"labels/org.opencontainers.image.version": "1.2",
+			"env/VERSION": "1.2",
+			"entrypoint":  "/bin/app\n",
+			"cmd":         "--serve\n",
+			"created":     "2019-06-01T12:00:00Z\n",
+		} {
+			if content, err := ioutil.ReadFile(filepath.Join(target, ".image", name)); err != nil || string(content) != want {
+				t.Errorf("unexpected content of %s: %q, %v", name, content, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(target, ".image", "config.json")); err != nil {
+			t.Error(err)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-metadata", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("NodePublishVolumeProvenance", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-provenance",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox", "provenance": "true", "mode": modeTmpfs},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(target, ".image-populator.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p provenance
+		if err := json.Unmarshal(data, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Image != "busybox" || p.Digest != "sha256:fake" || p.Driver != "image.csi.k8s.io" || p.DriverVersion == "" || p.Node != "sanity-node" || p.PulledAt.IsZero() {
+			t.Errorf("unexpected provenance %+v", p)
+		}
+		// Outside of a cluster, the node platform is the runtime one.
+		if p.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+			t.Errorf("unexpected platform %q in provenance", p.Platform)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-provenance", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("NodePublishVolumeOwner", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		for _, mode := range []string{modeBind, modeTmpfs} {
+			req := &csi.NodePublishVolumeRequest{
+				VolumeId:         "csi-sanity-owner",
+				TargetPath:       target,
+				VolumeCapability: capability,
+				VolumeContext:    map[string]string{"image": "busybox", "uid": "1000", "gid": "2000", "mode": mode},
+			}
+			if _, err := node.NodePublishVolume(ctx, req); err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			for _, name := range []string{".", "hello", "etc/app/config"} {
+				fi, err := os.Lstat(filepath.Join(target, name))
+				if err != nil {
+					t.Fatalf("%s: %v", mode, err)
+				}
+				if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 2000 {
+					t.Errorf("%s: %s is owned by %d:%d", mode, name, st.Uid, st.Gid)
+				}
+			}
+			if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-owner", TargetPath: target}); err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+		}
+	})
+
+	t.Run("RefreshVolume", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-refresh",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			Readonly:         true,
+			VolumeContext:    map[string]string{"image": "busybox", "mode": modeTmpfs},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		defer node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-refresh", TargetPath: target})
+		first, err := os.Readlink(filepath.Join(target, dataLink))
+		if err != nil {
+			t.Fatalf("content not published through %s: %v", dataLink, err)
+		}
+
+		if changed, err := ns.refreshVolume(ctx, "csi-sanity-refresh"); err != nil || changed {
+			t.Errorf("refresh of an unchanged image returned %v, %v", changed, err)
+		}
+		fake.setDigest("busybox", "sha256:updated")
+		defer fake.setDigest("busybox", "sha256:fake")
+		if changed, err := ns.refreshVolume(ctx, "csi-sanity-refresh"); err != nil || !changed {
+			t.Fatalf("refresh of an updated image returned %v, %v", changed, err)
+		}
+		if current, err := os.Readlink(filepath.Join(target, dataLink)); err != nil || current == first {
+			t.Errorf("content not swapped: %q, %v", current, err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(target, "hello")); err != nil || string(content) != "busybox" {
+			t.Errorf("unexpected content %q: %v", content, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(target, "new"), nil, 0644); err == nil {
+			t.Error("refreshed volume is writable")
+		}
+		if marker, err := ioutil.ReadFile(filepath.Join(target, updateMarker)); err != nil || string(marker) != "sha256:updated\n" {
+			t.Errorf("unexpected update marker %q: %v", marker, err)
+		}
+		if v, _ := ns.volumes.get("csi-sanity-refresh"); v.Digest != "sha256:updated" {
+			t.Errorf("volume tracks digest %q", v.Digest)
+		}
+		if _, ok := fake.containers[ns.containerName(nextContainer("csi-sanity-refresh"))]; ok {
+			t.Error("container of the refresh not renamed")
+		}
+	})
+
+	t.Run("UpdatePolicyWatch", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-watch",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox", "mode": modeTmpfs, "updatePolicy": updateWatch, "resyncInterval": "10ms"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument without an update interval, got %v", err)
+		}
+
+		ns.updates = newUpdateWatcher(time.Hour, 0, 0, ns.refreshVolume)
+		defer func() { ns.updates = nil }()
+		bind := *req
+		bind.VolumeContext = map[string]string{"image": "busybox", "updatePolicy": updateWatch}
+		if _, err := node.NodePublishVolume(ctx, &bind); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument in bind mode, got %v", err)
+		}
+
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		fake.setDigest("busybox", "sha256:watched")
+		defer fake.setDigest("busybox", "sha256:fake")
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if v, _ := ns.volumes.get("csi-sanity-watch"); v.Digest == "sha256:watched" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("volume not updated to the new digest")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-watch", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+		ns.updates.mu.Lock()
+		defer ns.updates.mu.Unlock()
+		if _, ok := ns.updates.watches["csi-sanity-watch"]; ok {
+			t.Error("volume still watched after unpublish")
+		}
+	})
+
+	t.Run("RefreshVolumeFailure", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-refresh-failure",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox", "mode": modeTmpfs},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		defer node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-refresh-failure", TargetPath: target})
+		first, err := os.Readlink(filepath.Join(target, dataLink))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fake.setDigest("busybox", "sha256:broken")
+		defer fake.setDigest("busybox", "sha256:fake")
+		for _, command := range []string{"pull", "from", "mount"} {
+			fake.setFailing(command, true)
+			changed, err := ns.refreshVolume(ctx, "csi-sanity-refresh-failure")
+			fake.setFailing(command, false)
+			if err == nil || changed {
+				t.Errorf("%s: refresh returned %v, %v", command, changed, err)
+			}
+			if current, err := os.Readlink(filepath.Join(target, dataLink)); err != nil || current != first {
+				t.Errorf("%s: content replaced by failed refresh: %q, %v", command, current, err)
+			}
+			if content, err := ioutil.ReadFile(filepath.Join(target, "hello")); err != nil || string(content) != "busybox" {
+				t.Errorf("%s: content broken by failed refresh: %q, %v", command, content, err)
+			}
+			if v, _ := ns.volumes.get("csi-sanity-refresh-failure"); v.Digest != "sha256:fake" {
+				t.Errorf("%s: volume tracks digest %q", command, v.Digest)
+			}
+			if _, ok := fake.containers[ns.containerName(nextContainer("csi-sanity-refresh-failure"))]; ok {
+				t.Errorf("%s: container of the failed refresh kept", command)
+			}
+		}
+
+		rec := httptest.NewRecorder()
+		metricsRegistry.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(rec.Body.String(), `image_populator_refreshes_total{result="failure"} `) {
+			t.Error("failed refreshes not counted")
+		}
+
+		// The next attempt succeeds.
+		if changed, err := ns.refreshVolume(ctx, "csi-sanity-refresh-failure"); err != nil || !changed {
+			t.Errorf("refresh after failures returned %v, %v", changed, err)
+		}
+	})
+
+	t.Run("MountPropagation", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-propagation",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox", "mountPropagation": "shared"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for an unknown propagation, got %v", err)
+		}
+		req.VolumeContext["mountPropagation"] = "rshared"
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		shared := false
+		for _, line := range strings.Split(string(mountinfo), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 6 && fields[4] == target && strings.HasPrefix(fields[6], "shared:") {
+				shared = true
+			}
+		}
+		if !shared {
+			t.Errorf("target %s is not a shared mount", target)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-propagation", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("RetainChanges", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		attrib := map[string]string{"image": "busybox", "retainChanges": "true"}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-retain-1",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    attrib,
+		}
+		if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("expected FailedPrecondition without pod information, got %v", err)
+		}
+		attrib["mode"] = modeTmpfs
+		if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument in tmpfs mode, got %v", err)
+		}
+		delete(attrib, "mode")
+		attrib["csi.storage.k8s.io/pod.namespace"] = "default"
+		attrib["csi.storage.k8s.io/pod.name"] = "web-0"
+		retained, err := retainedContainer(attrib, "busybox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fake.run([]string{"rm", retained})
+
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(target, "written"), []byte("kept"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-retain-1", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fake.containers[retained]; !ok {
+			t.Fatal("container not retained on unpublish")
+		}
+
+		// The next pod of the same name gets the changes back.
+		req.VolumeId = "csi-sanity-retain-2"
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(target, "written")); err != nil || string(content) != "kept" {
+			t.Errorf("changes not retained: %q, %v", content, err)
+		}
+		if _, ok := fake.containers[retained]; ok {
+			t.Error("retained container not reattached")
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-retain-2", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("BaseImage", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		attrib := map[string]string{"image": "busybox", "baseImage": "alpine"}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-base",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    attrib,
+		}
+		if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument in bind mode, got %v", err)
+		}
+		attrib["mode"] = modeTmpfs
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(target, "from-busybox")); err != nil {
+			t.Errorf("content added on top of the base image not published: %v", err)
+		}
+		if _, ok := fake.containers[ns.containerName(baseContainer("csi-sanity-base"))]; ok {
+			t.Error("base container not deleted after publish")
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-base", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Platform", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-platform",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox", "platform": "linux/arm64"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, call := range fake.calls {
+			if strings.Contains(strings.Join(call, " "), "from --name "+ns.containerName("csi-sanity-platform")+" --pull --platform linux/arm64 busybox") {
+				found = true
+			}
+		}
+		if !found {
+			t.Error("platform not passed to buildah from")
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-platform", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+		req.VolumeContext["platform"] = "arm64"
+		if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for an invalid platform, got %v", err)
+		}
+	})
+
+	t.Run("RepublishVolume", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-republish",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox"},
+		}
+		// A container left behind by an earlier attempt with another
+		// image is recreated, one of the same image is reused.
+		fake.setDigest("alpine", "sha256:alpine")
+		if _, err := fake.run([]string{"from", "--name", ns.containerName("csi-sanity-republish"), "--pull", "alpine"}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := node.NodePublishVolume(ctx, req); err != nil {
+				t.Fatalf("publish %d: %v", i+1, err)
+			}
+			if fake.from[ns.containerName("csi-sanity-republish")] != "busybox" {
+				t.Fatalf("publish %d: container of %q not recreated", i+1, fake.from[ns.containerName("csi-sanity-republish")])
+			}
+		}
+		if _, err := os.Stat(filepath.Join(target, "from-busybox")); err != nil {
+			t.Errorf("content of the volume image not published: %v", err)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-republish", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("UnpublishDeletedContainer", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-deleted",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fake.run([]string{"rm", ns.containerName("csi-sanity-deleted")}); err != nil {
+			t.Fatal(err)
+		}
+		unpublish := &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-deleted", TargetPath: target}
+		if _, err := node.NodeUnpublishVolume(ctx, unpublish); err != nil {
+			t.Fatalf("unpublish of a volume whose container is gone failed: %v", err)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, unpublish); err != nil {
+			t.Fatalf("repeated unpublish failed: %v", err)
+		}
+	})
+
+	t.Run("PullNotFound", func(t *testing.T) {
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-missing",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "missing"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.NotFound {
+			t.Errorf("expected NotFound for a missing image, got %v", err)
+		}
+	})
+
+	t.Run("RollbackFailedPublish", func(t *testing.T) {
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-rollback",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox", "path": "/does/not/exist"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("expected FailedPrecondition for a missing path, got %v", err)
+		}
+		if _, ok := fake.containers[ns.containerName("csi-sanity-rollback")]; ok {
+			t.Error("container of a failed publish not deleted")
+		}
+	})
+
+	t.Run("ReclaimLeakedContainers", func(t *testing.T) {
+		leaked := ns.containerName("csi-sanity-leaked")
+		layer := ns.containerName(layerContainer("csi-sanity-leaked", 1))
+		foreign := []string{"retained-0123abcd", "operator-debug", "csi-sanity-legacy", "csi-0123"}
+		for _, name := range append([]string{leaked, layer}, foreign...) {
+			if _, err := fake.run([]string{"from", "--name", name, "busybox"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		leaks := &leakDetector{ns: ns, grace: time.Hour}
+		if err := leaks.check(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fake.containers[leaked]; !ok {
+			t.Fatal("container deleted within the grace period")
+		}
+
+		leaks.grace = 0
+		if err := leaks.check(); err != nil {
+			t.Fatal(err)
+		}
+		for name, kept := range map[string]bool{leaked: false, layer: false} {
+			if _, ok := fake.containers[name]; ok != kept {
+				t.Errorf("container %s kept: %v, expected %v", name, ok, kept)
+			}
+		}
+		for _, name := range foreign {
+			if _, ok := fake.containers[name]; !ok {
+				t.Errorf("container %s not created by the driver deleted", name)
+			}
+		}
+	})
+
+	t.Run("MissingImage", func(t *testing.T) {
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-no-image",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"mode": "tmpfs"},
+		}
+		calls := len(fake.calls)
+		_, err := node.NodePublishVolume(ctx, req)
+		if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "supported attributes") {
+			t.Errorf("expected InvalidArgument listing the attributes, got %v", err)
+		}
+		if len(fake.calls) != calls {
+			t.Errorf("buildah called for a volume without image: %v", fake.calls[calls:])
+		}
+	})
+
+	t.Run("CancelledPull", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		err := ns.setupVolume(cancelled, "csi-sanity-cancelled", "busybox", "", 0, 0)
+		if status.Code(err) != codes.Canceled {
+			t.Errorf("expected Canceled for a cancelled call, got %v", err)
+		}
+		if _, ok := fake.containers[ns.containerName("csi-sanity-cancelled")]; ok {
+			t.Error("container created for a cancelled call")
+		}
+	})
+
+	t.Run("AdoptMountAfterRestart", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-adopt",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		// A restart without saved state forgets the volume, but leaves
+		// the container and the mount in place.
+		ns.volumes.remove("csi-sanity-adopt")
+		calls := len(fake.calls)
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatalf("publish of a mounted volume after a restart failed: %v", err)
+		}
+		for _, call := range fake.calls[calls:] {
+			if cmd := strings.Join(call, " "); strings.Contains(cmd, "from --name") || strings.Contains(cmd, "delete ") {
+				t.Errorf("unexpected buildah %s for a mounted volume", cmd)
+			}
+		}
+		if v, ok := ns.volumes.get("csi-sanity-adopt"); !ok || v.TargetPath != target {
+			t.Errorf("volume not tracked after adopting its mount: %+v", v)
+		}
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-adopt", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fake.containers[ns.containerName("csi-sanity-adopt")]; ok {
+			t.Error("container of the adopted volume not deleted on unpublish")
+		}
+	})
+
+	t.Run("UnpublishMissingTarget", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-missing-target",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		// A node reboot drops the mount, and the kubelet removes the
+		// target directory.
+		if err := mount.New("").Unmount(target); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(target); err != nil {
+			t.Fatal(err)
+		}
+		unpublish := &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-missing-target", TargetPath: target}
+		if _, err := node.NodeUnpublishVolume(ctx, unpublish); err != nil {
+			t.Fatalf("unpublish of a missing target failed: %v", err)
+		}
+		if _, ok := fake.containers[ns.containerName("csi-sanity-missing-target")]; ok {
+			t.Error("container not deleted on unpublish of a missing target")
+		}
+		if _, ok := ns.volumes.get("csi-sanity-missing-target"); ok {
+			t.Error("volume still tracked after unpublish of a missing target")
+		}
+	})
+
+	t.Run("FailedPullCache", func(t *testing.T) {
+		ns.pullFailures = newFailedPulls(time.Minute)
+		defer func() { ns.pullFailures = nil }()
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-failed-pull",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "missing"},
+		}
+		calls := len(fake.calls)
+		for i := 0; i < 3; i++ {
+			if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.NotFound {
+				t.Fatalf("publish %d: expected NotFound, got %v", i+1, err)
+			}
+		}
+		pulls := 0
+		for _, call := range fake.calls[calls:] {
+			if strings.Contains(strings.Join(call, " "), "from --name") {
+				pulls++
+			}
+		}
+		if pulls != 1 {
+			t.Errorf("expected a single pull of an image that is not found, got %d", pulls)
+		}
+	})
+
+	t.Run("ConflictingTargetPath", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-target-owner",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		defer node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-target-owner", TargetPath: target})
+		calls := len(fake.calls)
+		other := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-target-other",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox"},
+		}
+		if _, err := node.NodePublishVolume(ctx, other); status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("expected FailedPrecondition for a target used by another volume, got %v", err)
+		}
+		if len(fake.calls) != calls {
+			t.Errorf("buildah called for a conflicting publish: %v", fake.calls[calls:])
+		}
+	})
+	t.Run("SharedVolume", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mounting needs root")
+		}
+		second := filepath.Join(dir, "target-second")
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-sanity-shared",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"image": "busybox"},
+		}
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		// A second pod on the node uses the same persistent volume.
+		other := *req
+		other.TargetPath = second
+		calls := len(fake.calls)
+		for i := 0; i < 2; i++ {
+			if _, err := node.NodePublishVolume(ctx, &other); err != nil {
+				t.Fatalf("publish %d to the second target: %v", i+1, err)
+			}
+		}
+		if len(fake.calls) != calls {
+			t.Errorf("buildah called for a second target: %v", fake.calls[calls:])
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(second, "hello")); err != nil || string(content) != "busybox" {
+			t.Fatalf("unexpected content of the second target %q: %v", content, err)
+		}
+
+		// Unpublishing the first target keeps the container of the second.
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-shared", TargetPath: target}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fake.containers[ns.containerName("csi-sanity-shared")]; !ok {
+			t.Fatal("container deleted while the second target uses it")
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(second, "hello")); err != nil || string(content) != "busybox" {
+			t.Fatalf("second target broken by unpublishing the first: %q, %v", content, err)
+		}
+		if v, _ := ns.volumes.get("csi-sanity-shared"); v.TargetPath != second || len(v.SharedTargets) != 0 {
+			t.Errorf("unexpected targets %s %v", v.TargetPath, v.SharedTargets)
+		}
+
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-shared", TargetPath: second}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fake.containers[ns.containerName("csi-sanity-shared")]; ok {
+			t.Error("container left behind after the last unpublish")
+		}
+		if ns.volumes.busy("csi-sanity-shared") {
+			t.Error("volume still tracked after the last unpublish")
+		}
+		if _, err := os.Stat(second); !os.IsNotExist(err) {
+			t.Errorf("directory created for the second target left behind: %v", err)
+		}
+	})
+
+	t.Run("ExportOnce", func(t *testing.T) {
+		uploads := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			uploads++
+		}))
+		defer server.Close()
+		ns.exportURLs = []string{server.URL + "/"}
+		defer func() { ns.exportURLs = nil }()
+
+		// The kubelet retries an unpublish that failed after the export.
+		exportTarget := filepath.Join(dir, "target-export")
+		if err := os.Mkdir(exportTarget, 0750); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fake.run([]string{"from", "--name", ns.containerName("csi-sanity-export"), "busybox"}); err != nil {
+			t.Fatal(err)
+		}
+		ns.volumes.add(Volume{ID: "csi-sanity-export", Mode: modeBind, TargetPath: exportTarget,
+			Attributes: map[string]string{"export": exportContent, "exportURL": server.URL + "/export.tar.gz"}})
+		unpublish := &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-sanity-export", TargetPath: exportTarget}
+		fake.setFailing("delete", true)
+		if _, err := node.NodeUnpublishVolume(ctx, unpublish); err == nil {
+			t.Fatal("unpublish succeeded although the container cannot be deleted")
+		}
+		fake.setFailing("delete", false)
+		if _, err := node.NodeUnpublishVolume(ctx, unpublish); err != nil {
+			t.Fatal(err)
+		}
+		if uploads != 1 {
+			t.Errorf("expected one upload after a retried unpublish, got %d", uploads)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// selfTest verifies that the backend can serve volumes before the driver
+// starts listening. The CSI socket only appears once it passes, so the node
+// registrar never registers a driver that would fail every mount.
+func (ns *nodeServer) selfTest(image string) error {
+	start := time.Now()
+	if err := checkBackend(ns.storageRoot); err != nil {
+		return err
+	}
+
+	// buildah info opens the store, which fails on a broken storage root
+	// or an unsupported storage driver.
+	if output, err := ns.runCmd([]string{"info"}); err != nil {
+		return fmt.Errorf("cannot initialize storage: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	if image != "" {
+		if output, err := ns.runCmd([]string{"pull", "--quiet", image}); err != nil {
+			return fmt.Errorf("cannot pull self-test image %s: %v: %s", image, err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	logInfo(2, "self-test passed", "image", image, "duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
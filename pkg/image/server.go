@@ -0,0 +1,227 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+// nonBlockingGRPCServer is csicommon's server with the driver's own
+// interceptor chain.
+type nonBlockingGRPCServer struct {
+	wg     sync.WaitGroup
+	server *grpc.Server
+	health healthServer
+
+	// socketMode, socketUID and socketGID are applied to a unix socket
+	// endpoint. Zero and -1 leave the defaults.
+	socketMode os.FileMode
+	socketUID  int
+	socketGID  int
+	socketPath string
+
+	// tls secures TCP endpoints, nil serves them in plain text.
+	tls *tls.Config
+	// options are added to the driver's own server options.
+	options []grpc.ServerOption
+	// isLeader gates controller calls that change state, nil serves
+	// them on every instance.
+	isLeader func() bool
+}
+
+func NewNonBlockingGRPCServer() *nonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{socketUID: -1, socketGID: -1}
+}
+
+func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	s.wg.Add(1)
+	go s.serve(endpoint, ids, cs, ns)
+}
+
+func (s *nonBlockingGRPCServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *nonBlockingGRPCServer) Stop() {
+	if s.server != nil {
+		s.server.GracefulStop()
+	}
+}
+
+func (s *nonBlockingGRPCServer) ForceStop() {
+	if s.server != nil {
+		s.server.Stop()
+	}
+}
+
+func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	defer s.wg.Done()
+
+	proto, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		glog.Fatal(err.Error())
+	}
+
+	if proto == "unix" {
+		addr = "/" + addr
+		if err := removeStaleSocket(addr); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		glog.Fatalf("Failed to listen: %v", err)
+	}
+	if proto == "unix" {
+		s.socketPath = addr
+		if err := s.setSocketPermissions(addr); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	interceptor := unaryInterceptor
+	if s.isLeader != nil {
+		gate := leaderInterceptor(s.isLeader)
+		interceptor = func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return unaryInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return gate(ctx, req, info, handler)
+			})
+		}
+	}
+	opts := append([]grpc.ServerOption{grpc.UnaryInterceptor(interceptor)}, s.options...)
+	if proto == "tcp" {
+		if s.tls != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(s.tls)))
+		} else {
+			glog.Warningf("serving CSI on %s without TLS, use it for testing only", addr)
+		}
+	}
+	server := grpc.NewServer(opts...)
+	s.server = server
+
+	if ids != nil {
+		csi.RegisterIdentityServer(server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(server, ns)
+	}
+	if s.health != nil {
+		server.RegisterService(&healthServiceDesc, s.health)
+	}
+
+	glog.Infof("Listening for connections on address: %#v", listener.Addr())
+
+	server.Serve(listener)
+	s.removeSocket()
+}
+
+// grpcServerOptions translates the tuning options of the driver to server
+// options, leaving the grpc defaults for unset ones.
+func grpcServerOptions(o Options) []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if o.GRPCMaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(o.GRPCMaxRecvMsgSize))
+	}
+	if o.GRPCMaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(o.GRPCMaxSendMsgSize))
+	}
+	if o.GRPCMaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(o.GRPCMaxConcurrentStreams))
+	}
+	if o.GRPCKeepaliveTime > 0 || o.GRPCKeepaliveTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    o.GRPCKeepaliveTime,
+			Timeout: o.GRPCKeepaliveTimeout,
+		}))
+	}
+	if o.GRPCKeepaliveMinTime > 0 {
+		// kubelet reconnecting in bursts should not be answered with
+		// GOAWAY for pinging too often.
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             o.GRPCKeepaliveMinTime,
+			PermitWithoutStream: true,
+		}))
+	}
+	return opts
+}
+
+// removeStaleSocket removes the socket file at path left behind by a previous
+// instance. It refuses to remove files that are not sockets and sockets a
+// running server still accepts connections on.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket, refusing to remove it", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by a running server", path)
+	}
+	glog.Infof("removing stale socket %s", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove stale socket %s: %v", path, err)
+	}
+	return nil
+}
+
+func (s *nonBlockingGRPCServer) setSocketPermissions(path string) error {
+	if s.socketMode != 0 {
+		if err := os.Chmod(path, s.socketMode); err != nil {
+			return fmt.Errorf("cannot set mode of %s: %v", path, err)
+		}
+	}
+	if s.socketUID >= 0 || s.socketGID >= 0 {
+		if err := os.Chown(path, s.socketUID, s.socketGID); err != nil {
+			return fmt.Errorf("cannot set owner of %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// removeSocket removes the unix socket of the server, if any.
+func (s *nonBlockingGRPCServer) removeSocket() {
+	if s.socketPath == "" {
+		return
+	}
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("cannot remove socket %s: %v", s.socketPath, err)
+	}
+}
@@ -0,0 +1,52 @@
+package image
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "csi.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := removeStaleSocket(path); err == nil {
+		t.Fatal("socket of a running server removed")
+	}
+	l.Close()
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("stale socket not removed: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(path); err == nil {
+		t.Fatal("regular file removed")
+	}
+}
+
+func TestGRPCServerOptions(t *testing.T) {
+	if opts := grpcServerOptions(Options{}); len(opts) != 0 {
+		t.Fatalf("expected grpc defaults, got %d options", len(opts))
+	}
+	opts := grpcServerOptions(Options{
+		GRPCMaxRecvMsgSize:   16 << 20,
+		GRPCKeepaliveTimeout: 10 * time.Second,
+		GRPCKeepaliveMinTime: time.Minute,
+	})
+	if len(opts) != 3 {
+		t.Fatalf("expected 3 options, got %d", len(opts))
+	}
+}
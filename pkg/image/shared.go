@@ -0,0 +1,153 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// sharesTarget reports whether targetPath is one of the further targets of
+// v.
+func (v Volume) sharesTarget(targetPath string) bool {
+	for _, p := range v.SharedTargets {
+		if filepath.Clean(p) == filepath.Clean(targetPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishSharedTarget publishes a volume that is already published on this
+// node to another target, as happens when several pods on the node use the
+// same persistent volume. The target becomes a bind mount of the first one,
+// so all pods see the same content and the container is only released when
+// the last target is unpublished.
+func (ns *nodeServer) publishSharedTarget(v Volume, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	isBlock := req.GetVolumeCapability().GetBlock() != nil
+	if isBlock != v.Block {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume %s is published with another access type to %s", v.ID, v.TargetPath))
+	}
+	if v.ReadOnly && !req.GetReadonly() {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s is published read-only to %s", v.ID, v.TargetPath))
+	}
+	if err := ns.recoverTarget(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	mounter := mount.New("")
+	created := ""
+	notMnt, err := mounter.IsLikelyNotMountPoint(targetPath)
+	if os.IsNotExist(err) {
+		if created, err = createTarget(targetPath, isBlock || v.File); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		notMnt = true
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt && v.sharesTarget(targetPath) {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	if !notMnt {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("target path %s is already mounted", targetPath))
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	if err := mounter.Mount(v.TargetPath, targetPath, "", options); err != nil {
+		removeTarget(targetPath, created)
+		return nil, status.Error(codes.Internal, fmt.Sprintf("cannot mount %s to %s: %v", v.TargetPath, targetPath, err))
+	}
+	if !v.sharesTarget(targetPath) {
+		v.SharedTargets = append(v.SharedTargets, targetPath)
+		if created != "" {
+			v.SharedCreated = copyCreated(v.SharedCreated)
+			v.SharedCreated[filepath.Clean(targetPath)] = created
+		}
+		ns.volumes.add(v)
+	}
+	logInfo(4, "volume published to another target", "volume_id", v.ID, "target_path", targetPath, "first_target_path", v.TargetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// unpublishSharedTarget unmounts one target of a volume published to
+// several and removes the directories created for it. If it is the first
+// one, the next target takes its place, the bind mounts stay valid without
+// it.
+func (ns *nodeServer) unpublishSharedTarget(v Volume, targetPath string) error {
+	mounter := mount.New("")
+	notMnt, err := mounter.IsLikelyNotMountPoint(targetPath)
+	if os.IsNotExist(err) {
+		notMnt, err = true, nil
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		if err := mounter.Unmount(targetPath); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	if v.Block || v.File {
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	var shared []string
+	for _, p := range v.SharedTargets {
+		if filepath.Clean(p) != filepath.Clean(targetPath) {
+			shared = append(shared, p)
+		}
+	}
+	created := copyCreated(v.SharedCreated)
+	if filepath.Clean(targetPath) == filepath.Clean(v.TargetPath) {
+		removeTarget(targetPath, v.CreatedTarget)
+		v.TargetPath, v.CreatedTarget, shared = shared[0], created[filepath.Clean(shared[0])], shared[1:]
+		delete(created, filepath.Clean(v.TargetPath))
+	} else {
+		removeTarget(targetPath, created[filepath.Clean(targetPath)])
+		delete(created, filepath.Clean(targetPath))
+	}
+	if len(created) == 0 {
+		created = nil
+	}
+	v.SharedTargets, v.SharedCreated = shared, created
+	ns.volumes.add(v)
+	logInfo(4, "volume unpublished from one of its targets", "volume_id", v.ID, "target_path", targetPath, "remaining_target_path", v.TargetPath)
+	return nil
+}
+
+// copyCreated returns a copy of the SharedCreated of a volume, so changes do
+// not affect the tracked volume before it is added again.
+func copyCreated(created map[string]string) map[string]string {
+	c := map[string]string{}
+	for target, dir := range created {
+		c[target] = dir
+	}
+	return c
+}
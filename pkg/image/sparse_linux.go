@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// whence values of lseek(2), missing in the vendored x/sys.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// copySparse copies the data ranges of in to out and leaves holes in
+// between, so mostly empty files like VM disks keep their allocated size.
+// It returns false without copying anything if the filesystem of in cannot
+// report holes.
+func copySparse(in, out *os.File, size int64) (bool, error) {
+	fd := int(in.Fd())
+	var offset int64
+	for offset < size {
+		data, err := unix.Seek(fd, offset, seekData)
+		if err == unix.ENXIO {
+			// Only a hole is left.
+			break
+		}
+		if err == unix.EINVAL && offset == 0 {
+			return false, nil
+		}
+		if err != nil {
+			return true, err
+		}
+		hole, err := unix.Seek(fd, data, seekHole)
+		if err != nil {
+			return true, err
+		}
+
+		if _, err := in.Seek(data, io.SeekStart); err != nil {
+			return true, err
+		}
+		if _, err := out.Seek(data, io.SeekStart); err != nil {
+			return true, err
+		}
+		if _, err := io.CopyN(out, in, hole-data); err != nil {
+			return true, err
+		}
+		offset = hole
+	}
+	return true, out.Truncate(size)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// nodeState is what the driver persists across restarts.
+type nodeState struct {
+	Volumes []Volume `json:"volumes"`
+	// InFlight lists the volumes whose publish was interrupted. Their
+	// containers may be half created.
+	InFlight []string `json:"inFlight,omitempty"`
+}
+
+func statePath(dir string) string {
+	return filepath.Join(dir, "state.json")
+}
+
+// saveState writes the tracked volumes to dir.
+func (ns *nodeServer) saveState(dir string) error {
+	state := nodeState{Volumes: ns.volumes.list(), InFlight: ns.volumes.inFlight()}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp := statePath(dir) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath(dir))
+}
+
+// restoreState tracks the volumes saved in dir again and deletes the
+// containers of publishes that were interrupted by the last shutdown.
+func (ns *nodeServer) restoreState(dir string) error {
+	data, err := ioutil.ReadFile(statePath(dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state nodeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	for _, v := range state.Volumes {
+		ns.volumes.add(v)
+		if policy, _ := volumeUpdatePolicy(v.Attributes); policy == updateWatch {
+			resync, _ := volumeResyncInterval(v.Attributes)
+			ns.updates.watch(v.ID, resync)
+		}
+	}
+	for _, id := range state.InFlight {
+		if _, ok := ns.volumes.get(id); ok {
+			continue
+		}
+		// kubelet retries the publish, which then starts from scratch.
+		logWarning("removing container of interrupted publish", "volume_id", id)
+		if err := ns.unmergeImages(id); err != nil {
+			glog.Warningf("cannot remove merged images of volume %s: %v", id, err)
+		}
+		if err := ns.unsetupVolume(id); err != nil {
+			glog.Warningf("cannot remove container of volume %s: %v", id, err)
+		}
+	}
+	logInfo(2, "state restored", "volumes", len(state.Volumes), "interrupted", len(state.InFlight))
+	return nil
+}
+
+// shutdownOnSignal drains the server on SIGTERM or SIGINT: no new calls are
+// accepted and in-flight ones get up to timeout to finish. The state is saved
+// before the process exits. Mounts are left in place unless cleanup is set.
+func (ns *nodeServer) shutdownOnSignal(s *nonBlockingGRPCServer, timeout time.Duration, stateDir string, cleanup bool) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	logInfo(0, "shutting down", "signal", sig.String(), "in_flight", len(ns.volumes.inFlight()), "timeout", timeout.String())
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		logWarning("in-flight calls did not finish in time", "volumes", ns.volumes.inFlight())
+		s.ForceStop()
+	}
+	s.removeSocket()
+
+	if cleanup {
+		for _, v := range ns.volumes.list() {
+			for _, target := range v.SharedTargets {
+				if err := ns.teardownVolume(context.Background(), v.ID, target); err != nil {
+					logError("cannot clean up volume", "volume_id", v.ID, "target_path", target, "error", err)
+				}
+			}
+			if err := ns.teardownVolume(context.Background(), v.ID, v.TargetPath); err != nil {
+				logError("cannot clean up volume", "volume_id", v.ID, "error", err)
+			}
+		}
+	}
+	if stateDir != "" {
+		if err := ns.saveState(stateDir); err != nil {
+			logError("cannot save state", "dir", stateDir, "error", err)
+		}
+	}
+	glog.Flush()
+	os.Exit(0)
+}
@@ -0,0 +1,31 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	ns := &nodeServer{volumes: newVolumeTracker()}
+	ns.volumes.add(Volume{ID: "published", Image: "busybox", TargetPath: "/target"})
+	end := ns.volumes.begin("published")
+	if ids := ns.volumes.inFlight(); len(ids) != 1 || ids[0] != "published" {
+		t.Fatalf("unexpected in-flight volumes %v", ids)
+	}
+	end()
+	if ids := ns.volumes.inFlight(); len(ids) != 0 {
+		t.Fatalf("volume still in flight: %v", ids)
+	}
+	if err := ns.saveState(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &nodeServer{volumes: newVolumeTracker()}
+	if err := restored.restoreState(dir); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := restored.volumes.get("published"); !ok || v.TargetPath != "/target" {
+		t.Fatalf("volume not restored: %+v", v)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// availableBytes returns the number of bytes available to unprivileged
+// users on the filesystem holding path.
+func availableBytes(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// storageArgs returns the global buildah options selecting the storage of
+// this driver instance.
+func (ns *nodeServer) storageArgs() []string {
+	var args []string
+	if ns.storageRoot != "" {
+		args = append(args, "--root", ns.storageRoot)
+	}
+	if ns.runRoot != "" {
+		args = append(args, "--runroot", ns.runRoot)
+	}
+	if ns.storageDriver != "" {
+		args = append(args, "--storage-driver", ns.storageDriver)
+	}
+	if ns.mountProgram != "" {
+		args = append(args, "--storage-opt", "overlay.mount_program="+ns.mountProgram)
+	}
+	return args
+}
+
+// checkDiskSpace refuses to start a pull when the storage root would drop
+// below the reserved space. size is the compressed size of the image, the
+// fixed headroom covers what the layers grow by when they are unpacked.
+func (ns *nodeServer) checkDiskSpace(image string, size int64) error {
+	if ns.storageRoot == "" {
+		return nil
+	}
+	avail, err := availableBytes(ns.storageRoot)
+	if err != nil {
+		glog.Warningf("cannot stat storage root %s: %v", ns.storageRoot, err)
+		return nil
+	}
+	required := size + ns.reservedSpace + ns.pullHeadroom
+	if avail < required {
+		glog.Warningf("refusing to pull %s: %d bytes available on %s, %d required", image, avail, ns.storageRoot, required)
+		return imageError(codes.ResourceExhausted, errorReasonDiskPressure, image, time.Minute, fmt.Sprintf("not enough space on %s to pull %s: %d bytes available, %d required", ns.storageRoot, image, avail, required))
+	}
+	return nil
+}
+
+// maxManifestSize bounds the manifests read for the size of an image.
+const maxManifestSize = 4 << 20
+
+// imageManifest holds the fields of image manifests and manifest lists
+// needed for the compressed size of an image.
+type imageManifest struct {
+	Config struct {
+		Size int64 `json:"size"`
+	} `json:"config"`
+	Layers []struct {
+		Size int64 `json:"size"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// manifestSize returns the sum of the config and layer sizes of the image
+// manifest raw. For a manifest list, it returns the digest of the manifest
+// for platform instead, which has to be read next.
+func manifestSize(raw []byte, platform string) (size int64, digest string, err error) {
+	var m imageManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return 0, "", fmt.Errorf("invalid manifest: %v", err)
+	}
+	if len(m.Manifests) > 0 {
+		for _, entry := range m.Manifests {
+			p := entry.Platform.OS + "/" + entry.Platform.Architecture
+			if entry.Platform.Variant != "" && strings.Count(platform, "/") == 2 {
+				p += "/" + entry.Platform.Variant
+			}
+			if p == platform {
+				return 0, entry.Digest, nil
+			}
+		}
+		return 0, "", fmt.Errorf("manifest list has no manifest for %s", platform)
+	}
+	size = m.Config.Size
+	for _, layer := range m.Layers {
+		size += layer.Size
+	}
+	return size, "", nil
+}
+
+// imageRepository returns image without its tag or digest.
+func imageRepository(image string) string {
+	if i := strings.IndexRune(image, '@'); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// compressedSize returns the number of bytes a pull of image for platform
+// transfers at most, read from its manifest with skopeo. Layers already in
+// the storage root are counted too.
+func (ns *nodeServer) compressedSize(ctx context.Context, image, platform string, policy *RegistryConfig) (int64, error) {
+	if platform == "" {
+		platform = runtime.GOOS + "/" + runtime.GOARCH
+	}
+	ref := policy.rewrite(image)
+	for i := 0; i < 2; i++ {
+		args := []string{"inspect", "--raw"}
+		if authFile := policy.authFile(image); authFile != "" {
+			args = append(args, "--authfile", authFile)
+		}
+		args = append(args, "docker://"+ref)
+		var output []byte
+		var err error
+		if ns.inspectManifest != nil {
+			output, err = ns.inspectManifest(ref)
+		} else {
+			var timeout bool
+			output, timeout, err = runProcess(ctx, exec.Command("skopeo", args...), ns.commandTimeout(ctx))
+			if timeout {
+				err = TimeoutError
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot read manifest of %s: %v: %s", image, err, strings.TrimSpace(string(output)))
+		}
+		if len(output) > maxManifestSize {
+			return 0, fmt.Errorf("manifest of %s is larger than %d bytes", image, maxManifestSize)
+		}
+		size, digest, err := manifestSize(output, platform)
+		if err != nil || digest == "" {
+			return size, err
+		}
+		ref = imageRepository(ref) + "@" + digest
+	}
+	return 0, fmt.Errorf("manifest list of %s refers to another manifest list", image)
+}
+
+var sizeSuffixes = []struct {
+	suffix string
+	factor int64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1000}, {"K", 1000}, {"M", 1000 * 1000}, {"G", 1000 * 1000 * 1000}, {"T", 1000 * 1000 * 1000 * 1000},
+}
+
+// parseSize parses a byte count using the Kubernetes quantity suffixes, e.g.
+// "512Mi" or "2G". Plain numbers are bytes.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	factor := int64(1)
+	for _, suf := range sizeSuffixes {
+		if strings.HasSuffix(s, suf.suffix) {
+			s = strings.TrimSuffix(s, suf.suffix)
+			factor = suf.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * factor, nil
+}
+
+// volumeSizeLimit returns the sizeLimit volume attribute in bytes, or zero
+// if it is not set.
+func volumeSizeLimit(attrib map[string]string) (int64, error) {
+	v, ok := attrib["sizeLimit"]
+	if !ok {
+		return 0, nil
+	}
+	limit, err := parseSize(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sizeLimit: %v", err)
+	}
+	return limit, nil
+}
@@ -0,0 +1,71 @@
+package image
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCompressedSize(t *testing.T) {
+	manifests := map[string]string{
+		"example.com/app:v1": `{"manifests": [
+			{"digest": "sha256:arm", "platform": {"os": "linux", "architecture": "arm64"}},
+			{"digest": "sha256:amd", "platform": {"os": "linux", "architecture": "amd64"}}]}`,
+		"example.com/app@sha256:amd": `{"config": {"size": 100}, "layers": [{"size": 1000}, {"size": 20000}]}`,
+	}
+	ns := &nodeServer{registries: &registryPolicy{}}
+	ns.inspectManifest = func(ref string) ([]byte, error) {
+		if m, ok := manifests[ref]; ok {
+			return []byte(m), nil
+		}
+		return nil, fmt.Errorf("manifest unknown")
+	}
+	size, err := ns.compressedSize(context.Background(), "example.com/app:v1", "linux/amd64", ns.registries.get())
+	if err != nil || size != 21100 {
+		t.Errorf("expected 21100 bytes, got %d: %v", size, err)
+	}
+	if _, err := ns.compressedSize(context.Background(), "example.com/app:v1", "linux/s390x", ns.registries.get()); err == nil {
+		t.Error("expected an error for a platform missing from the manifest list")
+	}
+
+	// The compressed size counts against the available space.
+	ns.storageRoot = t.TempDir()
+	if err := ns.checkDiskSpace("example.com/app:v1", 1<<62); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted for an image larger than the disk, got %v", err)
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	ns := &nodeServer{storageRoot: t.TempDir()}
+	if err := ns.checkDiskSpace("busybox", 0); err != nil {
+		t.Fatalf("unexpected error without reserve: %v", err)
+	}
+
+	ns.reservedSpace = 1 << 62
+	err := ns.checkDiskSpace("busybox", 0)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"1024":  1024,
+		"1Ki":   1024,
+		"512Mi": 512 << 20,
+		"2G":    2000 * 1000 * 1000,
+	} {
+		got, err := parseSize(in)
+		if err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "-1", "1Xi", "Gi", "0"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) should fail", in)
+		}
+	}
+}
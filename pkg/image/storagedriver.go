@@ -0,0 +1,124 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var storageDriverInfo = metricsRegistry.NewGaugeVec("image_populator_storage_driver",
+	"Storage driver used for the storage root, 1 for the selected driver.", "driver")
+
+// Storage drivers selectable with --storage-driver. fuse-overlayfs is the
+// overlay driver with fuse-overlayfs as mount program.
+const (
+	storageDriverAuto          = "auto"
+	storageDriverOverlay       = "overlay"
+	storageDriverFuseOverlayfs = "fuse-overlayfs"
+	storageDriverVFS           = "vfs"
+)
+
+// selectStorageDriver sets up the containers/storage driver of the storage
+// root: one of the storage drivers above, "" meaning auto. fusePath is the
+// fuse-overlayfs binary.
+func (ns *nodeServer) selectStorageDriver(driver, fusePath string) error {
+	if ns.storageRoot == "" {
+		// The node's own buildah keeps its configured driver.
+		return nil
+	}
+	if driver == "" || driver == storageDriverAuto {
+		driver = detectStorageDriver(ns.storageRoot, fusePath)
+	}
+	switch driver {
+	case storageDriverOverlay, storageDriverVFS:
+		ns.storageDriver = driver
+	case storageDriverFuseOverlayfs:
+		if err := checkFuseOverlayfs(fusePath); err != nil {
+			return err
+		}
+		ns.storageDriver = storageDriverOverlay
+		ns.mountProgram = fusePath
+	default:
+		return fmt.Errorf("unknown storage driver %q", driver)
+	}
+	storageDriverInfo.Set(1, driver)
+	logInfo(2, "selected storage driver", "storage_root", ns.storageRoot, "driver", driver)
+	return nil
+}
+
+// detectStorageDriver returns the storage driver to use for root. Kernel
+// overlay is preferred. Where the kernel cannot mount it on root, e.g. on
+// old kernels, in user namespaces without native overlay support or on
+// network filesystems, fuse-overlayfs is used if it is installed, and vfs,
+// which works everywhere but copies every layer in full, otherwise.
+func detectStorageDriver(root, fusePath string) string {
+	err := probeOverlay(root)
+	if err == nil {
+		return storageDriverOverlay
+	}
+	if fuseErr := checkFuseOverlayfs(fusePath); fuseErr == nil {
+		logWarning("overlay is not usable on the storage root, falling back to fuse-overlayfs", "storage_root", root, "error", err)
+		return storageDriverFuseOverlayfs
+	}
+	logWarning("overlay is not usable on the storage root, falling back to vfs", "storage_root", root, "error", err)
+	return storageDriverVFS
+}
+
+// checkFuseOverlayfs checks that the fuse-overlayfs binary and the fuse
+// device are there.
+func checkFuseOverlayfs(path string) error {
+	if path == "" {
+		return errors.New("no fuse-overlayfs binary configured")
+	}
+	if _, err := exec.LookPath(path); err != nil {
+		return fmt.Errorf("fuse-overlayfs not usable: %v", err)
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return fmt.Errorf("fuse-overlayfs not usable: %v", err)
+	}
+	return nil
+}
+
+// probeOverlay mounts a scratch overlay below root to check that the kernel
+// supports overlay on its filesystem with the privileges of the driver.
+func probeOverlay(root string) error {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(root, ".overlay-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"lower", "upper", "work", "merged"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			return err
+		}
+	}
+	merged := filepath.Join(dir, "merged")
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		filepath.Join(dir, "lower"), filepath.Join(dir, "upper"), filepath.Join(dir, "work"))
+	if err := mountOverlay(options, merged); err != nil {
+		return fmt.Errorf("cannot mount overlay: %v", err)
+	}
+	return unmountOverlay(merged)
+}
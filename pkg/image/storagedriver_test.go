@@ -0,0 +1,40 @@
+package image
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelectStorageDriver(t *testing.T) {
+	root := t.TempDir()
+	ns := &nodeServer{storageRoot: root}
+	if err := ns.selectStorageDriver(storageDriverAuto, filepath.Join(root, "missing")); err != nil {
+		t.Fatal(err)
+	}
+	if ns.storageDriver != storageDriverOverlay && ns.storageDriver != storageDriverVFS {
+		t.Fatalf("unexpected storage driver %q", ns.storageDriver)
+	}
+	if entries, _ := ioutil.ReadDir(root); len(entries) != 0 {
+		t.Errorf("probe left %d entries in the storage root", len(entries))
+	}
+
+	ns = &nodeServer{storageRoot: root}
+	if err := ns.selectStorageDriver(storageDriverFuseOverlayfs, filepath.Join(root, "missing")); err == nil {
+		t.Error("expected an error for a missing fuse-overlayfs binary")
+	}
+	if err := ns.selectStorageDriver(storageDriverVFS, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := "--root " + root + " --storage-driver vfs"
+	if args := strings.Join(ns.storageArgs(), " "); args != want {
+		t.Errorf("expected storage args %q, got %q", want, args)
+	}
+
+	ns = &nodeServer{storageRoot: root, storageDriver: storageDriverOverlay, mountProgram: "/usr/bin/fuse-overlayfs"}
+	want = "--root " + root + " --storage-driver overlay --storage-opt overlay.mount_program=/usr/bin/fuse-overlayfs"
+	if args := strings.Join(ns.storageArgs(), " "); args != want {
+		t.Errorf("expected storage args %q, got %q", want, args)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Conditions of a degraded storage root.
+const (
+	storageReadOnly      = "ReadOnly"
+	storageDiskPressure  = "DiskPressure"
+	storageInodePressure = "InodePressure"
+)
+
+var storageConditions = []string{storageReadOnly, storageDiskPressure, storageInodePressure}
+
+// minFreeInodes is the share of inodes below which the storage root is
+// under inode pressure. Image layers with many small files run out of
+// inodes long before they run out of space.
+const minFreeInodes = 0.01
+
+// stReadOnly is ST_RDONLY of the mount flags statfs(2) returns.
+const stReadOnly = 0x1
+
+var (
+	storageCondition = metricsRegistry.NewGaugeVec("image_populator_storage_condition",
+		"1 while the storage root has the condition, 0 otherwise.", "condition")
+	storageFreeInodes = metricsRegistry.NewGaugeVec("image_populator_storage_free_inodes",
+		"Inodes available on the storage root.")
+)
+
+// storageMonitor periodically checks the filesystem of the storage root for
+// conditions that make publishes fail, so they show in the probes and
+// metrics of the driver before pods fail to start.
+type storageMonitor struct {
+	root          string
+	reservedSpace int64
+
+	mu         sync.Mutex
+	conditions []string
+}
+
+func newStorageMonitor(root string, reservedSpace int64) *storageMonitor {
+	return &storageMonitor{root: root, reservedSpace: reservedSpace}
+}
+
+// run checks the storage root every interval. It never returns.
+func (m *storageMonitor) run(interval time.Duration) {
+	for {
+		m.check()
+		time.Sleep(interval)
+	}
+}
+
+// check updates the conditions of the storage root.
+func (m *storageMonitor) check() {
+	var conditions []string
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(m.root, &st); err != nil {
+		logWarning("cannot stat storage root", "storage_root", m.root, "error", err)
+		return
+	}
+	if st.Flags&stReadOnly != 0 {
+		conditions = append(conditions, storageReadOnly)
+	}
+	if avail := int64(st.Bavail) * int64(st.Bsize); avail < m.reservedSpace {
+		conditions = append(conditions, storageDiskPressure)
+	}
+	// Filesystems without a fixed number of inodes report none.
+	if st.Files > 0 && float64(st.Ffree) < minFreeInodes*float64(st.Files) {
+		conditions = append(conditions, storageInodePressure)
+	}
+	storageFreeInodes.Set(float64(st.Ffree))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.Join(conditions, ",") != strings.Join(m.conditions, ",") {
+		if len(conditions) > 0 {
+			logWarning("storage root degraded", "storage_root", m.root, "conditions", strings.Join(conditions, ","))
+		} else {
+			logInfo(0, "storage root healthy again", "storage_root", m.root)
+		}
+	}
+	m.conditions = conditions
+	for _, c := range storageConditions {
+		storageCondition.Set(0, c)
+	}
+	for _, c := range conditions {
+		storageCondition.Set(1, c)
+	}
+}
+
+// degraded returns the current conditions of the storage root, nil if it is
+// healthy or not monitored.
+func (m *storageMonitor) degraded() []string {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conditions
+}
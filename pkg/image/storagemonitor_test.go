@@ -0,0 +1,35 @@
+package image
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+func TestStorageMonitor(t *testing.T) {
+	root := t.TempDir()
+	m := newStorageMonitor(root, 0)
+	m.check()
+	if conditions := m.degraded(); len(conditions) != 0 {
+		t.Fatalf("unexpected conditions %v of the test directory", conditions)
+	}
+
+	m = newStorageMonitor(root, 1<<62)
+	m.check()
+	if conditions := m.degraded(); len(conditions) != 1 || conditions[0] != storageDiskPressure {
+		t.Fatalf("expected disk pressure, got %v", conditions)
+	}
+	if conditions := (*storageMonitor)(nil).degraded(); conditions != nil {
+		t.Errorf("unexpected conditions %v without monitor", conditions)
+	}
+
+	if _, err := exec.LookPath("/bin/buildah"); err != nil {
+		t.Skip("buildah not installed")
+	}
+	ids := &identityServer{storageRoot: root, storage: m}
+	if resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{}); err != nil || resp.GetReady().GetValue() {
+		t.Errorf("expected a driver that is not ready, got %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// maxSymlinks bounds the number of symlinks followed when resolving a path
+// inside an image, like MAXSYMLINKS of the kernel.
+const maxSymlinks = 40
+
+// volumeSubPath returns the cleaned path attribute, or "" if the whole
+// rootfs is published.
+func volumeSubPath(attrib map[string]string) (string, error) {
+	p, ok := attrib["path"]
+	if !ok {
+		return "", nil
+	}
+	if p == "" {
+		return "", fmt.Errorf("path must not be empty")
+	}
+	if strings.ContainsRune(p, 0) {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == ".." {
+			return "", fmt.Errorf("path %q must not contain '..'", p)
+		}
+	}
+	p = filepath.Clean("/" + p)
+	if p == "/" {
+		return "", nil
+	}
+	return p, nil
+}
+
+// resolveInRoot resolves path below root, following symlinks as if root
+// were the filesystem root, so that links in the image cannot point outside
+// of it.
+func resolveInRoot(root, path string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(path, "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many symlinks resolving %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// subPathSource returns the part of the rootfs to publish for the path
+// attribute and whether it is a single file.
+func subPathSource(rootfs, subPath string) (string, bool, error) {
+	if subPath == "" {
+		return rootfs, false, nil
+	}
+	p, err := resolveInRoot(rootfs, subPath)
+	if err != nil {
+		return "", false, fmt.Errorf("path %s not found in image: %v", subPath, err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", false, err
+	}
+	switch {
+	case fi.IsDir():
+		return p, false, nil
+	case fi.Mode().IsRegular():
+		return p, true, nil
+	default:
+		return "", false, fmt.Errorf("path %s in image is neither a directory nor a regular file", subPath)
+	}
+}
+
+// makeFileTarget turns targetPath into an empty file a single file can be
+// mounted on. An empty directory, as created for directory volumes, is
+// replaced.
+func makeFileTarget(targetPath string) error {
+	fi, err := os.Lstat(targetPath)
+	if err == nil && fi.IsDir() {
+		if err := os.Remove(targetPath); err != nil {
+			return err
+		}
+	} else if err == nil && !fi.Mode().IsRegular() {
+		return fmt.Errorf("target %s is neither a directory nor a regular file", targetPath)
+	}
+	return makeFile(targetPath)
+}
+
+// publishFile publishes the single file src at targetPath. Bind mode bind
+// mounts it, tmpfs mode copies it, so the volume does not depend on the
+// container after publishing.
+func (ns *nodeServer) publishFile(volumeId, mode, src, targetPath string, o *owner, p *permissions, readOnly bool) error {
+	switch mode {
+	case modeBind:
+		if err := makeFileTarget(targetPath); err != nil {
+			return err
+		}
+		options := []string{"bind"}
+		if readOnly {
+			options = append(options, "ro")
+		}
+		return mount.New("").Mount(src, targetPath, "", options)
+	case modeTmpfs:
+		if err := makeFileTarget(targetPath); err != nil {
+			return err
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		tmp := targetPath + ".tmp"
+		os.Remove(tmp)
+		c := &copier{stripXattrs: ns.stripXattrs, owner: o, perms: p}
+		if err := copyFile(src, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := c.copyMetadata(src, info, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if readOnly {
+			os.Chmod(tmp, info.Mode().Perm()&^0222)
+		}
+		if err := os.Rename(tmp, targetPath); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		ns.releaseContainer(volumeId)
+		return nil
+	default:
+		return fmt.Errorf("publishing a single file is not supported in %s mode", mode)
+	}
+}
@@ -0,0 +1,52 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	rootfs := t.TempDir()
+	os.MkdirAll(filepath.Join(rootfs, "usr", "share", "myapp"), 0755)
+	os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)
+	os.Symlink("/usr/share/myapp", filepath.Join(rootfs, "etc", "myapp"))
+	os.Symlink("../usr/share", filepath.Join(rootfs, "etc", "share"))
+	os.Symlink("/", filepath.Join(rootfs, "etc", "root"))
+	os.Symlink("loop", filepath.Join(rootfs, "etc", "loop"))
+	ioutil.WriteFile(filepath.Join(rootfs, "etc", "hosts"), nil, 0644)
+
+	for path, want := range map[string]string{
+		"/etc/myapp":          "usr/share/myapp",
+		"etc/share/myapp":     "usr/share/myapp",
+		"/etc/root/etc":       "etc",
+		"/../../etc/root/../": "",
+	} {
+		got, err := resolveInRoot(rootfs, path)
+		if err != nil || got != filepath.Join(rootfs, want) {
+			t.Errorf("resolveInRoot(%q) = %q, %v, want %q", path, got, err, filepath.Join(rootfs, want))
+		}
+	}
+	if _, err := resolveInRoot(rootfs, "/etc/loop"); err == nil {
+		t.Errorf("expected an error for a symlink loop")
+	}
+	if p, isFile, err := subPathSource(rootfs, "/etc/hosts"); err != nil || !isFile || p != filepath.Join(rootfs, "etc", "hosts") {
+		t.Errorf("subPathSource for a file = %q, %v, %v", p, isFile, err)
+	}
+	if _, _, err := subPathSource(rootfs, "/missing"); err == nil {
+		t.Errorf("expected an error for a missing path")
+	}
+
+	for attr, want := range map[string]string{"/": "", "etc/./myapp/": "/etc/myapp"} {
+		got, err := volumeSubPath(map[string]string{"path": attr})
+		if err != nil || got != want {
+			t.Errorf("volumeSubPath(%q) = %q, %v, want %q", attr, got, err, want)
+		}
+	}
+	for _, attr := range []string{"", "../etc", "/etc/../../usr"} {
+		if _, err := volumeSubPath(map[string]string{"path": attr}); err == nil {
+			t.Errorf("expected an error for path %q", attr)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies. Links are unsafe if they are absolute or leave the
+// published directory with "..": a privileged pod following them reaches
+// paths of its own filesystem or the host instead of volume content.
+const (
+	// symlinkPreserve publishes links unchanged.
+	symlinkPreserve = "preserve"
+	// symlinkResolveInternal rewrites unsafe links into relative links to
+	// the same path inside the volume.
+	symlinkResolveInternal = "resolve-internal"
+	// symlinkRejectAbsolute refuses to publish volumes with unsafe links.
+	symlinkRejectAbsolute = "reject-absolute"
+)
+
+// volumeSymlinkPolicy returns the symlinkPolicy attribute.
+func volumeSymlinkPolicy(attrib map[string]string) (string, error) {
+	switch policy := attrib["symlinkPolicy"]; policy {
+	case "", symlinkPreserve:
+		return symlinkPreserve, nil
+	case symlinkResolveInternal, symlinkRejectAbsolute:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported symlinkPolicy %q", policy)
+	}
+}
+
+// internalTarget checks the target of the link at rel, a slash separated
+// path relative to the volume root. It returns whether the target is
+// unsafe and a relative target to the same path inside the volume, with
+// ".." stopping at the volume root like at the filesystem root.
+func internalTarget(rel, target string) (string, bool) {
+	dir := path.Dir("/" + rel)
+	unsafe := path.IsAbs(target)
+	if !unsafe {
+		depth := 0
+		if dir != "/" {
+			depth = strings.Count(dir, "/")
+		}
+		for _, name := range strings.Split(target, "/") {
+			switch name {
+			case "", ".":
+			case "..":
+				depth--
+			default:
+				depth++
+			}
+			if depth < 0 {
+				unsafe = true
+				break
+			}
+		}
+	}
+	if !unsafe {
+		return target, false
+	}
+
+	resolved := path.Join("/", target)
+	if !path.IsAbs(target) {
+		resolved = path.Join(dir, target)
+	}
+	internal, err := filepath.Rel(dir, resolved)
+	if err != nil {
+		return target, true
+	}
+	return filepath.ToSlash(internal), true
+}
+
+// applySymlinkPolicy checks the links below root against policy. With
+// reject-absolute it fails on the first unsafe link, with resolve-internal
+// and rewrite set it replaces unsafe links in place.
+func applySymlinkPolicy(root, policy string, rewrite bool) error {
+	if policy == symlinkPreserve || (policy == symlinkResolveInternal && !rewrite) {
+		return nil
+	}
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		internal, unsafe := internalTarget(filepath.ToSlash(rel), target)
+		if !unsafe {
+			return nil
+		}
+		if policy == symlinkRejectAbsolute {
+			return fmt.Errorf("symlink /%s points to %s outside of the volume", filepath.ToSlash(rel), target)
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		return os.Symlink(internal, p)
+	})
+}
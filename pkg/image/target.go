@@ -0,0 +1,147 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+var wedgedTargets = metricsRegistry.NewCounterVec("image_populator_wedged_targets_total",
+	"Wedged target paths unmounted lazily on publish.")
+
+// createTarget creates targetPath, a file for block volumes and a directory
+// otherwise, with all missing parents. It returns the topmost path it
+// created, "" if targetPath already existed, so exactly what the driver
+// created can be removed again.
+func createTarget(targetPath string, isFile bool) (string, error) {
+	created := ""
+	for p := filepath.Clean(targetPath); ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		created = p
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	var err error
+	if isFile {
+		err = makeFile(targetPath)
+	} else {
+		err = os.MkdirAll(targetPath, 0750)
+	}
+	if err != nil {
+		removeTarget(targetPath, created)
+		return "", err
+	}
+	return created, nil
+}
+
+// removeTarget removes targetPath and its parents up to created, as returned
+// by createTarget. Directories that are not empty, e.g. because the kubelet
+// keeps other files in them, or still mounted are left alone.
+func removeTarget(targetPath, created string) {
+	targetPath = filepath.Clean(targetPath)
+	if created == "" || (created != targetPath && !strings.HasPrefix(targetPath, created+string(filepath.Separator))) {
+		return
+	}
+	for p := targetPath; ; p = filepath.Dir(p) {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			glog.V(4).Infof("keeping %s: %v", p, err)
+			return
+		}
+		if p == created {
+			return
+		}
+	}
+}
+
+// maxWedgedMounts bounds the mounts recoverTarget detaches from one target.
+const maxWedgedMounts = 8
+
+// recoverTarget lazily unmounts targetPath while it is wedged, so a publish
+// can mount it again instead of failing until someone intervenes on the
+// node. Without --force-remount it does nothing and the publish fails as
+// before.
+func (ns *nodeServer) recoverTarget(targetPath string) error {
+	if !ns.forceRemount {
+		return nil
+	}
+	for i := 0; i < maxWedgedMounts; i++ {
+		_, err := os.Stat(targetPath)
+		if !isWedgedMount(err) {
+			return nil
+		}
+		logWarning("target path is wedged, unmounting it lazily", "target_path", targetPath, "error", err)
+		wedgedTargets.Inc()
+		if err := lazyUnmount(targetPath); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("target path %s is still wedged after %d unmounts", targetPath, maxWedgedMounts)
+}
+
+// checkTargetPath verifies that targetPath lies within podsDir, the pods
+// directory of the kubelet, also after resolving symlinks in the part of it
+// that exists. Otherwise a request could make the driver, which runs
+// privileged, mount over or remove host paths. An empty podsDir disables
+// the check.
+func checkTargetPath(podsDir, targetPath string) error {
+	if podsDir == "" {
+		return nil
+	}
+	if !filepath.IsAbs(targetPath) {
+		return fmt.Errorf("target path %s is not absolute", targetPath)
+	}
+	root, err := filepath.EvalSymlinks(podsDir)
+	if err != nil {
+		return fmt.Errorf("cannot resolve the kubelet pods directory: %v", err)
+	}
+	if !isBelow(filepath.Clean(targetPath), filepath.Clean(podsDir)) {
+		return fmt.Errorf("target path %s is not within %s", targetPath, podsDir)
+	}
+
+	// Resolve the deepest existing part, the rest is created below it.
+	existing, rest := filepath.Clean(targetPath), ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return fmt.Errorf("cannot resolve target path %s: %v", targetPath, err)
+	}
+	if !isBelow(filepath.Join(resolved, rest), root) {
+		return fmt.Errorf("target path %s resolves to %s, which is not within %s", targetPath, filepath.Join(resolved, rest), podsDir)
+	}
+	return nil
+}
+
+// isBelow reports whether the clean path p lies below dir.
+func isBelow(p, dir string) bool {
+	return strings.HasPrefix(p, dir+string(filepath.Separator))
+}
@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// isWedgedMount reports whether err comes from a mount that no longer
+// responds, like a stale NFS handle or a FUSE mount whose server is gone.
+func isWedgedMount(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == unix.ESTALE || err == unix.ENOTCONN
+}
+
+// lazyUnmount detaches the mount at path, even if it is busy or does not
+// respond.
+func lazyUnmount(path string) error {
+	return unix.Unmount(path, unix.MNT_DETACH)
+}
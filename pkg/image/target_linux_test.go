@@ -0,0 +1,28 @@
+package image
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRecoverTarget(t *testing.T) {
+	for _, err := range []error{&os.PathError{Op: "stat", Path: "/target", Err: unix.ESTALE}, unix.ENOTCONN} {
+		if !isWedgedMount(err) {
+			t.Errorf("%v not recognized as wedged mount", err)
+		}
+	}
+	if isWedgedMount(&os.PathError{Op: "stat", Path: "/target", Err: unix.ENOENT}) {
+		t.Error("missing target recognized as wedged mount")
+	}
+
+	target := t.TempDir()
+	ns := &nodeServer{forceRemount: true}
+	if err := ns.recoverTarget(target); err != nil {
+		t.Errorf("healthy target not left alone: %v", err)
+	}
+	if err := ns.recoverTarget(target + "/missing"); err != nil {
+		t.Errorf("missing target not left alone: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckTargetPath(t *testing.T) {
+	root := t.TempDir()
+	pods := filepath.Join(root, "pods")
+	volumes := filepath.Join(pods, "uid", "volumes", "kubernetes.io~csi")
+	os.MkdirAll(volumes, 0755)
+	os.Mkdir(filepath.Join(root, "etc"), 0755)
+	os.Symlink(filepath.Join(root, "etc"), filepath.Join(volumes, "escape"))
+	os.Symlink(volumes, filepath.Join(pods, "inside"))
+
+	for target, valid := range map[string]bool{
+		filepath.Join(volumes, "vol", "mount"):          true,
+		filepath.Join(pods, "inside", "vol", "mount"):   true,
+		filepath.Join(root, "etc"):                      false,
+		pods:                                            false,
+		filepath.Join(volumes, "..", "..", "..", ".."):  false,
+		filepath.Join(volumes, "escape"):                false,
+		filepath.Join(volumes, "escape", "new", "path"): false,
+		"relative/path":                                 false,
+	} {
+		if err := checkTargetPath(pods, target); (err == nil) != valid {
+			t.Errorf("unexpected result for %s: %v", target, err)
+		}
+	}
+	if err := checkTargetPath("", filepath.Join(root, "etc")); err != nil {
+		t.Errorf("check not disabled without pods directory: %v", err)
+	}
+}
+
+func TestCreateTarget(t *testing.T) {
+	root := t.TempDir()
+	target := filepath.Join(root, "pods", "uid", "mount")
+	created, err := createTarget(target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != filepath.Join(root, "pods") {
+		t.Errorf("unexpected created path %s", created)
+	}
+	if fi, err := os.Stat(target); err != nil || !fi.IsDir() {
+		t.Fatalf("target not created: %v", err)
+	}
+
+	// Directories holding other files are kept.
+	if err := ioutil.WriteFile(filepath.Join(root, "pods", "other"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	removeTarget(target, created)
+	if _, err := os.Stat(filepath.Join(root, "pods", "uid")); !os.IsNotExist(err) {
+		t.Errorf("created directory not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "pods")); err != nil {
+		t.Errorf("directory with other files removed: %v", err)
+	}
+
+	// Existing targets and paths outside of the target are not touched.
+	if created, err := createTarget(root, false); err != nil || created != "" {
+		t.Errorf("unexpected result for an existing target: %q, %v", created, err)
+	}
+	removeTarget(filepath.Join(root, "pods"), root)
+	removeTarget(root, filepath.Join(root, "pods"))
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("directory outside of the created path removed: %v", err)
+	}
+}
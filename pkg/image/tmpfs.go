@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// publishTmpfs mounts a tmpfs of the given size at targetPath and copies the
+// container rootfs, or the part of it selected by the filter, into it. The
+// content lives in memory and disappears with the unmount on unpublish.
+func (ns *nodeServer) publishTmpfs(volumeId, rootfs, targetPath string, size int64, content *contentOptions, readOnly bool) error {
+	if size == 0 {
+		size = ns.tmpfsSize
+	}
+
+	mounter := mount.New("")
+	if err := mounter.Mount("tmpfs", targetPath, "tmpfs", []string{"size=" + strconv.FormatInt(size, 10)}); err != nil {
+		return err
+	}
+
+	if err := ns.fillTmpfs(rootfs, targetPath, content); err != nil {
+		mounter.Unmount(targetPath)
+		return err
+	}
+	if readOnly {
+		if err := mounter.Mount("tmpfs", targetPath, "tmpfs", []string{"remount", "ro"}); err != nil {
+			mounter.Unmount(targetPath)
+			return err
+		}
+	}
+
+	// The content has been copied, the container does not need to stay
+	// mounted.
+	ns.releaseContainer(volumeId)
+	return nil
+}
+
+// fillTmpfs replaces the content of the tmpfs at targetPath with a copy of
+// rootfs.
+func (ns *nodeServer) fillTmpfs(rootfs, targetPath string, content *contentOptions) error {
+	c := content.copier(ns.stripXattrs)
+	if err := swapContent(targetPath, func(dir string) error {
+		return c.copyTree(rootfs, dir)
+	}); err != nil {
+		return err
+	}
+	// The volume root takes the owner and mode of the image root, like
+	// the directory holding the content.
+	info, err := os.Lstat(rootfs)
+	if err != nil {
+		return err
+	}
+	if err := c.copyMetadata(rootfs, info, targetPath); err != nil {
+		return err
+	}
+
+	// So do the links of the layout.
+	if content.owner == nil {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(targetPath)
+	if err != nil {
+		return err
+	}
+	uid, gid := content.owner.ids(-1, -1)
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if err := os.Lchown(filepath.Join(targetPath, entry.Name()), uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseContainer unmounts the containers of a volume whose content has
+// been copied, including the overlay and layers of a merged volume.
+func (ns *nodeServer) releaseContainer(volumeId string) {
+	containers := []string{ns.containerName(volumeId)}
+	if merged := ns.mergedRoot(volumeId); merged != "" {
+		if err := mount.New("").Unmount(merged); err != nil {
+			glog.Warningf("cannot unmount merged images of volume %s: %v", volumeId, err)
+		}
+		layers, _ := ns.recordedLayers(volumeId)
+		containers = append(containers, layers...)
+	}
+	for _, container := range containers {
+		if output, err := ns.runVolumeCmd(volumeId, []string{"umount", container}); err != nil {
+			glog.Warningf("cannot unmount container %s: %v: %s", container, err, output)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"runtime"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+const (
+	topologyArch   = "kubernetes.io/arch"
+	topologyRegion = "topology.kubernetes.io/region"
+	topologyZone   = "topology.kubernetes.io/zone"
+)
+
+// nodeTopologyLabels maps topology keys to the node labels they are read
+// from, in order of preference.
+var nodeTopologyLabels = map[string][]string{
+	topologyRegion: {"topology.kubernetes.io/region", "failure-domain.beta.kubernetes.io/region"},
+	topologyZone:   {"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"},
+}
+
+// nodeTopology returns the topology segments of this node: the architecture,
+// which determines the images it can run, and the region and zone labels of
+// the node object if it can be read.
+func nodeTopology(nodeName string) map[string]string {
+	segments := map[string]string{topologyArch: runtime.GOARCH}
+
+	labels, err := nodeLabels(nodeName)
+	if err != nil {
+		glog.Warningf("cannot read node labels, reporting architecture only: %v", err)
+		return segments
+	}
+	return topologyFromLabels(segments, labels)
+}
+
+// nodeLabels reads the labels of the node object.
+func nodeLabels(nodeName string) (map[string]string, error) {
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return getNodeLabels(client, nodeName)
+}
+
+// getNodeLabels reads the labels of the node object with client.
+func getNodeLabels(client *kube.Client, nodeName string) (map[string]string, error) {
+	var node struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := client.Do("GET", "/api/v1/nodes/"+nodeName, nil, &node); err != nil {
+		return nil, err
+	}
+	return node.Metadata.Labels, nil
+}
+
+func topologyFromLabels(segments, labels map[string]string) map[string]string {
+	for key, candidates := range nodeTopologyLabels {
+		for _, label := range candidates {
+			if v := labels[label]; v != "" {
+				segments[key] = v
+				break
+			}
+		}
+	}
+	return segments
+}
+
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp := &csi.NodeGetInfoResponse{
+		NodeId:            ns.nodeID,
+		MaxVolumesPerNode: ns.maxVolumes,
+	}
+	if ns.topology != nil {
+		resp.AccessibleTopology = &csi.Topology{Segments: ns.topology}
+	}
+	return resp, nil
+}
+
+func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	resp, err := ids.DefaultIdentityServer.GetPluginCapabilities(ctx, req)
+	if err != nil || !ids.topology {
+		return resp, err
+	}
+	resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+			},
+		},
+	})
+	return resp, nil
+}
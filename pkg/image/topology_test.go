@@ -0,0 +1,28 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+func TestNodeGetInfoTopology(t *testing.T) {
+	segments := topologyFromLabels(map[string]string{topologyArch: "amd64"}, map[string]string{
+		"failure-domain.beta.kubernetes.io/region": "eu-nl-1",
+		"failure-domain.beta.kubernetes.io/zone":   "eu-nl-1a",
+		"topology.kubernetes.io/zone":              "eu-nl-1b",
+	})
+	if segments[topologyRegion] != "eu-nl-1" || segments[topologyZone] != "eu-nl-1b" {
+		t.Fatalf("unexpected segments %v", segments)
+	}
+
+	ns := &nodeServer{nodeID: "node-1", topology: segments, maxVolumes: 20}
+	resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetNodeId() != "node-1" || resp.GetMaxVolumesPerNode() != 20 || resp.GetAccessibleTopology().GetSegments()[topologyArch] != "amd64" {
+		t.Fatalf("unexpected response %v", resp)
+	}
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Layer media types with a registered unpacker.
+const (
+	mediaTypeLayer          = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeLayerGzip      = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeDockerLayer    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeRaw            = "application/octet-stream"
+	mediaTypeWasm           = "application/vnd.wasm.content.layer.v1+wasm"
+	mediaTypeModelWeight    = "application/vnd.cncf.model.weight.v1"
+	mediaTypeModelConfig    = "application/vnd.cncf.model.weight.config.v1"
+	mediaTypeModelDoc       = "application/vnd.cncf.model.doc.v1"
+	mediaTypeModelCode      = "application/vnd.cncf.model.code.v1"
+	mediaTypeModelDataset   = "application/vnd.cncf.model.dataset.v1"
+	annotationTitle         = "org.opencontainers.image.title"
+	whiteoutPrefix          = ".wh."
+	whiteoutOpaqueDirectory = ".wh..wh..opq"
+)
+
+// unpacker writes the content of a layer blob into dir.
+type unpacker func(blob io.Reader, layer ociDescriptor, dir string) error
+
+// unpackers maps layer media types to the unpacker of their content. A new
+// kind of artifact only needs its media types registered here.
+var unpackers = map[string]unpacker{
+	// Image layers are applied like a rootfs, including whiteouts.
+	mediaTypeLayer:       unpackTar,
+	mediaTypeLayerGzip:   gunzip(unpackTar),
+	mediaTypeDockerLayer: gunzip(unpackTar),
+
+	// Single files are named after their title annotation, as set by
+	// oras push.
+	mediaTypeRaw:  unpackFile(""),
+	mediaTypeWasm: unpackFile("module.wasm"),
+
+	// CNCF ModelPack layers come as raw files or tarballs.
+	mediaTypeModelWeight + ".raw":       unpackFile(""),
+	mediaTypeModelWeight + ".tar":       unpackTar,
+	mediaTypeModelWeight + ".tar+gzip":  gunzip(unpackTar),
+	mediaTypeModelConfig + ".raw":       unpackFile(""),
+	mediaTypeModelConfig + ".tar":       unpackTar,
+	mediaTypeModelDoc + ".raw":          unpackFile(""),
+	mediaTypeModelDoc + ".tar":          unpackTar,
+	mediaTypeModelCode + ".raw":         unpackFile(""),
+	mediaTypeModelCode + ".tar":         unpackTar,
+	mediaTypeModelDataset + ".raw":      unpackFile(""),
+	mediaTypeModelDataset + ".tar":      unpackTar,
+	mediaTypeModelDataset + ".tar+gzip": gunzip(unpackTar),
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// blobPath returns the path of a blob in an OCI image layout.
+func blobPath(layout, digest string) (string, error) {
+	if !digestPattern.MatchString(digest) {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	return filepath.Join(layout, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")), nil
+}
+
+// readManifest returns the digest and manifest of the single artifact in an
+// OCI image layout. Every layer must have an unpacker.
+func readManifest(layout string) (string, *ociManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return "", nil, err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return "", nil, fmt.Errorf("cannot parse index: %v", err)
+	}
+	if len(index.Manifests) != 1 {
+		return "", nil, fmt.Errorf("expected a single manifest, found %d", len(index.Manifests))
+	}
+	digest := index.Manifests[0].Digest
+	p, err := blobPath(layout, digest)
+	if err != nil {
+		return "", nil, err
+	}
+	if data, err = ioutil.ReadFile(p); err != nil {
+		return "", nil, err
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", nil, fmt.Errorf("cannot parse manifest %s: %v", digest, err)
+	}
+	for _, layer := range m.Layers {
+		if _, ok := unpackers[layer.MediaType]; !ok {
+			return "", nil, unsupportedMediaTypeError(layer.MediaType)
+		}
+	}
+	return digest, &m, nil
+}
+
+// unsupportedMediaTypeError is returned for layers without an unpacker.
+type unsupportedMediaTypeError string
+
+func (e unsupportedMediaTypeError) Error() string {
+	return fmt.Sprintf("no unpacker for layer media type %q", string(e))
+}
+
+// unpackLayers unpacks the layers of a manifest into dir in order.
+func unpackLayers(layout string, m *ociManifest, dir string) error {
+	for _, layer := range m.Layers {
+		p, err := blobPath(layout, layer.Digest)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		glog.V(4).Infof("unpacking layer %s of type %s", layer.Digest, layer.MediaType)
+		err = unpackers[layer.MediaType](f, layer, dir)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("cannot unpack layer %s: %v", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// gunzip decompresses the blob for the wrapped unpacker.
+func gunzip(u unpacker) unpacker {
+	return func(blob io.Reader, layer ociDescriptor, dir string) error {
+		r, err := gzip.NewReader(blob)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return u(r, layer, dir)
+	}
+}
+
+// unpackFile writes the blob to the file named by the title annotation of
+// the layer, name or the digest if there is none.
+func unpackFile(name string) unpacker {
+	return func(blob io.Reader, layer ociDescriptor, dir string) error {
+		rel := layer.Annotations[annotationTitle]
+		if rel == "" {
+			rel = name
+		}
+		if rel == "" {
+			rel = strings.TrimPrefix(layer.Digest, "sha256:")
+		}
+		target, err := createInRoot(dir, rel)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, blob); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+// unpackTar applies a tar layer to dir, honoring overlay whiteouts of
+// previous layers.
+func unpackTar(blob io.Reader, layer ociDescriptor, dir string) error {
+	r := tar.NewReader(blob)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if rel == "" {
+			continue
+		}
+
+		base := path.Base(rel)
+		if base == whiteoutOpaqueDirectory {
+			parent, err := createInRoot(dir, path.Dir(rel)+"/")
+			if err != nil {
+				return err
+			}
+			entries, err := ioutil.ReadDir(parent)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := os.RemoveAll(filepath.Join(parent, entry.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			target, err := createInRoot(dir, path.Join(path.Dir(rel), strings.TrimPrefix(base, whiteoutPrefix)))
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		target, err := createInRoot(dir, rel)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, mode); err != nil && !os.IsExist(err) {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, r); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := createInRoot(dir, strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/"))
+			if err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		default:
+			glog.V(4).Infof("skipping %s with unsupported tar type %c", hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+			continue
+		}
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		// Chmod after chown, as chown clears the setuid and setgid bits.
+		if err := os.Chmod(target, os.FileMode(hdr.Mode)&os.ModePerm|tarSpecialBits(hdr.Mode)); err != nil {
+			return err
+		}
+		os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	}
+}
+
+// tarSpecialBits converts the setuid, setgid and sticky bits of a tar mode.
+func tarSpecialBits(mode int64) os.FileMode {
+	var bits os.FileMode
+	if mode&04000 != 0 {
+		bits |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		bits |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		bits |= os.ModeSticky
+	}
+	return bits
+}
+
+// createInRoot returns the path of rel below root, creating the missing
+// directories above it. A trailing slash creates rel itself. Like a layer
+// unpacked by the container runtime, entries cannot leave root through ".."
+// or symlinked directories.
+func createInRoot(root, rel string) (string, error) {
+	dir := strings.HasSuffix(rel, "/")
+	rel = path.Clean("/" + rel)
+	names := strings.Split(strings.TrimPrefix(rel, "/"), "/")
+	if !dir {
+		names = names[:len(names)-1]
+	}
+	p := root
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		p = filepath.Join(p, name)
+		fi, err := os.Lstat(p)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(p, 0755); err != nil {
+				return "", err
+			}
+		case err != nil:
+			return "", err
+		case !fi.IsDir():
+			return "", fmt.Errorf("%s is not a directory", strings.TrimPrefix(p, root))
+		}
+	}
+	return filepath.Join(root, rel), nil
+}
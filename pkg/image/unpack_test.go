@@ -0,0 +1,144 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarEntry is a file, a directory with a trailing slash in the name or a
+// symlink with a link target.
+type tarEntry struct {
+	name, content, link string
+}
+
+func makeTar(t *testing.T, gzipped bool, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		switch {
+		case e.link != "":
+			hdr = &tar.Header{Name: e.name, Typeflag: tar.TypeSymlink, Linkname: e.link}
+		case e.name[len(e.name)-1] == '/':
+			hdr = &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			w.Write([]byte(e.content))
+		}
+	}
+	w.Close()
+	if !gzipped {
+		return buf.Bytes()
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(buf.Bytes())
+	zw.Close()
+	return gz.Bytes()
+}
+
+// writeLayout writes an OCI image layout with a single manifest of the
+// given layers and returns its directory.
+func writeLayout(t *testing.T, layers []ociDescriptor, blobs [][]byte) string {
+	layout := t.TempDir()
+	os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), 0755)
+	writeBlob := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		p, _ := blobPath(layout, digest)
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+	for i := range layers {
+		layers[i].Digest = writeBlob(blobs[i])
+		layers[i].Size = int64(len(blobs[i]))
+	}
+	manifest, _ := json.Marshal(ociManifest{MediaType: "application/vnd.oci.image.manifest.v1+json", Layers: layers})
+	index, _ := json.Marshal(ociIndex{Manifests: []ociDescriptor{{MediaType: "application/vnd.oci.image.manifest.v1+json", Digest: writeBlob(manifest)}}})
+	if err := ioutil.WriteFile(filepath.Join(layout, "index.json"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+func TestUnpackLayers(t *testing.T) {
+	layout := writeLayout(t, []ociDescriptor{
+		{MediaType: mediaTypeLayerGzip},
+		{MediaType: mediaTypeLayer},
+		{MediaType: mediaTypeRaw, Annotations: map[string]string{annotationTitle: "models/weights.bin"}},
+		{MediaType: mediaTypeWasm},
+	}, [][]byte{
+		makeTar(t, true, tarEntry{name: "etc/"}, tarEntry{name: "etc/a", content: "a"}, tarEntry{name: "etc/b", content: "b"}),
+		makeTar(t, false, tarEntry{name: "etc/.wh.b"}, tarEntry{name: "etc/a", content: "new a"}, tarEntry{name: "etc/link", link: "a"}),
+		[]byte("weights"),
+		[]byte("\x00asm"),
+	})
+	digest, manifest, err := readManifest(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !digestPattern.MatchString(digest) {
+		t.Errorf("unexpected manifest digest %q", digest)
+	}
+	dir := t.TempDir()
+	if err := unpackLayers(layout, manifest, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"etc/a": "new a", "models/weights.bin": "weights", "module.wasm": "\x00asm"} {
+		if content, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(content) != want {
+			t.Errorf("unexpected content of %s: %q, %v", name, content, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "etc/b")); !os.IsNotExist(err) {
+		t.Errorf("whiteout did not remove etc/b: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "etc/link")); err != nil || link != "a" {
+		t.Errorf("unexpected symlink %q: %v", link, err)
+	}
+}
+
+func TestUnpackLayersUnsupported(t *testing.T) {
+	layout := writeLayout(t, []ociDescriptor{{MediaType: "application/vnd.example.unknown"}}, [][]byte{[]byte("x")})
+	if _, _, err := readManifest(layout); err == nil {
+		t.Fatal("expected an error for a layer without unpacker")
+	} else if _, ok := err.(unsupportedMediaTypeError); !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestUnpackTarEscape(t *testing.T) {
+	outside := t.TempDir()
+	dir := t.TempDir()
+	blob := makeTar(t, false,
+		tarEntry{name: "../escaped", content: "x"},
+		tarEntry{name: "link", link: outside},
+	)
+	if err := unpackTar(bytes.NewReader(blob), ociDescriptor{}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err != nil {
+		t.Errorf("entry with .. not unpacked below the root: %v", err)
+	}
+
+	blob = makeTar(t, false, tarEntry{name: "link/evil", content: "x"})
+	if err := unpackTar(bytes.NewReader(blob), ociDescriptor{}, dir); err == nil {
+		t.Error("expected an error for an entry below a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+		t.Errorf("entry written through a symlink: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Update policies, selected by the "updatePolicy" volume attribute.
+const (
+	// updateNever keeps the content of the image pulled on publish.
+	updateNever = "Never"
+	// updateWatch polls the tag and refreshes the content when it moves
+	// to another digest.
+	updateWatch = "Watch"
+)
+
+// volumeUpdatePolicy returns the updatePolicy attribute.
+func volumeUpdatePolicy(attrib map[string]string) (string, error) {
+	switch policy := attrib["updatePolicy"]; policy {
+	case "", updateNever:
+		return updateNever, nil
+	case updateWatch:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported updatePolicy %q", policy)
+	}
+}
+
+// volumeResyncInterval returns the resyncInterval attribute, zero if it is
+// not set.
+func volumeResyncInterval(attrib map[string]string) (time.Duration, error) {
+	v, ok := attrib["resyncInterval"]
+	if !ok {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid resyncInterval %q: must be a positive duration like 15m", v)
+	}
+	return d, nil
+}
+
+// updateWatcher runs a refresh of every watched volume each interval.
+type updateWatcher struct {
+	// interval applies to volumes without resyncInterval, which is
+	// bounded by min and max.
+	interval time.Duration
+	min, max time.Duration
+	refresh  func(ctx context.Context, volumeId string) (bool, error)
+
+	mu      sync.Mutex
+	watches map[string]*volumeWatch
+}
+
+// volumeWatch is the refresh loop of a volume. Cancelling it also cancels
+// a refresh in progress, done is closed when the loop returned.
+type volumeWatch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newUpdateWatcher(interval, min, max time.Duration, refresh func(context.Context, string) (bool, error)) *updateWatcher {
+	return &updateWatcher{interval: interval, min: min, max: max, refresh: refresh, watches: map[string]*volumeWatch{}}
+}
+
+// volumeInterval returns the interval of a volume with the given
+// resyncInterval, zero for the default.
+func (w *updateWatcher) volumeInterval(resync time.Duration) time.Duration {
+	switch {
+	case resync == 0:
+		return w.interval
+	case w.min > 0 && resync < w.min:
+		return w.min
+	case w.max > 0 && resync > w.max:
+		return w.max
+	}
+	return resync
+}
+
+// enabled reports whether volumes can be watched.
+func (w *updateWatcher) enabled() bool {
+	return w != nil && w.interval > 0
+}
+
+// watch starts to watch a volume unless it is watched already. resync is
+// the resyncInterval of the volume.
+func (w *updateWatcher) watch(volumeId string, resync time.Duration) {
+	if !w.enabled() {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watches[volumeId]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := &volumeWatch{cancel: cancel, done: make(chan struct{})}
+	w.watches[volumeId] = watch
+	interval := w.volumeInterval(resync)
+	if interval != resync && resync != 0 {
+		logWarning("resyncInterval out of bounds", "volume_id", volumeId, "resync_interval", resync.String(), "interval", interval.String())
+	}
+	go w.run(ctx, volumeId, interval, watch.done)
+}
+
+// unwatch stops watching a volume and waits for a refresh in progress to
+// give up, so the volume can be torn down afterwards.
+func (w *updateWatcher) unwatch(volumeId string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	watch, ok := w.watches[volumeId]
+	delete(w.watches, volumeId)
+	w.mu.Unlock()
+	if ok {
+		watch.cancel()
+		<-watch.done
+	}
+}
+
+func (w *updateWatcher) run(ctx context.Context, volumeId string, interval time.Duration, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := w.refresh(ctx, volumeId); err != nil && ctx.Err() == nil {
+				logWarning("cannot update volume", "volume_id", volumeId, "error", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package image
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestResyncInterval(t *testing.T) {
+	w := newUpdateWatcher(5*time.Minute, time.Minute, time.Hour, nil)
+	for _, test := range []struct {
+		attrib map[string]string
+		want   time.Duration
+	}{
+		{map[string]string{}, 5 * time.Minute},
+		{map[string]string{"resyncInterval": "15m"}, 15 * time.Minute},
+		{map[string]string{"resyncInterval": "10s"}, time.Minute},
+		{map[string]string{"resyncInterval": "48h"}, time.Hour},
+	} {
+		resync, err := volumeResyncInterval(test.attrib)
+		if err != nil {
+			t.Errorf("volumeResyncInterval(%v) failed: %v", test.attrib, err)
+			continue
+		}
+		if got := w.volumeInterval(resync); got != test.want {
+			t.Errorf("interval for %v is %v, want %v", test.attrib, got, test.want)
+		}
+	}
+	for _, v := range []string{"15", "-1m", "0s", "often"} {
+		if _, err := volumeResyncInterval(map[string]string{"resyncInterval": v}); err == nil {
+			t.Errorf("expected an error for resyncInterval %q", v)
+		}
+	}
+}
+
+func TestUnwatchWaitsForRefresh(t *testing.T) {
+	started := make(chan struct{})
+	finished := false
+	w := newUpdateWatcher(time.Millisecond, 0, 0, func(ctx context.Context, volumeId string) (bool, error) {
+		close(started)
+		<-ctx.Done()
+		finished = true
+		return false, ctx.Err()
+	})
+	w.watch("vol", 0)
+	<-started
+	w.unwatch("vol")
+	if !finished {
+		t.Fatal("unwatch returned during a refresh")
+	}
+}
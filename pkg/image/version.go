@@ -0,0 +1,73 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+// BuildahVersion returns the version of the buildah binary the driver uses,
+// or "unknown" if it cannot be run.
+func BuildahVersion() string {
+	output, err := exec.Command("/bin/buildah", "version").Output()
+	if err != nil {
+		return "unknown"
+	}
+	return parseBuildahVersion(output)
+}
+
+// parseBuildahVersion extracts the version from the output of
+// "buildah version".
+func parseBuildahVersion(output []byte) string {
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), ":", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "Version" {
+			return strings.TrimSpace(fields[1])
+		}
+	}
+	return "unknown"
+}
+
+// buildManifest returns the build information reported in the manifest of
+// GetPluginInfo.
+func buildManifest(buildDate, buildahVersion string) map[string]string {
+	m := map[string]string{
+		"go":      runtime.Version(),
+		"buildah": buildahVersion,
+	}
+	if buildDate != "" {
+		m["buildDate"] = buildDate
+	}
+	return m
+}
+
+func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	resp, err := ids.DefaultIdentityServer.GetPluginInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Manifest = ids.manifest
+	return resp, nil
+}
@@ -0,0 +1,15 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestParseBuildahVersion(t *testing.T) {
+	output := []byte("Version:         1.11.3\nGo Version:      go1.12.9\nImage Spec:      1.0.1\n")
+	if v := parseBuildahVersion(output); v != "1.11.3" {
+		t.Fatalf("expected 1.11.3, got %q", v)
+	}
+	if v := parseBuildahVersion([]byte("garbage")); v != "unknown" {
+		t.Fatalf("expected unknown, got %q", v)
+	}
+}
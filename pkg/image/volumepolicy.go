@@ -0,0 +1,207 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+var volumePolicyReloads = metricsRegistry.NewCounterVec("image_populator_volume_policy_reloads_total",
+	"Reloads of the ImageVolumePolicy object by result.", "result")
+
+// VolumePolicy is the spec of an ImageVolumePolicy object. It is the part of
+// the driver policy that is managed cluster-wide instead of per node, and
+// applies in addition to the registry config.
+type VolumePolicy struct {
+	// Allow and Deny restrict the images volumes may use like the fields
+	// of RegistryConfig.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// SignaturePolicy is a containers-policy.json document pulls are
+	// verified against.
+	SignaturePolicy json.RawMessage `json:"signaturePolicy,omitempty"`
+	// MaxSizeLimit is the largest sizeLimit volumes may request.
+	MaxSizeLimit string `json:"maxSizeLimit,omitempty"`
+	// DefaultAttributes are added to the attributes of volumes that do not
+	// set them.
+	DefaultAttributes map[string]string `json:"defaultAttributes,omitempty"`
+
+	maxSizeLimit        int64
+	signaturePolicyFile string
+}
+
+// parseVolumePolicy decodes the spec of an ImageVolumePolicy object. The
+// signature policy is written to a file in dir named after its content, as
+// buildah and skopeo only read it from a file.
+func parseVolumePolicy(spec []byte, dir string) (*VolumePolicy, error) {
+	v := &VolumePolicy{}
+	dec := json.NewDecoder(bytes.NewReader(spec))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return nil, err
+	}
+	if v.MaxSizeLimit != "" {
+		limit, err := parseSize(v.MaxSizeLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxSizeLimit: %v", err)
+		}
+		v.maxSizeLimit = limit
+	}
+	if len(v.SignaturePolicy) > 0 {
+		var policy struct {
+			Default []json.RawMessage `json:"default"`
+		}
+		if err := json.Unmarshal(v.SignaturePolicy, &policy); err != nil || len(policy.Default) == 0 {
+			return nil, fmt.Errorf("invalid signaturePolicy: needs a default requirement")
+		}
+		sum := sha256.Sum256(v.SignaturePolicy)
+		path := filepath.Join(dir, "signature-policy-"+hex.EncodeToString(sum[:8])+".json")
+		if err := ioutil.WriteFile(path, v.SignaturePolicy, 0644); err != nil {
+			return nil, err
+		}
+		v.signaturePolicyFile = path
+	}
+	return v, nil
+}
+
+// check returns an error if the policy does not allow image.
+func (v *VolumePolicy) check(image string) error {
+	if v == nil {
+		return nil
+	}
+	normalized := normalizeImage(image)
+	if matchAnyImage(v.Deny, normalized) || len(v.Allow) > 0 && !matchAnyImage(v.Allow, normalized) {
+		return fmt.Errorf("image %s is not allowed by the volume policy", image)
+	}
+	return nil
+}
+
+// checkSizeLimit returns an error if sizeLimit exceeds the maximum of the
+// policy.
+func (v *VolumePolicy) checkSizeLimit(sizeLimit int64) error {
+	if v == nil || v.maxSizeLimit == 0 || sizeLimit <= v.maxSizeLimit {
+		return nil
+	}
+	return fmt.Errorf("sizeLimit %d exceeds the maximum of the volume policy, %s", sizeLimit, v.MaxSizeLimit)
+}
+
+// withDefaults returns attrib with the default attributes of the policy
+// added. attrib itself is not modified.
+func (v *VolumePolicy) withDefaults(attrib map[string]string) map[string]string {
+	if v == nil || len(v.DefaultAttributes) == 0 {
+		return attrib
+	}
+	merged := make(map[string]string, len(attrib)+len(v.DefaultAttributes))
+	for k, val := range v.DefaultAttributes {
+		merged[k] = val
+	}
+	for k, val := range attrib {
+		merged[k] = val
+	}
+	return merged
+}
+
+// volumePolicyWatcher keeps the volume policy of a registryPolicy in sync
+// with an ImageVolumePolicy object.
+type volumePolicyWatcher struct {
+	policy *registryPolicy
+	client *kube.Client
+	name   string
+	dir    string
+
+	spec []byte
+}
+
+func volumePolicyPath(name string) string {
+	return "/apis/" + crdGroup + "/" + crdVersion + "/imagevolumepolicies/" + name
+}
+
+// reload fetches the object and applies its spec if it changed. A missing
+// object removes the volume policy, an invalid spec is rejected and the
+// previous policy stays in effect.
+func (w *volumePolicyWatcher) reload() (bool, error) {
+	var object struct {
+		Spec json.RawMessage `json:"spec"`
+	}
+	err := w.client.Do("GET", volumePolicyPath(w.name), nil, &object)
+	if kube.IsNotFound(err) {
+		object.Spec, err = nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if w.spec != nil && bytes.Equal(object.Spec, w.spec) || w.spec == nil && object.Spec == nil {
+		return false, nil
+	}
+
+	var v *VolumePolicy
+	if object.Spec != nil {
+		if v, err = parseVolumePolicy(object.Spec, w.dir); err != nil {
+			return false, fmt.Errorf("invalid ImageVolumePolicy %s: %v", w.name, err)
+		}
+	}
+	w.policy.setVolumePolicy(v)
+	w.spec = object.Spec
+	return true, nil
+}
+
+// watch polls the object until the process exits.
+func (w *volumePolicyWatcher) watch() {
+	for {
+		time.Sleep(configPollInterval)
+		changed, err := w.reload()
+		switch {
+		case err != nil:
+			volumePolicyReloads.Inc("failure")
+			glog.Errorf("cannot reload volume policy, keeping the previous one: %v", err)
+		case changed:
+			volumePolicyReloads.Inc("success")
+			logInfo(0, "volume policy reloaded", "name", w.name, "present", w.spec != nil)
+		}
+	}
+}
+
+// watchVolumePolicy loads the ImageVolumePolicy object name and keeps it
+// applied to policy. The first load must succeed, so that no volume is
+// published without the policy.
+func watchVolumePolicy(policy *registryPolicy, name string) error {
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return err
+	}
+	w := &volumePolicyWatcher{policy: policy, client: client, name: name, dir: os.TempDir()}
+	if _, err := w.reload(); err != nil {
+		return err
+	}
+	if w.spec == nil {
+		glog.Warningf("ImageVolumePolicy %s does not exist, only the registry config applies", name)
+	}
+	go w.watch()
+	return nil
+}
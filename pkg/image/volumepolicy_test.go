@@ -0,0 +1,70 @@
+package image
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+func TestVolumePolicy(t *testing.T) {
+	spec := `{"deny": ["docker.io/library/busybox"], "maxSizeLimit": "1Gi", "defaultAttributes": {"mode": "tmpfs"},
+		"signaturePolicy": {"default": [{"type": "reject"}]}}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spec == "" || r.URL.Path != volumePolicyPath("default") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"spec": ` + spec + `}`))
+	}))
+	defer srv.Close()
+
+	p := &registryPolicy{}
+	w := &volumePolicyWatcher{policy: p, client: kube.NewClient(srv.URL, "", srv.Client()), name: "default", dir: t.TempDir()}
+	if changed, err := w.reload(); err != nil || !changed {
+		t.Fatalf("volume policy not loaded: %v %v", changed, err)
+	}
+	c := p.get()
+	if c.check("busybox:1.31") == nil || c.check("alpine") != nil {
+		t.Fatal("deny list not applied")
+	}
+	if v := c.volumePolicy(); v.checkSizeLimit(2<<30) == nil || v.checkSizeLimit(1<<30) != nil {
+		t.Fatal("maxSizeLimit not applied")
+	}
+	attrib := c.volumePolicy().withDefaults(map[string]string{"image": "alpine"})
+	if attrib["mode"] != "tmpfs" || attrib["image"] != "alpine" {
+		t.Fatalf("default attributes not applied: %v", attrib)
+	}
+	if content, err := ioutil.ReadFile(c.signaturePolicy()); err != nil || !strings.Contains(string(content), "reject") {
+		t.Fatalf("signature policy not written: %v", err)
+	}
+
+	// A registry config reload keeps the volume policy.
+	path := filepath.Join(t.TempDir(), "registries.json")
+	if err := ioutil.WriteFile(path, []byte(`{"allow": ["docker.io/*"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.path = path
+	if _, err := p.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if p.get().check("busybox") == nil || p.get().check("alpine") != nil || p.get().check("quay.io/org/app") == nil {
+		t.Fatal("registry config and volume policy not combined")
+	}
+
+	// An invalid spec is rejected and the previous policy kept.
+	spec = `{"maxSizeLimit": "lots"}`
+	if _, err := w.reload(); err == nil || p.get().volumePolicy().MaxSizeLimit != "1Gi" {
+		t.Fatalf("invalid volume policy applied: %v", err)
+	}
+
+	// Deleting the object removes the policy.
+	spec = ""
+	if changed, err := w.reload(); err != nil || !changed || p.get().check("busybox") != nil {
+		t.Fatalf("volume policy not removed: %v %v", changed, err)
+	}
+}
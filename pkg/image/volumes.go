@@ -0,0 +1,227 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Volume describes a volume published by the driver.
+type Volume struct {
+	ID          string    `json:"id"`
+	Image       string    `json:"image"`
+	Digest      string    `json:"digest,omitempty"`
+	Mode        string    `json:"mode"`
+	Block       bool      `json:"block,omitempty"`
+	Container   string    `json:"container"`
+	MountPath   string    `json:"mountPath,omitempty"`
+	SubPath     string    `json:"subPath,omitempty"`
+	File        bool      `json:"file,omitempty"`
+	ReadOnly    bool      `json:"readOnly,omitempty"`
+	TargetPath  string    `json:"targetPath"`
+	PublishedAt time.Time `json:"publishedAt"`
+	// Retained is the name the container is kept under on unpublish
+	// with the retainChanges attribute.
+	Retained string `json:"retained,omitempty"`
+	// Attributes are the volume attributes, which a refresh of the
+	// content applies again.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// CreatedTarget is the topmost directory the driver created for the
+	// target path, which unpublish removes again.
+	CreatedTarget string `json:"createdTarget,omitempty"`
+	// SharedTargets are further target paths the volume is published to
+	// by other pods on the node, bind mounts of TargetPath.
+	SharedTargets []string `json:"sharedTargets,omitempty"`
+	// SharedCreated maps shared targets to the topmost directory the
+	// driver created for them, like CreatedTarget.
+	SharedCreated map[string]string `json:"sharedCreated,omitempty"`
+	// Exported is set once the volume was exported on unpublish, so a
+	// retried unpublish does not export it again.
+	Exported bool `json:"exported,omitempty"`
+}
+
+// volumeTracker keeps the volumes currently published on this node and the
+// ones being published.
+type volumeTracker struct {
+	mu      sync.Mutex
+	volumes map[string]Volume
+	pending map[string]int
+	targets map[string]*targetClaim
+	locks   map[string]*volumeLock
+}
+
+// volumeLock serializes publish, unpublish and refresh of a volume. It is
+// removed once nobody holds or waits for it.
+type volumeLock struct {
+	held chan struct{}
+	n    int
+}
+
+// targetClaim records the volume being published to a target path.
+type targetClaim struct {
+	id string
+	n  int
+}
+
+func newVolumeTracker() *volumeTracker {
+	return &volumeTracker{volumes: map[string]Volume{}, pending: map[string]int{}, targets: map[string]*targetClaim{}, locks: map[string]*volumeLock{}}
+}
+
+// lock blocks until no other publish, unpublish or refresh of volume id
+// runs and returns the function to call when done. It gives up with the
+// error of ctx when ctx is done first.
+func (t *volumeTracker) lock(ctx context.Context, id string) (func(), error) {
+	t.mu.Lock()
+	l, ok := t.locks[id]
+	if !ok {
+		l = &volumeLock{held: make(chan struct{}, 1)}
+		t.locks[id] = l
+	}
+	l.n++
+	t.mu.Unlock()
+
+	done := func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if l.n--; l.n <= 0 {
+			delete(t.locks, id)
+		}
+	}
+	select {
+	case l.held <- struct{}{}:
+		return func() {
+			<-l.held
+			done()
+		}, nil
+	case <-ctx.Done():
+		done()
+		return nil, ctx.Err()
+	}
+}
+
+// begin marks a volume as being published and returns the function to call
+// when done.
+func (t *volumeTracker) begin(id string) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[id]++
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.pending[id]--; t.pending[id] <= 0 {
+			delete(t.pending, id)
+		}
+	}
+}
+
+// claimTarget reserves targetPath for a publish of volume id and returns the
+// function to call when done. If another volume is published or being
+// published to targetPath, it returns the ID of that volume instead, as
+// mounting over it would hide it from its pod.
+func (t *volumeTracker) claimTarget(id, targetPath string) (func(), string) {
+	targetPath = filepath.Clean(targetPath)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, v := range t.volumes {
+		if v.ID != id && (v.TargetPath != "" && filepath.Clean(v.TargetPath) == targetPath || v.sharesTarget(targetPath)) {
+			return nil, v.ID
+		}
+	}
+	claim, ok := t.targets[targetPath]
+	if ok && claim.id != id {
+		return nil, claim.id
+	}
+	if !ok {
+		claim = &targetClaim{id: id}
+		t.targets[targetPath] = claim
+	}
+	claim.n++
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if claim.n--; claim.n <= 0 {
+			delete(t.targets, targetPath)
+		}
+	}, ""
+}
+
+// inFlight returns the IDs of volumes being published, ordered by ID.
+func (t *volumeTracker) inFlight() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]string, 0, len(t.pending))
+	for id := range t.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// busy reports whether a volume is published or being published.
+func (t *volumeTracker) busy(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, published := t.volumes[id]
+	return published || t.pending[id] > 0
+}
+
+// whileIdle runs fn if no volume is published or being published, keeping
+// publishes from starting until it returns, and reports whether it ran.
+func (t *volumeTracker) whileIdle(fn func() error) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.volumes) > 0 || len(t.pending) > 0 {
+		return false, nil
+	}
+	return true, fn()
+}
+
+func (t *volumeTracker) add(v Volume) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.volumes[v.ID] = v
+}
+
+func (t *volumeTracker) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.volumes, id)
+}
+
+func (t *volumeTracker) get(id string) (Volume, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.volumes[id]
+	return v, ok
+}
+
+// list returns all tracked volumes ordered by ID.
+func (t *volumeTracker) list() []Volume {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	volumes := make([]Volume, 0, len(t.volumes))
+	for _, v := range t.volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	return volumes
+}
@@ -0,0 +1,67 @@
+package image
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestClaimTarget(t *testing.T) {
+	volumes := newVolumeTracker()
+	volumes.add(Volume{ID: "published", TargetPath: "/pods/a/volumes/published"})
+	if _, owner := volumes.claimTarget("other", "/pods/a/volumes/published/"); owner != "published" {
+		t.Errorf("expected the target of a published volume to be refused, got owner %q", owner)
+	}
+	if release, owner := volumes.claimTarget("published", "/pods/a/volumes/published"); owner != "" {
+		t.Errorf("republish refused because of %q", owner)
+	} else {
+		release()
+	}
+
+	release, _ := volumes.claimTarget("first", "/pods/b/volumes/x")
+	again, owner := volumes.claimTarget("first", "/pods/b/volumes/x")
+	if owner != "" {
+		t.Fatalf("concurrent publish of the same volume refused because of %q", owner)
+	}
+	if _, owner := volumes.claimTarget("second", "/pods/b/volumes/x"); owner != "first" {
+		t.Errorf("expected the target of a volume being published to be refused, got owner %q", owner)
+	}
+	release()
+	if _, owner := volumes.claimTarget("second", "/pods/b/volumes/x"); owner != "first" {
+		t.Errorf("target released while a publish is still running, got owner %q", owner)
+	}
+	again()
+	if _, owner := volumes.claimTarget("second", "/pods/b/volumes/x"); owner != "" {
+		t.Errorf("target not released, owner %q", owner)
+	}
+}
+
+func TestVolumeLock(t *testing.T) {
+	tracker := newVolumeTracker()
+	unlock, err := tracker.lock(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other volumes are not blocked.
+	other, err := tracker.lock(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := tracker.lock(ctx, "a"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+	unlock()
+	unlock, err = tracker.lock(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if len(tracker.locks) != 0 {
+		t.Errorf("locks kept after release: %v", tracker.locks)
+	}
+}
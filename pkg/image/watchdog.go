@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	hungCommands = metricsRegistry.NewGaugeVec("image_populator_hung_commands",
+		"Backend commands running for longer than --hung-command-threshold.")
+	hungCommandsCancelled = metricsRegistry.NewCounterVec("image_populator_hung_commands_cancelled_total",
+		"Backend commands cancelled by the watchdog.")
+)
+
+// commandWatchdog keeps track of the running backend commands and reports
+// those that run for suspiciously long, e.g. on a registry connection that
+// hangs without a command timeout. Optionally it cancels them, so the
+// publish that waits for them fails, cleans up and releases the volume.
+type commandWatchdog struct {
+	threshold   time.Duration
+	cancelAfter time.Duration
+
+	mu       sync.Mutex
+	next     int
+	commands map[int]*watchedCommand
+}
+
+type watchedCommand struct {
+	args      []string
+	start     time.Time
+	timeout   time.Duration
+	cancel    context.CancelFunc
+	reported  bool
+	cancelled bool
+}
+
+// newCommandWatchdog returns a watchdog that reports commands running
+// longer than threshold and cancels those running longer than cancelAfter.
+// Zero disables either. It returns nil if both are disabled.
+func newCommandWatchdog(threshold, cancelAfter time.Duration) *commandWatchdog {
+	if threshold <= 0 && cancelAfter <= 0 {
+		return nil
+	}
+	return &commandWatchdog{threshold: threshold, cancelAfter: cancelAfter, commands: map[int]*watchedCommand{}}
+}
+
+// track watches a command with the given timeout, zero if it has none,
+// until the returned function is called. That reports whether the watchdog
+// cancelled the command.
+func (w *commandWatchdog) track(args []string, timeout time.Duration, cancel context.CancelFunc) func() bool {
+	if w == nil {
+		return func() bool { return false }
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	id := w.next
+	w.next++
+	c := &watchedCommand{args: args, start: time.Now(), timeout: timeout, cancel: cancel}
+	w.commands[id] = c
+	return func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.commands, id)
+		return c.cancelled
+	}
+}
+
+// run checks the running commands periodically. It never returns.
+func (w *commandWatchdog) run() {
+	interval := w.threshold
+	if interval <= 0 || (w.cancelAfter > 0 && w.cancelAfter < interval) {
+		interval = w.cancelAfter
+	}
+	interval /= 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		w.check(time.Now())
+	}
+}
+
+// check reports the commands that exceed the threshold once and cancels
+// those that exceed cancelAfter. A command with a longer timeout of its
+// own, like the pullTimeout of a volume, is only cancelled after that.
+func (w *commandWatchdog) check(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	hung := 0
+	for _, c := range w.commands {
+		age := now.Sub(c.start)
+		if w.threshold > 0 && age > w.threshold {
+			hung++
+			if !c.reported {
+				c.reported = true
+				logWarning("backend command hangs", "command", strings.Join(c.args, " "), "running_for", age.Round(time.Second).String())
+			}
+		}
+		limit := w.cancelAfter
+		if c.timeout > limit {
+			limit = c.timeout
+		}
+		if w.cancelAfter > 0 && age > limit && !c.cancelled {
+			c.cancelled = true
+			hungCommandsCancelled.Inc()
+			logError("cancelling hung backend command", "command", strings.Join(c.args, " "), "running_for", age.Round(time.Second).String())
+			c.cancel()
+		}
+	}
+	hungCommands.Set(float64(hung))
+}
@@ -0,0 +1,43 @@
+package image
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandWatchdog(t *testing.T) {
+	if w := newCommandWatchdog(0, 0); w != nil {
+		t.Fatal("watchdog created without threshold")
+	}
+	w := newCommandWatchdog(time.Minute, 10*time.Minute)
+	cancelled := map[string]bool{}
+	track := func(name string, timeout time.Duration) func() bool {
+		return w.track([]string{"pull", name}, timeout, func() { cancelled[name] = true })
+	}
+	short := track("short", 0)
+	hung := track("hung", 0)
+	long := track("long", time.Hour)
+
+	w.check(time.Now().Add(5 * time.Minute))
+	if len(cancelled) != 0 {
+		t.Errorf("commands below cancelAfter cancelled: %v", cancelled)
+	}
+	if short() {
+		t.Error("uncancelled command reported as cancelled")
+	}
+
+	w.check(time.Now().Add(30 * time.Minute))
+	if !cancelled["hung"] || cancelled["long"] {
+		t.Errorf("expected only the command without timeout to be cancelled, got %v", cancelled)
+	}
+	if !hung() {
+		t.Error("cancelled command not reported as cancelled")
+	}
+	w.check(time.Now().Add(2 * time.Hour))
+	if !cancelled["long"] || !long() {
+		t.Error("command not cancelled after its own timeout")
+	}
+	if len(w.commands) != 0 {
+		t.Errorf("%d commands still tracked", len(w.commands))
+	}
+}
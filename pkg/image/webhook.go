@@ -0,0 +1,362 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/sapcc/csi-driver-image-populator/pkg/kube"
+)
+
+const (
+	// maxWebhookBody bounds the payloads read from registries.
+	maxWebhookBody = 1 << 20
+	// forwardedHeader marks pushes forwarded by another node, which are
+	// not forwarded again.
+	forwardedHeader = "X-Image-Populator-Forwarded"
+)
+
+var webhookEvents = metricsRegistry.NewCounterVec("image_populator_webhook_events_total",
+	"Registry webhook requests by source and result.", "source", "result")
+
+// webhookParsers extract the pushed tags from the payloads of the registries,
+// keyed by the last element of the webhook path.
+var webhookParsers = map[string]func([]byte) ([]string, error){
+	"dockerhub": parseDockerHubPush,
+	"harbor":    parseHarborPush,
+	"gar":       parseGARPush,
+	"images":    parseImagesPush,
+}
+
+// parseDockerHubPush parses the webhook payload of Docker Hub.
+func parseDockerHubPush(body []byte) ([]string, error) {
+	var payload struct {
+		PushData struct {
+			Tag string `json:"tag"`
+		} `json:"push_data"`
+		Repository struct {
+			RepoName string `json:"repo_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Repository.RepoName == "" || payload.PushData.Tag == "" {
+		return nil, fmt.Errorf("repository or tag missing")
+	}
+	return []string{"docker.io/" + payload.Repository.RepoName + ":" + payload.PushData.Tag}, nil
+}
+
+// parseHarborPush parses the webhook payload of Harbor. Events other than
+// pushes are ignored.
+func parseHarborPush(body []byte) ([]string, error) {
+	var payload struct {
+		Type      string `json:"type"`
+		EventData struct {
+			Resources []struct {
+				ResourceURL string `json:"resource_url"`
+			} `json:"resources"`
+		} `json:"event_data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Type != "PUSH_ARTIFACT" && payload.Type != "pushImage" {
+		return nil, nil
+	}
+	var images []string
+	for _, r := range payload.EventData.Resources {
+		if r.ResourceURL != "" {
+			images = append(images, r.ResourceURL)
+		}
+	}
+	return images, nil
+}
+
+// parseGARPush parses a Pub/Sub push message with a notification of Google
+// Artifact Registry. Only insertions of tags are of interest.
+func parseGARPush(body []byte) ([]string, error) {
+	var payload struct {
+		Message struct {
+			Data string `json:"data"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(payload.Message.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message data: %v", err)
+	}
+	var notification struct {
+		Action string `json:"action"`
+		Tag    string `json:"tag"`
+	}
+	if err := json.Unmarshal(data, &notification); err != nil {
+		return nil, err
+	}
+	if notification.Action != "INSERT" || notification.Tag == "" {
+		return nil, nil
+	}
+	return []string{notification.Tag}, nil
+}
+
+// parseImagesPush parses the generic payload {"images": [...]}, which CI
+// pipelines can send directly and nodes forward to each other.
+func parseImagesPush(body []byte) ([]string, error) {
+	var payload struct {
+		Images []string `json:"images"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	return payload.Images, nil
+}
+
+// filterTags drops the references by digest from images, pushes by digest
+// do not move any tag.
+func filterTags(images []string) []string {
+	var tags []string
+	for _, image := range images {
+		if !strings.Contains(image, "@") {
+			tags = append(tags, image)
+		}
+	}
+	return tags
+}
+
+// normalizeTag returns the normalized form of an image reference with the
+// default tag made explicit.
+func normalizeTag(image string) string {
+	n := normalizeImage(image)
+	if !strings.ContainsAny(n[strings.LastIndex(n, "/")+1:], ":@") {
+		n += ":latest"
+	}
+	return n
+}
+
+// invalidateTags makes tags that were pushed resolve to their new digest:
+// watched volumes using them are refreshed, other cached tags are pulled
+// again, so that the next publish gets the new content. Tags not cached on
+// this node are left alone.
+func (ns *nodeServer) invalidateTags(images []string) {
+	for _, image := range images {
+		tag := normalizeTag(image)
+		refreshed := false
+		for _, v := range ns.volumes.list() {
+			if v.Attributes["updatePolicy"] != updateWatch || normalizeTag(v.Image) != tag {
+				continue
+			}
+			refreshed = true
+			if _, err := ns.refreshVolume(context.Background(), v.ID); err != nil {
+				logWarning("cannot refresh volume after push", "volume_id", v.ID, "image", image, "error", err)
+			}
+		}
+		if refreshed {
+			continue
+		}
+
+		if _, err := ns.runCmd([]string{"inspect", "--type", "image", ns.registries.get().rewrite(image)}); err != nil {
+			continue
+		}
+		if err := ns.pullImage(context.Background(), "webhook", image, "", backgroundPriority); err != nil {
+			logWarning("cannot re-resolve cached tag after push", "image", image, "error", err)
+			continue
+		}
+		logInfo(2, "re-resolved cached tag after push", "image", image, "digest", ns.imageDigest(image))
+	}
+}
+
+// webhookServer receives push notifications of registries. With a client,
+// pushes are forwarded to the drivers on all other nodes, which listen on
+// the same port of the node's address.
+type webhookServer struct {
+	ns       *nodeServer
+	token    string
+	client   *kube.Client
+	nodeName string
+	port     string
+	http     *http.Client
+}
+
+// serveWebhook serves the registry webhooks on addr. Requests must carry
+// the token in tokenFile.
+func serveWebhook(addr, tokenFile string, ns *nodeServer, nodeName string) error {
+	w := &webhookServer{ns: ns, nodeName: nodeName, http: &http.Client{Timeout: 10 * time.Second}}
+	if tokenFile == "" {
+		return fmt.Errorf("registry webhooks need a token file")
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return err
+	}
+	if w.token = strings.TrimSpace(string(token)); w.token == "" {
+		return fmt.Errorf("token file %s is empty", tokenFile)
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	w.port = port
+	if client, err := kube.NewInClusterClient(); err != nil {
+		glog.Warningf("registry webhooks are not forwarded to other nodes, cannot create Kubernetes client: %v", err)
+	} else {
+		w.client = client
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook/", w.handle)
+	glog.Infof("serving registry webhooks on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			glog.Errorf("webhook endpoint failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (w *webhookServer) authorized(r *http.Request) bool {
+	if w.token == "" {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.token)) == 1
+}
+
+// handle answers POST /webhook/<source>. The tags are invalidated in the
+// background, registries only wait a few seconds for the response.
+func (w *webhookServer) handle(rw http.ResponseWriter, r *http.Request) {
+	source := strings.TrimPrefix(r.URL.Path, "/webhook/")
+	parse, ok := webhookParsers[source]
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !w.authorized(r) {
+		webhookEvents.Inc(source, "unauthorized")
+		http.Error(rw, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pushed, err := parse(body)
+	if err != nil {
+		webhookEvents.Inc(source, "invalid")
+		http.Error(rw, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	tags := filterTags(pushed)
+	webhookEvents.Inc(source, "accepted")
+	logInfo(2, "registry push received", "source", source, "images", strings.Join(tags, ","))
+
+	if len(tags) > 0 {
+		go w.ns.invalidateTags(tags)
+		if r.Header.Get(forwardedHeader) == "" && w.client != nil {
+			go w.forward(tags)
+		}
+	}
+	rw.WriteHeader(http.StatusAccepted)
+	writeJSONResponse(rw, map[string][]string{"images": tags})
+}
+
+// forward sends the pushed tags to the drivers on all other nodes. The
+// webhooks are served over plain HTTP, so the token travels in cleartext
+// between the nodes.
+func (w *webhookServer) forward(tags []string) {
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Addresses []struct {
+					Type    string `json:"type"`
+					Address string `json:"address"`
+				} `json:"addresses"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := w.client.Do("GET", "/api/v1/nodes", nil, &list); err != nil {
+		glog.Warningf("cannot forward registry push, cannot list nodes: %v", err)
+		return
+	}
+	body, _ := json.Marshal(map[string][]string{"images": tags})
+
+	var wg sync.WaitGroup
+	for _, node := range list.Items {
+		if node.Metadata.Name == w.nodeName {
+			continue
+		}
+		for _, addr := range node.Status.Addresses {
+			if addr.Type != "InternalIP" {
+				continue
+			}
+			wg.Add(1)
+			go func(name, url string) {
+				defer wg.Done()
+				if err := w.post(url, body); err != nil {
+					logWarning("cannot forward registry push", "node", name, "error", err)
+				}
+			}(node.Metadata.Name, "http://"+net.JoinHostPort(addr.Address, w.port)+"/webhook/images")
+			break
+		}
+	}
+	wg.Wait()
+}
+
+func (w *webhookServer) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(forwardedHeader, w.nodeName)
+	req.Header.Set("Authorization", "Bearer "+w.token)
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package image
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	gar := base64.StdEncoding.EncodeToString([]byte(`{"action": "INSERT", "digest": "us-docker.pkg.dev/p/r/app@sha256:abc", "tag": "us-docker.pkg.dev/p/r/app:v2"}`))
+	for source, test := range map[string]struct{ body, images string }{
+		"dockerhub": {`{"push_data": {"tag": "v1"}, "repository": {"repo_name": "org/app"}}`, "docker.io/org/app:v1"},
+		"harbor":    {`{"type": "PUSH_ARTIFACT", "event_data": {"resources": [{"resource_url": "harbor.local/lib/app:v1"}, {"resource_url": "harbor.local/lib/app@sha256:abc"}]}}`, "harbor.local/lib/app:v1"},
+		"gar":       {`{"message": {"data": "` + gar + `"}}`, "us-docker.pkg.dev/p/r/app:v2"},
+		"images":    {`{"images": ["busybox"]}`, "busybox"},
+	} {
+		images, err := webhookParsers[source]([]byte(test.body))
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		if images = filterTags(images); strings.Join(images, ",") != test.images {
+			t.Errorf("%s: expected %s, got %v", source, test.images, images)
+		}
+	}
+	if images, err := parseHarborPush([]byte(`{"type": "DELETE_ARTIFACT"}`)); err != nil || len(images) != 0 {
+		t.Errorf("deletion treated as push: %v %v", images, err)
+	}
+
+	ns := &nodeServer{volumes: newVolumeTracker(), backend: newFakeBuildah(t.TempDir()).run}
+	w := &webhookServer{ns: ns, token: "secret"}
+	for _, test := range []struct {
+		path, auth string
+		code       int
+	}{
+		{"/webhook/images?token=secret", "", http.StatusAccepted},
+		{"/webhook/images", "Bearer secret", http.StatusAccepted},
+		{"/webhook/images?token=guess", "", http.StatusUnauthorized},
+		{"/webhook/quay", "Bearer secret", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(`{"images": []}`))
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		rec := httptest.NewRecorder()
+		w.handle(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.path, test.code, rec.Code)
+		}
+	}
+
+	// Only cached tags are pulled again.
+	fake := newFakeBuildah(t.TempDir())
+	fake.images["example.com/app:v1"] = true
+	ns.backend = fake.run
+	ns.invalidateTags([]string{"example.com/app:v1", "example.com/other:v1"})
+	var pulls []string
+	for _, call := range fake.calls {
+		if call[0] == "pull" {
+			pulls = append(pulls, call[len(call)-1])
+		}
+	}
+	if strings.Join(pulls, ",") != "example.com/app:v1" {
+		t.Fatalf("unexpected pulls %v", pulls)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kube is a minimal client for the few Kubernetes API calls the
+// driver makes. It talks JSON over HTTPS using the in-cluster service
+// account, which avoids vendoring client-go and its dependency tree.
+package kube
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// ErrNotInCluster is returned by NewInClusterClient when the process does
+// not run in a pod.
+var ErrNotInCluster = errors.New("not running in a Kubernetes cluster")
+
+// Client issues requests against the Kubernetes API server.
+type Client struct {
+	host       string
+	token      string
+	httpClient *http.Client
+}
+
+// StatusError is returned for responses with a non-2xx status code.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d: %s", e.Code, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 response.
+func IsNotFound(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.Code == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 response.
+func IsConflict(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.Code == http.StatusConflict
+}
+
+// NewInClusterClient creates a client from the service account mounted into
+// the pod.
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found in service account CA bundle")
+	}
+
+	return &Client{
+		host:  "https://" + net.JoinHostPort(host, port),
+		token: string(token),
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// NewClient creates a client for host using the given bearer token. It is
+// meant for tests and out-of-cluster use.
+func NewClient(host, token string, httpClient *http.Client) *Client {
+	return &Client{host: host, token: token, httpClient: httpClient}
+}
+
+// Do sends body encoded as JSON to path and decodes the response into out.
+// body and out may be nil.
+func (c *Client) Do(method, path string, body, out interface{}) error {
+	return c.do(method, path, "application/json", body, out)
+}
+
+// Patch sends a JSON merge patch to path.
+func (c *Client) Patch(path string, patch, out interface{}) error {
+	return c.do(http.MethodPatch, path, "application/merge-patch+json", patch, out)
+}
+
+func (c *Client) do(method, path, contentType string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.host+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = string(data)
+		}
+		return &StatusError{Code: resp.StatusCode, Message: status.Message}
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
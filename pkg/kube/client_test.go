@@ -0,0 +1,90 @@
+package kube
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/default/events":
+			var in map[string]string
+			json.NewDecoder(r.Body).Decode(&in)
+			json.NewEncoder(w).Encode(map[string]string{"reason": in["reason"]})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","message":"not found"}`))
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, "token", srv.Client())
+	var out map[string]string
+	if err := c.Do("POST", "/api/v1/namespaces/default/events", map[string]string{"reason": "Test"}, &out); err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if out["reason"] != "Test" {
+		t.Fatalf("unexpected response %v", out)
+	}
+
+	err := c.Do("GET", "/api/v1/nodes/missing", nil, nil)
+	if !IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	if err.(*StatusError).Message != "not found" {
+		t.Fatalf("unexpected message %q", err.(*StatusError).Message)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	var lease *Lease
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if lease == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(lease)
+		case "POST", "PUT":
+			var in Lease
+			json.NewDecoder(r.Body).Decode(&in)
+			if lease != nil && in.Metadata.ResourceVersion != lease.Metadata.ResourceVersion {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			in.Metadata.ResourceVersion += "1"
+			lease = &in
+			json.NewEncoder(w).Encode(lease)
+		}
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "", srv.Client())
+
+	a := &LeaderElector{Client: c, Namespace: "kube-system", Name: "image", Identity: "a", LeaseDuration: 15 * time.Second}
+	b := &LeaderElector{Client: c, Namespace: "kube-system", Name: "image", Identity: "b", LeaseDuration: 15 * time.Second}
+	now := time.Now()
+	if err := a.tryAcquireOrRenew(now); err != nil {
+		t.Fatalf("a cannot acquire the lease: %v", err)
+	}
+	if err := b.tryAcquireOrRenew(now); err == nil {
+		t.Fatal("b acquired a valid lease held by a")
+	}
+	if err := a.tryAcquireOrRenew(now.Add(5 * time.Second)); err != nil {
+		t.Fatalf("a cannot renew the lease: %v", err)
+	}
+	if err := b.tryAcquireOrRenew(now.Add(30 * time.Second)); err != nil {
+		t.Fatalf("b cannot take over the expired lease: %v", err)
+	}
+	if lease.Spec.HolderIdentity != "b" || lease.Spec.LeaseTransitions != 1 {
+		t.Fatalf("unexpected lease %+v", lease.Spec)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// microTimeFormat is the wire format of metav1.MicroTime.
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Lease is the subset of a coordination.k8s.io/v1 Lease used for leader
+// election.
+type Lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   LeaseMetadata `json:"metadata"`
+	Spec       LeaseSpec     `json:"spec"`
+}
+
+type LeaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// LeaderElector elects a single leader among the instances sharing a Lease
+// object. Leadership changes are made with optimistic concurrency on the
+// lease's resourceVersion, so two instances never both believe to hold it
+// for longer than the lease duration.
+type LeaderElector struct {
+	Client    *Client
+	Namespace string
+	Name      string
+	Identity  string
+	// LeaseDuration is how long a leader keeps the lease without renewing
+	// it. The lease is renewed every third of it.
+	LeaseDuration time.Duration
+	// OnChange is called with the new state when leadership is gained or
+	// lost.
+	OnChange func(leading bool)
+
+	mu      sync.Mutex
+	leading bool
+	renewed time.Time
+}
+
+// IsLeader reports whether this instance holds the lease. A leader that
+// could not renew it within the lease duration stops considering itself the
+// leader before anybody else can take over.
+func (le *LeaderElector) IsLeader() bool {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.leading && time.Since(le.renewed) < le.LeaseDuration
+}
+
+// Run tries to acquire and renew the lease until stop is closed.
+func (le *LeaderElector) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(le.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		le.setLeading(le.tryAcquireOrRenew(time.Now()) == nil)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (le *LeaderElector) setLeading(leading bool) {
+	le.mu.Lock()
+	changed := le.leading != leading
+	le.leading = leading
+	if leading {
+		le.renewed = time.Now()
+	}
+	le.mu.Unlock()
+	if changed && le.OnChange != nil {
+		le.OnChange(leading)
+	}
+}
+
+func (le *LeaderElector) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + le.Namespace + "/leases"
+}
+
+// errNotLeader is returned when another holder owns a valid lease.
+type errNotLeader struct{ holder string }
+
+func (e errNotLeader) Error() string { return "lease is held by " + e.holder }
+
+func (le *LeaderElector) tryAcquireOrRenew(now time.Time) error {
+	nowStr := now.UTC().Format(microTimeFormat)
+	seconds := int(le.LeaseDuration / time.Second)
+
+	var lease Lease
+	err := le.Client.Do(http.MethodGet, le.path()+"/"+le.Name, nil, &lease)
+	if IsNotFound(err) {
+		lease = Lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   LeaseMetadata{Name: le.Name, Namespace: le.Namespace},
+			Spec: LeaseSpec{
+				HolderIdentity:       le.Identity,
+				LeaseDurationSeconds: seconds,
+				AcquireTime:          nowStr,
+				RenewTime:            nowStr,
+			},
+		}
+		return le.Client.Do(http.MethodPost, le.path(), &lease, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	if lease.Spec.HolderIdentity != le.Identity && lease.Spec.HolderIdentity != "" {
+		renewed, err := time.Parse(microTimeFormat, lease.Spec.RenewTime)
+		expiry := renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+		if err == nil && now.Before(expiry) {
+			return errNotLeader{lease.Spec.HolderIdentity}
+		}
+		lease.Spec.AcquireTime = nowStr
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.HolderIdentity = le.Identity
+	lease.Spec.LeaseDurationSeconds = seconds
+	lease.Spec.RenewTime = nowStr
+	// The update fails with a conflict if somebody else changed the lease
+	// since it was read.
+	return le.Client.Do(http.MethodPut, le.path()+"/"+le.Name, &lease, nil)
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_pulls_total", "Pulls.", "registry", "result")
+	c.Inc("docker.io", "success")
+	c.Add(2, "docker.io", "success")
+	g := r.NewGaugeVec("test_inflight", "In-flight operations.", "operation")
+	g.Inc("publish")
+	g.Inc("publish")
+	g.Dec("publish")
+	h := r.NewHistogramVec("test_duration_seconds", "Durations.", []float64{1, 10})
+	h.Observe(0.5)
+	h.Observe(5)
+	r.NewGaugeFunc("test_free_bytes", "Free bytes.", func() float64 { return 42 })
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		"# TYPE test_pulls_total counter",
+		`test_pulls_total{registry="docker.io",result="success"} 3`,
+		`test_inflight{operation="publish"} 1`,
+		`test_duration_seconds_bucket{le="1"} 1`,
+		`test_duration_seconds_bucket{le="10"} 2`,
+		`test_duration_seconds_bucket{le="+Inf"} 2`,
+		"test_duration_seconds_sum 5.5",
+		"test_duration_seconds_count 2",
+		"test_free_bytes 42",
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("missing %q in output:\n%s", want, body)
+		}
+	}
+}